@@ -0,0 +1,158 @@
+// Package auth provides password hashing and related functionality on top of a user state
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Names of the password hashing algorithms, as returned by HashAlgo
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+	Sha256   = "sha256"
+)
+
+// Argon2Params are the tunable parameters for argon2id
+type Argon2Params struct {
+	Memory  uint32 // memory usage, in KiB
+	Time    uint32 // number of iterations
+	Threads uint8  // degree of parallelism
+}
+
+// DefaultArgon2Params are the argon2id parameters recommended by OWASP
+var DefaultArgon2Params = Argon2Params{Memory: 19 * 1024, Time: 2, Threads: 1}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// ErrMalformedHash is returned when an argon2id hash can not be parsed
+var ErrMalformedHash = errors.New("auth: malformed argon2id hash")
+
+// HashAlgo returns the name of the algorithm that was used for creating the
+// given password hash, or an empty string if it is not recognized.
+func HashAlgo(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2id
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return Bcrypt
+	case len(hash) == sha256.Size:
+		return Sha256
+	}
+	return ""
+}
+
+// Hash hashes the password with the given algorithm ("argon2id", "bcrypt",
+// "bcrypt+" or "sha256"), with the default bcrypt cost and argon2id parameters.
+// The cookie secret and the username are used for salting sha256 hashes.
+func Hash(algorithm, cookieSecret, username, password string) (string, error) {
+	return hashWith(algorithm, bcrypt.DefaultCost, DefaultArgon2Params, cookieSecret, username, password)
+}
+
+// hashWith hashes the password with the given algorithm and parameters
+func hashWith(algorithm string, cost int, p Argon2Params, cookieSecret, username, password string) (string, error) {
+	switch algorithm {
+	case Sha256:
+		return hashSha256(cookieSecret, username, password), nil
+	case Bcrypt, "bcrypt+":
+		return hashBcrypt(password, cost)
+	case Argon2id:
+		return hashArgon2id(password, p)
+	}
+	return "", errors.New("auth: " + algorithm + " is an unsupported password hashing algorithm")
+}
+
+// Correct checks if the password matches the given hash. Which hashes are
+// accepted depends on the current algorithm: with "bcrypt", sha256 hashes
+// are not accepted, and with "sha256", only sha256 hashes are accepted.
+func Correct(algorithm, hash, cookieSecret, username, password string) bool {
+	switch HashAlgo(hash) {
+	case Argon2id:
+		return correctArgon2id(hash, password)
+	case Bcrypt:
+		return algorithm != Sha256 && correctBcrypt(hash, password)
+	case Sha256:
+		return algorithm != Bcrypt && correctSha256(hash, cookieSecret, username, password)
+	}
+	return false
+}
+
+// hashSha256 hashes the password the same way as the permissions2 packages do
+// (the cookie secret and the username are used for salting)
+func hashSha256(cookieSecret, username, password string) string {
+	hasher := sha256.New()
+	io.WriteString(hasher, password+cookieSecret+username)
+	return string(hasher.Sum(nil))
+}
+
+func correctSha256(hash, cookieSecret, username, password string) bool {
+	comparisonHash := hashSha256(cookieSecret, username, password)
+	if len(hash) != len(comparisonHash) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(comparisonHash)) == 1
+}
+
+func hashBcrypt(password string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(hash), err
+}
+
+func correctBcrypt(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// hashArgon2id hashes the password with a random salt and returns it
+// in the PHC string format: $argon2id$v=19$m=...,t=...,p=...$salt$key
+func hashArgon2id(password string, p Argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// parseArgon2id returns the parameters, salt and key of an argon2id hash
+func parseArgon2id(hash string) (p Argon2Params, salt, key []byte, err error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[1] != Argon2id {
+		return p, nil, nil, ErrMalformedHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrMalformedHash
+	}
+	if _, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrMalformedHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(fields[4]); err != nil {
+		return p, nil, nil, ErrMalformedHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(fields[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, ErrMalformedHash
+	}
+	return p, salt, key, nil
+}
+
+func correctArgon2id(hash, password string) bool {
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	comparisonKey := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, comparisonKey) == 1
+}
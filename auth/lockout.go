@@ -0,0 +1,380 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// Name of the HashMap with the failed attempts, per "user/name" and "ip/address"
+	failuresID = "__auth_failures"
+
+	// Name of the KeyValue that is used as a ring buffer for the audit log
+	auditID = "__auth_audit"
+
+	// The failed attempts for all usernames that do not exist are counted
+	// with this key, so that random usernames do not add new entries
+	unknownKey = "unknown/"
+)
+
+// How often the entries that are older than the window are removed
+var pruneInterval = time.Minute
+
+// Events in the audit log
+const (
+	EventPasswordFailure = "password_failure"
+	EventPasswordSuccess = "password_success"
+	EventLockedOut       = "locked_out" // an attempt was made while locked out
+	EventLockout         = "lockout"    // a lockout was started
+	EventUnlock          = "unlock"     // a lockout was cleared
+	EventLogin           = "login"
+	EventLogout          = "logout"
+	EventTOTPFailure     = "totp_failure"
+	EventTOTPSuccess     = "totp_success"
+)
+
+// LockoutPolicy decides when and for how long usernames and IP addresses are locked out
+type LockoutPolicy struct {
+	MaxAttempts   int           // failed attempts per username before a lockout
+	MaxIPAttempts int           // failed attempts per IP address before a lockout
+	BaseDuration  time.Duration // the first lockout, doubled for each additional failed attempt
+	MaxDuration   time.Duration // the longest possible lockout
+	Window        time.Duration // failed attempts are forgotten after this long without failures
+	AuditSize     int           // number of entries that are kept in the audit log
+}
+
+// DefaultLockoutPolicy is the lockout policy that is used by default
+var DefaultLockoutPolicy = LockoutPolicy{
+	MaxAttempts:   5,
+	MaxIPAttempts: 20,
+	BaseDuration:  30 * time.Second,
+	MaxDuration:   time.Hour,
+	Window:        24 * time.Hour,
+	AuditSize:     1000,
+}
+
+// Guard keeps track of failed authentication attempts in the database,
+// locks out usernames and IP addresses and keeps an audit log
+type Guard struct {
+	policy   LockoutPolicy
+	failures pinterface.IHashMap
+	audit    pinterface.IKeyValue
+	pruned   time.Time // when the old entries were last removed
+	mut      sync.Mutex
+}
+
+// NewGuard creates a new Guard that stores the attempts and the audit log with the given creator
+func NewGuard(creator pinterface.ICreator, policy LockoutPolicy) (*Guard, error) {
+	failures, err := creator.NewHashMap(failuresID)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := creator.NewKeyValue(auditID)
+	if err != nil {
+		return nil, err
+	}
+	return &Guard{policy: policy, failures: failures, audit: audit}, nil
+}
+
+// Policy returns the current lockout policy
+func (g *Guard) Policy() LockoutPolicy {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	return g.policy
+}
+
+// SetPolicy changes the lockout policy
+func (g *Guard) SetPolicy(policy LockoutPolicy) {
+	g.mut.Lock()
+	g.policy = policy
+	g.mut.Unlock()
+}
+
+// The keys are used as element IDs in a HashMap, where ":" is not allowed
+
+func userKey(username string) string {
+	return "user/" + username
+}
+
+func ipKey(ip string) string {
+	return "ip/" + strings.Replace(ip, ":", "_", -1)
+}
+
+// totpKey is used for failed one-time passwords, which are tracked separately,
+// so that a correct password does not reset the count
+func totpKey(username string) string {
+	return "totp/" + username
+}
+
+func (g *Guard) getInt(key, field string) int64 {
+	s, err := g.failures.Get(key, field)
+	if err != nil {
+		return 0
+	}
+	i, _ := strconv.ParseInt(s, 10, 64)
+	return i
+}
+
+// Locked returns the time the lockout for the given key ends, and true if it is in the future
+func (g *Guard) Locked(key string) (time.Time, bool) {
+	until := time.Unix(g.getInt(key, "until"), 0)
+	return until, time.Now().Before(until)
+}
+
+// Failures returns the number of recent failed attempts for the given key
+func (g *Guard) Failures(key string) int {
+	g.mut.Lock()
+	window := g.policy.Window
+	g.mut.Unlock()
+	if time.Since(time.Unix(g.getInt(key, "last"), 0)) > window {
+		return 0
+	}
+	return int(g.getInt(key, "count"))
+}
+
+// Fail registers a failed attempt for the given key. If there have been at least
+// maxAttempts failures, the key is locked out for an exponentially growing duration.
+// Returns true if a lockout was started.
+func (g *Guard) Fail(key string, maxAttempts int) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	now := time.Now()
+	count := g.getInt(key, "count")
+	if now.Sub(time.Unix(g.getInt(key, "last"), 0)) > g.policy.Window {
+		count = 0
+	}
+	count++
+	if err := g.failures.Set(key, "count", strconv.FormatInt(count, 10)); err != nil {
+		log.Error("Could not register a failed attempt: ", err)
+	}
+	g.failures.Set(key, "last", strconv.FormatInt(now.Unix(), 10))
+	if now.Sub(g.pruned) > pruneInterval {
+		g.prune(now)
+	}
+	if maxAttempts <= 0 || count < int64(maxAttempts) {
+		return false
+	}
+	duration := g.policy.BaseDuration
+	for i := int64(maxAttempts); i < count && duration < g.policy.MaxDuration; i++ {
+		duration *= 2
+	}
+	if duration > g.policy.MaxDuration {
+		duration = g.policy.MaxDuration
+	}
+	g.failures.Set(key, "until", strconv.FormatInt(now.Add(duration).Unix(), 10))
+	return true
+}
+
+// prune removes the entries where the last failed attempt is older than the
+// window and the lockout has ended. g.mut must be locked.
+func (g *Guard) prune(now time.Time) {
+	g.pruned = now
+	keys, err := g.failures.All()
+	if err != nil {
+		log.Error("Could not remove old failed attempts: ", err)
+		return
+	}
+	for _, key := range keys {
+		last := time.Unix(g.getInt(key, "last"), 0)
+		until := time.Unix(g.getInt(key, "until"), 0)
+		if now.Sub(last) > g.policy.Window && !now.Before(until) {
+			g.failures.Del(key)
+		}
+	}
+}
+
+// Clear removes the failed attempts and any lockout for the given key
+func (g *Guard) Clear(key string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.failures.Del(key)
+}
+
+// Audit adds an entry to the audit log and the server log
+func (g *Guard) Audit(event, username, ip string) {
+	g.mut.Lock()
+	size := g.policy.AuditSize
+	g.mut.Unlock()
+	if size <= 0 {
+		return
+	}
+	if username == "" {
+		username = "-"
+	}
+	if ip == "" {
+		ip = "-"
+	}
+	entry := fmt.Sprintf("%s %s %s %s", time.Now().UTC().Format(time.RFC3339), event, username, ip)
+	logger := log.WithFields(log.Fields{"event": event, "username": username, "ip": ip})
+	if event == EventLockout {
+		logger.Warn("Authentication event")
+	} else {
+		logger.Info("Authentication event")
+	}
+	nextString, err := g.audit.Inc("next")
+	if err != nil {
+		return
+	}
+	next, _ := strconv.Atoi(nextString)
+	g.audit.Set("entry:"+strconv.Itoa(next%size), entry)
+}
+
+// AuditLog returns up to n of the most recent entries in the audit log,
+// newest first. Each entry is on the form "time event username ip".
+func (g *Guard) AuditLog(n int) []string {
+	g.mut.Lock()
+	size := g.policy.AuditSize
+	g.mut.Unlock()
+	nextString, err := g.audit.Get("next")
+	if err != nil || size <= 0 {
+		return []string{}
+	}
+	next, _ := strconv.Atoi(nextString)
+	if n > size {
+		n = size
+	}
+	entries := make([]string, 0, n)
+	for i := next; i > 0 && len(entries) < n; i-- {
+		entry, err := g.audit.Get("entry:" + strconv.Itoa(i%size))
+		if err != nil || entry == "" {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// RemoteIP returns the IP address of the client, without the port
+func RemoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return strings.TrimSpace(req.RemoteAddr)
+	}
+	return host
+}
+
+// Guard returns the Guard that keeps track of failed attempts, or nil
+func (state *UserState) Guard() *Guard {
+	return state.guard
+}
+
+// failureKey returns the key that failed password attempts for the given
+// username are counted with. All usernames that do not exist share one key.
+func (state *UserState) failureKey(username string) string {
+	if !state.HasUser(username) {
+		return unknownKey
+	}
+	return userKey(username)
+}
+
+// lockedOut checks if the given username or IP address is locked out
+func (state *UserState) lockedOut(key, ip string) bool {
+	if _, locked := state.guard.Locked(key); locked {
+		return true
+	}
+	if ip != "" {
+		if _, locked := state.guard.Locked(ipKey(ip)); locked {
+			return true
+		}
+	}
+	return false
+}
+
+// fail registers a failed attempt for the given key and IP address (if given)
+func (state *UserState) fail(key, username, ip string) {
+	g := state.guard
+	policy := g.Policy()
+	if g.Fail(key, policy.MaxAttempts) {
+		g.Audit(EventLockout, username, "")
+	}
+	if ip != "" && g.Fail(ipKey(ip), policy.MaxIPAttempts) {
+		g.Audit(EventLockout, "", ip)
+	}
+}
+
+// CheckPassword checks if a password is correct, like CorrectPassword, but also
+// tracks failed attempts per IP address, if an IP address is given.
+// Returns false while the username or the IP address is locked out.
+func (state *UserState) CheckPassword(username, password, ip string) bool {
+	g := state.guard
+	if g == nil {
+		return state.correctPassword(username, password)
+	}
+	key := state.failureKey(username)
+	if state.lockedOut(key, ip) {
+		g.Audit(EventLockedOut, username, ip)
+		return false
+	}
+	if state.correctPassword(username, password) {
+		g.Clear(key)
+		g.Audit(EventPasswordSuccess, username, ip)
+		return true
+	}
+	g.Audit(EventPasswordFailure, username, ip)
+	state.fail(key, username, ip)
+	return false
+}
+
+// Lockout returns when the lockout for the given username ends,
+// and true if the username is currently locked out
+func (state *UserState) Lockout(username string) (time.Time, bool) {
+	if state.guard == nil {
+		return time.Time{}, false
+	}
+	until, locked := state.guard.Locked(state.failureKey(username))
+	if totpUntil, totpLocked := state.guard.Locked(totpKey(username)); totpLocked && totpUntil.After(until) {
+		return totpUntil, true
+	}
+	return until, locked
+}
+
+// IPLockout returns when the lockout for the given IP address ends,
+// and true if the IP address is currently locked out
+func (state *UserState) IPLockout(ip string) (time.Time, bool) {
+	if state.guard == nil {
+		return time.Time{}, false
+	}
+	return state.guard.Locked(ipKey(ip))
+}
+
+// FailedAttempts returns the number of recent failed password attempts for the given username
+func (state *UserState) FailedAttempts(username string) int {
+	if state.guard == nil {
+		return 0
+	}
+	return state.guard.Failures(state.failureKey(username))
+}
+
+// ClearLockout removes the failed attempts and the lockout for the given username
+func (state *UserState) ClearLockout(username string) {
+	if state.guard == nil {
+		return
+	}
+	state.guard.Clear(userKey(username))
+	state.guard.Clear(totpKey(username))
+	state.guard.Audit(EventUnlock, username, "")
+}
+
+// ClearIPLockout removes the failed attempts and the lockout for the given IP address
+func (state *UserState) ClearIPLockout(ip string) {
+	if state.guard == nil {
+		return
+	}
+	state.guard.Clear(ipKey(ip))
+	state.guard.Audit(EventUnlock, "", ip)
+}
+
+// audit adds an entry to the audit log, if there is one
+func (state *UserState) audit(event, username string) {
+	if state.guard != nil {
+		state.guard.Audit(event, username, "")
+	}
+}
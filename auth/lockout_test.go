@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/pinterface"
+)
+
+func TestLockout(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+
+	for i := 0; i < DefaultLockoutPolicy.MaxAttempts-1; i++ {
+		assert.Equal(t, state.CheckPassword("bob", "wrong", "10.0.0.1"), false)
+	}
+	assert.Equal(t, state.FailedAttempts("bob"), DefaultLockoutPolicy.MaxAttempts-1)
+	_, locked := state.Lockout("bob")
+	assert.Equal(t, locked, false)
+
+	// A correct password resets the count
+	assert.Equal(t, state.CheckPassword("bob", "hunter2", "10.0.0.1"), true)
+	assert.Equal(t, state.FailedAttempts("bob"), 0)
+
+	for i := 0; i < DefaultLockoutPolicy.MaxAttempts; i++ {
+		state.CheckPassword("bob", "wrong", "10.0.0.1")
+	}
+	until, locked := state.Lockout("bob")
+	assert.Equal(t, locked, true)
+	assert.Equal(t, until.After(time.Now().Add(DefaultLockoutPolicy.BaseDuration-2*time.Second)), true)
+
+	// The correct password is rejected while locked out
+	assert.Equal(t, state.CheckPassword("bob", "hunter2", "10.0.0.2"), false)
+	assert.Equal(t, state.CorrectPassword("bob", "hunter2"), false)
+
+	// Each additional failure doubles the lockout
+	state.guard.Fail(userKey("bob"), DefaultLockoutPolicy.MaxAttempts)
+	until2, _ := state.Lockout("bob")
+	assert.Equal(t, until2.After(until), true)
+
+	state.ClearLockout("bob")
+	_, locked = state.Lockout("bob")
+	assert.Equal(t, locked, false)
+	assert.Equal(t, state.CheckPassword("bob", "hunter2", "10.0.0.2"), true)
+}
+
+func TestUnknownAndPrune(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+
+	// Usernames that do not exist share one entry
+	for _, username := range []string{"a", "b", "c"} {
+		assert.Equal(t, state.CheckPassword(username, "wrong", ""), false)
+	}
+	keys, _ := state.guard.failures.All()
+	assert.Equal(t, keys, []string{unknownKey})
+	assert.Equal(t, state.FailedAttempts("d"), 3)
+
+	// Entries older than the window are removed
+	policy := state.Guard().Policy()
+	policy.Window = time.Second
+	state.Guard().SetPolicy(policy)
+	state.guard.failures.Set(unknownKey, "last", "0")
+	state.guard.pruned = time.Time{}
+	state.CheckPassword("bob", "wrong", "")
+	keys, _ = state.guard.failures.All()
+	assert.Equal(t, keys, []string{userKey("bob")})
+}
+
+func TestIPLockout(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	state.Guard().SetPolicy(LockoutPolicy{
+		MaxAttempts:   100,
+		MaxIPAttempts: 3,
+		BaseDuration:  time.Minute,
+		MaxDuration:   time.Hour,
+		Window:        time.Hour,
+		AuditSize:     10,
+	})
+
+	// Different usernames from the same address
+	for _, username := range []string{"alice", "carol", "dave"} {
+		assert.Equal(t, state.CheckPassword(username, "guess", "10.0.0.1"), false)
+	}
+	_, locked := state.IPLockout("10.0.0.1")
+	assert.Equal(t, locked, true)
+	assert.Equal(t, state.CheckPassword("bob", "hunter2", "10.0.0.1"), false)
+	assert.Equal(t, state.CheckPassword("bob", "hunter2", "10.0.0.2"), true)
+
+	state.ClearIPLockout("10.0.0.1")
+	assert.Equal(t, state.CheckPassword("bob", "hunter2", "10.0.0.1"), true)
+}
+
+func TestTOTPLockout(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	secret, _, err := state.EnrollTOTP("bob", "example.com")
+	assert.Equal(t, err, nil)
+	state.SetBooleanField("bob", fieldTOTPEnabled, true)
+
+	for i := 0; i < DefaultLockoutPolicy.MaxAttempts; i++ {
+		assert.Equal(t, state.VerifyTOTP(httptest.NewRecorder(), "bob", "000000x"), false)
+	}
+	_, locked := state.Lockout("bob")
+	assert.Equal(t, locked, true)
+
+	// A correct password does not reset the failed one-time passwords
+	state.guard.Clear(userKey("bob"))
+	assert.Equal(t, state.CheckPassword("bob", "hunter2", ""), true)
+	code, _ := TOTP(secret, time.Now())
+	assert.Equal(t, state.VerifyTOTP(httptest.NewRecorder(), "bob", code), false)
+
+	state.ClearLockout("bob")
+	assert.Equal(t, state.VerifyTOTP(httptest.NewRecorder(), "bob", code), true)
+}
+
+func TestAuditLog(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+	g := state.Guard()
+	policy := g.Policy()
+	policy.AuditSize = 3
+	g.SetPolicy(policy)
+
+	assert.Equal(t, len(g.AuditLog(10)), 0)
+	for _, event := range []string{"a", "b", "c", "d"} {
+		g.Audit(event, "bob", "10.0.0.1")
+	}
+	entries := g.AuditLog(10)
+	assert.Equal(t, len(entries), 3)
+	assert.Equal(t, strings.Fields(entries[0])[1:], []string{"d", "bob", "10.0.0.1"})
+	assert.Equal(t, strings.Fields(entries[2])[1], "b")
+	assert.Equal(t, len(g.AuditLog(1)), 1)
+
+	g.Audit("e", "", "")
+	assert.Equal(t, strings.Fields(g.AuditLog(1)[0])[1:], []string{"e", "-", "-"})
+}
+
+func TestSetCreator(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	state.Guard().SetPolicy(LockoutPolicy{MaxAttempts: 2, MaxIPAttempts: 10, BaseDuration: time.Minute, MaxDuration: time.Hour, Window: time.Hour, AuditSize: 10})
+
+	store := datastore.New(state.IUserState.Creator())
+	assert.Equal(t, state.SetCreator(store), nil)
+	assert.Equal(t, state.Creator(), pinterface.ICreator(store))
+	assert.Equal(t, state.Guard().Policy().MaxAttempts, 2)
+
+	// The failed attempts are kept with the Store, so that they can be exported
+	assert.Equal(t, state.CheckPassword("bob", "wrong", "10.0.0.1"), false)
+	names, err := store.Names()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, names, []datastore.Name{{Kind: "hashmap", ID: failuresID}, {Kind: "keyvalue", ID: auditID}})
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xyproto/onthefly"
+	"rsc.io/qr"
+)
+
+// Parameters for the time-based one-time passwords (RFC 6238).
+// These are the defaults that all authenticator apps support.
+const (
+	totpDigits       = 6
+	totpPeriod       = 30 // seconds
+	totpSkew         = 1  // number of periods before and after the current one that are accepted
+	totpSecretLength = 20 // bytes, as recommended for HMAC-SHA1
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 encoded secret
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// decodeSecret decodes a base32 secret, ignoring case, spaces and padding
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return base32NoPadding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// hotp returns the one-time password for the given counter (RFC 4226)
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// TOTP returns the one-time password for the given secret, at the given time
+func TOTP(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(t.Unix())/totpPeriod), nil
+}
+
+// validTOTP checks the code against the periods around the given time.
+// Returns the counter of the matching period, so that it can not be used again.
+func validTOTP(secret, code string, t time.Time) (uint64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := uint64(t.Unix()) / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// OTPAuthURI returns an otpauth:// URI that can be added to an authenticator
+// app, typically by scanning it as a QR code
+func OTPAuthURI(issuer, username, secret string) string {
+	label := url.PathEscape(username)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+	v := url.Values{}
+	v.Set("secret", secret)
+	if issuer != "" {
+		v.Set("issuer", issuer)
+	}
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// QRCodeSVG encodes the given text as a QR code and returns it as a TinySVG image
+func QRCodeSVG(text string) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	const quietZone = 4 // modules of white space around the code
+	size := code.Size + 2*quietZone
+	page, svg := onthefly.NewTinySVG(0, 0, size, size)
+	svg.Box(0, 0, size, size, "white")
+	for y := 0; y < code.Size; y++ {
+		// Draw each horizontal run of black modules as one rectangle
+		for x := 0; x < code.Size; x++ {
+			if !code.Black(x, y) {
+				continue
+			}
+			start := x
+			for x < code.Size && code.Black(x, y) {
+				x++
+			}
+			svg.Box(start+quietZone, y+quietZone, x-start, 1, "black")
+		}
+	}
+	return page.String(), nil
+}
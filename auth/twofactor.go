@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/lua/cookies"
+)
+
+// Fields in the users hash map that are used for two-factor authentication
+const (
+	fieldTOTPSecret    = "totp_secret"
+	fieldTOTPEnabled   = "totp_enabled"
+	fieldTOTPCounter   = "totp_counter"  // the last counter that was used, to prevent replays
+	fieldTOTPSessions  = "totp_sessions" // comma separated IDs of the sessions where the second factor has been verified
+	fieldRecoveryCodes = "totp_recovery" // comma separated sha256 hashes of the recovery codes
+)
+
+const (
+	// RecoveryCodeCount is the number of recovery codes that are generated
+	RecoveryCodeCount = 10
+
+	// TwoFactorCookieName is the name of the signed cookie that holds the ID
+	// of the session where the second factor has been verified
+	TwoFactorCookieName = "algernon_2fa"
+
+	// The number of sessions per user where the second factor is kept as verified
+	maxTOTPSessions = 10
+)
+
+var (
+	// ErrNoSuchUser is returned when trying to enroll a user that does not exist
+	ErrNoSuchUser = errors.New("auth: no such user")
+
+	// ErrTwoFactorRequired is returned by Login for users that have enabled
+	// two-factor authentication, since they must log in with LoginWithCode
+	ErrTwoFactorRequired = errors.New("auth: a one-time password or recovery code is required for logging in")
+)
+
+// EnrollTOTP generates a new TOTP secret for the given user and returns the
+// secret together with an otpauth:// URI. Two-factor authentication is not
+// enabled before the user has confirmed the enrollment with ConfirmTOTP.
+func (state *UserState) EnrollTOTP(username, issuer string) (string, string, error) {
+	if !state.HasUser(username) {
+		return "", "", ErrNoSuchUser
+	}
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	users := state.Users()
+	users.Set(username, fieldTOTPSecret, secret)
+	users.Set(username, fieldTOTPEnabled, "false")
+	users.DelKey(username, fieldTOTPCounter)
+	return secret, OTPAuthURI(issuer, username, secret), nil
+}
+
+// ConfirmTOTP enables two-factor authentication for the given user, if the
+// code is valid for the secret that was generated by EnrollTOTP. The second
+// factor is marked as verified for the session of the given response.
+func (state *UserState) ConfirmTOTP(w http.ResponseWriter, username, code string) bool {
+	if !state.HasUser(username) {
+		return false
+	}
+	if !state.checkTOTP(username, code) {
+		return false
+	}
+	state.SetBooleanField(username, fieldTOTPEnabled, true)
+	state.markVerified(w, username)
+	return true
+}
+
+// TOTPEnabled checks if two-factor authentication is enabled for the given user
+func (state *UserState) TOTPEnabled(username string) bool {
+	return state.BooleanField(username, fieldTOTPEnabled)
+}
+
+// DisableTOTP disables two-factor authentication for the given user and
+// removes the secret and the recovery codes
+func (state *UserState) DisableTOTP(username string) {
+	users := state.Users()
+	for _, field := range []string{fieldTOTPSecret, fieldTOTPEnabled, fieldTOTPCounter, fieldTOTPSessions, fieldRecoveryCodes} {
+		users.DelKey(username, field)
+	}
+}
+
+// VerifyTOTP checks a one-time password or a recovery code for the given user.
+// If it is correct, the second factor is marked as verified for the session of
+// the given response, until the user logs out. Each code can only be used once.
+// Too many failed attempts leads to a lockout.
+func (state *UserState) VerifyTOTP(w http.ResponseWriter, username, code string) bool {
+	if !state.TOTPEnabled(username) {
+		return false
+	}
+	// One-time passwords are short, so failed attempts lead to lockouts as well
+	if state.guard != nil && state.lockedOut(totpKey(username), "") {
+		state.audit(EventLockedOut, username)
+		return false
+	}
+	code = strings.TrimSpace(code)
+	if state.checkTOTP(username, code) || state.useRecoveryCode(username, code) {
+		state.markVerified(w, username)
+		if state.guard != nil {
+			state.guard.Clear(totpKey(username))
+		}
+		state.audit(EventTOTPSuccess, username)
+		return true
+	}
+	state.audit(EventTOTPFailure, username)
+	if state.guard != nil {
+		state.fail(totpKey(username), username, "")
+	}
+	return false
+}
+
+// markVerified marks the second factor as verified for a new session, and
+// sets a signed cookie with the ID of the session
+func (state *UserState) markVerified(w http.ResponseWriter, username string) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return
+	}
+	id := hex.EncodeToString(b)
+	state.totpMut.Lock()
+	defer state.totpMut.Unlock()
+	users := state.Users()
+	var ids []string
+	if s, err := users.Get(username, fieldTOTPSessions); err == nil && s != "" {
+		ids = strings.Split(s, ",")
+	}
+	ids = append(ids, id)
+	if len(ids) > maxTOTPSessions {
+		ids = ids[len(ids)-maxTOTPSessions:]
+	}
+	users.Set(username, fieldTOTPSessions, strings.Join(ids, ","))
+	cookies.Set(w, state.CookieSecret(), TwoFactorCookieName, username+":"+id, cookies.Options{
+		Path:     "/",
+		HTTPOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Signed:   true,
+	})
+}
+
+// TwoFactorVerified checks if the given user has two-factor authentication
+// enabled and has verified the second factor in the session of the given request
+func (state *UserState) TwoFactorVerified(req *http.Request, username string) bool {
+	if !state.TOTPEnabled(username) {
+		return false
+	}
+	value, ok := cookies.Get(req, state.CookieSecret(), TwoFactorCookieName, true, false)
+	if !ok || !strings.HasPrefix(value, username+":") {
+		return false
+	}
+	id := strings.TrimPrefix(value, username+":")
+	ids, err := state.Users().Get(username, fieldTOTPSessions)
+	if err != nil || ids == "" {
+		return false
+	}
+	for _, verified := range strings.Split(ids, ",") {
+		if subtle.ConstantTimeCompare([]byte(verified), []byte(id)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTOTP checks the code against the stored secret and
+// makes sure that the same code can not be used twice
+func (state *UserState) checkTOTP(username, code string) bool {
+	users := state.Users()
+	secret, err := users.Get(username, fieldTOTPSecret)
+	if err != nil || secret == "" {
+		return false
+	}
+	counter, ok := validTOTP(secret, code, time.Now())
+	if !ok {
+		return false
+	}
+	state.totpMut.Lock()
+	defer state.totpMut.Unlock()
+	if lastString, err := users.Get(username, fieldTOTPCounter); err == nil {
+		if last, err := strconv.ParseUint(lastString, 10, 64); err == nil && counter <= last {
+			return false
+		}
+	}
+	users.Set(username, fieldTOTPCounter, strconv.FormatUint(counter, 10))
+	return true
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.Replace(code, "-", "", -1))))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateRecoveryCodes creates a new set of recovery codes for the given user,
+// replacing any previous ones. Only the hashes of the codes are stored.
+func (state *UserState) GenerateRecoveryCodes(username string) ([]string, error) {
+	if !state.HasUser(username) {
+		return nil, ErrNoSuchUser
+	}
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	state.Users().Set(username, fieldRecoveryCodes, strings.Join(hashes, ","))
+	return codes, nil
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes for the given user
+func (state *UserState) RecoveryCodesLeft(username string) int {
+	hashes, err := state.Users().Get(username, fieldRecoveryCodes)
+	if err != nil || hashes == "" {
+		return 0
+	}
+	return len(strings.Split(hashes, ","))
+}
+
+// useRecoveryCode checks the given recovery code and removes it if it is correct
+func (state *UserState) useRecoveryCode(username, code string) bool {
+	state.totpMut.Lock()
+	defer state.totpMut.Unlock()
+	users := state.Users()
+	hashesString, err := users.Get(username, fieldRecoveryCodes)
+	if err != nil || hashesString == "" {
+		return false
+	}
+	hash := hashRecoveryCode(code)
+	hashes := strings.Split(hashesString, ",")
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			users.Set(username, fieldRecoveryCodes, strings.Join(hashes, ","))
+			return true
+		}
+	}
+	return false
+}
+
+// Login logs in the given user and stores the username in a cookie. Users
+// that have enabled two-factor authentication are not logged in, and
+// ErrTwoFactorRequired is returned, since they must log in with LoginWithCode.
+func (state *UserState) Login(w http.ResponseWriter, username string) error {
+	if state.TOTPEnabled(username) {
+		return ErrTwoFactorRequired
+	}
+	state.audit(EventLogin, username)
+	return state.IUserState.Login(w, username)
+}
+
+// LoginTrusted logs in the given user without asking for the second factor.
+// It is meant for logins that an external identity provider has already
+// authenticated. The second factor is not marked as verified for the
+// session, so pages that require it still ask for a one-time password.
+func (state *UserState) LoginTrusted(w http.ResponseWriter, username string) error {
+	state.audit(EventLogin, username)
+	return state.IUserState.Login(w, username)
+}
+
+// LoginWithCode logs in the given user, but only if two-factor authentication
+// is disabled for the user, or if the given code is correct.
+// Returns true if the user was logged in.
+func (state *UserState) LoginWithCode(w http.ResponseWriter, username, code string) bool {
+	if !state.TOTPEnabled(username) {
+		return state.Login(w, username) == nil
+	}
+	if !state.VerifyTOTP(w, username, code) {
+		return false
+	}
+	if err := state.IUserState.Login(w, username); err != nil {
+		return false
+	}
+	state.audit(EventLogin, username)
+	return true
+}
+
+// Logout logs out the given user, and forgets the sessions where the
+// second factor has been verified
+func (state *UserState) Logout(username string) {
+	state.Users().DelKey(username, fieldTOTPSessions)
+	state.audit(EventLogout, username)
+	state.IUserState.Logout(username)
+}
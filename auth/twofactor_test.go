@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/base32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vector from RFC 6238, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	code, err := TOTP(secret, time.Unix(59, 0))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, code, "287082")
+	code, _ = TOTP(secret, time.Unix(1111111109, 0))
+	assert.Equal(t, code, "081804")
+
+	// The previous and the next period are also accepted
+	_, ok := validTOTP(secret, "287082", time.Unix(59+totpPeriod, 0))
+	assert.Equal(t, ok, true)
+	_, ok = validTOTP(secret, "287082", time.Unix(59+2*totpPeriod, 0))
+	assert.Equal(t, ok, false)
+
+	uri := OTPAuthURI("example.com", "bob", "ABC")
+	assert.Equal(t, strings.HasPrefix(uri, "otpauth://totp/example.com:bob?"), true)
+	assert.Equal(t, strings.Contains(uri, "secret=ABC"), true)
+
+	svg, err := QRCodeSVG(uri)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(svg, "<svg"), true)
+	assert.Equal(t, strings.Contains(svg, "<rect"), true)
+}
+
+func TestTwoFactor(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+
+	secret, uri, err := state.EnrollTOTP("bob", "example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(uri, secret), true)
+	assert.Equal(t, state.TOTPEnabled("bob"), false)
+	_, _, err = state.EnrollTOTP("nobody", "example.com")
+	assert.Equal(t, err, ErrNoSuchUser)
+
+	// Confirm the enrollment with the code for the previous period,
+	// so that the current one has not been used yet
+	code, _ := TOTP(secret, time.Now().Add(-totpPeriod*time.Second))
+	assert.Equal(t, state.ConfirmTOTP(httptest.NewRecorder(), "bob", "000000"), false)
+	assert.Equal(t, state.ConfirmTOTP(httptest.NewRecorder(), "bob", code), true)
+	assert.Equal(t, state.TOTPEnabled("bob"), true)
+
+	// Logging in without a code is refused
+	w := httptest.NewRecorder()
+	assert.Equal(t, state.Login(w, "bob"), ErrTwoFactorRequired)
+	assert.Equal(t, state.IsLoggedIn("bob"), false)
+
+	// A code can not be used twice
+	assert.Equal(t, state.LoginWithCode(w, "bob", code), false)
+	assert.Equal(t, state.IsLoggedIn("bob"), false)
+	code, _ = TOTP(secret, time.Now())
+	assert.Equal(t, state.LoginWithCode(w, "bob", code), true)
+	assert.Equal(t, state.IsLoggedIn("bob"), true)
+
+	// The second factor is only verified for the session that gave the code
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, state.TwoFactorVerified(req, "bob"), false)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	assert.Equal(t, state.TwoFactorVerified(req, "bob"), true)
+	assert.Equal(t, state.TwoFactorVerified(req, "alice"), false)
+
+	// Logging out forgets the verification
+	state.Logout("bob")
+	assert.Equal(t, state.TwoFactorVerified(req, "bob"), false)
+
+	// Recovery codes can be used once
+	codes, err := state.GenerateRecoveryCodes("bob")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(codes), RecoveryCodeCount)
+	stored, _ := state.Users().Get("bob", fieldRecoveryCodes)
+	assert.Equal(t, strings.Contains(stored, codes[0]), false)
+	assert.Equal(t, state.VerifyTOTP(w, "bob", codes[0]), true)
+	assert.Equal(t, state.VerifyTOTP(w, "bob", codes[0]), false)
+	assert.Equal(t, state.RecoveryCodesLeft("bob"), RecoveryCodeCount-1)
+
+	state.DisableTOTP("bob")
+	assert.Equal(t, state.TOTPEnabled("bob"), false)
+	assert.Equal(t, state.VerifyTOTP(w, "bob", codes[1]), false)
+}
+
+func TestAdminTwoFactor(t *testing.T) {
+	perm, cleanup := newPermissions(t)
+	defer cleanup()
+	state := perm.UserState().(*UserState)
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	state.SetAdminStatus("bob")
+
+	// Log in and keep the cookies
+	var cookies []*http.Cookie
+	keep := func(w *httptest.ResponseRecorder) {
+		cookies = append(cookies, w.Result().Cookies()...)
+	}
+	w := httptest.NewRecorder()
+	assert.Equal(t, state.Login(w, "bob"), nil)
+	keep(w)
+	request := func(path string, twoFactor bool) *http.Request {
+		req := httptest.NewRequest("GET", path, nil)
+		for _, c := range cookies {
+			if twoFactor || c.Name != TwoFactorCookieName {
+				req.AddCookie(c)
+			}
+		}
+		return req
+	}
+	assert.Equal(t, perm.Rejected(httptest.NewRecorder(), request("/admin/page", true)), false)
+
+	// Admins without a verified second factor are rejected
+	perm.SetAdminTwoFactor(true)
+	assert.Equal(t, perm.Rejected(httptest.NewRecorder(), request("/admin/page", true)), true)
+	secret, _, _ := state.EnrollTOTP("bob", "")
+	code, _ := TOTP(secret, time.Now())
+	w = httptest.NewRecorder()
+	assert.Equal(t, state.ConfirmTOTP(w, "bob", code), true)
+	keep(w)
+	assert.Equal(t, perm.Rejected(httptest.NewRecorder(), request("/admin/page", true)), false)
+
+	// Other admin prefixes are covered as well, after the prefixes are cleared,
+	// and the second factor must be verified in each session
+	perm.Clear()
+	perm.AddAdminPath("/secret")
+	assert.Equal(t, perm.Rejected(httptest.NewRecorder(), request("/secret", true)), false)
+	assert.Equal(t, perm.Rejected(httptest.NewRecorder(), request("/secret", false)), true)
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/pinterface"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserState wraps a user state from one of the permissions2 packages and
+// takes over the password hashing. In addition to sha256, bcrypt and bcrypt+,
+// argon2id is supported, and the bcrypt cost and argon2id parameters can be
+// configured. When a user logs in with a correct password that is stored with
+// an older algorithm or weaker parameters, the password is hashed again.
+type UserState struct {
+	pinterface.IUserState
+
+	mut          sync.RWMutex
+	algorithm    string
+	bcryptCost   int
+	argon2Params Argon2Params
+
+	totpMut sync.Mutex // for checking and using one-time codes
+
+	guard *Guard // for tracking failed attempts, may be nil
+
+	creator pinterface.ICreator // returned by Creator, if set
+}
+
+// NewUserState wraps the given user state. The password hashing algorithm
+// is initially the same as for the given user state.
+func NewUserState(state pinterface.IUserState) *UserState {
+	guard, err := NewGuard(state.Creator(), DefaultLockoutPolicy)
+	if err != nil {
+		log.Errorf("Could not set up tracking of failed login attempts: %s", err)
+	}
+	return &UserState{
+		IUserState:   state,
+		algorithm:    state.PasswordAlgo(),
+		bcryptCost:   bcrypt.DefaultCost,
+		argon2Params: DefaultArgon2Params,
+		guard:        guard,
+	}
+}
+
+// SetCreator sets the creator that is returned by Creator, and that failed
+// attempts and the audit log are kept with. This makes it possible to create
+// these data structures with a datastore.Store, so that they can be exported.
+// Must be called before the user state is used.
+func (state *UserState) SetCreator(creator pinterface.ICreator) error {
+	policy := DefaultLockoutPolicy
+	if state.guard != nil {
+		policy = state.guard.Policy()
+	}
+	guard, err := NewGuard(creator, policy)
+	if err != nil {
+		return err
+	}
+	state.creator = creator
+	state.guard = guard
+	return nil
+}
+
+// Creator returns the creator that was set with SetCreator, or the
+// creator of the wrapped user state
+func (state *UserState) Creator() pinterface.ICreator {
+	if state.creator != nil {
+		return state.creator
+	}
+	return state.IUserState.Creator()
+}
+
+// PasswordAlgo returns the current password hashing algorithm
+func (state *UserState) PasswordAlgo() string {
+	state.mut.RLock()
+	defer state.mut.RUnlock()
+	return state.algorithm
+}
+
+/*SetPasswordAlgo determines which password hashing algorithm should be used.
+ *
+ * Possible values are:
+ *    argon2id -> Store passwords with argon2id, but check with all of the
+ *                algorithms below as well. Older hashes are upgraded at login.
+ *    bcrypt   -> Store and check passwords with the bcrypt hash.
+ *    sha256   -> Store and check passwords with the sha256 hash.
+ *    bcrypt+  -> Store passwords with bcrypt, but check with both
+ *                bcrypt and sha256, for backwards compatibility
+ *                with old passwords that has been stored as sha256.
+ */
+func (state *UserState) SetPasswordAlgo(algorithm string) error {
+	switch algorithm {
+	case Argon2id:
+	case Sha256, Bcrypt, "bcrypt+":
+		if err := state.IUserState.SetPasswordAlgo(algorithm); err != nil {
+			return err
+		}
+	default:
+		return errors.New("auth: " + algorithm + " is an unsupported password hashing algorithm")
+	}
+	state.mut.Lock()
+	state.algorithm = algorithm
+	state.mut.Unlock()
+	return nil
+}
+
+// BcryptCost returns the cost that is used when hashing passwords with bcrypt
+func (state *UserState) BcryptCost() int {
+	state.mut.RLock()
+	defer state.mut.RUnlock()
+	return state.bcryptCost
+}
+
+// SetBcryptCost sets the cost that is used when hashing passwords with bcrypt
+func (state *UserState) SetBcryptCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return bcrypt.InvalidCostError(cost)
+	}
+	state.mut.Lock()
+	state.bcryptCost = cost
+	state.mut.Unlock()
+	return nil
+}
+
+// Argon2Params returns the parameters that are used when hashing passwords with argon2id
+func (state *UserState) Argon2Params() Argon2Params {
+	state.mut.RLock()
+	defer state.mut.RUnlock()
+	return state.argon2Params
+}
+
+// SetArgon2Params sets the parameters that are used when hashing passwords with argon2id
+func (state *UserState) SetArgon2Params(p Argon2Params) error {
+	if p.Memory < 8*uint32(p.Threads) || p.Time < 1 || p.Threads < 1 {
+		return errors.New("auth: invalid argon2id parameters")
+	}
+	state.mut.Lock()
+	state.argon2Params = p
+	state.mut.Unlock()
+	return nil
+}
+
+// HashPassword takes a password and creates a password hash.
+// It also takes a username, since some algorithms may use it for salt.
+func (state *UserState) HashPassword(username, password string) string {
+	state.mut.RLock()
+	algorithm, cost, p := state.algorithm, state.bcryptCost, state.argon2Params
+	state.mut.RUnlock()
+
+	hash, err := hashWith(algorithm, cost, p, state.CookieSecret(), username, password)
+	if err != nil {
+		log.Errorf("Could not hash the password with %s: %s", algorithm, err)
+		return ""
+	}
+	return hash
+}
+
+// SetPassword sets/changes the password for a user.
+// Does not take a password hash, will hash the password string.
+func (state *UserState) SetPassword(username, password string) {
+	state.Users().Set(username, "password", state.HashPassword(username, password))
+}
+
+// AddUser creates a user and hashes the password, does not check for rights.
+// The given data must be valid.
+func (state *UserState) AddUser(username, password, email string) {
+	state.IUserState.AddUser(username, password, email)
+	if state.PasswordAlgo() == Argon2id {
+		state.SetPassword(username, password)
+	}
+}
+
+// UserPasswordAlgo returns the name of the algorithm that was used for
+// hashing the stored password of the given user, or an empty string.
+func (state *UserState) UserPasswordAlgo(username string) string {
+	hash, err := state.PasswordHash(username)
+	if err != nil {
+		return ""
+	}
+	return HashAlgo(hash)
+}
+
+// CorrectPassword checks if a password is correct. "username" is needed because
+// it may be part of the hash for some password hashing algorithms.
+// If the password is correct, but the stored hash is outdated, the password is hashed again.
+// Failed attempts are tracked, and usernames with too many failed attempts are locked out.
+func (state *UserState) CorrectPassword(username, password string) bool {
+	return state.CheckPassword(username, password, "")
+}
+
+// correctPassword checks the password, without tracking failed attempts
+func (state *UserState) correctPassword(username, password string) bool {
+	if !state.HasUser(username) {
+		return false
+	}
+	hash, err := state.PasswordHash(username)
+	if err != nil || hash == "" {
+		return false
+	}
+
+	correct := Correct(state.PasswordAlgo(), hash, state.CookieSecret(), username, password)
+	if correct && state.needsRehash(hash) {
+		state.SetPassword(username, password)
+	}
+	return correct
+}
+
+// needsRehash checks if the given hash was created with an older algorithm
+// or weaker parameters than the ones currently configured
+func (state *UserState) needsRehash(hash string) bool {
+	state.mut.RLock()
+	algorithm, cost, p := state.algorithm, state.bcryptCost, state.argon2Params
+	state.mut.RUnlock()
+
+	switch algorithm {
+	case Argon2id:
+		if HashAlgo(hash) != Argon2id {
+			return true
+		}
+		hp, _, _, err := parseArgon2id(hash)
+		return err != nil || hp.Memory < p.Memory || hp.Time < p.Time || hp.Threads < p.Threads
+	case Bcrypt, "bcrypt+":
+		switch HashAlgo(hash) {
+		case Sha256:
+			return true
+		case Bcrypt:
+			hashCost, err := bcrypt.Cost([]byte(hash))
+			return err == nil && hashCost < cost
+		}
+	}
+	// Never downgrade from argon2id, and never rehash when using sha256
+	return false
+}
+
+// Permissions wraps a permissions middleware, so that the user state that
+// is returned by UserState is wrapped by the auth package. It can also
+// require two-factor authentication for accessing the admin path prefixes.
+type Permissions struct {
+	pinterface.IPermissions
+	state *UserState
+
+	mut               sync.RWMutex
+	adminPathPrefixes []string // the same as the ones in the wrapped middleware
+	adminTwoFactor    bool
+}
+
+// NewPermissions wraps the given permissions middleware
+func NewPermissions(perm pinterface.IPermissions) *Permissions {
+	return &Permissions{
+		IPermissions:      perm,
+		state:             NewUserState(perm.UserState()),
+		adminPathPrefixes: []string{"/admin"}, // the default for all of the permissions2 packages
+	}
+}
+
+// UserState returns the wrapped user state
+func (perm *Permissions) UserState() pinterface.IUserState {
+	return perm.state
+}
+
+// Clear removes all user and admin path prefixes
+func (perm *Permissions) Clear() {
+	perm.mut.Lock()
+	perm.adminPathPrefixes = []string{}
+	perm.mut.Unlock()
+	perm.IPermissions.Clear()
+}
+
+// AddAdminPath adds an URL path prefix for pages that are only accessible for admins
+func (perm *Permissions) AddAdminPath(prefix string) {
+	perm.mut.Lock()
+	perm.adminPathPrefixes = append(perm.adminPathPrefixes, prefix)
+	perm.mut.Unlock()
+	perm.IPermissions.AddAdminPath(prefix)
+}
+
+// SetAdminPath sets all URL path prefixes for pages that are only accessible for admins
+func (perm *Permissions) SetAdminPath(pathPrefixes []string) {
+	perm.mut.Lock()
+	perm.adminPathPrefixes = pathPrefixes
+	perm.mut.Unlock()
+	perm.IPermissions.SetAdminPath(pathPrefixes)
+}
+
+// SetAdminTwoFactor can be used for requiring that admins have verified
+// their second factor before accessing the admin path prefixes
+func (perm *Permissions) SetAdminTwoFactor(required bool) {
+	perm.mut.Lock()
+	perm.adminTwoFactor = required
+	perm.mut.Unlock()
+}
+
+// Rejected checks if a given request should be rejected
+func (perm *Permissions) Rejected(w http.ResponseWriter, req *http.Request) bool {
+	if perm.IPermissions.Rejected(w, req) {
+		return true
+	}
+	perm.mut.RLock()
+	defer perm.mut.RUnlock()
+	if !perm.adminTwoFactor {
+		return false
+	}
+	path := req.URL.Path
+	for _, prefix := range perm.adminPathPrefixes {
+		// The root path is always public
+		if path != "/" && strings.HasPrefix(path, prefix) {
+			return !perm.state.TwoFactorVerified(req, perm.state.Username(req))
+		}
+	}
+	return false
+}
+
+// ServeHTTP is the middleware handler (compatible with Negroni)
+func (perm *Permissions) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if perm.Rejected(w, req) {
+		perm.DenyFunction()(w, req)
+		return
+	}
+	next(w, req)
+}
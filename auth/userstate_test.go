@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	bolt "github.com/xyproto/permissionbolt"
+)
+
+// Cheap argon2id parameters, to keep the tests fast
+var testParams = Argon2Params{Memory: 64, Time: 1, Threads: 1}
+
+func newPermissions(t *testing.T) (*Permissions, func()) {
+	dir, err := ioutil.TempDir("", "authtest")
+	assert.Equal(t, err, nil)
+	perm, err := bolt.NewWithConf(filepath.Join(dir, "test.db"))
+	assert.Equal(t, err, nil)
+	return NewPermissions(perm), func() { os.RemoveAll(dir) }
+}
+
+func newUserState(t *testing.T) (*UserState, func()) {
+	perm, cleanup := newPermissions(t)
+	return perm.UserState().(*UserState), cleanup
+}
+
+func TestArgon2id(t *testing.T) {
+	hash, err := hashArgon2id("hunter2", testParams)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, HashAlgo(hash), Argon2id)
+	assert.Equal(t, correctArgon2id(hash, "hunter2"), true)
+	assert.Equal(t, correctArgon2id(hash, "hunter3"), false)
+	p, _, _, err := parseArgon2id(hash)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p, testParams)
+	assert.Equal(t, correctArgon2id("$argon2id$v=19$m=64$abc$def", "hunter2"), false)
+}
+
+func TestRehash(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+
+	// Start out with sha256
+	assert.Equal(t, state.SetPasswordAlgo("sha256"), nil)
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	assert.Equal(t, state.UserPasswordAlgo("bob"), Sha256)
+
+	// Upgrade to bcrypt at login
+	assert.Equal(t, state.SetPasswordAlgo("bcrypt+"), nil)
+	assert.Equal(t, state.CorrectPassword("bob", "wrong"), false)
+	assert.Equal(t, state.UserPasswordAlgo("bob"), Sha256)
+	assert.Equal(t, state.CorrectPassword("bob", "hunter2"), true)
+	assert.Equal(t, state.UserPasswordAlgo("bob"), Bcrypt)
+
+	// Upgrade to argon2id at login
+	assert.Equal(t, state.SetPasswordAlgo("argon2id"), nil)
+	assert.Equal(t, state.SetArgon2Params(testParams), nil)
+	assert.Equal(t, state.CorrectPassword("bob", "hunter2"), true)
+	assert.Equal(t, state.UserPasswordAlgo("bob"), Argon2id)
+
+	// Stronger parameters gives a new hash, the same parameters does not
+	stronger := testParams
+	stronger.Time = 2
+	assert.Equal(t, state.SetArgon2Params(stronger), nil)
+	assert.Equal(t, state.CorrectPassword("bob", "hunter2"), true)
+	hash, _ := state.PasswordHash("bob")
+	p, _, _, _ := parseArgon2id(hash)
+	assert.Equal(t, p, stronger)
+	assert.Equal(t, state.CorrectPassword("bob", "hunter2"), true)
+	hash2, _ := state.PasswordHash("bob")
+	assert.Equal(t, hash, hash2)
+
+	// Never downgrade
+	assert.Equal(t, state.SetPasswordAlgo("bcrypt"), nil)
+	assert.Equal(t, state.CorrectPassword("bob", "hunter2"), true)
+	assert.Equal(t, state.UserPasswordAlgo("bob"), Argon2id)
+
+	// New users get argon2id hashes
+	assert.Equal(t, state.SetPasswordAlgo("argon2id"), nil)
+	state.AddUser("alice", "s3cret", "alice@example.com")
+	assert.Equal(t, state.UserPasswordAlgo("alice"), Argon2id)
+	assert.Equal(t, state.CorrectPassword("alice", "s3cret"), true)
+
+	assert.NotEqual(t, state.SetPasswordAlgo("md5"), nil)
+	assert.NotEqual(t, state.SetBcryptCost(100), nil)
+}
+
+func TestBcryptCost(t *testing.T) {
+	state, cleanup := newUserState(t)
+	defer cleanup()
+
+	assert.Equal(t, state.SetPasswordAlgo("bcrypt"), nil)
+	assert.Equal(t, state.SetBcryptCost(4), nil)
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	state.SetPassword("bob", "hunter2")
+	assert.Equal(t, state.SetBcryptCost(5), nil)
+	hash, _ := state.PasswordHash("bob")
+	assert.Equal(t, state.CorrectPassword("bob", "hunter2"), true)
+	hash2, _ := state.PasswordHash("bob")
+	assert.NotEqual(t, hash, hash2)
+	assert.Equal(t, state.UserPasswordAlgo("bob"), Bcrypt)
+}
@@ -0,0 +1,169 @@
+// Package csrf provides protection against cross-site request forgery, for
+// requests to the path prefixes that have been registered
+package csrf
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/algernon/lua/cookies"
+)
+
+const (
+	// CookieName is the name of the cookie that the tokens are tied to
+	CookieName = "algernon_csrf"
+
+	// FieldName is the name of the form field that holds the token
+	FieldName = "csrf_token"
+
+	// HeaderName is the name of the HTTP header that can hold the token,
+	// for requests that are not sent by forms
+	HeaderName = "X-CSRF-Token"
+
+	// The length of the random value in the cookie, in bytes
+	nonceLength = 16
+)
+
+// Protection keeps track of which path prefixes are protected, and issues
+// and checks tokens. The tokens are tied to a random value in a cookie, and
+// signed with the cookie secret.
+type Protection struct {
+	mut       sync.RWMutex
+	prefixes  []string
+	secret    func() string
+	parseForm func(*http.Request) error
+}
+
+// New returns a Protection without any protected path prefixes. The given
+// functions return the current cookie secret, and parse the form in a
+// request. The form should be parsed the same way as by the handlers, so
+// that the same limit for the size of the body applies.
+func New(secret func() string, parseForm func(*http.Request) error) *Protection {
+	return &Protection{secret: secret, parseForm: parseForm}
+}
+
+// AddPrefix protects requests to the given path prefix, like "/account"
+func (p *Protection) AddPrefix(prefix string) {
+	p.mut.Lock()
+	p.prefixes = append(p.prefixes, prefix)
+	p.mut.Unlock()
+}
+
+// Protected checks if the given URL path is protected
+func (p *Protection) Protected(urlpath string) bool {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(urlpath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the token for the given cookie value
+func (p *Protection) sign(nonce string) string {
+	h := hmac.New(sha256.New, []byte(p.secret()))
+	h.Write([]byte("csrf:" + nonce))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// nonce returns the random value in the cookie of the given request, if any
+func nonce(req *http.Request) (string, bool) {
+	cookie, err := req.Cookie(CookieName)
+	if err != nil {
+		return "", false
+	}
+	b, err := hex.DecodeString(cookie.Value)
+	if err != nil || len(b) != nonceLength {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// Token returns a token for forms and requests that are sent from the page
+// that is being served. The cookie that the token is tied to is set if the
+// request does not have one, so Token must be called before any output.
+func (p *Protection) Token(w http.ResponseWriter, req *http.Request) (string, error) {
+	value, ok := nonce(req)
+	if !ok {
+		// The same cookie is used for all tokens of a response
+		for _, cookie := range (&http.Response{Header: w.Header()}).Cookies() {
+			if cookie.Name == CookieName {
+				return p.sign(cookie.Value), nil
+			}
+		}
+		b := make([]byte, nonceLength)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		value = hex.EncodeToString(b)
+		if err := cookies.Set(w, "", CookieName, value, cookies.DefaultOptions(req)); err != nil {
+			return "", err
+		}
+	}
+	return p.sign(value), nil
+}
+
+// ValidToken checks if the given token belongs to the cookie of the given request
+func (p *Protection) ValidToken(req *http.Request, token string) bool {
+	value, ok := nonce(req)
+	return ok && token != "" && hmac.Equal([]byte(token), []byte(p.sign(value)))
+}
+
+// requestToken returns the token that was sent with the request, either in
+// the header or in a posted form
+func (p *Protection) requestToken(req *http.Request) string {
+	if token := req.Header.Get(HeaderName); token != "" {
+		return token
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		if err := p.parseForm(req); err != nil {
+			return ""
+		}
+		return req.PostForm.Get(FieldName)
+	}
+	return ""
+}
+
+// SameOrigin checks if the Origin header, or the Referer header if there is
+// no Origin header, refers to the host of the request
+func SameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		origin = req.Header.Get("Referer")
+	}
+	if origin == "" || origin == "null" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+// safeMethod checks if the given HTTP method is only for reading
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// Rejected checks if the given request should be rejected: requests with
+// methods like POST to a protected path must either have a valid token or
+// come from the same origin.
+func (p *Protection) Rejected(req *http.Request) bool {
+	if safeMethod(req.Method) || !p.Protected(req.URL.Path) {
+		return false
+	}
+	return !p.ValidToken(req, p.requestToken(req)) && !SameOrigin(req)
+}
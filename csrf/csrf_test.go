@@ -0,0 +1,94 @@
+package csrf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// parseForm parses the form in the request, like the server does
+func parseForm(req *http.Request) error {
+	return req.ParseForm()
+}
+
+func newProtection() *Protection {
+	p := New(func() string { return "secret" }, parseForm)
+	p.AddPrefix("/account")
+	return p
+}
+
+// post returns a form POST request to the given path, with the given cookies
+func post(path string, form url.Values, cookies []*http.Cookie) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestToken(t *testing.T) {
+	p := newProtection()
+
+	// Get a token and a cookie
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/account/edit", nil)
+	token, err := p.Token(w, req)
+	assert.Equal(t, err, nil)
+	again, err := p.Token(w, req)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, again, token)
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	assert.Equal(t, len(cookies), 1)
+
+	// Requests with a valid token are accepted
+	assert.Equal(t, p.Rejected(post("/account/edit", url.Values{FieldName: {token}}, cookies)), false)
+	req = post("/account/edit", nil, cookies)
+	req.Header.Set(HeaderName, token)
+	assert.Equal(t, p.Rejected(req), false)
+
+	// Requests without a token, with a token for another cookie or signed
+	// with another secret are rejected
+	assert.Equal(t, p.Rejected(post("/account/edit", nil, cookies)), true)
+	assert.Equal(t, p.Rejected(post("/account/edit", url.Values{FieldName: {token}}, nil)), true)
+	other := []*http.Cookie{{Name: CookieName, Value: strings.Repeat("ab", nonceLength)}}
+	assert.Equal(t, p.Rejected(post("/account/edit", url.Values{FieldName: {token}}, other)), true)
+	p2 := New(func() string { return "other secret" }, parseForm)
+	p2.AddPrefix("/account")
+	assert.Equal(t, p2.Rejected(post("/account/edit", url.Values{FieldName: {token}}, cookies)), true)
+
+	// The form is parsed with the given function, so the token in the form
+	// is not found if the body can not be read
+	p3 := New(func() string { return "secret" }, func(*http.Request) error { return errors.New("too large") })
+	p3.AddPrefix("/account")
+	assert.Equal(t, p3.Rejected(post("/account/edit", url.Values{FieldName: {token}}, cookies)), true)
+
+	// Safe methods and paths that are not protected are not checked
+	assert.Equal(t, p.Rejected(httptest.NewRequest("GET", "/account/edit", nil)), false)
+	assert.Equal(t, p.Rejected(post("/public", nil, nil)), false)
+}
+
+func TestSameOrigin(t *testing.T) {
+	p := newProtection()
+
+	req := post("/account/edit", nil, nil)
+	req.Header.Set("Origin", "http://example.com")
+	assert.Equal(t, p.Rejected(req), false)
+
+	req = post("/account/edit", nil, nil)
+	req.Header.Set("Origin", "http://evil.example")
+	assert.Equal(t, p.Rejected(req), true)
+
+	req = post("/account/edit", nil, nil)
+	req.Header.Set("Referer", "http://example.com/account/")
+	assert.Equal(t, p.Rejected(req), false)
+
+	req = post("/account/edit", nil, nil)
+	req.Header.Set("Origin", "null")
+	assert.Equal(t, p.Rejected(req), true)
+}
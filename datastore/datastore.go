@@ -0,0 +1,241 @@
+// Package datastore provides data structures that go beyond what
+// pinterface.ICreator offers: sorted sets, keys that expire, publish/subscribe
+// channels and transactions. They are implemented natively for Redis and
+// emulated on top of the pinterface data structures for the other backends.
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/simpleredis"
+)
+
+// ErrNotFound is returned when a member of a sorted set could not be found
+var ErrNotFound = errors.New("datastore: not found")
+
+// ExpiringKeyValue is a KeyValue where keys can be set to expire
+type ExpiringKeyValue interface {
+	pinterface.IKeyValue
+	SetExpire(key, value string, ttl time.Duration) error
+	TimeToLive(key string) (time.Duration, error)
+}
+
+// ExpiringHashMap is a HashMap where owners, with all of their keys, can be set to expire
+type ExpiringHashMap interface {
+	pinterface.IHashMap
+	Expire(owner string, ttl time.Duration) error
+	TimeToLive(owner string) (time.Duration, error)
+}
+
+// Store creates data structures for a database backend. It implements
+// pinterface.ICreator, where the HashMaps and KeyValues that are returned
+// also implement ExpiringHashMap and ExpiringKeyValue.
+type Store struct {
+	creator  pinterface.ICreator
+	base     pinterface.ICreator         // the creator for database index 0, for the backends that are not Redis
+	pool     *simpleredis.ConnectionPool // only for Redis
+	dbindex  int
+	home     int // the database index of the Store that this Store was created from
+	broker   *broker
+	mut      *sync.Mutex   // for read-modify-write of emulated sorted sets
+	lock     *sync.RWMutex // for writing transactions, for the backends that are not Redis
+	versions *memVersions  // for detecting conflicts between transactions, for the backends that are not Redis
+	known    *sync.Map     // the data structures that have been added to the index
+}
+
+// New creates a Store that emulates the data structures on top of the given creator
+func New(creator pinterface.ICreator) *Store {
+	return &Store{creator: creator, base: creator, broker: newBroker(), mut: &sync.Mutex{}, lock: &sync.RWMutex{}, versions: newMemVersions(), known: &sync.Map{}}
+}
+
+// NewRedis creates a Store that uses Redis natively, with the given database index
+func NewRedis(pool *simpleredis.ConnectionPool, dbindex int) *Store {
+	return &Store{creator: simpleredis.NewCreator(pool, dbindex), pool: pool, dbindex: dbindex, home: dbindex, known: &sync.Map{}}
+}
+
+// Creator returns the creator that the data structures are created with
+func (s *Store) Creator() pinterface.ICreator {
+	return s.creator
+}
+
+// DatabaseIndex returns the database index of the Store
+func (s *Store) DatabaseIndex() int {
+	return s.dbindex
+}
+
+// Database returns a Store for the given database index, without changing
+// this Store. For Redis, this is the Redis database index. For the other
+// backends, the names of the data structures are prefixed with the index,
+// which places them in a separate namespace (bucket or table names). Data
+// structures that were used with a database index before then, are still
+// found by their old name.
+func (s *Store) Database(dbindex int) *Store {
+	if dbindex == s.dbindex {
+		return s
+	}
+	if s.pool != nil {
+		return &Store{creator: simpleredis.NewCreator(s.pool, dbindex), pool: s.pool, dbindex: dbindex, home: s.home, known: s.known}
+	}
+	creator := s.base
+	if dbindex != 0 {
+		creator = &prefixCreator{s.base, fmt.Sprintf("db%d_", dbindex)}
+	}
+	return &Store{creator: creator, base: s.base, dbindex: dbindex, home: s.home, broker: s.broker, mut: s.mut, lock: s.lock, versions: s.versions, known: s.known}
+}
+
+// tracker returns a tracker for the data structure of the given kind and ID
+func (s *Store) tracker(kind, id string) tracker {
+	return tracker{store: s, name: fmt.Sprintf("%d:%s:%s", s.dbindex, kind, id), id: id}
+}
+
+// NewList can create a new List with the given ID.
+// The returned List can be attached to a transaction.
+func (s *Store) NewList(id string) (pinterface.IList, error) {
+	list, err := s.creatorFor("list", id).NewList(id)
+	if err != nil {
+		return nil, err
+	}
+	s.register("list", id)
+	return &txList{s.tracker("list", id), list}, nil
+}
+
+// NewSet can create a new Set with the given ID.
+// The returned Set can be attached to a transaction.
+func (s *Store) NewSet(id string) (pinterface.ISet, error) {
+	set, err := s.creatorFor("set", id).NewSet(id)
+	if err != nil {
+		return nil, err
+	}
+	s.register("set", id)
+	return &txSet{s.tracker("set", id), set}, nil
+}
+
+// NewHashMap can create a new HashMap with the given ID.
+// The returned HashMap is also an ExpiringHashMap, and can be attached to a transaction.
+func (s *Store) NewHashMap(id string) (pinterface.IHashMap, error) {
+	hm, err := s.newHashMap(id)
+	if err != nil {
+		return nil, err
+	}
+	s.register("hashmap", id)
+	return &txHashMap{s.tracker("hashmap", id), hm}, nil
+}
+
+func (s *Store) newHashMap(id string) (ExpiringHashMap, error) {
+	hm, err := s.creatorFor("hashmap", id).NewHashMap(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.pool != nil {
+		return &redisHashMap{hm, s.pool, id, s.dbindex}, nil
+	}
+	expires, err := s.creator.NewKeyValue(expiresPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	return &hashMap{hm, expires}, nil
+}
+
+// NewKeyValue can create a new KeyValue with the given ID.
+// The returned KeyValue is also an ExpiringKeyValue, and can be attached to a transaction.
+func (s *Store) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	kv, err := s.newKeyValue(id)
+	if err != nil {
+		return nil, err
+	}
+	s.register("keyvalue", id)
+	txkv := &txKeyValue{tracker: s.tracker("keyvalue", id), kv: kv}
+	if ekv, ok := kv.(*keyValue); ok {
+		txkv.tracking = ekv.tracking
+		if _, ok := ekv.IKeyValue.(keyLister); ok {
+			// The backend can list the keys
+			return txkv, nil
+		}
+	}
+	if txkv.keys, err = s.creator.NewSet(keysPrefix + id); err != nil {
+		return nil, err
+	}
+	return txkv, nil
+}
+
+func (s *Store) newKeyValue(id string) (ExpiringKeyValue, error) {
+	kv, err := s.creatorFor("keyvalue", id).NewKeyValue(id)
+	if err != nil {
+		return nil, err
+	}
+	if ekv, ok := kv.(ExpiringKeyValue); ok {
+		// Redis supports this natively
+		return ekv, nil
+	}
+	expires, err := s.creator.NewKeyValue(expiresPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	return &keyValue{kv, expires, &tracking{s.creator, id, fmt.Sprintf("tracked:%d:%s", s.dbindex, id), s.known}}, nil
+}
+
+// NewSortedSet can create a new SortedSet with the given ID.
+// The returned SortedSet can be attached to a transaction.
+func (s *Store) NewSortedSet(id string) (SortedSet, error) {
+	zset, err := s.newSortedSet(id)
+	if err != nil {
+		return nil, err
+	}
+	s.register("sortedset", id)
+	return &txSortedSet{s.tracker("sortedset", id), zset}, nil
+}
+
+func (s *Store) newSortedSet(id string) (SortedSet, error) {
+	if s.pool != nil {
+		return &redisSortedSet{s.pool, id, s.dbindex}, nil
+	}
+	hm, err := s.creator.NewHashMap(sortedSetPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	return &sortedSet{hm, s.mut}, nil
+}
+
+// Publish sends a message to everyone that is subscribed to the given
+// channel. Returns the number of subscribers that received the message.
+func (s *Store) Publish(channel, data string) (int, error) {
+	if s.pool != nil {
+		return redisPublish(s.pool, channel, data)
+	}
+	return s.broker.publish(channel, data), nil
+}
+
+// Subscribe listens for messages on the given channels.
+// The subscription must be closed when it is no longer needed.
+func (s *Store) Subscribe(channels ...string) (*Subscription, error) {
+	if s.pool != nil {
+		return redisSubscribe(s.pool, channels)
+	}
+	return s.broker.subscribe(channels), nil
+}
+
+// prefixCreator places the data structures in a namespace, by prefixing their names
+type prefixCreator struct {
+	creator pinterface.ICreator
+	prefix  string
+}
+
+func (c *prefixCreator) NewList(id string) (pinterface.IList, error) {
+	return c.creator.NewList(c.prefix + id)
+}
+
+func (c *prefixCreator) NewSet(id string) (pinterface.ISet, error) {
+	return c.creator.NewSet(c.prefix + id)
+}
+
+func (c *prefixCreator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	return c.creator.NewHashMap(c.prefix + id)
+}
+
+func (c *prefixCreator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	return c.creator.NewKeyValue(c.prefix + id)
+}
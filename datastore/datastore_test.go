@@ -0,0 +1,515 @@
+package datastore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/sqlite"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/simplebolt"
+)
+
+// Check that the Store can be used in place of the other creators
+var _ pinterface.ICreator = &Store{}
+
+func setup(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "datastoretest")
+	assert.Equal(t, err, nil)
+	db, err := simplebolt.New(filepath.Join(dir, "test.db"))
+	assert.Equal(t, err, nil)
+	return New(simplebolt.NewCreator(db)), func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func names(members []Member) []string {
+	s := make([]string, len(members))
+	for i, m := range members {
+		s[i] = m.Name
+	}
+	return s
+}
+
+func TestSortedSet(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	z, err := store.NewSortedSet("scores")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, z.Add("alice", 30), nil)
+	assert.Equal(t, z.Add("bob", 10), nil)
+	assert.Equal(t, z.Add("carol", 20), nil)
+	assert.Equal(t, z.Add("dave", 20), nil)
+
+	size, err := z.Size()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, size, int64(4))
+
+	members, err := z.Range(0, -1, false)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, names(members), []string{"bob", "carol", "dave", "alice"})
+	members, _ = z.Range(0, 1, true)
+	assert.Equal(t, names(members), []string{"alice", "dave"})
+	members, _ = z.Range(10, 20, false)
+	assert.Equal(t, len(members), 0)
+
+	members, _ = z.RangeByScore(15, 25, false)
+	assert.Equal(t, names(members), []string{"carol", "dave"})
+
+	score, err := z.Inc("bob", 25)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, score, 35.0)
+	rank, err := z.Rank("bob", true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, rank, int64(0))
+
+	_, err = z.Score("nobody")
+	assert.Equal(t, err, ErrNotFound)
+	assert.Equal(t, z.Del("bob"), nil)
+	_, err = z.Rank("bob", false)
+	assert.Equal(t, err, ErrNotFound)
+
+	// Sorted sets with different names are separate
+	other, _ := store.NewSortedSet("other")
+	size, _ = other.Size()
+	assert.Equal(t, size, int64(0))
+
+	assert.Equal(t, z.Clear(), nil)
+	size, _ = z.Size()
+	assert.Equal(t, size, int64(0))
+
+	// Negative scores are ordered before the positive ones
+	z.Add("minus", -5)
+	z.Add("zero", 0)
+	z.Add("half", -0.5)
+	z.Add("big", 1e300)
+	members, _ = z.Range(0, -1, false)
+	assert.Equal(t, names(members), []string{"minus", "half", "zero", "big"})
+	assert.Equal(t, members[1].Score, -0.5)
+	members, _ = z.RangeByScore(-1, 0, true)
+	assert.Equal(t, names(members), []string{"zero", "half"})
+	members, _ = z.RangeByScore(math.Inf(-1), math.Inf(1), false)
+	assert.Equal(t, len(members), 4)
+	z.Add("minus", 5)
+	rank, _ = z.Rank("minus", false)
+	assert.Equal(t, rank, int64(2))
+	size, _ = z.Size()
+	assert.Equal(t, size, int64(4))
+}
+
+func TestKeyValueExpire(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	kv, err := store.NewKeyValue("sessions")
+	assert.Equal(t, err, nil)
+	ekv := kv.(ExpiringKeyValue)
+
+	assert.Equal(t, ekv.SetExpire("short", "a", 10*time.Millisecond), nil)
+	assert.Equal(t, ekv.SetExpire("long", "b", time.Hour), nil)
+	assert.Equal(t, kv.Set("forever", "c"), nil)
+
+	ttl, _ := ekv.TimeToLive("long")
+	assert.Equal(t, ttl > 59*time.Minute, true)
+	ttl, _ = ekv.TimeToLive("forever")
+	assert.Equal(t, ttl, time.Duration(0))
+
+	time.Sleep(20 * time.Millisecond)
+	_, err = kv.Get("short")
+	assert.NotEqual(t, err, nil)
+	value, _ := kv.Get("long")
+	assert.Equal(t, value, "b")
+	value, _ = kv.Get("forever")
+	assert.Equal(t, value, "c")
+
+	// Setting a key without an expiry time removes the expiry time
+	ekv.SetExpire("long", "b", 10*time.Millisecond)
+	kv.Set("long", "d")
+	time.Sleep(20 * time.Millisecond)
+	value, _ = kv.Get("long")
+	assert.Equal(t, value, "d")
+}
+
+func TestKeyValueTracking(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	kv, err := store.NewKeyValue("counters")
+	assert.Equal(t, err, nil)
+	txkv := kv.(*txKeyValue)
+
+	// The keys are not kept track of before they are listed
+	assert.Equal(t, kv.Set("a", "1"), nil)
+	assert.Equal(t, txkv.tracked(), false)
+	keys, err := txkv.keys.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 0)
+
+	keys, err = txkv.allKeys()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 0)
+	assert.Equal(t, txkv.tracked(), true)
+	assert.Equal(t, kv.Set("b", "2"), nil)
+	keys, _ = txkv.allKeys()
+	assert.Equal(t, keys, []string{"b"})
+
+	// A new KeyValue with the same ID is also kept track of
+	kv, _ = store.NewKeyValue("counters")
+	assert.Equal(t, kv.(*txKeyValue).tracked(), true)
+
+	// SQLite can list the keys
+	dir, err := ioutil.TempDir("", "datastoretest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	db, err := sqlite.Open(filepath.Join(dir, "test.sqlite"))
+	assert.Equal(t, err, nil)
+	defer db.Close()
+	kv, err = New(sqlite.NewCreator(db)).NewKeyValue("counters")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, kv.Set("a", "1"), nil)
+	assert.Equal(t, kv.(*txKeyValue).tracked(), false)
+	keys, err = kv.(*txKeyValue).allKeys()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, keys, []string{"a"})
+}
+
+func TestHashMapExpire(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	hm, err := store.NewHashMap("carts")
+	assert.Equal(t, err, nil)
+	hm.Set("bob", "apples", "3")
+	hm.Set("alice", "pears", "2")
+	assert.Equal(t, hm.(ExpiringHashMap).Expire("bob", 10*time.Millisecond), nil)
+	time.Sleep(20 * time.Millisecond)
+
+	exists, _ := hm.Exists("bob")
+	assert.Equal(t, exists, false)
+	owners, err := hm.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, owners, []string{"alice"})
+
+	// The old keys do not come back when the owner is set again
+	hm.Set("bob", "plums", "1")
+	keys, _ := hm.Keys("bob")
+	assert.Equal(t, keys, []string{"plums"})
+}
+
+func TestPubSub(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	sub, err := store.Subscribe("news", "weather")
+	assert.Equal(t, err, nil)
+
+	received, err := store.Publish("news", "hello")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, received, 1)
+	store.Publish("sports", "ignored")
+	store.Publish("weather", "sunny")
+
+	assert.Equal(t, <-sub.Messages(), Message{"news", "hello"})
+	assert.Equal(t, <-sub.Messages(), Message{"weather", "sunny"})
+
+	assert.Equal(t, sub.Close(), nil)
+	assert.Equal(t, sub.Close(), nil)
+	_, ok := <-sub.Messages()
+	assert.Equal(t, ok, false)
+	received, _ = store.Publish("news", "nobody is listening")
+	assert.Equal(t, received, 0)
+}
+
+func TestDatabase(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	other := store.Database(2)
+	assert.Equal(t, store.DatabaseIndex(), 0)
+	assert.Equal(t, other.DatabaseIndex(), 2)
+	assert.Equal(t, other.Database(0), store.Database(0))
+
+	kv, err := store.NewKeyValue("settings")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, kv.Set("color", "red"), nil)
+	otherKV, err := other.NewKeyValue("settings")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, otherKV.Set("color", "blue"), nil)
+
+	// The two databases do not share data
+	value, err := kv.Get("color")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, value, "red")
+	value, err = otherKV.Get("color")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, value, "blue")
+
+	z, err := other.NewSortedSet("scores")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, z.Add("alice", 1), nil)
+	z, err = store.NewSortedSet("scores")
+	assert.Equal(t, err, nil)
+	size, err := z.Size()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, size, int64(0))
+}
+
+func TestLegacyDatabase(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+
+	// A list that was used with database index 3, before the namespaces
+	old, err := store.Creator().NewList("log")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, old.Add("first"), nil)
+	list, err := store.Database(3).NewList("log")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, list.Add("second"), nil)
+	values, err := old.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, values, []string{"first", "second"})
+
+	// This is remembered, also when the list is used without a database index
+	_, err = store.NewList("log")
+	assert.Equal(t, err, nil)
+	list, err = New(store.Creator()).Database(3).NewList("log")
+	assert.Equal(t, err, nil)
+	values, _ = list.All()
+	assert.Equal(t, values, []string{"first", "second"})
+
+	// Data structures that are used for database index 0 are not shared
+	hm, err := store.NewHashMap("people")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hm.Set("bob", "email", "bob@example.com"), nil)
+	hm, err = store.Database(3).NewHashMap("people")
+	assert.Equal(t, err, nil)
+	owners, err := hm.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(owners), 0)
+}
+
+func TestRegistry(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	registry := NewRegistry(store)
+	assert.Equal(t, registry.Default(), store)
+	found, err := registry.Get("")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, found, store)
+	_, err = registry.Get("cache")
+	assert.Equal(t, err, ErrNoConnection)
+	other := store.Database(1)
+	registry.Add("cache", other)
+	found, err = registry.Get("cache")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, found, other)
+}
+
+func TestTransaction(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	from, err := store.NewList("from")
+	assert.Equal(t, err, nil)
+	to, err := store.NewList("to")
+	assert.Equal(t, err, nil)
+	stock, err := store.NewKeyValue("stock")
+	assert.Equal(t, err, nil)
+	other, err := store.NewList("to")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, from.Add("a"), nil)
+	assert.Equal(t, stock.Set("apples", "1"), nil)
+
+	// A transaction that is rolled back
+	err = Transaction(func(tx *Tx) error {
+		tx.Attach(from)
+		tx.Attach(to)
+		tx.Attach(stock)
+		assert.Equal(t, from.Clear(), nil)
+		assert.Equal(t, to.Add("a"), nil)
+		// Values that are changed within the transaction can be read back
+		apples, err := stock.Inc("apples")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, apples, "2")
+		apples, err = stock.Inc("apples")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, apples, "3")
+		assert.Equal(t, stock.Set("pears", "3"), nil)
+		pears, err := stock.Get("pears")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, pears, "3")
+		assert.Equal(t, stock.Clear(), ErrNotAtomic)
+		// Changes that are made by others are kept when the transaction is rolled back
+		assert.Equal(t, other.Add("b"), nil)
+		return ErrRollback
+	})
+	assert.Equal(t, err, ErrRollback)
+	values, err := from.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, values, []string{"a"})
+	values, err = to.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, values, []string{"b"})
+	value, err := stock.Get("apples")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, value, "1")
+	_, err = stock.Get("pears")
+	assert.NotEqual(t, err, nil)
+
+	// A transaction that is committed
+	err = Transaction(func(tx *Tx) error {
+		tx.Attach(from)
+		tx.Attach(to)
+		assert.Equal(t, from.Clear(), nil)
+		if err := to.Add("a"); err != nil {
+			return err
+		}
+		// The changes are written when the function returns
+		values, err := other.All()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, values, []string{"b"})
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	values, err = to.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, values, []string{"b", "a"})
+	values, err = from.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(values), 0)
+}
+
+func TestTransactionConflict(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	hash, err := store.NewHashMap("users")
+	assert.Equal(t, err, nil)
+	other, err := store.NewHashMap("users")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hash.Set("bob", "visits", "1"), nil)
+
+	// The first attempt is interrupted by a change that is made outside of the transaction
+	attempts := 0
+	err = Transaction(func(tx *Tx) error {
+		attempts++
+		tx.Attach(hash)
+		visits, err := hash.Get("bob", "visits")
+		assert.Equal(t, err, nil)
+		if attempts == 1 {
+			assert.Equal(t, other.Set("bob", "visits", "5"), nil)
+		}
+		return hash.Set("bob", "visits", visits+"0")
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, attempts, 2)
+	visits, err := hash.Get("bob", "visits")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, visits, "50")
+
+	// A transaction that is always interrupted gives up
+	err = Transaction(func(tx *Tx) error {
+		tx.Attach(hash)
+		if _, err := hash.Get("bob", "visits"); err != nil {
+			return err
+		}
+		assert.Equal(t, hash.Set("bob", "visits", "7"), nil)
+		return other.Set("bob", "visits", "8")
+	})
+	assert.Equal(t, err, ErrConflict)
+	visits, err = hash.Get("bob", "visits")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, visits, "8")
+}
+
+func TestExportImport(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	list, err := store.NewList("log")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, list.Add("first"), nil)
+	assert.Equal(t, list.Add("second"), nil)
+	hash, err := store.NewHashMap("people")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hash.Set("bob", "email", "bob@example.com"), nil)
+	assert.Equal(t, hash.Set("session", "user", "bob"), nil)
+	assert.Equal(t, hash.(ExpiringHashMap).Expire("session", time.Hour), nil)
+	kv, err := store.NewKeyValue("settings")
+	assert.Equal(t, err, nil)
+	// Bolt can not list the keys, which are kept track of from the first key that expires
+	assert.Equal(t, kv.(ExpiringKeyValue).SetExpire("token", "abc", time.Hour), nil)
+	assert.Equal(t, kv.Set("color", "red"), nil)
+	assert.Equal(t, kv.Set("size", "large"), nil)
+	assert.Equal(t, kv.Del("size"), nil)
+	z, err := store.NewSortedSet("scores")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, z.Add("alice", 3), nil)
+	set, err := store.Database(2).NewSet("tags")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, set.Add("blue"), nil)
+
+	names, err := store.Names()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, names, []Name{{"hashmap", "people", 0}, {"keyvalue", "settings", 0}, {"list", "log", 0}, {"sortedset", "scores", 0}})
+	names, err = store.AllNames()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(names), 5)
+	assert.Equal(t, names[4], Name{"set", "tags", 2})
+
+	name, err := ParseName("hashmap:visitors", 1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, name, Name{"hashmap", "visitors", 1})
+	_, err = ParseName("table:visitors", 0)
+	assert.NotEqual(t, err, nil)
+
+	var buf bytes.Buffer
+	assert.Equal(t, store.Export(&buf, names), nil)
+
+	// Import into an SQLite database
+	dir, err := ioutil.TempDir("", "datastoretest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	db, err := sqlite.Open(filepath.Join(dir, "test.sqlite"))
+	assert.Equal(t, err, nil)
+	defer db.Close()
+	other := New(sqlite.NewCreator(db))
+	count, err := other.Import(&buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 5)
+
+	list, err = other.NewList("log")
+	assert.Equal(t, err, nil)
+	values, err := list.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, values, []string{"first", "second"})
+	hash, err = other.NewHashMap("people")
+	assert.Equal(t, err, nil)
+	email, err := hash.Get("bob", "email")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, email, "bob@example.com")
+	kv, err = other.NewKeyValue("settings")
+	assert.Equal(t, err, nil)
+	color, err := kv.Get("color")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, color, "red")
+	_, err = kv.Get("size")
+	assert.NotEqual(t, err, nil)
+	ttl, err := kv.(ExpiringKeyValue).TimeToLive("token")
+	assert.Equal(t, err, nil)
+	assert.T(t, ttl > 59*time.Minute && ttl <= time.Hour)
+	ttl, err = hash.(ExpiringHashMap).TimeToLive("session")
+	assert.Equal(t, err, nil)
+	assert.T(t, ttl > 59*time.Minute && ttl <= time.Hour)
+	set, err = other.Database(2).NewSet("tags")
+	assert.Equal(t, err, nil)
+	values, err = set.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, values, []string{"blue"})
+	z, err = other.NewSortedSet("scores")
+	assert.Equal(t, err, nil)
+	score, err := z.Score("alice")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, score, 3.0)
+
+	_, err = other.Import(bytes.NewBufferString("{}\n"))
+	assert.Equal(t, err, ErrFormat)
+}
@@ -0,0 +1,273 @@
+package datastore
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xyproto/pinterface"
+)
+
+// The expiry times for a HashMap or KeyValue are stored in a KeyValue with this prefix.
+// Expired keys are removed the next time they are accessed.
+const expiresPrefix = "__expires_"
+
+// deadline returns the time the given key expires, and true if it has an expiry time
+func deadline(expires pinterface.IKeyValue, key string) (time.Time, bool) {
+	s, err := expires.Get(key)
+	if err != nil || s == "" {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+func setDeadline(expires pinterface.IKeyValue, key string, ttl time.Duration) error {
+	return expires.Set(key, strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10))
+}
+
+func timeToLive(expires pinterface.IKeyValue, key string) time.Duration {
+	t, ok := deadline(expires, key)
+	if !ok {
+		return 0
+	}
+	if ttl := time.Until(t); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// The IDs of the KeyValues that keep track of their keys and expiry times
+// are kept in a Set with this ID. A KeyValue only starts doing so once a key
+// that expires has been set or the keys have been listed, so that setting a
+// key is a single write until then.
+const trackedID = "__tracked"
+
+// tracking is used for checking if a KeyValue keeps track of its keys and
+// expiry times, and for making it start doing so
+type tracking struct {
+	creator pinterface.ICreator
+	id      string
+	name    string    // the name in the cache
+	known   *sync.Map // the cache, shared by all Stores for the same database
+}
+
+// enabled checks if the KeyValue keeps track of its keys and expiry times.
+// If this can not be checked, it is assumed that it does.
+func (t *tracking) enabled() bool {
+	if _, ok := t.known.Load(t.name); ok {
+		return true
+	}
+	set, err := t.creator.NewSet(trackedID)
+	if err != nil {
+		return true
+	}
+	if has, err := set.Has(t.id); err == nil && !has {
+		return false
+	}
+	t.known.Store(t.name, true)
+	return true
+}
+
+// enable makes the KeyValue keep track of its keys and expiry times
+func (t *tracking) enable() error {
+	if t.enabled() {
+		return nil
+	}
+	set, err := t.creator.NewSet(trackedID)
+	if err != nil {
+		return err
+	}
+	if err := set.Add(t.id); err != nil {
+		// It may have been added in the meantime
+		if has, _ := set.Has(t.id); !has {
+			return err
+		}
+	}
+	t.known.Store(t.name, true)
+	return nil
+}
+
+// keyLister is implemented by the KeyValues of the backends that can list their keys
+type keyLister interface {
+	Keys() ([]string, error)
+}
+
+// keyValue emulates keys that expire
+type keyValue struct {
+	pinterface.IKeyValue
+	expires  pinterface.IKeyValue
+	tracking *tracking
+}
+
+// expired removes the given key if it has expired. Returns true if it was removed.
+func (kv *keyValue) expired(key string) bool {
+	t, ok := deadline(kv.expires, key)
+	if !ok || time.Now().Before(t) {
+		return false
+	}
+	kv.IKeyValue.Del(key)
+	kv.expires.Del(key)
+	return true
+}
+
+// Set a key and value, without an expiry time
+func (kv *keyValue) Set(key, value string) error {
+	if kv.tracking.enabled() {
+		kv.expires.Del(key)
+	}
+	return kv.IKeyValue.Set(key, value)
+}
+
+// SetExpire sets a key and value that expires after the given duration
+func (kv *keyValue) SetExpire(key, value string, ttl time.Duration) error {
+	if err := kv.tracking.enable(); err != nil {
+		return err
+	}
+	if err := kv.IKeyValue.Set(key, value); err != nil {
+		return err
+	}
+	return setDeadline(kv.expires, key, ttl)
+}
+
+// TimeToLive returns how long the given key has left before it expires,
+// or 0 if it does not expire
+func (kv *keyValue) TimeToLive(key string) (time.Duration, error) {
+	return timeToLive(kv.expires, key), nil
+}
+
+// Get a value given a key
+func (kv *keyValue) Get(key string) (string, error) {
+	if kv.expired(key) {
+		return "", ErrNotFound
+	}
+	return kv.IKeyValue.Get(key)
+}
+
+// Inc increases the value of the given key, keeping the expiry time
+func (kv *keyValue) Inc(key string) (string, error) {
+	kv.expired(key)
+	return kv.IKeyValue.Inc(key)
+}
+
+// Del removes a key
+func (kv *keyValue) Del(key string) error {
+	if kv.tracking.enabled() {
+		kv.expires.Del(key)
+	}
+	return kv.IKeyValue.Del(key)
+}
+
+// Remove the KeyValue
+func (kv *keyValue) Remove() error {
+	kv.expires.Remove()
+	return kv.IKeyValue.Remove()
+}
+
+// Clear the KeyValue
+func (kv *keyValue) Clear() error {
+	kv.expires.Clear()
+	return kv.IKeyValue.Clear()
+}
+
+// hashMap emulates owners that expire
+type hashMap struct {
+	pinterface.IHashMap
+	expires pinterface.IKeyValue
+}
+
+// expired removes the given owner if it has expired. Returns true if it was removed.
+func (hm *hashMap) expired(owner string) bool {
+	t, ok := deadline(hm.expires, owner)
+	if !ok || time.Now().Before(t) {
+		return false
+	}
+	hm.IHashMap.Del(owner)
+	hm.expires.Del(owner)
+	return true
+}
+
+// Expire makes the given owner, with all keys, expire after the given duration
+func (hm *hashMap) Expire(owner string, ttl time.Duration) error {
+	return setDeadline(hm.expires, owner, ttl)
+}
+
+// TimeToLive returns how long the given owner has left before it expires,
+// or 0 if it does not expire
+func (hm *hashMap) TimeToLive(owner string) (time.Duration, error) {
+	return timeToLive(hm.expires, owner), nil
+}
+
+// Set a value for the given owner and key
+func (hm *hashMap) Set(owner, key, value string) error {
+	hm.expired(owner)
+	return hm.IHashMap.Set(owner, key, value)
+}
+
+// Get a value for the given owner and key
+func (hm *hashMap) Get(owner, key string) (string, error) {
+	if hm.expired(owner) {
+		return "", ErrNotFound
+	}
+	return hm.IHashMap.Get(owner, key)
+}
+
+// Has checks if the given owner has the given key
+func (hm *hashMap) Has(owner, key string) (bool, error) {
+	if hm.expired(owner) {
+		return false, nil
+	}
+	return hm.IHashMap.Has(owner, key)
+}
+
+// Exists checks if the given owner exists
+func (hm *hashMap) Exists(owner string) (bool, error) {
+	if hm.expired(owner) {
+		return false, nil
+	}
+	return hm.IHashMap.Exists(owner)
+}
+
+// All returns all owners that have not expired
+func (hm *hashMap) All() ([]string, error) {
+	owners, err := hm.IHashMap.All()
+	if err != nil {
+		return nil, err
+	}
+	alive := owners[:0]
+	for _, owner := range owners {
+		if !hm.expired(owner) {
+			alive = append(alive, owner)
+		}
+	}
+	return alive, nil
+}
+
+// Keys returns all keys for the given owner
+func (hm *hashMap) Keys(owner string) ([]string, error) {
+	if hm.expired(owner) {
+		return []string{}, nil
+	}
+	return hm.IHashMap.Keys(owner)
+}
+
+// Del removes the given owner
+func (hm *hashMap) Del(owner string) error {
+	hm.expires.Del(owner)
+	return hm.IHashMap.Del(owner)
+}
+
+// Remove the HashMap
+func (hm *hashMap) Remove() error {
+	hm.expires.Remove()
+	return hm.IHashMap.Remove()
+}
+
+// Clear the HashMap
+func (hm *hashMap) Clear() error {
+	hm.expires.Clear()
+	return hm.IHashMap.Clear()
+}
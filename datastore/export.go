@@ -0,0 +1,428 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// The names of the data structures that have been created with a Store
+	// are kept in a Set with this ID, so that they can be exported
+	indexID = "__index"
+
+	// The keys of each KeyValue are kept in a Set with this prefix, for
+	// the backends where a KeyValue can not list its keys
+	keysPrefix = "__keys_"
+
+	// The format and version of exported data
+	exportFormat  = "algernon"
+	exportVersion = 1
+)
+
+// ErrFormat is returned when importing data that is not in the export format
+var ErrFormat = errors.New("datastore: not exported Algernon data")
+
+// The database indexes other than the one of the Store, where data
+// structures have been created, are added to the index with this kind
+const databaseKind = "db"
+
+// Name identifies a data structure by kind ("list", "set", "hashmap",
+// "keyvalue" or "sortedset"), ID and database index
+type Name struct {
+	Kind     string
+	ID       string
+	Database int
+}
+
+// ParseName parses a name on the form "kind:id", for the given database index
+func ParseName(s string, dbindex int) (Name, error) {
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		return Name{}, fmt.Errorf("datastore: not a name on the form kind:id: %s", s)
+	}
+	switch fields[0] {
+	case "list", "set", "hashmap", "keyvalue", "sortedset":
+		return Name{fields[0], fields[1], dbindex}, nil
+	}
+	return Name{}, fmt.Errorf("datastore: unknown kind of data structure: %s", fields[0])
+}
+
+// header is the first line of exported data
+type header struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// record is a line of exported data, with the contents of one data structure
+type record struct {
+	Kind     string                       `json:"kind"`
+	ID       string                       `json:"id"`
+	Database int                          `json:"db,omitempty"`
+	Values   []string                     `json:"values,omitempty"`  // for lists and sets
+	Owners   map[string]map[string]string `json:"owners,omitempty"`  // for hash maps
+	Keys     map[string]string            `json:"keys,omitempty"`    // for key/values
+	Members  []Member                     `json:"members,omitempty"` // for sorted sets
+	Expires  map[string]int64             `json:"expires,omitempty"` // when owners or keys expire, in Unix milliseconds
+}
+
+// addToIndex adds the given name to the index of the given Store
+func addToIndex(s *Store, name string) {
+	index, err := s.creator.NewSet(indexID)
+	if err != nil {
+		return
+	}
+	// Adding a name that is already there may fail
+	if has, err := index.Has(name); err == nil && !has {
+		index.Add(name)
+	}
+}
+
+// register adds the data structure to the index, the first time it is created.
+// The database index is added to the index of the Store that this Store was
+// created from, if they differ.
+func (s *Store) register(kind, id string) {
+	name := kind + ":" + id
+	if _, known := s.known.LoadOrStore(fmt.Sprintf("%d:%s", s.dbindex, name), true); known {
+		return
+	}
+	addToIndex(s, name)
+	if s.dbindex != s.home {
+		addToIndex(s.Database(s.home), fmt.Sprintf("%s:%d", databaseKind, s.dbindex))
+	}
+}
+
+// index returns the sorted names in the index of the Store
+func (s *Store) index() ([]string, error) {
+	index, err := s.creator.NewSet(indexID)
+	if err != nil {
+		return nil, err
+	}
+	all, err := index.All()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(all)
+	return all, nil
+}
+
+// Names returns the data structures that have been created with the Store,
+// sorted by kind and ID
+func (s *Store) Names() ([]Name, error) {
+	all, err := s.index()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]Name, 0, len(all))
+	for _, name := range all {
+		if fields := strings.SplitN(name, ":", 2); len(fields) == 2 && fields[0] != databaseKind {
+			names = append(names, Name{fields[0], fields[1], s.dbindex})
+		}
+	}
+	return names, nil
+}
+
+// AllNames returns the data structures that have been created with the
+// Store and with the Stores for other database indexes, as returned by Database
+func (s *Store) AllNames() ([]Name, error) {
+	home := s.Database(s.home)
+	names, err := home.Names()
+	if err != nil {
+		return nil, err
+	}
+	all, err := home.index()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range all {
+		fields := strings.SplitN(name, ":", 2)
+		if len(fields) != 2 || fields[0] != databaseKind {
+			continue
+		}
+		dbindex, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		more, err := s.Database(dbindex).Names()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, more...)
+	}
+	return names, nil
+}
+
+// deadlineMillis converts the time that is left before something expires to
+// Unix milliseconds, or 0 if it does not expire
+func deadlineMillis(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+}
+
+// timeLeft returns the time that is left until the given Unix milliseconds
+func timeLeft(ms int64) time.Duration {
+	return time.Until(time.Unix(0, ms*int64(time.Millisecond)))
+}
+
+// ownerValues returns all keys and values for the given owner
+func ownerValues(hm pinterface.IHashMap, owner string) (map[string]string, error) {
+	keys, err := hm.Keys(owner)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := hm.Get(owner, key)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// read returns a record with the contents of the given data structure
+func (s *Store) read(name Name) (*record, error) {
+	r := &record{Kind: name.Kind, ID: name.ID, Database: name.Database}
+	switch name.Kind {
+	case "list":
+		list, err := s.NewList(name.ID)
+		if err != nil {
+			return nil, err
+		}
+		if r.Values, err = list.All(); err != nil {
+			return nil, err
+		}
+	case "set":
+		set, err := s.NewSet(name.ID)
+		if err != nil {
+			return nil, err
+		}
+		if r.Values, err = set.All(); err != nil {
+			return nil, err
+		}
+	case "hashmap":
+		hm, err := s.NewHashMap(name.ID)
+		if err != nil {
+			return nil, err
+		}
+		owners, err := hm.All()
+		if err != nil {
+			return nil, err
+		}
+		r.Owners = make(map[string]map[string]string, len(owners))
+		for _, owner := range owners {
+			if r.Owners[owner], err = ownerValues(hm, owner); err != nil {
+				return nil, err
+			}
+			ttl, err := hm.(ExpiringHashMap).TimeToLive(owner)
+			if err != nil {
+				return nil, err
+			}
+			r.expires(owner, ttl)
+		}
+	case "keyvalue":
+		kv, err := s.NewKeyValue(name.ID)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := kv.(*txKeyValue).allKeys()
+		if err != nil {
+			return nil, err
+		}
+		r.Keys = make(map[string]string, len(keys))
+		for _, key := range keys {
+			// Keys that have expired or been removed are skipped
+			if value, err := kv.Get(key); err == nil {
+				r.Keys[key] = value
+				ttl, err := kv.(ExpiringKeyValue).TimeToLive(key)
+				if err != nil {
+					return nil, err
+				}
+				r.expires(key, ttl)
+			}
+		}
+	case "sortedset":
+		zset, err := s.NewSortedSet(name.ID)
+		if err != nil {
+			return nil, err
+		}
+		if r.Members, err = zset.Range(0, -1, false); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("datastore: unknown kind of data structure: %s", name.Kind)
+	}
+	return r, nil
+}
+
+// expires records when the given owner or key expires, if it does
+func (r *record) expires(name string, ttl time.Duration) {
+	ms := deadlineMillis(ttl)
+	if ms == 0 {
+		return
+	}
+	if r.Expires == nil {
+		r.Expires = make(map[string]int64)
+	}
+	r.Expires[name] = ms
+}
+
+// write replaces the contents of a data structure with the contents of the record
+func (s *Store) write(r *record) error {
+	switch r.Kind {
+	case "list":
+		list, err := s.NewList(r.ID)
+		if err != nil {
+			return err
+		}
+		if err := list.Clear(); err != nil {
+			return err
+		}
+		for _, value := range r.Values {
+			if err := list.Add(value); err != nil {
+				return err
+			}
+		}
+	case "set":
+		set, err := s.NewSet(r.ID)
+		if err != nil {
+			return err
+		}
+		if err := set.Clear(); err != nil {
+			return err
+		}
+		for _, value := range r.Values {
+			if err := set.Add(value); err != nil {
+				return err
+			}
+		}
+	case "hashmap":
+		hm, err := s.NewHashMap(r.ID)
+		if err != nil {
+			return err
+		}
+		if err := hm.Clear(); err != nil {
+			return err
+		}
+		for owner, values := range r.Owners {
+			ms, expires := r.Expires[owner]
+			if expires && timeLeft(ms) <= 0 {
+				continue
+			}
+			for key, value := range values {
+				if err := hm.Set(owner, key, value); err != nil {
+					return err
+				}
+			}
+			if expires {
+				if err := hm.(ExpiringHashMap).Expire(owner, timeLeft(ms)); err != nil {
+					return err
+				}
+			}
+		}
+	case "keyvalue":
+		kv, err := s.NewKeyValue(r.ID)
+		if err != nil {
+			return err
+		}
+		if err := kv.Clear(); err != nil {
+			return err
+		}
+		// Keep track of the keys, so that they can be exported again
+		if t := kv.(*txKeyValue).tracking; t != nil {
+			if err := t.enable(); err != nil {
+				return err
+			}
+		}
+		for key, value := range r.Keys {
+			ms, expires := r.Expires[key]
+			if !expires {
+				err = kv.Set(key, value)
+			} else if ttl := timeLeft(ms); ttl > 0 {
+				err = kv.(ExpiringKeyValue).SetExpire(key, value, ttl)
+			} else {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case "sortedset":
+		zset, err := s.NewSortedSet(r.ID)
+		if err != nil {
+			return err
+		}
+		if err := zset.Clear(); err != nil {
+			return err
+		}
+		for _, m := range r.Members {
+			if err := zset.Add(m.Name, m.Score); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("datastore: unknown kind of data structure: %s", r.Kind)
+	}
+	return nil
+}
+
+// Export writes the contents of the given data structures as JSON lines,
+// where the first line is a header and each following line is a data
+// structure. Owners of hash maps and keys that expire, are exported with
+// the time when they expire.
+func (s *Store) Export(w io.Writer, names []Name) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header{exportFormat, exportVersion}); err != nil {
+		return err
+	}
+	for _, name := range names {
+		r, err := s.Database(name.Database).read(name)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", name.Kind, name.ID, err)
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads data that has been written by Export, and replaces the
+// contents of the data structures, in the same database indexes. Owners and
+// keys that have expired in the meantime are skipped. Returns the number of
+// data structures.
+func (s *Store) Import(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	var h header
+	if err := dec.Decode(&h); err != nil || h.Format != exportFormat {
+		return 0, ErrFormat
+	}
+	if h.Version > exportVersion {
+		return 0, fmt.Errorf("datastore: unsupported version of exported data: %d", h.Version)
+	}
+	count := 0
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := s.Database(rec.Database).write(&rec); err != nil {
+			return count, fmt.Errorf("%s %s: %s", rec.Kind, rec.ID, err)
+		}
+		count++
+	}
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/xyproto/pinterface"
+)
+
+// Before the data structures were placed in a namespace for each database
+// index, the database index was ignored by the backends that are not Redis.
+// The data structures that were used with a database index then, are still
+// found by their old name. Their names are kept in a Set with this ID, in
+// the namespace of the database index.
+const legacyID = "__legacy"
+
+// creatorFor returns the creator for the data structure of the given kind
+// and ID. This is the creator of the Store, unless the data structure was
+// created without a namespace, before the database index was used for it.
+func (s *Store) creatorFor(kind, id string) pinterface.ICreator {
+	if s.pool != nil || s.creator == s.base {
+		return s.creator
+	}
+	cacheKey := fmt.Sprintf("legacy:%d:%s:%s", s.dbindex, kind, id)
+	if legacy, ok := s.known.Load(cacheKey); ok {
+		if legacy.(bool) {
+			return s.base
+		}
+		return s.creator
+	}
+	legacy := s.legacy(kind, id)
+	s.known.Store(cacheKey, legacy)
+	if legacy {
+		return s.base
+	}
+	return s.creator
+}
+
+// legacy checks if the data structure of the given kind and ID should be
+// found by the name it had before the database index was used for it. This
+// is the case if it has data by that name, but not in the namespace, and the
+// name is not used for database index 0 since then. Once a data structure is
+// found by its old name, it stays that way.
+func (s *Store) legacy(kind, id string) bool {
+	name := kind + ":" + id
+	set, err := s.creator.NewSet(legacyID)
+	if err != nil {
+		return false
+	}
+	if has, err := set.Has(name); err == nil && has {
+		return true
+	}
+	if hasData(s.creator, kind, id) || !hasData(s.base, kind, id) {
+		return false
+	}
+	if index, err := s.base.NewSet(indexID); err == nil {
+		if has, err := index.Has(name); err != nil || has {
+			return false
+		}
+	}
+	return set.Add(name) == nil
+}
+
+// hasData checks if the data structure of the given kind and ID contains
+// anything. Returns false if this can not be checked, which is the case for
+// the KeyValues of the backends that can not list the keys.
+func hasData(creator pinterface.ICreator, kind, id string) bool {
+	var (
+		values []string
+		err    error
+	)
+	switch kind {
+	case "list":
+		var list pinterface.IList
+		if list, err = creator.NewList(id); err == nil {
+			values, err = list.All()
+		}
+	case "set":
+		var set pinterface.ISet
+		if set, err = creator.NewSet(id); err == nil {
+			values, err = set.All()
+		}
+	case "hashmap":
+		var hm pinterface.IHashMap
+		if hm, err = creator.NewHashMap(id); err == nil {
+			values, err = hm.All()
+		}
+	case "keyvalue":
+		var kv pinterface.IKeyValue
+		if kv, err = creator.NewKeyValue(id); err == nil {
+			lister, ok := kv.(keyLister)
+			if !ok {
+				return false
+			}
+			values, err = lister.Keys()
+		}
+	}
+	return err == nil && len(values) > 0
+}
@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"sync"
+)
+
+// Number of messages that are buffered per subscription.
+// If a subscriber falls further behind, new messages are dropped for that subscriber.
+const subscriptionBuffer = 64
+
+// Message is a message that has been published on a channel
+type Message struct {
+	Channel string
+	Data    string
+}
+
+// Subscription receives the messages that are published on one or more channels
+type Subscription struct {
+	messages chan Message
+	close    func() error
+	once     sync.Once
+}
+
+// Messages returns the channel that the messages are received on.
+// The channel is closed when the subscription is closed.
+func (sub *Subscription) Messages() <-chan Message {
+	return sub.messages
+}
+
+// Close stops the subscription
+func (sub *Subscription) Close() error {
+	var err error
+	sub.once.Do(func() {
+		err = sub.close()
+	})
+	return err
+}
+
+// broker passes messages between subscribers in the same process,
+// for the backends that do not have publish/subscribe
+type broker struct {
+	subscriptions map[string]map[*Subscription]bool
+	mut           sync.RWMutex
+}
+
+func newBroker() *broker {
+	return &broker{subscriptions: make(map[string]map[*Subscription]bool)}
+}
+
+func (b *broker) publish(channel, data string) int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	received := 0
+	for sub := range b.subscriptions[channel] {
+		select {
+		case sub.messages <- Message{channel, data}:
+			received++
+		default:
+			// The subscriber is too far behind
+		}
+	}
+	return received
+}
+
+func (b *broker) subscribe(channels []string) *Subscription {
+	sub := &Subscription{messages: make(chan Message, subscriptionBuffer)}
+	b.mut.Lock()
+	for _, channel := range channels {
+		if b.subscriptions[channel] == nil {
+			b.subscriptions[channel] = make(map[*Subscription]bool)
+		}
+		b.subscriptions[channel][sub] = true
+	}
+	b.mut.Unlock()
+	sub.close = func() error {
+		b.mut.Lock()
+		defer b.mut.Unlock()
+		for _, channel := range channels {
+			delete(b.subscriptions[channel], sub)
+			if len(b.subscriptions[channel]) == 0 {
+				delete(b.subscriptions, channel)
+			}
+		}
+		close(sub.messages)
+		return nil
+	}
+	return sub
+}
@@ -0,0 +1,197 @@
+package datastore
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/simpleredis"
+)
+
+// do runs a single Redis command on a connection from the pool
+func do(pool *simpleredis.ConnectionPool, dbindex int, command string, args ...interface{}) (interface{}, error) {
+	conn := pool.Get(dbindex)
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+// redisHashMap is a HashMap where owners can expire, using EXPIRE
+type redisHashMap struct {
+	pinterface.IHashMap
+	pool    *simpleredis.ConnectionPool
+	id      string
+	dbindex int
+}
+
+// Expire makes the given owner, with all keys, expire after the given duration
+func (hm *redisHashMap) Expire(owner string, ttl time.Duration) error {
+	// simpleredis stores each owner as a Redis hash named "id:owner"
+	_, err := do(hm.pool, hm.dbindex, "PEXPIRE", hm.id+":"+owner, int64(ttl/time.Millisecond))
+	return err
+}
+
+// TimeToLive returns how long the given owner has left before it expires,
+// or 0 if it does not expire
+func (hm *redisHashMap) TimeToLive(owner string) (time.Duration, error) {
+	ms, err := redis.Int64(do(hm.pool, hm.dbindex, "PTTL", hm.id+":"+owner))
+	if err != nil || ms <= 0 {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// redisSortedSet is a Redis sorted set
+type redisSortedSet struct {
+	pool    *simpleredis.ConnectionPool
+	id      string
+	dbindex int
+}
+
+func (z *redisSortedSet) do(command string, args ...interface{}) (interface{}, error) {
+	return do(z.pool, z.dbindex, command, args...)
+}
+
+// formatScore formats a score the way Redis expects it
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// members converts a reply from a command with WITHSCORES
+func members(reply interface{}, err error) ([]Member, error) {
+	values, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]Member, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, Member{values[i], score})
+	}
+	return found, nil
+}
+
+// notFound converts a nil reply to ErrNotFound
+func notFound(err error) error {
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Add a member with the given score, or update the score if the member exists
+func (z *redisSortedSet) Add(member string, score float64) error {
+	_, err := z.do("ZADD", z.id, formatScore(score), member)
+	return err
+}
+
+// Inc increases the score of the given member, and returns the new score
+func (z *redisSortedSet) Inc(member string, delta float64) (float64, error) {
+	return redis.Float64(z.do("ZINCRBY", z.id, formatScore(delta), member))
+}
+
+// Score returns the score of the given member
+func (z *redisSortedSet) Score(member string) (float64, error) {
+	score, err := redis.Float64(z.do("ZSCORE", z.id, member))
+	return score, notFound(err)
+}
+
+// Rank returns the position of the given member, starting at 0
+func (z *redisSortedSet) Rank(member string, reverse bool) (int64, error) {
+	command := "ZRANK"
+	if reverse {
+		command = "ZREVRANK"
+	}
+	rank, err := redis.Int64(z.do(command, z.id, member))
+	return rank, notFound(err)
+}
+
+// Del removes the given member
+func (z *redisSortedSet) Del(member string) error {
+	_, err := z.do("ZREM", z.id, member)
+	return err
+}
+
+// Size returns the number of members
+func (z *redisSortedSet) Size() (int64, error) {
+	return redis.Int64(z.do("ZCARD", z.id))
+}
+
+// Range returns the members from the start rank to the stop rank, inclusive
+func (z *redisSortedSet) Range(start, stop int64, reverse bool) ([]Member, error) {
+	command := "ZRANGE"
+	if reverse {
+		command = "ZREVRANGE"
+	}
+	return members(z.do(command, z.id, start, stop, "WITHSCORES"))
+}
+
+// RangeByScore returns the members with a score from min to max, inclusive
+func (z *redisSortedSet) RangeByScore(min, max float64, reverse bool) ([]Member, error) {
+	if reverse {
+		return members(z.do("ZREVRANGEBYSCORE", z.id, formatScore(max), formatScore(min), "WITHSCORES"))
+	}
+	return members(z.do("ZRANGEBYSCORE", z.id, formatScore(min), formatScore(max), "WITHSCORES"))
+}
+
+// Remove the sorted set
+func (z *redisSortedSet) Remove() error {
+	_, err := z.do("DEL", z.id)
+	return err
+}
+
+// Clear the sorted set
+func (z *redisSortedSet) Clear() error {
+	return z.Remove()
+}
+
+func redisPublish(pool *simpleredis.ConnectionPool, channel, data string) (int, error) {
+	// Channels are not tied to a database index
+	received, err := redis.Int(do(pool, 0, "PUBLISH", channel, data))
+	return received, err
+}
+
+func redisSubscribe(pool *simpleredis.ConnectionPool, channels []string) (*Subscription, error) {
+	psc := redis.PubSubConn{Conn: pool.Get(0)}
+	if err := psc.Subscribe(redis.Args{}.AddFlat(channels)...); err != nil {
+		psc.Close()
+		return nil, err
+	}
+	sub := &Subscription{
+		messages: make(chan Message, subscriptionBuffer),
+		// The receiving goroutine closes the connection when all channels are unsubscribed
+		close: func() error { return psc.Unsubscribe() },
+	}
+	go func() {
+		defer close(sub.messages)
+		defer psc.Close()
+		for {
+			// Wait for messages without the read timeout of the pool
+			switch v := psc.ReceiveWithTimeout(0).(type) {
+			case redis.Message:
+				select {
+				case sub.messages <- Message{v.Channel, string(v.Data)}:
+				default:
+					// The subscriber is too far behind
+				}
+			case redis.Subscription:
+				if v.Kind == "unsubscribe" && v.Count == 0 {
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
@@ -0,0 +1,46 @@
+package datastore
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoConnection is returned when there is no connection with the given name
+var ErrNoConnection = errors.New("datastore: no such connection")
+
+// Registry keeps track of the default Store and any named Stores,
+// for using more than one database backend at the same time
+type Registry struct {
+	stores map[string]*Store
+	mut    sync.RWMutex
+}
+
+// NewRegistry creates a Registry where the given Store is the default one
+func NewRegistry(store *Store) *Registry {
+	return &Registry{stores: map[string]*Store{"": store}}
+}
+
+// Add a named Store. An existing Store with the same name is replaced.
+func (r *Registry) Add(name string, store *Store) {
+	r.mut.Lock()
+	r.stores[name] = store
+	r.mut.Unlock()
+}
+
+// Get the Store with the given name. An empty name gives the default Store.
+func (r *Registry) Get(name string) (*Store, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	store, ok := r.stores[name]
+	if !ok || store == nil {
+		return nil, ErrNoConnection
+	}
+	return store, nil
+}
+
+// Default returns the default Store
+func (r *Registry) Default() *Store {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.stores[""]
+}
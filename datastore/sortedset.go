@@ -0,0 +1,275 @@
+package datastore
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/xyproto/pinterface"
+)
+
+// Each emulated sorted set is stored in a HashMap with this prefix. The
+// members and their scores are stored under one owner, and a score index,
+// where the keys are the encoded score followed by the member name, is
+// stored under the other owner.
+const (
+	sortedSetPrefix = "__sortedset_"
+	memberOwner     = "member"
+	indexOwner      = "index"
+)
+
+// Member is a member of a sorted set, together with its score
+type Member struct {
+	Name  string  `json:"member"`
+	Score float64 `json:"score"`
+}
+
+// SortedSet is a set where each member has a score. The members are ordered
+// by score, and then by name. Ranks start at 0, and negative ranks count from
+// the end, like in Redis.
+type SortedSet interface {
+	Add(member string, score float64) error
+	Inc(member string, delta float64) (float64, error)
+	Score(member string) (float64, error)
+	Rank(member string, reverse bool) (int64, error)
+	Del(member string) error
+	Size() (int64, error)
+	Range(start, stop int64, reverse bool) ([]Member, error)
+	RangeByScore(min, max float64, reverse bool) ([]Member, error)
+	Remove() error
+	Clear() error
+}
+
+// rankRange adjusts the given ranks to a set with n members, like ZRANGE does.
+// Returns false if the range is empty.
+func rankRange(n, start, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, start <= stop && start < n
+}
+
+// indexKey encodes a score and a member, so that the keys sort in the same
+// order as the members of the sorted set: by score, and then by name
+func indexKey(member string, score float64) string {
+	if score == 0 {
+		// -0 and 0 are the same score
+		score = 0
+	}
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return fmt.Sprintf("%016x", bits) + member
+}
+
+// parseIndexKey returns the member and the score of a key in the score index
+func parseIndexKey(key string) (Member, error) {
+	if len(key) < 16 {
+		return Member{}, fmt.Errorf("datastore: invalid sorted set index key: %q", key)
+	}
+	bits, err := strconv.ParseUint(key[:16], 16, 64)
+	if err != nil {
+		return Member{}, err
+	}
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return Member{key[16:], math.Float64frombits(bits)}, nil
+}
+
+// sortedSet emulates a sorted set with a HashMap, where each member is
+// stored under its own key, both with the score and in the score index
+type sortedSet struct {
+	hm  pinterface.IHashMap
+	mut *sync.Mutex
+}
+
+// set stores the score of a member and updates the score index.
+// The lock must be held.
+func (z *sortedSet) set(member string, score float64) error {
+	if old, err := z.score(member); err == nil {
+		if err := z.hm.DelKey(indexOwner, indexKey(member, old)); err != nil {
+			return err
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+	if err := z.hm.Set(memberOwner, member, formatScore(score)); err != nil {
+		return err
+	}
+	return z.hm.Set(indexOwner, indexKey(member, score), "")
+}
+
+// score returns the score of a member, or ErrNotFound
+func (z *sortedSet) score(member string) (float64, error) {
+	found, err := z.hm.Has(memberOwner, member)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrNotFound
+	}
+	value, err := z.hm.Get(memberOwner, member)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// sorted returns the keys of the score index, in order
+func (z *sortedSet) sorted(reverse bool) ([]string, error) {
+	keys, err := z.hm.Keys(indexOwner)
+	if err != nil {
+		return nil, err
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	} else {
+		sort.Strings(keys)
+	}
+	return keys, nil
+}
+
+// decode returns the members for the given keys of the score index
+func decode(keys []string) ([]Member, error) {
+	members := make([]Member, len(keys))
+	for i, key := range keys {
+		m, err := parseIndexKey(key)
+		if err != nil {
+			return nil, err
+		}
+		members[i] = m
+	}
+	return members, nil
+}
+
+// Add a member with the given score, or update the score if the member exists
+func (z *sortedSet) Add(member string, score float64) error {
+	z.mut.Lock()
+	defer z.mut.Unlock()
+	return z.set(member, score)
+}
+
+// Inc increases the score of the given member, and returns the new score.
+// The member is added with a score of delta if it does not exist.
+func (z *sortedSet) Inc(member string, delta float64) (float64, error) {
+	z.mut.Lock()
+	defer z.mut.Unlock()
+	score, err := z.score(member)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	score += delta
+	return score, z.set(member, score)
+}
+
+// Score returns the score of the given member
+func (z *sortedSet) Score(member string) (float64, error) {
+	return z.score(member)
+}
+
+// Rank returns the position of the given member, starting at 0
+func (z *sortedSet) Rank(member string, reverse bool) (int64, error) {
+	score, err := z.score(member)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := z.sorted(false)
+	if err != nil {
+		return 0, err
+	}
+	key := indexKey(member, score)
+	i := sort.SearchStrings(keys, key)
+	if i == len(keys) || keys[i] != key {
+		return 0, ErrNotFound
+	}
+	if reverse {
+		return int64(len(keys) - 1 - i), nil
+	}
+	return int64(i), nil
+}
+
+// Del removes the given member
+func (z *sortedSet) Del(member string) error {
+	z.mut.Lock()
+	defer z.mut.Unlock()
+	score, err := z.score(member)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := z.hm.DelKey(indexOwner, indexKey(member, score)); err != nil {
+		return err
+	}
+	return z.hm.DelKey(memberOwner, member)
+}
+
+// Size returns the number of members
+func (z *sortedSet) Size() (int64, error) {
+	keys, err := z.hm.Keys(indexOwner)
+	return int64(len(keys)), err
+}
+
+// Range returns the members from the start rank to the stop rank, inclusive
+func (z *sortedSet) Range(start, stop int64, reverse bool) ([]Member, error) {
+	keys, err := z.sorted(reverse)
+	if err != nil {
+		return nil, err
+	}
+	start, stop, ok := rankRange(int64(len(keys)), start, stop)
+	if !ok {
+		return []Member{}, nil
+	}
+	return decode(keys[start : stop+1])
+}
+
+// RangeByScore returns the members with a score from min to max, inclusive
+func (z *sortedSet) RangeByScore(min, max float64, reverse bool) ([]Member, error) {
+	if min > max {
+		return []Member{}, nil
+	}
+	keys, err := z.sorted(false)
+	if err != nil {
+		return nil, err
+	}
+	// The keys start with the encoded score, which is 16 characters long
+	lower, upper := indexKey("", min), indexKey("", max)
+	from := sort.SearchStrings(keys, lower)
+	to := sort.Search(len(keys), func(i int) bool {
+		return keys[i][:16] > upper
+	})
+	keys = keys[from:to]
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+	return decode(keys)
+}
+
+// Remove the sorted set
+func (z *sortedSet) Remove() error {
+	return z.Clear()
+}
+
+// Clear the sorted set
+func (z *sortedSet) Clear() error {
+	z.mut.Lock()
+	defer z.mut.Unlock()
+	return z.hm.Clear()
+}
@@ -0,0 +1,513 @@
+package datastore
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/xyproto/pinterface"
+)
+
+// The data structures that a Store returns. Every call is passed on to the
+// underlying data structure. Within a transaction, the changes are queued
+// instead, together with the Redis commands that make the same changes, and
+// the values of keys and members are remembered, so that they can be read
+// back before the transaction is done.
+
+// txList is a List that can be attached to a transaction
+type txList struct {
+	tracker
+	list pinterface.IList
+}
+
+// Add an element to the list
+func (l *txList) Add(value string) error {
+	return l.change(func() error { return l.list.Add(value) }, l.command("RPUSH", l.id, value))
+}
+
+// All returns all elements of the list
+func (l *txList) All() ([]string, error) {
+	done, err := l.read(l.id)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return l.list.All()
+}
+
+// Last returns the last element of the list
+func (l *txList) Last() (string, error) {
+	done, err := l.read(l.id)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	return l.list.Last()
+}
+
+// LastN returns the N last elements of the list
+func (l *txList) LastN(n int) ([]string, error) {
+	done, err := l.read(l.id)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return l.list.LastN(n)
+}
+
+// Remove the list
+func (l *txList) Remove() error {
+	return l.change(l.list.Remove, l.command("DEL", l.id))
+}
+
+// Clear the list
+func (l *txList) Clear() error {
+	return l.change(l.list.Clear, l.command("DEL", l.id))
+}
+
+// txSet is a Set that can be attached to a transaction
+type txSet struct {
+	tracker
+	set pinterface.ISet
+}
+
+// Add an element to the set
+func (s *txSet) Add(value string) error {
+	return s.change(func() error { return s.set.Add(value) }, s.command("SADD", s.id, value))
+}
+
+// Has checks if the set has the given element
+func (s *txSet) Has(value string) (bool, error) {
+	done, err := s.read(s.id)
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	return s.set.Has(value)
+}
+
+// All returns all elements of the set
+func (s *txSet) All() ([]string, error) {
+	done, err := s.read(s.id)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return s.set.All()
+}
+
+// Del removes an element from the set
+func (s *txSet) Del(value string) error {
+	return s.change(func() error { return s.set.Del(value) }, s.command("SREM", s.id, value))
+}
+
+// Remove the set
+func (s *txSet) Remove() error {
+	return s.change(s.set.Remove, s.command("DEL", s.id))
+}
+
+// Clear the set
+func (s *txSet) Clear() error {
+	return s.change(s.set.Clear, s.command("DEL", s.id))
+}
+
+// txHashMap is a HashMap that can be attached to a transaction
+type txHashMap struct {
+	tracker
+	hm ExpiringHashMap
+}
+
+// ownerPart and keyPart name the parts of the hash map that are remembered
+// within a transaction
+func ownerPart(owner string) string {
+	return "owner:" + owner + "\x00"
+}
+
+func keyPart(owner, key string) string {
+	return ownerPart(owner) + key
+}
+
+// Set a key and value for the given owner
+func (h *txHashMap) Set(owner, key, value string) error {
+	h.remember(keyPart(owner, key), pending{value: value})
+	return h.change(func() error { return h.hm.Set(owner, key, value) }, h.command("HSET", h.key(owner), key, value))
+}
+
+// Get the value of a key for the given owner
+func (h *txHashMap) Get(owner, key string) (string, error) {
+	if p, ok := h.lookup(keyPart(owner, key), ownerPart(owner)); ok {
+		if p.deleted {
+			return "", ErrNotFound
+		}
+		return p.value, nil
+	}
+	done, err := h.read(h.key(owner))
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	return h.hm.Get(owner, key)
+}
+
+// Has checks if the given owner has the given key
+func (h *txHashMap) Has(owner, key string) (bool, error) {
+	if p, ok := h.lookup(keyPart(owner, key), ownerPart(owner)); ok {
+		return !p.deleted, nil
+	}
+	done, err := h.read(h.key(owner))
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	return h.hm.Has(owner, key)
+}
+
+// Exists checks if the given owner exists
+func (h *txHashMap) Exists(owner string) (bool, error) {
+	done, err := h.read(h.key(owner))
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	return h.hm.Exists(owner)
+}
+
+// All returns all owners. With Redis, owners that are added or removed by
+// others while a transaction runs are not detected.
+func (h *txHashMap) All() ([]string, error) {
+	done, err := h.read()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return h.hm.All()
+}
+
+// Keys returns all keys for the given owner
+func (h *txHashMap) Keys(owner string) ([]string, error) {
+	done, err := h.read(h.key(owner))
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return h.hm.Keys(owner)
+}
+
+// DelKey removes a key for the given owner
+func (h *txHashMap) DelKey(owner, key string) error {
+	h.remember(keyPart(owner, key), pending{deleted: true})
+	return h.change(func() error { return h.hm.DelKey(owner, key) }, h.command("HDEL", h.key(owner), key))
+}
+
+// Del removes the given owner, with all keys
+func (h *txHashMap) Del(owner string) error {
+	h.remember(ownerPart(owner), pending{deleted: true})
+	return h.change(func() error { return h.hm.Del(owner) }, h.command("DEL", h.key(owner)))
+}
+
+// Expire makes the given owner, with all keys, expire after the given duration
+func (h *txHashMap) Expire(owner string, ttl time.Duration) error {
+	return h.change(func() error { return h.hm.Expire(owner, ttl) }, h.command("PEXPIRE", h.key(owner), int64(ttl/time.Millisecond)))
+}
+
+// TimeToLive returns how long it is until the given owner expires
+func (h *txHashMap) TimeToLive(owner string) (time.Duration, error) {
+	done, err := h.read(h.key(owner))
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return h.hm.TimeToLive(owner)
+}
+
+// Remove the hash map. The owners can not be listed atomically with Redis,
+// so this is not possible within a transaction.
+func (h *txHashMap) Remove() error {
+	if h.tx != nil {
+		return ErrNotAtomic
+	}
+	return h.change(h.hm.Remove)
+}
+
+// Clear the hash map. The owners can not be listed atomically with Redis,
+// so this is not possible within a transaction.
+func (h *txHashMap) Clear() error {
+	if h.tx != nil {
+		return ErrNotAtomic
+	}
+	return h.change(h.hm.Clear)
+}
+
+// txKeyValue is a KeyValue that can be attached to a transaction
+type txKeyValue struct {
+	tracker
+	kv       ExpiringKeyValue
+	keys     pinterface.ISet // the keys, for the backends where a KeyValue can not list them
+	tracking *tracking       // nil for Redis, where the keys are always kept track of
+}
+
+// tracked checks if the keys are kept track of in the set of keys
+func (kv *txKeyValue) tracked() bool {
+	return kv.keys != nil && (kv.tracking == nil || kv.tracking.enabled())
+}
+
+// addKey adds the key to the set of keys, after it has been set
+func (kv *txKeyValue) addKey(key string) {
+	if kv.tracked() {
+		// Adding a key that is already there may fail
+		kv.keys.Add(key)
+	}
+}
+
+// allKeys returns all keys. For the backends where a KeyValue can not list
+// its keys, only the keys that have been set since the keys were first
+// listed, or since a key that expires was first set, are returned.
+func (kv *txKeyValue) allKeys() ([]string, error) {
+	if kv.tracking != nil {
+		if err := kv.tracking.enable(); err != nil {
+			return nil, err
+		}
+	}
+	if kv.keys == nil {
+		return kv.kv.(*keyValue).IKeyValue.(keyLister).Keys()
+	}
+	return kv.keys.All()
+}
+
+// set returns a function that sets a key and value with the given function,
+// and adds the key to the set of keys
+func (kv *txKeyValue) set(key string, f func() error) func() error {
+	return func() error {
+		if err := f(); err != nil {
+			return err
+		}
+		kv.addKey(key)
+		return nil
+	}
+}
+
+// Set a key and value
+func (kv *txKeyValue) Set(key, value string) error {
+	kv.remember("key:"+key, pending{value: value})
+	return kv.change(kv.set(key, func() error { return kv.kv.Set(key, value) }),
+		kv.command("SET", kv.key(key), value),
+		kv.command("SADD", keysPrefix+kv.id, key))
+}
+
+// SetExpire sets a key and value that expires after the given duration
+func (kv *txKeyValue) SetExpire(key, value string, ttl time.Duration) error {
+	kv.remember("key:"+key, pending{value: value})
+	return kv.change(kv.set(key, func() error { return kv.kv.SetExpire(key, value, ttl) }),
+		kv.command("SET", kv.key(key), value, "PX", int64(ttl/time.Millisecond)),
+		kv.command("SADD", keysPrefix+kv.id, key))
+}
+
+// Get the value of the given key
+func (kv *txKeyValue) Get(key string) (string, error) {
+	if p, ok := kv.lookup("key:" + key); ok {
+		if p.deleted {
+			return "", ErrNotFound
+		}
+		return p.value, nil
+	}
+	done, err := kv.read(kv.key(key))
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	return kv.kv.Get(key)
+}
+
+// TimeToLive returns how long it is until the given key expires
+func (kv *txKeyValue) TimeToLive(key string) (time.Duration, error) {
+	done, err := kv.read(kv.key(key))
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return kv.kv.TimeToLive(key)
+}
+
+// Del removes the given key
+func (kv *txKeyValue) Del(key string) error {
+	kv.remember("key:"+key, pending{deleted: true})
+	return kv.change(func() error {
+		if err := kv.kv.Del(key); err != nil {
+			return err
+		}
+		if kv.tracked() {
+			kv.keys.Del(key)
+		}
+		return nil
+	}, kv.command("DEL", kv.key(key)), kv.command("SREM", keysPrefix+kv.id, key))
+}
+
+// Inc increases the number that is stored for the given key, and returns the new value
+func (kv *txKeyValue) Inc(key string) (string, error) {
+	if kv.tx == nil {
+		var value string
+		err := kv.change(kv.set(key, func() (err error) {
+			value, err = kv.kv.Inc(key)
+			return err
+		}))
+		return value, err
+	}
+	// Within a transaction, the new value is found by reading the current value
+	current, err := kv.Get(key)
+	if err != nil {
+		// Get fails if the key does not exist
+		current = "0"
+	}
+	n, err := strconv.ParseInt(current, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	value := strconv.FormatInt(n+1, 10)
+	kv.remember("key:"+key, pending{value: value})
+	return value, kv.change(kv.set(key, func() error {
+		_, err := kv.kv.Inc(key)
+		return err
+	}), kv.command("INCR", kv.key(key)), kv.command("SADD", keysPrefix+kv.id, key))
+}
+
+// Remove the KeyValue. The keys of a KeyValue can not be listed atomically,
+// so this is not possible within a transaction.
+func (kv *txKeyValue) Remove() error {
+	if kv.tx != nil {
+		return ErrNotAtomic
+	}
+	return kv.change(func() error {
+		if err := kv.kv.Remove(); err != nil {
+			return err
+		}
+		if kv.keys != nil {
+			kv.keys.Clear()
+		}
+		return nil
+	})
+}
+
+// Clear the KeyValue. The keys of a KeyValue can not be listed atomically,
+// so this is not possible within a transaction.
+func (kv *txKeyValue) Clear() error {
+	if kv.tx != nil {
+		return ErrNotAtomic
+	}
+	return kv.change(func() error {
+		if err := kv.kv.Clear(); err != nil {
+			return err
+		}
+		if kv.keys != nil {
+			kv.keys.Clear()
+		}
+		return nil
+	})
+}
+
+// txSortedSet is a SortedSet that can be attached to a transaction
+type txSortedSet struct {
+	tracker
+	zset SortedSet
+}
+
+// Add a member with the given score, or update the score if the member exists
+func (z *txSortedSet) Add(member string, score float64) error {
+	z.remember("member:"+member, pending{value: formatScore(score)})
+	return z.change(func() error { return z.zset.Add(member, score) }, z.command("ZADD", z.id, formatScore(score), member))
+}
+
+// Inc increases the score of the given member, and returns the new score
+func (z *txSortedSet) Inc(member string, delta float64) (float64, error) {
+	if z.tx == nil {
+		var score float64
+		err := z.change(func() (err error) {
+			score, err = z.zset.Inc(member, delta)
+			return err
+		})
+		return score, err
+	}
+	// Within a transaction, the new score is found by reading the current score
+	score, err := z.Score(member)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	score += delta
+	z.remember("member:"+member, pending{value: formatScore(score)})
+	return score, z.change(func() error {
+		_, err := z.zset.Inc(member, delta)
+		return err
+	}, z.command("ZINCRBY", z.id, formatScore(delta), member))
+}
+
+// Score returns the score of the given member
+func (z *txSortedSet) Score(member string) (float64, error) {
+	if p, ok := z.lookup("member:" + member); ok {
+		if p.deleted {
+			return 0, ErrNotFound
+		}
+		return strconv.ParseFloat(p.value, 64)
+	}
+	done, err := z.read(z.id)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return z.zset.Score(member)
+}
+
+// Rank returns the position of the given member, starting at 0
+func (z *txSortedSet) Rank(member string, reverse bool) (int64, error) {
+	done, err := z.read(z.id)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return z.zset.Rank(member, reverse)
+}
+
+// Del removes the given member
+func (z *txSortedSet) Del(member string) error {
+	z.remember("member:"+member, pending{deleted: true})
+	return z.change(func() error { return z.zset.Del(member) }, z.command("ZREM", z.id, member))
+}
+
+// Size returns the number of members
+func (z *txSortedSet) Size() (int64, error) {
+	done, err := z.read(z.id)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return z.zset.Size()
+}
+
+// Range returns the members from the start rank to the stop rank, inclusive
+func (z *txSortedSet) Range(start, stop int64, reverse bool) ([]Member, error) {
+	done, err := z.read(z.id)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return z.zset.Range(start, stop, reverse)
+}
+
+// RangeByScore returns the members with a score from min to max, inclusive
+func (z *txSortedSet) RangeByScore(min, max float64, reverse bool) ([]Member, error) {
+	done, err := z.read(z.id)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return z.zset.RangeByScore(min, max, reverse)
+}
+
+// Remove the sorted set
+func (z *txSortedSet) Remove() error {
+	z.remember("", pending{deleted: true})
+	return z.change(z.zset.Remove, z.command("DEL", z.id))
+}
+
+// Clear the sorted set
+func (z *txSortedSet) Clear() error {
+	z.remember("", pending{deleted: true})
+	return z.change(z.zset.Clear, z.command("DEL", z.id))
+}
@@ -0,0 +1,335 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// ErrConflict is returned when a transaction could not be completed
+	// because the data structures it used kept being changed by others
+	ErrConflict = errors.New("datastore: conflicting changes, the transaction was rolled back")
+
+	// ErrRollback can be returned from a transaction function, to roll back the changes
+	ErrRollback = errors.New("datastore: the transaction was rolled back")
+
+	// ErrNotAtomic is returned for changes that can not be made atomically,
+	// and are therefore not allowed within a transaction
+	ErrNotAtomic = errors.New("datastore: the change can not be made within a transaction")
+
+	// ErrMixed is returned when a transaction uses data structures from
+	// more than one database backend
+	ErrMixed = errors.New("datastore: a transaction can only use one database backend")
+)
+
+// The number of times a transaction function is run before giving up,
+// if the data structures are changed by others in the meantime
+const maxAttempts = 5
+
+// memVersions counts the changes to each data structure, for detecting
+// changes that are made by others while a transaction is running. Only used
+// for the emulated backends, where Redis uses WATCH.
+type memVersions struct {
+	counts map[string]uint64
+	mut    sync.Mutex
+}
+
+func newMemVersions() *memVersions {
+	return &memVersions{counts: make(map[string]uint64)}
+}
+
+func (v *memVersions) version(name string) uint64 {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	return v.counts[name]
+}
+
+func (v *memVersions) bump(name string) {
+	v.mut.Lock()
+	v.counts[name]++
+	v.mut.Unlock()
+}
+
+// command is a Redis command, for the given database index
+type command struct {
+	dbindex int
+	name    string
+	args    []interface{}
+}
+
+// change is a change that has been queued by a transaction. apply makes the
+// change with the emulated backends, and commands make the same change in Redis.
+type change struct {
+	name     string // the data structure that is changed
+	apply    func() error
+	commands []command
+}
+
+// pending is a value that has been changed by a transaction, so that it can
+// be read back before the transaction is done
+type pending struct {
+	value   string
+	deleted bool
+}
+
+// partKey identifies a part of a data structure, like a key or a member
+type partKey struct {
+	name string
+	part string
+}
+
+// Tx is a transaction. Changes to the attached data structures are queued,
+// and written all at once when the transaction function returns, unless the
+// data structures that were read have been changed by others in the meantime.
+type Tx struct {
+	store    *Store            // the backend of the attached data structures
+	seen     map[string]uint64 // the version of each data structure that has been read
+	changes  []change
+	pending  map[partKey]pending
+	attached []*tracker
+	conn     redis.Conn // for Redis, the connection where the keys are watched
+	err      error
+}
+
+func newTx() *Tx {
+	return &Tx{seen: make(map[string]uint64), pending: make(map[partKey]pending)}
+}
+
+// Attach makes a data structure, as returned by a Store, part of the transaction.
+// Other values are ignored.
+func (tx *Tx) Attach(v interface{}) {
+	tv, ok := v.(interface {
+		getTracker() *tracker
+	})
+	if !ok {
+		return
+	}
+	t := tv.getTracker()
+	if t.tx == tx {
+		return
+	}
+	if tx.store == nil {
+		tx.store = t.store
+	} else if t.store.pool != tx.store.pool || t.store.lock != tx.store.lock {
+		tx.err = ErrMixed
+		return
+	}
+	t.tx = tx
+	tx.attached = append(tx.attached, t)
+}
+
+// selectDatabase returns the connection where the keys are watched, with
+// the given database index selected
+func (tx *Tx) selectDatabase(dbindex int) (redis.Conn, error) {
+	if tx.conn == nil {
+		tx.conn = tx.store.pool.Get(0)
+	}
+	// The connections in the pool may have any database selected
+	_, err := tx.conn.Do("SELECT", dbindex)
+	return tx.conn, err
+}
+
+// commit writes the queued changes, or returns ErrConflict if the data
+// structures that were read have been changed by others
+func (tx *Tx) commit() error {
+	if tx.err != nil {
+		return tx.err
+	}
+	if len(tx.changes) == 0 {
+		return nil
+	}
+	if tx.store.pool != nil {
+		return tx.commitRedis()
+	}
+	// Other changes wait until all of the changes have been written
+	tx.store.lock.Lock()
+	defer tx.store.lock.Unlock()
+	for name, version := range tx.seen {
+		if tx.store.versions.version(name) != version {
+			return ErrConflict
+		}
+	}
+	for _, c := range tx.changes {
+		if err := c.apply(); err != nil {
+			return err
+		}
+		tx.store.versions.bump(c.name)
+	}
+	return nil
+}
+
+// commitRedis sends the queued changes with MULTI and EXEC. EXEC fails if
+// any of the watched keys have been changed.
+func (tx *Tx) commitRedis() error {
+	dbindex := tx.changes[0].commands[0].dbindex
+	conn, err := tx.selectDatabase(dbindex)
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	for _, c := range tx.changes {
+		for _, cmd := range c.commands {
+			if cmd.dbindex != dbindex {
+				conn.Send("SELECT", cmd.dbindex)
+				dbindex = cmd.dbindex
+			}
+			conn.Send(cmd.name, cmd.args...)
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil {
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// close ends the transaction, so that the attached data structures can be
+// used on their own again
+func (tx *Tx) close() {
+	for _, t := range tx.attached {
+		t.tx = nil
+	}
+	if tx.conn != nil {
+		// Also stops watching the keys
+		tx.conn.Close()
+	}
+}
+
+// Transaction runs the given function as a transaction. Changes to the
+// attached data structures are queued while the function runs, and written
+// when it returns. If the function returns an error, the changes are
+// discarded. If the data structures that the function has read were changed
+// by others in the meantime, the function is run again, up to 5 times before
+// ErrConflict is returned. Transactions can not be nested.
+//
+// With Redis, the changes are written with MULTI and EXEC, and the keys that
+// are read are watched. With the other backends, other changes to the Store
+// wait while the changes are written, but a transaction is not isolated from
+// other processes that use the same database, and if writing fails halfway,
+// the changes that were written are kept.
+func Transaction(fn func(tx *Tx) error) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		tx := newTx()
+		err := fn(tx)
+		if err == nil {
+			err = tx.commit()
+		}
+		tx.close()
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// tracker is part of every data structure that a Store returns, and queues
+// the changes that are made within a transaction
+type tracker struct {
+	store *Store
+	name  string // identifies the data structure within the Store's backend
+	id    string
+	tx    *Tx
+}
+
+func (t *tracker) getTracker() *tracker {
+	return t
+}
+
+// command returns a Redis command for the database of the data structure
+func (t *tracker) command(name string, args ...interface{}) command {
+	return command{t.store.dbindex, name, args}
+}
+
+// key returns the Redis key that simpleredis uses for the given part
+func (t *tracker) key(part string) string {
+	return t.id + ":" + part
+}
+
+// read must be called before the data structure is read. Within a
+// transaction, the version of the data structure is recorded, or for Redis,
+// the given keys are watched. The returned function must be called when done.
+func (t *tracker) read(keys ...string) (func(), error) {
+	if t.tx != nil {
+		if t.store.pool != nil && len(keys) > 0 {
+			conn, err := t.tx.selectDatabase(t.store.dbindex)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+				return nil, err
+			}
+		} else if _, ok := t.tx.seen[t.name]; !ok {
+			t.tx.seen[t.name] = t.store.versions.version(t.name)
+		}
+	}
+	if t.store.lock == nil {
+		return func() {}, nil
+	}
+	// Wait if a transaction is being written
+	t.store.lock.RLock()
+	return t.store.lock.RUnlock, nil
+}
+
+// change makes a change to the data structure, or queues it if a transaction
+// is running. apply makes the change with the emulated backends, and the
+// given commands make the same change in Redis.
+func (t *tracker) change(apply func() error, commands ...command) error {
+	if t.tx != nil {
+		t.tx.changes = append(t.tx.changes, change{t.name, apply, commands})
+		return nil
+	}
+	if t.store.lock == nil {
+		return apply()
+	}
+	// Changes outside of transactions can be made side by side,
+	// but not while a transaction is being written
+	t.store.lock.RLock()
+	defer t.store.lock.RUnlock()
+	if err := apply(); err != nil {
+		return err
+	}
+	t.store.versions.bump(t.name)
+	return nil
+}
+
+// lookup returns the value that the running transaction has set for the
+// first of the given parts of the data structure, or for all of it, if any
+func (t *tracker) lookup(parts ...string) (pending, bool) {
+	if t.tx == nil {
+		return pending{}, false
+	}
+	for _, part := range append(parts, "") {
+		if p, ok := t.tx.pending[partKey{t.name, part}]; ok {
+			return p, true
+		}
+	}
+	return pending{}, false
+}
+
+// remember records the value of the given part of the data structure, or
+// of all of it if the part is empty, so that it can be read back within the
+// transaction. The values of the parts that start with the given part are
+// forgotten, when all of the data structure or an owner is removed.
+func (t *tracker) remember(part string, p pending) {
+	if t.tx == nil {
+		return
+	}
+	if p.deleted && (part == "" || strings.HasSuffix(part, "\x00")) {
+		for key := range t.tx.pending {
+			if key.name == t.name && strings.HasPrefix(key.part, part) {
+				delete(t.tx.pending, key)
+			}
+		}
+	}
+	t.tx.pending[partKey{t.name, part}] = p
+}
@@ -2,7 +2,10 @@ package engine
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -19,12 +22,67 @@ import (
 	"github.com/xyproto/gopher-lua"
 )
 
+// errBodyTooLarge is returned when the request body is larger than the body limit
+var errBodyTooLarge = errors.New("the request body is too large")
+
 // FutureStatus is useful when redirecting in combination with writing to a
 // buffer before writing to a client. May contain more fields in the future.
 type FutureStatus struct {
 	code int // Buffered HTTP status code
 }
 
+// bufferedBody is a request body that has been read, so that it can be read again
+type bufferedBody struct {
+	*bytes.Reader
+	data []byte
+	err  error
+}
+
+// Close does nothing, since the body has already been read
+func (b *bufferedBody) Close() error {
+	return nil
+}
+
+// readBody reads the request body, up to the body limit. The body can only
+// be read once, so it is kept in the request, for body, jsonbody, formdata
+// and the CSRF check.
+func (ac *Config) readBody(req *http.Request) ([]byte, error) {
+	if b, ok := req.Body.(*bufferedBody); ok {
+		return b.data, b.err
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if req.Body != nil {
+		data, err = ioutil.ReadAll(io.LimitReader(req.Body, ac.bodyLimit+1))
+		if err == nil && int64(len(data)) > ac.bodyLimit {
+			data, err = nil, errBodyTooLarge
+		}
+	}
+	req.Body = &bufferedBody{bytes.NewReader(data), data, err}
+	return data, err
+}
+
+// parseForm parses the form in the request, also for multipart forms.
+// The form is parsed from the body that is kept by readBody, so that the
+// body limit applies and the body can still be read afterwards.
+func (ac *Config) parseForm(req *http.Request) error {
+	if req.Form != nil {
+		// Already parsed
+		return nil
+	}
+	data, err := ac.readBody(req)
+	if err != nil {
+		return err
+	}
+	req.Body = &bufferedBody{bytes.NewReader(data), data, nil}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		return req.ParseMultipartForm(ac.bodyLimit)
+	}
+	return req.ParseForm()
+}
+
 // LoadBasicSystemFunctions loads functions related to logging, markdown and the
 // current server directory into the given Lua state
 func (ac *Config) LoadBasicSystemFunctions(L *lua.LState) {
@@ -223,16 +281,33 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 0 // number of results
 	}))
 
-	// Return the HTTP body in the request
+	// Return the HTTP body in the request, or an empty string and an error
+	// if the body could not be read or is larger than the body limit
 	L.SetGlobal("body", L.NewFunction(func(L *lua.LState) int {
-		body, err := ioutil.ReadAll(req.Body)
-		var result lua.LString
+		body, err := ac.readBody(req)
 		if err != nil {
-			result = lua.LString("")
-		} else {
-			result = lua.LString(string(body))
+			L.Push(lua.LString(""))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
 		}
-		L.Push(result)
+		L.Push(lua.LString(string(body)))
+		return 1 // number of results
+	}))
+
+	// Return the JSON in the HTTP body of the request as Lua values, or nil
+	// and an error if the body could not be read or decoded
+	L.SetGlobal("jsonbody", L.NewFunction(func(L *lua.LState) int {
+		body, err := ac.readBody(req)
+		var value interface{}
+		if err == nil {
+			err = json.Unmarshal(body, &value)
+		}
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(convert.Interface2value(L, value))
 		return 1 // number of results
 	}))
 
@@ -298,15 +373,30 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 	L.SetGlobal("formdata", L.NewFunction(func(L *lua.LState) int {
 		// Place the form data in a map
 		m := make(map[string]string)
-		req.ParseForm()
-		for key, values := range req.Form {
-			m[key] = values[0]
+		if err := ac.parseForm(req); err != nil {
+			log.Error("formdata: ", err)
+		} else {
+			for key, values := range req.Form {
+				m[key] = values[0]
+			}
 		}
 		// Convert the map to a table and return it
 		L.Push(convert.Map2table(L, m))
 		return 1 // number of results
 	}))
 
+	// Retrieve a table with keys and lists of all the values from the form
+	// in the request, for keys that are given several times
+	L.SetGlobal("formdata_all", L.NewFunction(func(L *lua.LState) int {
+		if err := ac.parseForm(req); err != nil {
+			log.Error("formdata_all: ", err)
+			L.Push(L.NewTable())
+			return 1 // number of results
+		}
+		L.Push(convert.Values2table(L, req.Form))
+		return 1 // number of results
+	}))
+
 	// Retrieve a table with keys and values from the URL in the request
 	L.SetGlobal("urldata", L.NewFunction(func(L *lua.LState) int {
 
@@ -339,6 +429,20 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 1 // number of results
 	}))
 
+	// Retrieve a table with keys and lists of all the values from the URL in
+	// the request, or from the given URL, like "?tag=a&tag=b"
+	L.SetGlobal("urldata_all", L.NewFunction(func(L *lua.LState) int {
+		valueMap := req.URL.Query()
+		if L.GetTop() == 1 {
+			var err error
+			if valueMap, err = url.ParseQuery(L.ToString(1)); err != nil {
+				log.Error(err)
+			}
+		}
+		L.Push(convert.Values2table(L, valueMap))
+		return 1 // number of results
+	}))
+
 	// Redirect a request (as found, by default)
 	L.SetGlobal("redirect", L.NewFunction(func(L *lua.LState) int {
 		newurl := L.ToString(1)
@@ -373,7 +477,7 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 			log.Error("Could not find:", luaFilename)
 			return 0 // number of results
 		}
-		if err := L.DoFile(luaFilename); err != nil {
+		if err := ac.doFile(L, luaFilename); err != nil {
 			log.Errorf("Error running %s: %s\n", luaFilename, err)
 			return 0 // number of results
 		}
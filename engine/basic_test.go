@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// formRequestTest runs the given Lua code for a posted form, and checks
+// that both the body and the form data can be read
+func formRequestTest(t *testing.T, code string) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader("name=bob&color=red"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	ac, err := New("Algernon 123", "Just a test")
+	assert.Equal(t, err, nil)
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadBasicWeb(w, req, L, "index.lua", nil, nil)
+	assert.Equal(t, L.DoString(code), nil)
+}
+
+func TestBodyAndFormData(t *testing.T) {
+	// Both orders work
+	formRequestTest(t, `
+		assert(body() == "name=bob&color=red")
+		assert(formdata().name == "bob")
+	`)
+	formRequestTest(t, `
+		assert(formdata().color == "red")
+		assert(body() == "name=bob&color=red")
+		assert(formdata_all().name[1] == "bob")
+	`)
+}
+
+func TestBodyLimit(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader("name="+strings.Repeat("x", 100)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	ac, err := New("Algernon 123", "Just a test")
+	assert.Equal(t, err, nil)
+	ac.bodyLimit = 10
+
+	// The form is not parsed, also when the CSRF check comes first
+	ac.csrf.AddPrefix("/")
+	assert.Equal(t, ac.csrf.Rejected(req), true)
+	assert.NotEqual(t, ac.parseForm(req), nil)
+	assert.Equal(t, len(req.Form), 0)
+	_, err = ac.readBody(req)
+	assert.Equal(t, err, errBodyTooLarge)
+}
@@ -20,8 +20,20 @@ import (
 	"github.com/jvatic/goja-babel"
 	"github.com/mitchellh/colorstring"
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/auth"
 	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/algernon/csrf"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/algernon/js"
+	"github.com/xyproto/algernon/lua/jobs"
 	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/algernon/lua/sandbox"
+	"github.com/xyproto/algernon/lua/session"
+	"github.com/xyproto/algernon/lua/sqldb"
+	"github.com/xyproto/algernon/lua/tasks"
+	"github.com/xyproto/algernon/lua/transpile"
+	"github.com/xyproto/algernon/mail"
+	"github.com/xyproto/algernon/oidc"
 	"github.com/xyproto/algernon/platformdep"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/datablock"
@@ -116,6 +128,8 @@ type Config struct {
 	// Databases
 	boltFilename       string
 	useBolt            bool
+	sqliteFilename     string
+	leveldbDir         string
 	mariadbDSN         string // connection string
 	mariaDatabase      string // database name
 	postgresDSN        string // connection string
@@ -124,6 +138,10 @@ type Config struct {
 	redisDBindex       int
 	redisAddrSpecified bool
 
+	// For exporting or importing data, then quitting
+	exportFilename string
+	importFilename string
+
 	limitRequests       int64 // rate limit to this many requests per client per second
 	disableRateLimiting bool
 
@@ -179,6 +197,13 @@ type Config struct {
 	// Look for files in the directory with the same name as the requested hostname
 	serverAddDomain bool
 
+	// Run Lua scripts with limits, for all sites or per site (domain).
+	// A nil *sandbox.Options for a site means that it is not sandboxed.
+	sandboxMode   bool
+	sandbox       *sandbox.Options
+	siteSandboxes map[string]*sandbox.Options
+	sandboxMut    sync.RWMutex
+
 	// Don't use a database backend. There will be loss of functionality.
 	// TODO: Add a flag for this.
 	useNoDatabase bool
@@ -210,9 +235,15 @@ type Config struct {
 	ctrldTwice bool
 
 	// State and caching
-	perm    pinterface.IPermissions
-	luapool *pool.LStatePool
-	cache   *datablock.FileCache
+	perm      pinterface.IPermissions
+	luapool   *pool.LStatePool
+	jspool    *js.Pool // for server-side JavaScript
+	cache     *datablock.FileCache
+	scheduler *jobs.Scheduler // for periodic and scheduled Lua jobs
+	tasks     *tasks.Pool     // for Lua functions that run in the background
+
+	// For compiling Fennel and MoonScript files to Lua
+	compiler *transpile.Compiler
 
 	// Default program for opening files and URLs in the current OS
 	defaultOpenExecutable string
@@ -233,6 +264,11 @@ type Config struct {
 	// Convert JSX to HyperApp JS or React JS?
 	hyperApp bool
 
+	// Render HyperApp pages on the server, and cache the rendered pages
+	serverSideRendering bool
+	ssrCache            map[string]ssrEntry
+	ssrMut              sync.Mutex
+
 	// Support clients like "curl" that downloads uncompressed by default
 	curlSupport bool
 
@@ -242,6 +278,32 @@ type Config struct {
 
 	// Secret to be used when setting and getting user login cookies
 	cookieSecret string
+
+	// How long sessions last after they were last used
+	sessionTimeout time.Duration
+
+	// The largest request body that body and jsonbody will read, in bytes
+	bodyLimit int64
+
+	// Path prefixes where requests that change data must have a CSRF token
+	csrf *csrf.Protection
+
+	// OpenID Connect client, if configured in the server configuration
+	oidcClient *oidc.Client
+
+	// For sending e-mail, if configured in the server configuration
+	mailer   mail.Mailer
+	mailFrom string
+
+	// Account confirmation and password reset flows, if configured
+	accounts *mail.Accounts
+
+	// SQL connections that can be used from Lua with SQL()
+	sqlConnections *sqldb.Registry
+
+	// Data structures for Lua, including sorted sets and publish/subscribe,
+	// for the database backend and for any named connections
+	stores *datastore.Registry
 }
 
 // ErrVersion is returned when the initialization quits because all that is done
@@ -249,6 +311,10 @@ type Config struct {
 var (
 	ErrVersion  = errors.New("only showing version information")
 	ErrDatabase = errors.New("could not find a usable database backend")
+
+	// ErrDataTransfer is returned when the initialization quits because
+	// all that is done is exporting or importing data
+	ErrDataTransfer = errors.New("only exporting or importing data")
 )
 
 // New creates a new server configuration based using the default values
@@ -304,6 +370,15 @@ func New(versionString, description string) (*Config, error) {
 		versionString: versionString,
 		description:   description,
 
+		// Pages that have been rendered on the server
+		ssrCache: make(map[string]ssrEntry),
+
+		// Sessions last for a day after they were last used
+		sessionTimeout: session.DefaultTimeout,
+
+		// Request bodies up to 10 MiB can be read by body and jsonbody
+		bodyLimit: 10 * utils.MiB,
+
 		// JSX rendering options
 		jsxOptions: map[string]interface{}{
 			"plugins": []string{
@@ -321,6 +396,9 @@ func New(versionString, description string) (*Config, error) {
 	// File stat cache
 	ac.fs = datablock.NewFileStat(ac.cacheFileStat, ac.defaultStatCacheRefresh)
 
+	// No path prefixes are protected against CSRF until configured
+	ac.csrf = csrf.New(ac.currentCookieSecret, ac.parseForm)
+
 	// JSX rendering pool
 	babel.Init(8)
 
@@ -499,7 +577,7 @@ func (ac *Config) shouldCache(ext string) bool {
 		return true
 	case cachemode.Production, cachemode.Small:
 		switch ext {
-		case ".amber", ".lua", ".po2", ".tpl", ".pongo2":
+		case ".amber", ".lua", ".fnl", ".moon", ".server.js", ".po2", ".tpl", ".pongo2":
 			return false
 		default:
 			return true
@@ -517,7 +595,7 @@ func (ac *Config) shouldCache(ext string) bool {
 		fallthrough
 	default:
 		switch ext {
-		case ".amber", ".lua", ".md", ".gcss", ".jsx", ".po2", ".tpl", ".pongo2", ".happ", ".js", ".scss":
+		case ".amber", ".lua", ".fnl", ".moon", ".server.js", ".md", ".gcss", ".jsx", ".po2", ".tpl", ".pongo2", ".happ", ".js", ".scss":
 			return false
 		default:
 			return true
@@ -663,6 +741,31 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		}
 	}
 
+	// Connections for running SQL queries from Lua
+	ac.sqlConnections = sqldb.NewRegistry(ac.verboseMode)
+	if ac.perm != nil {
+		ac.addBackendSQLConnection()
+		ac.stores = datastore.NewRegistry(ac.newStore())
+		// Let the user state, OpenID Connect and the mail accounts create
+		// their data structures with the Store, so that they can be exported
+		if state, ok := ac.perm.UserState().(*auth.UserState); ok {
+			if err := state.SetCreator(ac.stores.Default()); err != nil {
+				log.Error("Could not use the data store for the user state: ", err)
+			}
+		}
+	}
+	AtShutdown(func() {
+		ac.sqlConnections.Close()
+	})
+
+	// Export or import data, then quit (--export and --import)
+	if ac.exportFilename != "" || ac.importFilename != "" {
+		if err := ac.transferData(); err != nil {
+			return err
+		}
+		return ErrDataTransfer
+	}
+
 	// Lua LState pool
 	ac.luapool = pool.New()
 	AtShutdown(func() {
@@ -670,9 +773,18 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		ac.luapool.Shutdown()
 	})
 
+	// JavaScript runtime pool, for .server.js files
+	ac.jspool = js.NewPool()
+
+	// Periodic and scheduled Lua jobs, from the server configuration
+	ac.scheduler = ac.newScheduler()
+
+	// Background tasks and queues, kept in the database if there is one
+	ac.tasks = ac.newTaskPool()
+
 	// TODO: save repl history + close luapool + close logs ++ at shutdown
 
-	if ac.singleFileMode && filepath.Ext(ac.serverDirOrFilename) == ".lua" {
+	if ac.singleFileMode && (isLuaScript(ac.serverDirOrFilename) || isServerJS(ac.serverDirOrFilename)) {
 		ac.luaServerFilename = ac.serverDirOrFilename
 		if ac.luaServerFilename == "index.lua" || ac.luaServerFilename == "data.lua" {
 			// Friendly message to new users
@@ -686,6 +798,9 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		ac.singleFileMode = false
 	}
 
+	// Fennel and MoonScript files are compiled to Lua when they are served
+	ac.compiler = ac.newCompiler()
+
 	ac.serverConfigurationFilenames = unique(ac.serverConfigurationFilenames)
 
 	// Color scheme
@@ -757,6 +872,28 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		ac.RegisterHandlers(mux, "/", ac.serverDirOrFilename, ac.serverAddDomain)
 	}
 
+	// Register the login and callback handlers for OpenID Connect, if configured
+	if ac.oidcClient != nil {
+		// The username cookie must be signed with the configured cookie secret
+		if ac.cookieSecret != "" {
+			ac.perm.UserState().SetCookieSecret(ac.cookieSecret)
+		}
+		ac.oidcClient.Register(mux)
+		if ac.verboseMode {
+			conf := ac.oidcClient.Config()
+			log.Infof("OpenID Connect login at %s, callback at %s", conf.LoginPath, conf.CallbackPath)
+		}
+	}
+
+	// Register the account confirmation and password reset handlers, if configured
+	if ac.accounts != nil {
+		ac.accounts.Register(mux)
+		if ac.verboseMode {
+			conf := ac.accounts.Config()
+			log.Infof("Account confirmation at %s, password reset at %s", conf.ConfirmPath, conf.ResetPath)
+		}
+	}
+
 	// Set the values that has not been set by flags nor scripts
 	// (and can be set by both)
 	ranServerReadyFunction := ac.finalConfiguration(ac.serverHost)
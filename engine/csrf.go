@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"html"
+	"net/http"
+
+	"github.com/flosch/pongo2"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/csrf"
+	"github.com/xyproto/algernon/themes"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/sheepcounter"
+)
+
+func init() {
+	pongo2.RegisterTag("csrf_token", tagCSRFTokenParser)
+}
+
+// currentCookieSecret returns the secret that is used for signing cookies
+func (ac *Config) currentCookieSecret() string {
+	if ac.perm != nil {
+		return ac.perm.UserState().CookieSecret()
+	}
+	return ac.cookieSecret
+}
+
+// csrfToken returns a CSRF token for the given request, or an empty string
+func (ac *Config) csrfToken(w http.ResponseWriter, req *http.Request) string {
+	token, err := ac.csrf.Token(w, req)
+	if err != nil {
+		log.Error("Could not create a CSRF token: ", err)
+		return ""
+	}
+	return token
+}
+
+// csrfRejected checks if the given request lacks a valid CSRF token while
+// being sent to a protected path from another origin. If so, a
+// "Forbidden" page is served, and true is returned.
+func (ac *Config) csrfRejected(w http.ResponseWriter, req *http.Request, theme string) bool {
+	if !ac.csrf.Rejected(req) {
+		return false
+	}
+	if ac.verboseMode {
+		log.Warnf("Rejected %s %s from %s: missing or invalid CSRF token", req.Method, req.URL.Path, req.RemoteAddr)
+	}
+	// Prepare to count bytes written
+	sc := sheepcounter.New(w)
+	sc.Header().Set("Content-Type", "text/html;charset=utf-8")
+	sc.WriteHeader(http.StatusForbidden)
+	sc.Write([]byte(themes.MessagePage("Forbidden", "<div style='color:red'>The request could not be verified. Please reload the page and try again.</div>", theme)))
+	// Log the response
+	ac.LogAccess(req, http.StatusForbidden, sc.Counter())
+	return true
+}
+
+// LoadCSRF makes the csrf_token function available to the given Lua state
+func (ac *Config) LoadCSRF(w http.ResponseWriter, req *http.Request, L *lua.LState) {
+
+	// Return a token that must be sent as the "csrf_token" form field or the
+	// "X-CSRF-Token" header, for requests to paths that are protected with
+	// AddCSRFPrefix. Must be called before any output, since a cookie may be set.
+	L.SetGlobal("csrf_token", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(ac.csrfToken(w, req)))
+		return 1 // number of results
+	}))
+}
+
+// tagCSRFTokenNode is the {% csrf_token %} tag for Pongo2 templates
+type tagCSRFTokenNode struct{}
+
+// Execute outputs a hidden form field with the CSRF token
+func (node *tagCSRFTokenNode) Execute(ctx *pongo2.ExecutionContext, writer pongo2.TemplateWriter) *pongo2.Error {
+	token, _ := ctx.Public[csrf.FieldName].(func() string)
+	if token == nil {
+		return ctx.Error("csrf_token is not available", nil)
+	}
+	writer.WriteString(`<input type="hidden" name="` + csrf.FieldName + `" value="` + html.EscapeString(token()) + `">`)
+	return nil
+}
+
+func tagCSRFTokenParser(doc *pongo2.Parser, start *pongo2.Token, arguments *pongo2.Parser) (pongo2.INodeTag, *pongo2.Error) {
+	if arguments.Remaining() > 0 {
+		return nil, arguments.Error("csrf_token takes no arguments.", nil)
+	}
+	return &tagCSRFTokenNode{}, nil
+}
@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/algernon/leveldb"
+	"github.com/xyproto/algernon/sqlite"
+	"github.com/xyproto/simplebolt"
+	"github.com/xyproto/simplehstore"
+	"github.com/xyproto/simplemaria"
+	"github.com/xyproto/simpleredis"
+)
+
+// openStore connects to a database backend that is used in addition to the
+// main database backend, for the data structures in Lua. Returns the Store
+// and a function for closing the connection.
+func openStore(backend, conf string) (*datastore.Store, func(), error) {
+	switch backend {
+	case "redis":
+		if conf == "" {
+			conf = "localhost:6379"
+		}
+		if err := simpleredis.TestConnectionHost(conf); err != nil {
+			return nil, nil, err
+		}
+		pool := simpleredis.NewConnectionPoolHost(conf)
+		return datastore.NewRedis(pool, 0), pool.Close, nil
+	case "bolt":
+		db, err := simplebolt.New(conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return datastore.New(simplebolt.NewCreator(db)), db.Close, nil
+	case "sqlite", "sqlite3":
+		db, err := sqlite.Open(conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return datastore.New(sqlite.NewCreator(db)), db.Close, nil
+	case "leveldb":
+		db, err := leveldb.Open(conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return datastore.New(leveldb.NewCreator(db)), db.Close, nil
+	case "mariadb", "mysql":
+		// NewHost exits if it can not connect, so test the connection first
+		if err := simplemaria.TestConnectionHost(conf); err != nil {
+			return nil, nil, err
+		}
+		host := simplemaria.NewHost(conf)
+		return datastore.New(simplemaria.NewCreator(host)), host.Close, nil
+	case "postgres", "postgresql":
+		// NewHost exits if it can not connect, so test the connection first
+		if err := simplehstore.TestConnectionHost(conf); err != nil {
+			return nil, nil, err
+		}
+		host := simplehstore.NewHost(conf)
+		return datastore.New(simplehstore.NewCreator(host)), host.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unknown database backend: %s", backend)
+}
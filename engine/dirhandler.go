@@ -16,7 +16,7 @@ import (
 
 var (
 	// List of filenames that should be displayed instead of a directory listing
-	indexFilenames = []string{"index.lua", "index.html", "index.md", "index.txt", "index.pongo2", "index.tmpl", "index.po2", "index.amber", "index.happ", "index.hyper", "index.hyper.js", "index.hyper.jsx"}
+	indexFilenames = []string{"index.lua", "index.fnl", "index.moon", "index.server.js", "index.html", "index.md", "index.txt", "index.pongo2", "index.tmpl", "index.po2", "index.amber", "index.happ", "index.hyper", "index.hyper.js", "index.hyper.jsx"}
 
 	doubleP  = utils.Pathsep + utils.Pathsep /* // */
 	dotSlash = "." + utils.Pathsep           /* ./ */
@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The data structures that the permission middleware keeps the users in
+var userNames = []datastore.Name{
+	{Kind: "hashmap", ID: "users"},
+	{Kind: "set", ID: "usernames"},
+	{Kind: "set", ID: "unconfirmed"},
+}
+
+// exportNames returns the names of the users and of the data structures that
+// have been created with the data store, in all database indexes. This
+// includes code libraries, sessions and the data structures that are used
+// for logging in, OpenID Connect and mail accounts. Data structures that were
+// created before the data store kept track of them can be given as extra names.
+func (ac *Config) exportNames(extra []datastore.Name) ([]datastore.Name, error) {
+	store := ac.stores.Default()
+	names, err := store.AllNames()
+	if err != nil {
+		return nil, err
+	}
+	all := make([]datastore.Name, 0, len(userNames)+len(names)+len(extra))
+	for _, name := range userNames {
+		name.Database = store.DatabaseIndex()
+		all = append(all, name)
+	}
+	all = append(all, names...)
+	for _, name := range extra {
+		// Skip the names that are already included
+		found := false
+		for _, existing := range all {
+			if existing == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			all = append(all, name)
+		}
+	}
+	return all, nil
+}
+
+// exportData writes users and data structures from the database backend
+func (ac *Config) exportData(w io.Writer, extra []datastore.Name) error {
+	if ac.stores == nil {
+		return ErrDatabase
+	}
+	names, err := ac.exportNames(extra)
+	if err != nil {
+		return err
+	}
+	return ac.stores.Default().Export(w, names)
+}
+
+// importData reads exported users and data structures into the database backend
+func (ac *Config) importData(r io.Reader) (int, error) {
+	if ac.stores == nil {
+		return 0, ErrDatabase
+	}
+	return ac.stores.Default().Import(r)
+}
+
+// transferData exports data to or imports data from the files given
+// with --export and --import, where "-" is stdout or stdin
+func (ac *Config) transferData() error {
+	if ac.exportFilename != "" && ac.importFilename != "" {
+		return errors.New("can not both export and import data")
+	}
+	if ac.exportFilename != "" {
+		w := os.Stdout
+		if ac.exportFilename != "-" {
+			f, err := os.Create(ac.exportFilename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := ac.exportData(w, nil); err != nil {
+			return err
+		}
+		log.Info("Exported data from " + ac.dbName)
+		return nil
+	}
+	r := os.Stdin
+	if ac.importFilename != "-" {
+		f, err := os.Open(ac.importFilename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	count, err := ac.importData(r)
+	if err != nil {
+		return err
+	}
+	log.Infof("Imported %d data structures into %s", count, ac.dbName)
+	return nil
+}
+
+// LoadDataFunctions makes functions for exporting and importing data
+// available to Lua. These should only be used from admin pages.
+func (ac *Config) LoadDataFunctions(L *lua.LState) {
+
+	// Export users and data structures as JSON lines. Takes an optional table
+	// with extra names on the form "kind:id", for data structures that were
+	// created before they were kept track of.
+	// Returns the exported data, or nil and an error message.
+	L.SetGlobal("ExportData", L.NewFunction(func(L *lua.LState) int {
+		var extra []datastore.Name
+		if ac.stores != nil {
+			dbindex := ac.stores.Default().DatabaseIndex()
+			if table := L.OptTable(1, nil); table != nil {
+				table.ForEach(func(_, value lua.LValue) {
+					name, err := datastore.ParseName(value.String(), dbindex)
+					if err != nil {
+						L.ArgError(1, err.Error())
+					}
+					extra = append(extra, name)
+				})
+			}
+		}
+		var buf bytes.Buffer
+		if err := ac.exportData(&buf, extra); err != nil {
+			log.Error("ExportData: ", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(buf.String()))
+		return 1 // number of results
+	}))
+
+	// Import data that has been exported, replacing the contents of the
+	// data structures. Returns the number of data structures, or nil and an error message.
+	L.SetGlobal("ImportData", L.NewFunction(func(L *lua.LState) int {
+		data := L.CheckString(1)
+		count, err := ac.importData(strings.NewReader(data))
+		if err != nil {
+			log.Error("ImportData: ", err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LNumber(count))
+		return 1 // number of results
+	}))
+}
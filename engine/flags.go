@@ -59,8 +59,15 @@ Available flags:
   -d, --debug                  Enable debug mode (show errors in the browser).
   -b, --bolt                   Use "` + ac.defaultBoltFilename + `" for the Bolt database.
   --boltdb=FILENAME            Use a specific file for the Bolt database
+  --sqlite=FILENAME            Use the given file for an SQLite database.
+  --leveldb=DIRECTORY          Use the given directory for a LevelDB database.
   --redis=[HOST][:PORT]        Use "` + ac.defaultRedisColonPort + `" for the Redis database.
   --dbindex=INDEX              Redis database index (0 is default).
+  --export=FILENAME            Export users and data structures from the
+                               database backend as JSON lines ("-" is stdout),
+                               then quit.
+  --import=FILENAME            Import data that has been exported into the
+                               database backend ("-" is stdin), then quit.
   --conf=FILENAME              Lua script with additional configuration.
   --log=FILENAME               Log to a file instead of to the console.
   --internal=FILENAME          Internal log file (can be a bit verbose).
@@ -100,11 +107,20 @@ Available flags:
                                Only use if served files will not be removed.
   --accesslog=FILENAME         Access log filename. Logged in Combined Log Format (CLF).
   --ncsa=FILENAME              Alternative access log filename. Logged in Common Log Format (NCSA).
-  --cookiesecret=STRING        Secret that will be used for login cookies.
+  --cookiesecret=STRING        Secret that will be used for login cookies, and
+                               for signed and encrypted cookies.
   -x, --simple                 Serve as regular HTTP, enable server mode and
                                disable all features that requires a database.
   --domain                     Serve files from the subdirectory with the same
                                name as the requested domain.
+  --sandbox                    Run Lua scripts with a time and instruction limit,
+                               only some of the standard libraries and no access
+                               to files outside of the server directory (or the
+                               directory for the domain).
+  --ssr                        Render HyperApp pages on the server, with the
+                               variables from data.lua, before they are
+                               started in the browser. React .jsx files are
+                               not rendered on the server.
   -u                           Serve over QUIC.
 
 
@@ -184,6 +200,10 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.postgresDatabase, "postgresdb", "", "PostgreSQL database name")
 	flag.BoolVar(&ac.useBolt, "bolt", false, "Use the default Bolt filename")
 	flag.StringVar(&ac.boltFilename, "boltdb", "", "Bolt database filename")
+	flag.StringVar(&ac.sqliteFilename, "sqlite", "", "SQLite database filename")
+	flag.StringVar(&ac.leveldbDir, "leveldb", "", "LevelDB database directory")
+	flag.StringVar(&ac.exportFilename, "export", "", "Export data to a file")
+	flag.StringVar(&ac.importFilename, "import", "", "Import data from a file")
 	flag.Int64Var(&ac.limitRequests, "limit", ac.defaultLimit, "Limit clients to a number of requests per second")
 	flag.BoolVar(&ac.disableRateLimiting, "nolimit", false, "Disable rate limiting")
 	flag.BoolVar(&ac.devMode, "dev", false, "Development mode")
@@ -200,6 +220,8 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.traceFilename, "tracefile", "", "Write the trace to file")
 	flag.BoolVar(&ac.cacheFileStat, "statcache", false, "Cache os.Stat")
 	flag.BoolVar(&ac.serverAddDomain, "domain", false, "Look for files in the directory named the same as the hostname")
+	flag.BoolVar(&ac.sandboxMode, "sandbox", false, "Run Lua scripts with limits")
+	flag.BoolVar(&ac.serverSideRendering, "ssr", false, "Render HyperApp pages on the server")
 	flag.BoolVar(&ac.simpleMode, "simple", false, "Serve a directory of files over HTTP")
 	flag.StringVar(&ac.openExecutable, "open", "", "Open URL after serving, with an application")
 	flag.BoolVar(&ac.quitAfterFirstRequest, "quit", false, "Quit after the first request")
@@ -14,6 +14,8 @@ import (
 	"github.com/didip/tollbooth"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xyproto/algernon/lua/sandbox"
+	"github.com/xyproto/algernon/lua/transpile"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/datablock"
@@ -130,11 +132,13 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 	lowercaseFilename := strings.ToLower(filename)
 	ext := filepath.Ext(lowercaseFilename)
 
-	// Filenames ending with .hyper.js or .hyper.jsx are special cases
+	// Filenames ending with .hyper.js, .hyper.jsx or .server.js are special cases
 	if strings.HasSuffix(lowercaseFilename, ".hyper.js") {
 		ext = ".hyper.js"
 	} else if strings.HasSuffix(lowercaseFilename, ".hyper.jsx") {
 		ext = ".hyper.jsx"
+	} else if isServerJS(lowercaseFilename) {
+		ext = ".server.js"
 	}
 
 	// Serve the file in different ways based on the filename extension
@@ -242,9 +246,15 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 		}
 		return
 
-	case ".lua":
+	case ".lua", ".fnl", ".moon", ".server.js":
 		// If in debug mode, let the Lua script print to a buffer first, in
 		// case there are errors that should be displayed instead.
+		// Fennel and MoonScript files are compiled to Lua before they are run,
+		// and server-side JavaScript files are run with the same functions.
+		lang := "lua"
+		if ext == ".server.js" {
+			lang = "javascript"
+		}
 
 		// If debug mode is enabled
 		if ac.debugMode {
@@ -260,6 +270,8 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 			// Run the lua script, without the possibility to flush
 			if err := ac.RunLua(recorder, req, filename, flushFunc, httpStatus); err != nil {
 				errortext := err.Error()
+				limitErr, exceeded := err.(*sandbox.LimitError)
+				_, compileErr := err.(*transpile.Error)
 				fileblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
 				if err != nil {
 					// If the file could not be read, use the error message as the data
@@ -267,8 +279,23 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 					// if reading the file failed.
 					fileblock = datablock.NewDataBlock([]byte(err.Error()), true)
 				}
+				// The line numbers in runtime errors from MoonScript files refer to the
+				// compiled Lua code. Use the lines of the MoonScript file, if moonc gave
+				// them, or else show the compiled Lua code.
+				if ext == ".moon" && !compileErr {
+					if mapped, ok := ac.compiler.MapLines(filename, errortext); ok {
+						errortext = mapped
+					} else if code, err := ac.compiler.Compile(filename); err == nil {
+						fileblock = datablock.NewDataBlock(code, true)
+					}
+				}
+				// If a sandbox limit was exceeded, log it and use the right status code
+				if exceeded {
+					log.Error("Error in " + filename + ": " + errortext)
+					w.WriteHeader(limitErr.StatusCode())
+				}
 				// If there were errors, display an error page
-				ac.PrettyError(w, req, filename, fileblock.MustData(), errortext, "lua")
+				ac.PrettyError(w, req, filename, fileblock.MustData(), errortext, lang)
 			} else {
 				// If things went well, check if there is a status code we should write first
 				// (especially for the case of a redirect)
@@ -291,6 +318,10 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 				} else {
 					log.Error("Error in " + filename + ": " + err.Error())
 				}
+				// If a sandbox limit was exceeded, respond with 500 or 503
+				if limitErr, ok := err.(*sandbox.LimitError); ok {
+					http.Error(w, http.StatusText(limitErr.StatusCode()), limitErr.StatusCode())
+				}
 			}
 		}
 		return
@@ -452,6 +483,11 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 			}
 		}
 
+		// Requests that change data on protected paths must have a CSRF token
+		if ac.csrfRejected(w, req, theme) {
+			return
+		}
+
 		// Local to this function
 		servedir := servedir
 
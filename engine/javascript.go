@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/dop251/goja"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/js"
+	"github.com/xyproto/algernon/lua/sandbox"
+	"github.com/xyproto/gopher-lua"
+)
+
+// isServerJS checks if the given file is a JavaScript file that should be
+// run on the server, like index.server.js
+func isServerJS(filename string) bool {
+	return strings.HasSuffix(strings.ToLower(filename), ".server.js")
+}
+
+// runJS runs a server-side JavaScript file, where the global functions of the
+// given Lua state are available. If the Lua state has a context, the script
+// is interrupted when the context is done.
+func (ac *Config) runJS(L *lua.LState, filename string) error {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var r *js.Runtime
+	if ctx := L.Context(); ctx != nil && sandbox.Active(ctx) {
+		// Sandboxed scripts do not share global variables with other scripts
+		r = js.New()
+	} else {
+		r = ac.jspool.Get()
+		defer ac.jspool.Put(r)
+	}
+	r.Load(L)
+	return r.Run(L.Context(), filename, source)
+}
+
+// runJSConfiguration runs a server-side JavaScript file as a server
+// configuration script, where the global functions of the given Lua state are
+// available. If withHandlerFunctions is true, handle(path, function) can be
+// used for handling requests with JavaScript functions.
+func (ac *Config) runJSConfiguration(L *lua.LState, filename string, mux *http.ServeMux, withHandlerFunctions bool) error {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// This runtime is kept for as long as the handlers are in use
+	r := js.New()
+	r.Load(L)
+
+	if withHandlerFunctions {
+		// The JavaScript runtime can only run one function at the time
+		var mut sync.Mutex
+
+		r.Set("handle", func(call goja.FunctionCall) goja.Value {
+			handlePath := call.Argument(0).String()
+			handleFunc, ok := goja.AssertFunction(call.Argument(1))
+			if !ok {
+				panic(r.VM.NewTypeError("handle: the second argument must be a function"))
+			}
+
+			wrappedHandleFunc := func(w http.ResponseWriter, req *http.Request) {
+				// Set up a Lua state with the current http.ResponseWriter and *http.Request
+				L := ac.luapool.Get()
+				defer ac.putLuaState(L)
+				ac.LoadCommonFunctions(w, req, filename, L, nil, nil)
+
+				// Then run the given JavaScript function
+				mut.Lock()
+				r.Load(L)
+				_, err := handleFunc(goja.Undefined())
+				mut.Unlock()
+				if err != nil {
+					// Non-fatal error
+					log.Error("Handler for "+handlePath+" failed:", err)
+				}
+
+				// Then exit after the first request, if specified
+				if ac.quitAfterFirstRequest {
+					go ac.quitSoon("Quit after first request", defaultSoonDuration)
+				}
+			}
+
+			ac.registerHandleFunc(mux, handlePath, wrappedHandleFunc, ac.defaultTheme)
+			return goja.Undefined()
+		})
+	}
+
+	return r.Run(nil, filename, source)
+}
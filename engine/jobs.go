@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/algernon/lua/codelib"
+	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/algernon/lua/httpclient"
+	"github.com/xyproto/algernon/lua/jnode"
+	"github.com/xyproto/algernon/lua/jobs"
+	"github.com/xyproto/algernon/lua/modules"
+	"github.com/xyproto/algernon/lua/pure"
+	"github.com/xyproto/algernon/lua/sqldb"
+	"github.com/xyproto/algernon/lua/tasks"
+	"github.com/xyproto/gopher-lua"
+)
+
+// backgroundState borrows a Lua state from the pool, with the functions that
+// jobs and background tasks can use. JSON files are relative to the server directory.
+func (ac *Config) backgroundState() *lua.LState {
+	L := ac.luapool.Get()
+
+	// Basic system functions, like log()
+	ac.LoadBasicSystemFunctions(L)
+
+	// If there is a database backend
+	if ac.perm != nil {
+		// Simpleredis data structures
+		datastruct.LoadList(L, ac.stores)
+		datastruct.LoadSet(L, ac.stores)
+		datastruct.LoadHash(L, ac.stores)
+		datastruct.LoadKeyValue(L, ac.stores)
+		datastruct.LoadSortedSet(L, ac.stores)
+		datastruct.LoadTransaction(L)
+		datastruct.LoadChannel(L, ac.stores, nil)
+
+		// Raw SQL queries, if the database backend is an SQL database
+		sqldb.Load(L, ac.sqlConnections)
+
+		// For saving and loading Lua functions
+		codelib.Load(L, ac.stores.Default())
+
+		// For exporting and importing users and data structures
+		ac.LoadDataFunctions(L)
+	}
+
+	// For handling JSON data
+	scriptdir := ac.serverDirOrFilename
+	if ac.singleFileMode {
+		scriptdir = filepath.Dir(scriptdir)
+	}
+	jnode.LoadJSONFunctions(L)
+	ac.LoadJFile(L, scriptdir)
+	jnode.Load(L)
+
+	// For sending HTTP requests
+	httpclient.Load(L)
+
+	// For running functions in the background
+	if ac.tasks != nil {
+		tasks.Load(L, ac.tasks)
+	}
+
+	// Extras
+	pure.Load(L)
+
+	// Cache
+	ac.LoadCacheFunctions(L)
+
+	// For importing Lua modules from the server directory and the lib directory
+	modules.Load(L, scriptdir, filepath.Join(ac.serverDirOrFilename, "lib"))
+
+	return L
+}
+
+// newScheduler returns a scheduler for periodic and scheduled jobs, that is stopped at shutdown
+func (ac *Config) newScheduler() *jobs.Scheduler {
+	scheduler := jobs.New(ac.backgroundState, ac.putLuaState)
+	AtShutdown(scheduler.Stop)
+	return scheduler
+}
+
+// newTaskPool returns a worker pool for background tasks, that is stopped at
+// shutdown. The queues are kept in the database, if there is one.
+func (ac *Config) newTaskPool() *tasks.Pool {
+	var store *datastore.Store
+	if ac.perm != nil {
+		store = ac.stores.Default()
+	}
+	pool := tasks.New(runtime.NumCPU(), store, ac.backgroundState, ac.putLuaState)
+	AtShutdown(pool.Stop)
+	return pool
+}
+
+// jobsInfo returns a description of the periodic and scheduled jobs, one per line
+func (ac *Config) jobsInfo() string {
+	if ac.scheduler == nil {
+		return "No jobs"
+	}
+	statuses := ac.scheduler.Status()
+	if len(statuses) == 0 {
+		return "No jobs"
+	}
+	var sb strings.Builder
+	for _, status := range statuses {
+		fmt.Fprintf(&sb, "%d: %s, ran %d times", status.ID, status.Spec, status.Runs)
+		if status.Skipped > 0 {
+			fmt.Fprintf(&sb, ", skipped %d times", status.Skipped)
+		}
+		if status.Running {
+			sb.WriteString(", running")
+		}
+		if !status.LastRun.IsZero() {
+			outcome := "ok"
+			if status.Failed {
+				outcome = "failed"
+			}
+			fmt.Fprintf(&sb, ", last run at %s (%s", status.LastRun.Format(time.RFC3339), outcome)
+			if status.Result != "" {
+				sb.WriteString(": " + status.Result)
+			}
+			sb.WriteString(")")
+		}
+		if !status.NextRun.IsZero() {
+			fmt.Fprintf(&sb, ", next run at %s", status.NextRun.Format(time.RFC3339))
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
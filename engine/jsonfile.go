@@ -1,14 +1,13 @@
 package engine
 
 import (
-	"io/ioutil"
-	"os"
+	"errors"
 	"path/filepath"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/jsonfile"
 	"github.com/xyproto/algernon/lua/jnode"
-	"github.com/xyproto/datablock"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/jpath"
 )
@@ -18,20 +17,35 @@ import (
 const (
 	// Identifier for the JFile class in Lua
 	lJFileClass = "JFile"
+
+	// Prefix for the channels where changes to JSON files are published
+	jfileChannelPrefix = "jfile:"
 )
 
-// Get the first argument, "self", and cast it from userdata to a library (which is really a hash map).
-func checkJFile(L *lua.LState) *jpath.JFile {
+// Get the first argument, "self", and cast it from userdata to a JSON file.
+func checkJFile(L *lua.LState) *jsonfile.File {
 	ud := L.CheckUserData(1)
-	if jfile, ok := ud.Value.(*jpath.JFile); ok {
+	if jfile, ok := ud.Value.(*jsonfile.File); ok {
 		return jfile
 	}
 	L.ArgError(1, "JSON file expected")
 	return nil
 }
 
+// Push true, or false and an error message if the change could not be made.
+func pushChanged(L *lua.LState, err error) int {
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LTrue)
+	return 1 // number of results
+}
+
 // Takes a JFile, a JSON path (optional) and JSON data.
-// Stores the JSON data. Returns true if successful.
+// Stores the JSON data. Returns true if successful,
+// or false and an error message.
 func jfileAdd(L *lua.LState) int {
 	jfile := checkJFile(L) // arg 1
 	top := L.GetTop()
@@ -61,8 +75,7 @@ func jfileAdd(L *lua.LState) int {
 			log.Error(err)
 		}
 	}
-	L.Push(lua.LBool(err == nil))
-	return 1 // number of results
+	return pushChanged(L, err)
 }
 
 // Takes a JFile and a JSON path.
@@ -73,10 +86,12 @@ func jfileGetString(L *lua.LState) int {
 	if jsonpath == "" {
 		L.ArgError(2, "JSON path expected")
 	}
-	val, err := jfile.GetString(jsonpath)
+	val := ""
+	node, err := jsonNode(jfile, jsonpath)
 	if err != nil {
 		log.Error(err)
-		val = ""
+	} else {
+		val = node.String()
 	}
 	L.Push(lua.LString(val))
 	return 1 // number of results
@@ -90,7 +105,7 @@ func jfileGetNode(L *lua.LState) int {
 	if jsonpath == "" {
 		L.ArgError(2, "JSON path expected")
 	}
-	node, err := jfile.GetNode(jsonpath)
+	node, err := jsonNode(jfile, jsonpath)
 	if err != nil {
 		L.Push(lua.LNil)
 		return 1 // number of results
@@ -114,7 +129,7 @@ func jfileGet(L *lua.LState) int {
 	}
 
 	// Will handle nil nodes below, so the error value can be ignored
-	node, _ := jfile.GetNode(jsonpath)
+	node, _ := jsonNode(jfile, jsonpath)
 
 	// Convert the JSON node to a Lua value, if possible
 	var retval lua.LValue
@@ -158,7 +173,7 @@ func jfileGet(L *lua.LState) int {
 }
 
 // Take a JFile, a JSON path and a string.
-// Returns a value or an empty string.
+// Returns true if successful, or false and an error message.
 func jfileSet(L *lua.LState) int {
 	jfile := checkJFile(L) // arg 1
 	jsonpath := L.ToString(2)
@@ -173,12 +188,11 @@ func jfileSet(L *lua.LState) int {
 	if err != nil {
 		log.Error(err)
 	}
-	L.Push(lua.LBool(err == nil))
-	return 1 // number of results
+	return pushChanged(L, err)
 }
 
 // Take a JFile and a JSON path.
-// Remove a key from a map. Return true if successful.
+// Remove a key from a map. Return true if successful, or false and an error message.
 func jfileDelKey(L *lua.LState) int {
 	jfile := checkJFile(L) // arg 1
 	jsonpath := L.ToString(2)
@@ -189,7 +203,32 @@ func jfileDelKey(L *lua.LState) int {
 	if err != nil {
 		log.Error(err)
 	}
-	L.Push(lua.LBool(nil == err))
+	return pushChanged(L, err)
+}
+
+// Return the name of the channel where changes to the given JSON file are
+// published. The path is relative to the server directory, so that the
+// absolute path on the server is not revealed.
+func (ac *Config) jfileChannelName(filename string) string {
+	root := ac.serverDirOrFilename
+	if !ac.fs.IsDir(root) {
+		root = filepath.Dir(root)
+	}
+	if absRoot, err := filepath.Abs(root); err == nil {
+		rel, err := filepath.Rel(absRoot, filename)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return jfileChannelPrefix + filepath.ToSlash(rel)
+		}
+	}
+	// The file is outside of the server directory
+	return jfileChannelPrefix + filepath.Base(filename)
+}
+
+// Given a JFile, return the name of the channel where the JSON document
+// is published every time it is changed.
+func (ac *Config) jfileChannel(L *lua.LState) int {
+	jfile := checkJFile(L) // arg 1
+	L.Push(lua.LString(ac.jfileChannelName(jfile.Filename())))
 	return 1 // number of results
 }
 
@@ -207,22 +246,45 @@ func jfileJSON(L *lua.LState) int {
 	return 1 // number of results
 }
 
-// Create a new JSON file
-func constructJFile(L *lua.LState, filename string, fperm os.FileMode, fs *datablock.FileStat) (*lua.LUserData, error) {
-	fullFilename := filename
-	// Check if the file exists
-	if !fs.Exists(fullFilename) {
-		// Create an empty JSON document/file
-		if err := ioutil.WriteFile(fullFilename, []byte("[]\n"), fperm); err != nil {
+// Find the JSON node that the JSON path points to, in the current JSON document
+func jsonNode(jfile *jsonfile.File, jsonpath string) (*jpath.Node, error) {
+	root, err := jfile.Node()
+	if err != nil {
+		return jpath.NilNode, err
+	}
+	node, _, err := root.GetNodes(jsonpath)
+	if node == jpath.NilNode {
+		return jpath.NilNode, errors.New("nil node")
+	}
+	return node, err
+}
+
+// Create a new JSON file. The schema filename may be empty.
+// Changes are published to the default database.
+func (ac *Config) constructJFile(L *lua.LState, filename, schemaFilename string) (*lua.LUserData, error) {
+	var schema *jsonfile.Schema
+	if schemaFilename != "" {
+		var err error
+		if schema, err = jsonfile.ReadSchema(schemaFilename); err != nil {
 			return nil, err
 		}
 	}
-	// Create a new JFile
-	jfile, err := jpath.NewFile(fullFilename)
+	// Create a new JFile, and the file if it does not exist
+	jfile, err := jsonfile.New(filename, ac.defaultPermissions, schema)
 	if err != nil {
-		log.Error(err)
 		return nil, err
 	}
+	if err := jfile.Validate(); err != nil {
+		log.Warn(filename + " does not match the JSON Schema: " + err.Error())
+	}
+	channel := ac.jfileChannelName(jfile.Filename())
+	jfile.OnChange(func(data []byte) {
+		if store := ac.stores.Default(); store != nil {
+			if _, err := store.Publish(channel, string(data)); err != nil {
+				log.Error(err)
+			}
+		}
+	})
 	// Create a new userdata struct
 	ud := L.NewUserData()
 	ud.Value = jfile
@@ -249,14 +311,19 @@ func (ac *Config) LoadJFile(L *lua.LState, scriptdir string) {
 	mt := L.NewTypeMetatable(lJFileClass)
 	mt.RawSetH(lua.LString("__index"), mt)
 	L.SetFuncs(mt, jfileMethods)
+	mt.RawSetString("channel", L.NewFunction(ac.jfileChannel))
 
-	// The constructor for new Libraries takes only an optional id
+	// The constructor for JSON files takes a filename and an optional JSON Schema filename
 	L.SetGlobal("JFile", L.NewFunction(func(L *lua.LState) int {
 		// Get the filename and schema
 		filename := L.ToString(1)
+		schemaFilename := L.OptString(2, "")
+		if schemaFilename != "" {
+			schemaFilename = filepath.Join(scriptdir, schemaFilename)
+		}
 
 		// Construct a new JFile
-		userdata, err := constructJFile(L, filepath.Join(scriptdir, filename), ac.defaultPermissions, ac.fs)
+		userdata, err := ac.constructJFile(L, filepath.Join(scriptdir, filename), schemaFilename)
 		if err != nil {
 			log.Error(err)
 			L.Push(lua.LString(err.Error()))
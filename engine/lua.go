@@ -9,10 +9,16 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/lua/codelib"
 	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/cookies"
 	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/algernon/lua/httpclient"
 	"github.com/xyproto/algernon/lua/jnode"
+	"github.com/xyproto/algernon/lua/modules"
 	"github.com/xyproto/algernon/lua/onthefly"
 	"github.com/xyproto/algernon/lua/pure"
+	"github.com/xyproto/algernon/lua/session"
+	"github.com/xyproto/algernon/lua/sqldb"
+	"github.com/xyproto/algernon/lua/tasks"
 	"github.com/xyproto/algernon/lua/upload"
 	"github.com/xyproto/algernon/lua/users"
 	"github.com/xyproto/algernon/utils"
@@ -22,6 +28,14 @@ import (
 // LoadCommonFunctions adds most of the available Lua functions in algernon to
 // the given Lua state struct
 func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request, filename string, L *lua.LState, flushFunc func(), httpStatus *FutureStatus) {
+	ac.loadCommonFunctions(w, req, filename, L, flushFunc, httpStatus, false)
+}
+
+// loadCommonFunctions adds most of the available Lua functions in algernon to
+// the given Lua state struct. If sandboxed is true, the functions for
+// configuring the server, for managing users, for exporting and importing
+// data and for running background tasks are left out.
+func (ac *Config) loadCommonFunctions(w http.ResponseWriter, req *http.Request, filename string, L *lua.LState, flushFunc func(), httpStatus *FutureStatus, sandboxed bool) {
 
 	// Make basic functions, like print, available to the Lua script.
 	// Only exports functions that can relate to HTTP responses or requests.
@@ -33,6 +47,9 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 	// Functions for rendering markdown or amber
 	ac.LoadRenderFunctions(w, req, L)
 
+	// Functions for sending e-mail
+	ac.LoadMailFunctions(req, L, filename)
+
 	// If there is a database backend
 	if ac.perm != nil {
 
@@ -48,28 +65,68 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 		ac.LoadServeFile(w, req, L, filename)
 
 		// Functions mainly for adding admin prefixes and configuring permissions
-		ac.LoadServerConfigFunctions(L, filename)
-
-		// Make the functions related to userstate available to the Lua script
-		users.Load(w, req, L, userstate)
+		if !sandboxed {
+			ac.LoadServerConfigFunctions(L, filename)
+		}
 
-		creator := userstate.Creator()
+		// Make the functions related to userstate available to the Lua script.
+		// Sandboxed sites can only check the current user.
+		if sandboxed {
+			users.LoadSandboxed(w, req, L, userstate)
+		} else {
+			users.Load(w, req, L, userstate)
+		}
 
 		// Simpleredis data structures
-		datastruct.LoadList(L, creator)
-		datastruct.LoadSet(L, creator)
-		datastruct.LoadHash(L, creator)
-		datastruct.LoadKeyValue(L, creator)
+		datastruct.LoadList(L, ac.stores)
+		datastruct.LoadSet(L, ac.stores)
+		datastruct.LoadHash(L, ac.stores)
+		datastruct.LoadKeyValue(L, ac.stores)
+		datastruct.LoadSortedSet(L, ac.stores)
+		datastruct.LoadTransaction(L)
+
+		// Publish/subscribe channels, also as server-sent events
+		datastruct.LoadChannel(L, ac.stores, req.Context().Done())
+		ac.LoadEventStream(w, req, L, flushFunc)
+
+		// Raw SQL queries, if the database backend is an SQL database
+		sqldb.Load(L, ac.sqlConnections)
 
 		// For saving and loading Lua functions
-		codelib.Load(L, creator)
+		codelib.Load(L, ac.stores.Default())
+
+		// For data that is kept per visitor, with session and endsession
+		session.Load(w, req, L, ac.stores.Default(), userstate.CookieSecret(), ac.sessionTimeout)
+
+		// For exporting and importing users and data structures, only for
+		// admins. The Lua states are reused, so the functions are removed otherwise.
+		if !sandboxed && userstate.AdminRights(req) {
+			ac.LoadDataFunctions(L)
+		} else {
+			L.SetGlobal("ExportData", lua.LNil)
+			L.SetGlobal("ImportData", lua.LNil)
+		}
 	}
 
+	// For getting and setting cookies, that can be signed or encrypted
+	cookies.Load(w, req, L, ac.currentCookieSecret())
+
+	// For protecting forms against cross-site request forgery
+	ac.LoadCSRF(w, req, L)
+
 	// For handling JSON data
 	jnode.LoadJSONFunctions(L)
 	ac.LoadJFile(L, filepath.Dir(filename))
 	jnode.Load(L)
 
+	// For sending HTTP requests
+	httpclient.Load(L)
+
+	// For running functions in the background
+	if ac.tasks != nil && !sandboxed {
+		tasks.Load(L, ac.tasks)
+	}
+
 	// Extras
 	pure.Load(L)
 
@@ -87,6 +144,9 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 
 	// File uploads
 	upload.Load(L, w, req, filepath.Dir(filename))
+
+	// For importing Lua modules from the script directory and the lib directory
+	modules.Load(L, filepath.Dir(filename), filepath.Join(ac.siteDir(req), "lib"))
 }
 
 // RunLua uses a Lua file as the HTTP handler. Also has access to the userstate
@@ -94,9 +154,18 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 // script, otherwise nil.
 func (ac *Config) RunLua(w http.ResponseWriter, req *http.Request, filename string, flushFunc func(), fust *FutureStatus) error {
 
+	// Sandboxed scripts get a new Lua state, since the standard libraries are changed
+	sandboxOptions := ac.sandboxOptions(req)
+
 	// Retrieve a Lua state
-	L := ac.luapool.Get()
-	defer ac.luapool.Put(L)
+	var L *lua.LState
+	if sandboxOptions != nil {
+		L = lua.NewState()
+		defer closeLuaState(L)
+	} else {
+		L = ac.luapool.Get()
+		defer ac.putLuaState(L)
+	}
 
 	// Warn if the connection is closed before the script has finished.
 	// Requires that the requestWriter has CloseNotify.
@@ -137,11 +206,14 @@ func (ac *Config) RunLua(w http.ResponseWriter, req *http.Request, filename stri
 
 	// Export functions to the Lua state
 	// Flush can be an uninitialized channel, it is handled in the function.
-	ac.LoadCommonFunctions(w, req, filename, L, flushFunc, fust)
+	ac.loadCommonFunctions(w, req, filename, L, flushFunc, fust, sandboxOptions != nil)
 
 	// Run the script and return the error value.
 	// Logging and/or HTTP response is handled elsewhere.
-	return L.DoFile(filename)
+	if sandboxOptions != nil {
+		return ac.runSandboxed(L, req, filename, sandboxOptions)
+	}
+	return ac.doFile(L, filename)
 }
 
 // RunConfiguration runs a Lua file as a configuration script. Also has access
@@ -164,22 +236,26 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 	// If there is a database backend
 	if ac.perm != nil {
 
-		// Retrieve the userstate
-		userstate := ac.perm.UserState()
-
 		// Server configuration functions
 		ac.LoadServerConfigFunctions(L, filename)
 
-		creator := userstate.Creator()
-
 		// Simpleredis data structures (could be used for storing server stats)
-		datastruct.LoadList(L, creator)
-		datastruct.LoadSet(L, creator)
-		datastruct.LoadHash(L, creator)
-		datastruct.LoadKeyValue(L, creator)
+		datastruct.LoadList(L, ac.stores)
+		datastruct.LoadSet(L, ac.stores)
+		datastruct.LoadHash(L, ac.stores)
+		datastruct.LoadKeyValue(L, ac.stores)
+		datastruct.LoadSortedSet(L, ac.stores)
+		datastruct.LoadTransaction(L)
+		datastruct.LoadChannel(L, ac.stores, nil)
+
+		// Raw SQL queries, if the database backend is an SQL database
+		sqldb.Load(L, ac.sqlConnections)
 
 		// For saving and loading Lua functions
-		codelib.Load(L, creator)
+		codelib.Load(L, ac.stores.Default())
+
+		// For exporting and importing users and data structures
+		ac.LoadDataFunctions(L)
 	}
 
 	// For handling JSON data
@@ -187,6 +263,14 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 	ac.LoadJFile(L, filepath.Dir(filename))
 	jnode.Load(L)
 
+	// For sending HTTP requests
+	httpclient.Load(L)
+
+	// For running functions in the background
+	if ac.tasks != nil {
+		tasks.Load(L, ac.tasks)
+	}
+
 	// Extras
 	pure.Load(L)
 
@@ -199,13 +283,22 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 	// Pages and Tags
 	onthefly.Load(L)
 
+	// For importing Lua modules from the configuration directory and the lib directory
+	modules.Load(L, filepath.Dir(filename), filepath.Join(ac.serverDirOrFilename, "lib"))
+
 	if withHandlerFunctions {
 		// Lua HTTP handlers
 		ac.LoadLuaHandlerFunctions(L, filename, mux, false, nil, ac.defaultTheme)
 	}
 
-	// Run the script
-	if err := L.DoFile(filename); err != nil {
+	// Run the script, which may also be a server-side JavaScript file
+	var err error
+	if isServerJS(filename) {
+		err = ac.runJSConfiguration(L, filename, mux, withHandlerFunctions)
+	} else {
+		err = ac.doFile(L, filename)
+	}
+	if err != nil {
 		// Close the Lua state
 		L.Close()
 
@@ -230,21 +323,20 @@ func (ac *Config) LuaFunctionMap(w http.ResponseWriter, req *http.Request, luada
 	ac.pongomutex.Lock()
 	defer ac.pongomutex.Unlock()
 
-	// Retrieve a Lua state
-	L := ac.luapool.Get()
-	defer ac.luapool.Put(L)
+	// The sandbox limits for the site, if any
+	sandboxOptions := ac.sandboxOptions(req)
+
+	// Retrieve a Lua state, with the functions that are available to the site
+	L, done := ac.luaState(w, req, filename, sandboxOptions)
+	defer done()
 
 	// Prepare an empty map of functions (and variables)
 	funcs := make(template.FuncMap)
 
-	// Give no filename (an empty string will be handled correctly by the function).
-	ac.LoadCommonFunctions(w, req, filename, L, nil, nil)
-
 	// Run the script
-	if err := L.DoString(string(luadata)); err != nil {
-		// Close the Lua state
-		L.Close()
-
+	if err := ac.runLuaFunc(L, req, filename, sandboxOptions, func() error {
+		return L.DoString(string(luadata))
+	}); err != nil {
 		// Logging and/or HTTP response is handled elsewhere
 		return funcs, err
 	}
@@ -294,7 +386,7 @@ func (ac *Config) LuaFunctionMap(w http.ResponseWriter, req *http.Request, luada
 					defer L2.Close()
 
 					// Set up a new Lua state with the current http.ResponseWriter and *http.Request
-					ac.LoadCommonFunctions(w, req, filename, L2, nil, nil)
+					ac.loadCommonFunctions(w, req, filename, L2, nil, nil, sandboxOptions != nil)
 
 					// Push the Lua function to run
 					L2.Push(luaFunc)
@@ -304,8 +396,10 @@ func (ac *Config) LuaFunctionMap(w http.ResponseWriter, req *http.Request, luada
 						L2.Push(lua.LString(arg))
 					}
 
-					// Run the Lua function
-					err := L2.PCall(len(args), lua.MultRet, nil)
+					// Run the Lua function, with the same limits as the script
+					err := ac.runLuaFunc(L2, req, filename, sandboxOptions, func() error {
+						return L2.PCall(len(args), lua.MultRet, nil)
+					})
 					if err != nil {
 						// If calling the function did not work out, return the infostring and error
 						return utils.Infostring(functionName, args), err
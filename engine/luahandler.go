@@ -7,6 +7,7 @@ import (
 
 	"github.com/didip/tollbooth"
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/sqldb"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/gopher-lua"
 )
@@ -38,6 +39,7 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 				// Non-fatal error
 				log.Error("Handler for "+handlePath+" failed:", err)
 			}
+			sqldb.Release(L)
 
 			// Then exit after the first request, if specified
 			if ac.quitAfterFirstRequest {
@@ -45,15 +47,7 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 			}
 		}
 
-		// Handle requests differently depending on if rate limiting is enabled or not
-		if ac.disableRateLimiting {
-			mux.HandleFunc(handlePath, wrappedHandleFunc)
-		} else {
-			limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
-			limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
-			limiter.SetMessageContentType("text/html;charset=utf-8")
-			mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, wrappedHandleFunc))
-		}
+		ac.registerHandleFunc(mux, handlePath, wrappedHandleFunc, theme)
 
 		return 0 // number of results
 	}))
@@ -69,3 +63,23 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 	}))
 
 }
+
+// registerHandleFunc adds a handler function for the given path to the mux,
+// with CSRF protection, and rate limiting if it is enabled
+func (ac *Config) registerHandleFunc(mux *http.ServeMux, handlePath string, handleFunc http.HandlerFunc, theme string) {
+	handler := handleFunc
+	handleFunc = func(w http.ResponseWriter, req *http.Request) {
+		if !ac.csrfRejected(w, req, theme) {
+			handler(w, req)
+		}
+	}
+	// Handle requests differently depending on if rate limiting is enabled or not
+	if ac.disableRateLimiting {
+		mux.HandleFunc(handlePath, handleFunc)
+	} else {
+		limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
+		limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
+		limiter.SetMessageContentType("text/html;charset=utf-8")
+		mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, handleFunc))
+	}
+}
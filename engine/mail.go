@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/mail"
+	"github.com/xyproto/gopher-lua"
+)
+
+// LoadMailFunctions makes functions for sending e-mail available to the given Lua state
+func (ac *Config) LoadMailFunctions(req *http.Request, L *lua.LState, filename string) {
+
+	// Send an e-mail. Takes a recipient, a subject, a body and an optional
+	// table. If a table is given, the body is used as a Pongo2 template and the
+	// table as the template data. If the body is the name of a .po2 file in
+	// the script directory, the contents of the file are used as the template.
+	// Returns true if the e-mail could be sent.
+	L.SetGlobal("sendmail", L.NewFunction(func(L *lua.LState) int {
+		to := L.CheckString(1)
+		subject := L.CheckString(2)
+		body := L.CheckString(3)
+		if ac.mailer == nil {
+			log.Error("sendmail: no mailer has been configured, see the Mailer function")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		isTemplate := L.GetTop() >= 4
+		if strings.HasSuffix(body, ".po2") {
+			templateFilename := filepath.Join(filepath.Dir(filename), body)
+			if ac.fs.Exists(templateFilename) {
+				templateData, err := ac.cache.Read(templateFilename, ac.shouldCache(".po2"))
+				if err != nil {
+					log.Errorf("sendmail: unable to read %s: %s", templateFilename, err)
+					L.Push(lua.LBool(false))
+					return 1 // number of results
+				}
+				body = templateData.String()
+				isTemplate = true
+			}
+		}
+		if isTemplate {
+			data := make(map[string]interface{})
+			if L.GetTop() >= 4 {
+				data = convert.Table2interfaceMap(L.CheckTable(4))
+			}
+			rendered, err := mail.Render(body, data)
+			if err != nil {
+				log.Error("sendmail: could not render the Pongo2 template: ", err)
+				L.Push(lua.LBool(false))
+				return 1 // number of results
+			}
+			body = rendered
+		}
+		msg := &mail.Message{From: ac.mailFrom, To: to, Subject: subject, Body: body}
+		if err := ac.mailer.Send(msg); err != nil {
+			log.Errorf("sendmail: could not send an e-mail to %s: %s", to, err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Mark a user as unconfirmed and send an e-mail with a confirmation link.
+	// Requires AccountHandlers in the server configuration.
+	// Takes a username, returns true if the e-mail could be sent.
+	L.SetGlobal("SendConfirmation", L.NewFunction(func(L *lua.LState) int {
+		username := L.CheckString(1)
+		if ac.accounts == nil {
+			log.Error("SendConfirmation: the account handlers have not been configured, see the AccountHandlers function")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if err := ac.accounts.SendConfirmation(username); err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Send an e-mail with a link for choosing a new password.
+	// Requires AccountHandlers in the server configuration.
+	// Takes a username, returns true if the e-mail could be sent.
+	L.SetGlobal("SendPasswordReset", L.NewFunction(func(L *lua.LState) int {
+		username := L.CheckString(1)
+		if ac.accounts == nil {
+			log.Error("SendPasswordReset: the account handlers have not been configured, see the AccountHandlers function")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if err := ac.accounts.SendPasswordReset(username); err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
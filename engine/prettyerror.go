@@ -27,6 +27,8 @@ func errorPageTitle(lang string) string {
 		return "GCSS Error"
 	case "html":
 		return "HTML Error"
+	case "javascript":
+		return "JavaScript Error"
 	case "jsx":
 		return "JSX Error"
 	default:
@@ -52,11 +54,11 @@ func (ac *Config) PrettyError(w http.ResponseWriter, req *http.Request, filename
 		err  error
 	)
 
-	// The line that the error refers to, for the case of Lua
+	// The line that the error refers to, for the case of Lua and JavaScript
 	linenr := -1
 
 	if len(filebytes) > 0 {
-		if lang == "lua" {
+		if lang == "lua" || lang == "javascript" {
 			// If the first line of the error message has two colons, see if the second field is a number
 			fields := strings.SplitN(errormessage, ":", 3)
 			if len(fields) > 2 {
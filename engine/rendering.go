@@ -17,6 +17,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/wellington/sass/compiler"
 	"github.com/xyproto/algernon/console"
+	"github.com/xyproto/algernon/csrf"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/algernon/utils"
@@ -509,6 +510,11 @@ func (ac *Config) PongoPage(w http.ResponseWriter, req *http.Request, filename s
 		}
 	}
 
+	// For the csrf_token function and the {% csrf_token %} tag
+	okfuncs[csrf.FieldName] = func() string {
+		return ac.csrfToken(w, req)
+	}
+
 	// Make the Lua functions available to Pongo
 	pongo2.Globals.Update(okfuncs)
 
@@ -798,8 +804,26 @@ func (ac *Config) HyperAppPage(w http.ResponseWriter, req *http.Request, filenam
 	// Include the hyperapp javascript from unpkg.com
 	//htmlbuf.WriteString("</head><body><script src=\"https://unpkg.com/hyperapp\"></script><script>")
 
+	htmlbuf.WriteString("</head><body>")
+
+	// Render the view on the server, if enabled. HyperApp uses the first
+	// element in <body> as the root of the app, so the rendered HTML is reused.
+	if ac.serverSideRendering {
+		rendered, err := ac.renderHyperApp(w, req, filename, jsxdata)
+		if err != nil {
+			if e, ok := err.(*ssrError); ok && ac.debugMode {
+				ac.PrettyError(w, req, e.filename, e.source, e.Error(), e.lang)
+				return
+			}
+			// Render the view in the browser instead
+			log.Errorf("Could not render %s on the server:\n%s", filename, err)
+		} else {
+			htmlbuf.Write(rendered)
+		}
+	}
+
 	// Embed the hyperapp script directly, for speed
-	htmlbuf.WriteString("</head><body><script>")
+	htmlbuf.WriteString("<script>")
 	htmlbuf.Write(hyperAppJSBytes)
 
 	// The HyperApp library + compiled JSX can live in the same script tag. No need for this:
@@ -15,8 +15,12 @@ import (
 	"github.com/xyproto/algernon/lua/codelib"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/algernon/lua/httpclient"
 	"github.com/xyproto/algernon/lua/jnode"
+	"github.com/xyproto/algernon/lua/modules"
 	"github.com/xyproto/algernon/lua/pure"
+	"github.com/xyproto/algernon/lua/sqldb"
+	"github.com/xyproto/algernon/lua/tasks"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/term"
 )
@@ -25,9 +29,10 @@ const (
 	generalHelpText = `Available functions:
 
 Data structures
+(the constructors take an optional database index and connection name)
 
 // Get or create database-backed Set (takes a name, returns a set object)
-Set(string) -> userdata
+Set(string, [number], [string]) -> userdata
 // Add an element to the set
 set:add(string)
 // Remove an element from the set
@@ -43,7 +48,7 @@ set:remove() -> bool
 set:clear() -> bool
 
 // Get or create a database-backed List (takes a name, returns a list object)
-List(string) -> userdata
+List(string, [number], [string]) -> userdata
 // Add an element to the list
 list:add(string)
 // Get all members of the list
@@ -61,7 +66,7 @@ list:json() -> string
 
 // Get or create a database-backed HashMap
 // (takes a name, returns a hash map object)
-HashMap(string) -> userdata
+HashMap(string, [number], [string]) -> userdata
 // For a given element id (for instance a user id), set a key.
 // Returns true if successful.
 hash:set(string, string, string) -> bool
@@ -78,6 +83,8 @@ hash:getall() -> table
 hash:delkey(string, string) -> bool
 // Remove an element (for instance a user). Returns true if successful
 hash:del(string) -> bool
+// Make an element expire after the given number of seconds.
+hash:expire(string, number) -> bool
 // Remove the hash map itself. Returns true if successful.
 hash:remove() -> bool
 // Clear the hash map. Returns true if successful.
@@ -85,9 +92,13 @@ hash:clear() -> bool
 
 // Get or create a database-backed KeyValue collection
 // (takes a name, returns a key/value object)
-KeyValue(string) -> userdata
+KeyValue(string, [number], [string]) -> userdata
 // Set a key and value. Returns true if successful.
 kv:set(string, string) -> bool
+// Set a key and value that expires after the given number of seconds.
+kv:setex(string, string, number) -> bool
+// Takes a key, returns the number of seconds until it expires, or 0.
+kv:ttl(string) -> number
 // Takes a key, returns a value. May return an empty string.
 kv:get(string) -> string
 // Takes a key, returns the value+1.
@@ -100,6 +111,67 @@ kv:remove() -> bool
 // Clear the KeyValue. Returns true if successful.
 kv:clear() -> bool
 
+// Get or create a database-backed SortedSet
+// (takes a name, returns a sorted set object)
+SortedSet(string, [number], [string]) -> userdata
+// Add a member with a score. Returns true if successful.
+zset:add(string, number) -> bool
+// Increase the score of a member (default 1) and return the new score.
+zset:inc(string, [number]) -> number
+// Return the score of a member, or nil.
+zset:score(string) -> number
+// Return the rank of a member, starting at 1, or nil. Highest first if true is given.
+zset:rank(string, [bool]) -> number
+// Remove a member. Returns true if successful.
+zset:del(string) -> bool
+// Return the number of members.
+zset:size() -> number
+// Return the members from one rank to another, as tables with "member" and "score".
+// Highest scores first if true is given.
+zset:range(number, number, [bool]) -> table
+// Return the members with a score from min to max.
+zset:rangebyscore(number, number, [bool]) -> table
+// Remove the sorted set itself. Returns true if successful.
+zset:remove() -> bool
+// Clear the sorted set. Returns true if successful.
+zset:clear() -> bool
+
+// Get a publish/subscribe channel (takes a name, returns a channel object)
+Channel(string, [string]) -> userdata
+// Publish a message. Returns the number of subscribers that received it.
+ch:publish(string) -> number
+// Wait for the next message, for up to the given number of seconds, or nil.
+ch:receive([number]) -> string
+// Call the function with each message until it returns false or the time is up.
+ch:listen(function, [number]) -> number
+
+// Run the function as a transaction, where changes to the data structures
+// are written when it returns, or discarded if it fails or returns false.
+// Returns true if successful.
+transaction(function) -> bool, [string]
+
+SQL queries
+
+// Get the connection to the SQL database backend, or a named connection
+SQL([string]) -> userdata
+// Run a query and return a table with one table per row. Returns nil and an error if it failed.
+sql:query(string, ...) -> table
+// Run a query and return the first row, or nil.
+sql:row(string, ...) -> table
+// Run a statement. Returns the number of affected rows and the last inserted ID.
+sql:exec(string, ...) -> number, number
+// Create a prepared statement, with the query, row, exec and close methods.
+sql:prepare(string) -> userdata
+// Start a transaction, and commit or roll it back. Transactions that are
+// left open are rolled back when the request is done.
+sql:begin() -> userdata
+sql:commit() -> bool
+sql:rollback() -> bool
+// Run a function in a transaction. Rolls back if the function fails or returns false.
+sql:transaction(function) -> bool
+// Return the name of the database driver.
+sql:driver() -> string
+
 Live server configuration
 
 // Reset the URL prefixes and make everything *public*.
@@ -108,6 +180,9 @@ ClearPermissions()
 AddAdminPrefix(string)
 // Add an URL prefix that will have *user* rights.
 AddUserPrefix(string)
+// Add an URL prefix where requests with methods like POST must have a valid
+// CSRF token, or come from the same origin.
+AddCSRFPrefix(string)
 // Provide a lua function that will be used as the permission denied handler.
 DenyHandler(function)
 // Direct the logging to the given filename. If the filename is an empty
@@ -147,21 +222,25 @@ preload(string) -> bool // Load a file into the cache, returns true on success.
 
 JSON
 
-// Use, or create, a JSON document/file.
-JFile(filename) -> userdata
+// Use, or create, a JSON document/file. Takes an optional JSON Schema filename.
+JFile(filename[, schemafilename]) -> userdata
 // Retrieve a string, given a valid JSON path. May return an empty string.
 jfile:getstring(string) -> string
 // Retrieve a JSON node, given a valid JSON path. May return nil.
 jfile:getnode(string) -> userdata
 // Retrieve a value, given a valid JSON path. May return nil.
 jfile:get(string) -> value
-// Change an entry given a JSON path and a value. Returns true if successful.
-jfile:set(string, string) -> bool
+// Change an entry given a JSON path and a value.
+// Returns true if successful, or false and an error message.
+jfile:set(string, string) -> bool, [string]
 // Given a JSON path (optional) and JSON data, add it to a JSON list.
-// Returns true if successful.
-jfile:add([string, ]string) -> bool
-// Removes a key in a map in a JSON document. Returns true if successful.
-jfile:delkey(string) -> bool
+// Returns true if successful, or false and an error message.
+jfile:add([string, ]string) -> bool, [string]
+// Removes a key in a map in a JSON document.
+// Returns true if successful, or false and an error message.
+jfile:delkey(string) -> bool, [string]
+// Return the name of the channel where changes are published.
+jfile:channel() -> string
 // Convert a Lua table with strings or ints to JSON.
 // Takes an optional number of spaces to indent the JSON data.
 json(table[, number]) -> string
@@ -201,6 +280,46 @@ jnode:GET(string) -> string
 // Alias for jnode:GET
 jnode:receive(string) -> string
 
+HTTP requests
+
+// Create a new HTTP client. Takes an optional table with timeout, redirects,
+// maxbody, headers and cookies.
+HTTPClient([table]) -> userdata
+// Send a request, given a method, an URL and an optional table with headers,
+// query, form, json, body, multipart, timeout and maxbody.
+// Returns a table with status, status_text, headers, cookies, body and url,
+// or nil and an error message.
+client:request(string, string[, table]) -> table | nil, string
+// Send a request with the given method, given an URL and an optional table.
+client:get(string[, table]) -> table | nil, string
+client:head(string[, table]) -> table | nil, string
+client:post(string[, table]) -> table | nil, string
+client:put(string[, table]) -> table | nil, string
+client:patch(string[, table]) -> table | nil, string
+client:delete(string[, table]) -> table | nil, string
+// Set or remove a header that is sent with every request.
+client:header(string[, string])
+// Set the timeout for each request, in seconds.
+client:timeout(number)
+// Set the maximum number of redirects to follow.
+client:redirects(number)
+// Set the maximum size of a response body, in bytes.
+client:maxbody(number)
+// Return the cookies for the given URL.
+client:cookies(string) -> table
+
+Background tasks
+
+// Run a Lua function in the background, with the given arguments.
+// Returns the task ID, or nil and an error message.
+spawn(function, ...) -> string | nil, string
+// Add a task to a queue, given a queue name, a payload and an optional table
+// with attempts and delay. Returns the task ID, or nil and an error message.
+enqueue(string, payload[, table]) -> string | nil, string
+// Get the status of a task, as a table with id, queue, state, attempts,
+// result and error. Returns nil if there is no such task.
+task(string) -> table | nil
+
 Plugins
 
 // Load a plugin given the path to an executable. Returns true if successful.
@@ -217,17 +336,26 @@ Code libraries
 
 // Create or use a code library object. Takes an optional data structure name.
 CodeLib([string]) -> userdata
-// Given a namespace and Lua code, add the given code to the namespace.
-// Returns true if successful.
+// Given a namespace and Lua code, add the given code to the namespace,
+// as a new version. Returns true if successful.
 codelib:add(string, string) -> bool
 // Given a namespace and Lua code, set the given code as the only code
-// in the namespace. Returns true if successful.
+// in the namespace, as a new version. Returns true if successful.
 codelib:set(string, string) -> bool
-// Given a namespace, return Lua code, or an empty string.
-codelib:get(string) -> string
-// Import (eval) code from the given namespace into the current Lua state.
-// Returns true if successful.
-codelib:import(string) -> bool
+// Given a namespace and an optional version, return Lua code, or an empty string.
+codelib:get(string, [number]) -> string
+// Given a namespace, return the current version number, or 0.
+codelib:version(string) -> number
+// Given a namespace, return a table with the code of every version.
+codelib:history(string) -> table
+// Make the given version, or the previous one, the current version.
+codelib:rollback(string, [number]) -> bool
+// Import code from the given namespace as a module, and return the module.
+// Code that returns nothing also sets its globals in the script.
+// Returns false if there was an error.
+codelib:import(string) -> table
+// Import code from the default code library as a module.
+require("db:" .. string) -> table
 // Completely clear the code library. Returns true if successful.
 codelib:clear() -> bool
 
@@ -245,6 +373,8 @@ sleep(number)
 unixnano() -> number
 // Convert Markdown to HTML
 markdown(string) -> string
+// Import a module from the script directory, the lib directory or the code library
+require(string) -> any
 
 Extra
 
@@ -261,7 +391,8 @@ dir([table]) -> string
 	usageMessage = `
 Type "webhelp" for an overview of functions that are available when
 handling requests. Or "confighelp" for an overview of functions that are
-available when configuring an Algernon application.
+available when configuring an Algernon application. Type "jobs" to list
+the periodic and scheduled jobs.
 `
 	webHelpText = `Available functions:
 
@@ -324,8 +455,9 @@ AddUser(string, string, string)
 SetLoggedIn(string)
 // Set a user as logged out on the server (not cookie). Takes a username.
 SetLoggedOut(string)
-// Log in a user, both on the server and with a cookie. Takes a username.
-Login(string)
+// Log in a user, both on the server and with a cookie. Takes a username
+// and an optional one-time password or recovery code.
+Login(string, [string]) -> bool
 // Log out a user, on the server (which is enough). Takes a username.
 Logout(string)
 // Get the current username, from the cookie
@@ -338,17 +470,25 @@ SetCookieTimeout(number)
 CookieSecret() -> string
 // Set the current server-side cookie secret, for persistent logins
 SetCookieSecret(string)
-// Get the current password hashing algorithm (bcrypt, bcrypt+ or sha256)
+// Get the current password hashing algorithm (argon2id, bcrypt, bcrypt+ or sha256)
 PasswordAlgo() -> string
-// Set the current password hashing algorithm (bcrypt, bcrypt+ or sha256)
+// Set the current password hashing algorithm (argon2id, bcrypt, bcrypt+ or sha256)
 // Takes a string
 SetPasswordAlgo(string)
+// Get the algorithm that was used for hashing the stored password of a user
+// Takes a username
+UserPasswordAlgo(string) -> string
+// Set the bcrypt cost, from 4 to 31
+SetBcryptCost(number) -> bool
+// Set the argon2id memory usage (in KiB), iterations and optionally threads
+SetArgon2Params(number, number, [number]) -> bool
 // Hash the password
 // Takes a username and password (username can be used for salting)
 HashPassword(string, string) -> string
 // Change the password for a user, given a username and a new password
 SetPassword(string, string)
-// Check if a given username and password is correct
+// Check if a given username and password is correct.
+// Too many failed attempts leads to a lockout.
 // Takes a username and password
 CorrectPassword(string, string) -> bool
 // Checks if a confirmation code is already in use
@@ -369,6 +509,58 @@ SetMinimumConfirmationCodeLength(number)
 // Generates a unique confirmation code, or an empty string
 GenerateUniqueConfirmationCode() -> string
 
+Two-factor authentication
+
+// Generate a new TOTP secret for a user. Takes a username and an optional issuer.
+// Returns the secret and an otpauth:// URI.
+EnrollTOTP(string, [string]) -> string, string
+// Render an otpauth:// URI as a QR code. Returns an SVG image as a string.
+TOTPQRCode(string) -> string
+// Enable two-factor authentication for a user, if the one-time password is valid
+ConfirmTOTP(string, string) -> bool
+// Check a one-time password or recovery code, and mark the second factor as
+// verified for the current session
+VerifyTOTP(string, string) -> bool
+// Check if a user has enabled two-factor authentication
+HasTOTP(string) -> bool
+// Check if a user has verified the second factor in the current session
+TwoFactorVerified(string) -> bool
+// Disable two-factor authentication for a user
+DisableTOTP(string)
+// Generate new recovery codes for a user. Returns a table with codes.
+RecoveryCodes(string) -> table
+// Get the number of unused recovery codes for a user
+RecoveryCodesLeft(string) -> number
+
+Lockouts and the audit log
+
+// Check if a username is locked out. Returns true and the seconds left.
+IsLockedOut(string) -> bool, number
+// Check if an IP address is locked out. Returns true and the seconds left.
+IsIPLockedOut(string) -> bool, number
+// Get the number of recent failed login attempts for a username
+FailedLogins(string) -> number
+// Remove the failed login attempts and any lockout for a username
+ClearLockout(string)
+// Remove the failed login attempts and any lockout for an IP address
+ClearIPLockout(string)
+// Get the most recent authentication events, newest first
+AuditLog([number]) -> table
+// Change the lockout policy. Takes a table with the optional fields
+// max_attempts, max_ip_attempts, lockout, max_lockout, window and audit_size.
+SetLockoutPolicy(table) -> bool
+
+Sending e-mail
+
+// Send an e-mail. Takes a recipient, a subject, a body and an optional table.
+// If a table is given, the body is used as a Pongo2 template with the table
+// as data. The body can also be the filename of a .po2 file.
+sendmail(string, string, string, [table]) -> bool
+// Mark a user as unconfirmed and send an e-mail with a confirmation link
+SendConfirmation(string) -> bool
+// Send an e-mail with a link to a form for choosing a new password
+SendPasswordReset(string) -> bool
+
 File uploads
 
 // Creates a file upload object. Takes a form ID (from a POST request) as the
@@ -404,8 +596,8 @@ header(string) -> string
 setheader(string, string)
 // Return the HTTP headers, as a table.
 headers() -> table
-// Return the HTTP body in the request
-// (will only read the body once, since it's streamed).
+// Return the HTTP body in the request, up to the body limit. Returns an
+// empty string and an error if the body could not be read or is too large.
 body() -> string
 // Set a HTTP status code (like 200 or 404).
 // Must be used before other functions that writes to the client!
@@ -430,12 +622,36 @@ render(string) -> string
 // Return a table with keys and values as given in a posted form, or as given
 // in the URL ("/some/page?x=7" makes "x" with the value "7" available).
 formdata() -> table
+// Return a table with keys and lists of all values from a posted form or the URL.
+formdata_all() -> table
+// Return a table with keys and lists of all values from the URL in the
+// request, or from the given URL ("?tag=a&tag=b" makes "tag" with "a" and "b").
+urldata_all([string]) -> table
+// Return the JSON in the request body as Lua values, or nil and an error.
+jsonbody() -> table
 // Redirect to an absolute or relative URL. Also takes a HTTP status code.
 redirect(string[, number])
 // Permanently redirect to an absolute or relative URL. Uses status code 302.
 permanent_redirect(string)
 // Transmit what has been outputted so far, to the client.
 flush()
+
+Cookies and sessions
+
+// Return the value of a cookie, or nil. Takes the name and an optional
+// table where "signed" or "encrypted" can be true.
+getcookie(string[, table]) -> string
+// Set a cookie. Takes the name, the value and an optional table with "path",
+// "domain", "maxage", "secure", "httponly", "samesite", "signed" and "encrypted".
+setcookie(string, string[, table]) -> bool
+// Remove a cookie. Takes the name and an optional table with "path" and "domain".
+clearcookie(string[, table])
+// Return a table for the session of the current visitor, kept in the database
+session() -> table
+// End the session of the current visitor, and remove all of the data
+endsession() -> bool
+// Return a CSRF token, for the "csrf_token" form field or "X-CSRF-Token" header
+csrf_token() -> string
 `
 	configHelpText = `Available functions:
 
@@ -447,8 +663,14 @@ SetAddr(string)
 ClearPermissions()
 // Add an URL prefix that will have *admin* rights.
 AddAdminPrefix(string)
+// Require admins to have verified their second factor before accessing the
+// admin URL prefixes. Takes an optional bool.
+AdminRequiresTwoFactor([bool])
 // Add an URL prefix that will have *user* rights.
 AddUserPrefix(string)
+// Add an URL prefix where requests with methods like POST must have a valid
+// CSRF token, or come from the same origin.
+AddCSRFPrefix(string)
 // Provide a lua function that will be used as the permission denied handler.
 DenyHandler(function)
 // Provide a lua function that will be run once,
@@ -460,6 +682,54 @@ ServerFile(string) -> bool
 CookieSecret() -> string
 // Set the cookie secret that will be used when setting and getting browser cookies.
 SetCookieSecret(string)
+// Set how long sessions last after they were last used, in seconds.
+SetSessionTimeout(number)
+// Set the largest request body that body() and jsonbody() will read, in bytes.
+SetBodyLimit(number)
+// Log in users with an OpenID Connect identity provider. Takes a table with
+// "issuer", "client_id", "client_secret" and optionally "scopes",
+// "redirect_url", "login_path", "callback_path", "after_login" and
+// "username_claim". Returns true if successful.
+OpenIDConnect(table) -> bool
+// Configure how e-mail is sent. Takes a table with "from" and either "smtp"
+// (host:port, with optional "username" and "password"), "maildir" or "file".
+Mailer(table) -> bool
+// Set up handlers for account confirmation and password reset links.
+// Takes a table with "base_url" (required, like "https://example.com"),
+// "confirm_path", "reset_path", "after_confirm", "after_reset", "expiry"
+// (seconds), "confirm_subject", "reset_subject", "confirm_template" and
+// "reset_template" (Pongo2 files).
+AccountHandlers(table) -> bool
+// Connect to an SQL database that can be used with SQL(name).
+// Takes a name, a driver ("mysql", "postgres" or "sqlite3") and a DSN.
+SQLConnection(string, string, string) -> bool
+// Connect to another database backend for data structures.
+// Takes a name, a backend ("redis", "bolt", "sqlite", "leveldb", "mariadb"
+// or "postgres") and a host, filename or connection string.
+DatabaseConnection(string, string, [string]) -> bool
+// Run a Lua function every given interval, like "5m" or a number of seconds.
+// The function runs in the background, and can not use local variables from
+// outside of the function. Returns the job ID, or nil and an error message.
+every(string | number, function) -> number | nil, string
+// Run a Lua function at the times that match a cron expression, like
+// "0 3 * * *" for 03:00 every night. Returns the job ID, or nil and an error message.
+schedule(string, function) -> number | nil, string
+// Set the function that runs the tasks in the given queue. The function is
+// called with the payload and the task ID, and the task is tried again later
+// if it raises an error.
+worker(string, function)
+// Run the Lua scripts of all sites, or of the site with the given domain,
+// in a sandbox. The optional table can have timeout, instructions, memory
+// (in MiB), libs and allow. Given a domain and false, the site is not sandboxed.
+Sandbox([string], [table | false]) -> bool
+
+Exporting and importing data
+
+// Export the users, data structures and code libraries as JSON lines.
+// Takes an optional table with extra names, like "hashmap:visitors".
+ExportData([table]) -> string
+// Import exported data. Returns the number of data structures.
+ImportData(string) -> number
 
 `
 	exitMessage = "bye"
@@ -572,6 +842,9 @@ func outputHelpAbout(o *term.TextOutput, helpText, topic string) {
 	case "confighelp":
 		o.Println(o.DarkGray("Output help about configuration-related functions."))
 		return
+	case "jobs":
+		o.Println(o.DarkGray("Output the periodic and scheduled jobs, and how they last ran."))
+		return
 	case "quit", "exit", "shutdown", "halt":
 		o.Println(o.DarkGray("Quit Algernon."))
 		return
@@ -620,17 +893,23 @@ func (ac *Config) LoadLuaFunctionsForREPL(L *lua.LState, o *term.TextOutput) {
 	// If there is a database backend
 	if ac.perm != nil {
 
-		// Retrieve the creator struct
-		creator := ac.perm.UserState().Creator()
-
 		// Simpleredis data structures
-		datastruct.LoadList(L, creator)
-		datastruct.LoadSet(L, creator)
-		datastruct.LoadHash(L, creator)
-		datastruct.LoadKeyValue(L, creator)
+		datastruct.LoadList(L, ac.stores)
+		datastruct.LoadSet(L, ac.stores)
+		datastruct.LoadHash(L, ac.stores)
+		datastruct.LoadKeyValue(L, ac.stores)
+		datastruct.LoadSortedSet(L, ac.stores)
+		datastruct.LoadTransaction(L)
+		datastruct.LoadChannel(L, ac.stores, nil)
+
+		// Raw SQL queries, if the database backend is an SQL database
+		sqldb.Load(L, ac.sqlConnections)
 
 		// For saving and loading Lua functions
-		codelib.Load(L, creator)
+		codelib.Load(L, ac.stores.Default())
+
+		// For exporting and importing users and data structures
+		ac.LoadDataFunctions(L)
 	}
 
 	// For handling JSON data
@@ -638,6 +917,14 @@ func (ac *Config) LoadLuaFunctionsForREPL(L *lua.LState, o *term.TextOutput) {
 	ac.LoadJFile(L, ac.serverDirOrFilename)
 	jnode.Load(L)
 
+	// For sending HTTP requests
+	httpclient.Load(L)
+
+	// For running functions in the background
+	if ac.tasks != nil {
+		tasks.Load(L, ac.tasks)
+	}
+
 	// Extras
 	pure.Load(L)
 
@@ -649,6 +936,9 @@ func (ac *Config) LoadLuaFunctionsForREPL(L *lua.LState, o *term.TextOutput) {
 
 	// Cache
 	ac.LoadCacheFunctions(L)
+
+	// For importing Lua modules from the server directory and the lib directory
+	modules.Load(L, ac.serverDirOrFilename, filepath.Join(ac.serverDirOrFilename, "lib"))
 }
 
 // REPL provides a "Read Eval Print" loop for interacting with Lua.
@@ -788,6 +1078,9 @@ func (ac *Config) REPL(ready, done chan bool) error {
 		case "confighelp":
 			outputHelp(o, configHelpText)
 			continue
+		case "jobs":
+			o.Println(ac.jobsInfo())
+			continue
 		case "quit", "exit", "shutdown", "halt":
 			done <- true
 			return nil
@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/xyproto/algernon/lua/sandbox"
+	"github.com/xyproto/algernon/lua/sqldb"
+	"github.com/xyproto/algernon/lua/upload"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/gopher-lua"
+)
+
+// sandboxOptions returns the sandbox limits for the site of the given
+// request, or nil if the Lua scripts of the site are not sandboxed
+func (ac *Config) sandboxOptions(req *http.Request) *sandbox.Options {
+	ac.sandboxMut.RLock()
+	defer ac.sandboxMut.RUnlock()
+	if o, ok := ac.siteSandboxes[utils.GetDomain(req)]; ok {
+		return o
+	}
+	if ac.sandbox == nil && ac.sandboxMode {
+		o := sandbox.DefaultOptions()
+		return &o
+	}
+	return ac.sandbox
+}
+
+// siteDir returns the directory that is served for the given request
+func (ac *Config) siteDir(req *http.Request) string {
+	if ac.serverAddDomain {
+		return filepath.Join(ac.serverDirOrFilename, utils.GetDomain(req))
+	}
+	return ac.serverDirOrFilename
+}
+
+// applySandbox removes the functions that are not allowed from the given Lua
+// state, and restricts file access to the directory of the site
+func (ac *Config) applySandbox(L *lua.LState, req *http.Request, filename string, o *sandbox.Options) {
+	scriptdir := filepath.Dir(filename)
+	sitedir := ac.siteDir(req)
+
+	sandbox.Apply(L, *o, scriptdir, sitedir)
+
+	// Functions that take filenames relative to the script directory
+	sandbox.Restrict(L, L.G.Global, scriptdir, sitedir, 1, "dofile", "serve", "serve2", "render", "JFile")
+	sandbox.Restrict(L, L.G.Global, scriptdir, sitedir, 2, "serve", "render", "JFile")
+	if mt, ok := L.GetTypeMetatable(upload.Class).(*lua.LTable); ok {
+		sandbox.Restrict(L, mt, scriptdir, sitedir, 2, "save", "savein")
+	}
+
+	// The file cache is shared by all sites
+	L.SetGlobal("preload", lua.LNil)
+
+	// Functions that run other programs
+	if !o.Allowed("run") {
+		L.SetGlobal("run", lua.LNil)
+	}
+	if !o.Allowed("py") {
+		L.SetGlobal("py", lua.LNil)
+	}
+	if !o.Allowed("Plugin") {
+		L.SetGlobal("Plugin", lua.LNil)
+		L.SetGlobal("PluginCode", lua.LNil)
+		L.SetGlobal("CallPlugin", lua.LNil)
+	}
+}
+
+// runSandboxed runs the given Lua script with the given limits.
+// Returns a *sandbox.LimitError if a limit was exceeded.
+func (ac *Config) runSandboxed(L *lua.LState, req *http.Request, filename string, o *sandbox.Options) error {
+	return ac.sandboxed(L, req, filename, o, func() error {
+		return ac.doFile(L, filename)
+	})
+}
+
+// sandboxed removes the functions that are not allowed from the given Lua
+// state, and then calls the given function with the limits of the sandbox.
+// The filename is the script that the Lua state is for. Returns a
+// *sandbox.LimitError if a limit was exceeded.
+func (ac *Config) sandboxed(L *lua.LState, req *http.Request, filename string, o *sandbox.Options, f func() error) error {
+	ac.applySandbox(L, req, filename, o)
+	ctx, cancel := sandbox.Context(req.Context(), *o)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	return sandbox.Check(ctx, f())
+}
+
+// luaState returns a Lua state for running a script for the given request,
+// with the functions that are available for the script. Sandboxed sites get
+// a new Lua state, since the standard libraries are changed. The returned
+// function must be called when the Lua state is no longer in use.
+func (ac *Config) luaState(w http.ResponseWriter, req *http.Request, filename string, o *sandbox.Options) (*lua.LState, func()) {
+	if o != nil {
+		L := lua.NewState()
+		ac.loadCommonFunctions(w, req, filename, L, nil, nil, true)
+		return L, func() { closeLuaState(L) }
+	}
+	L := ac.luapool.Get()
+	ac.LoadCommonFunctions(w, req, filename, L, nil, nil)
+	return L, func() { ac.putLuaState(L) }
+}
+
+// putLuaState rolls back the SQL transactions and closes the prepared
+// statements that a script has left open, and puts the Lua state back in the pool
+func (ac *Config) putLuaState(L *lua.LState) {
+	sqldb.Release(L)
+	ac.luapool.Put(L)
+}
+
+// closeLuaState rolls back the SQL transactions and closes the prepared
+// statements that a script has left open, and closes the Lua state
+func closeLuaState(L *lua.LState) {
+	sqldb.Release(L)
+	L.Close()
+}
+
+// runLuaFunc runs the given code in the given Lua state, with the limits
+// of the sandbox if o is not nil
+func (ac *Config) runLuaFunc(L *lua.LState, req *http.Request, filename string, o *sandbox.Options, f func() error) error {
+	if o != nil {
+		return ac.sandboxed(L, req, filename, o, f)
+	}
+	return f()
+}
+
+// checkSandboxOptions returns the sandbox limits in the given Lua table,
+// starting with the default limits
+func checkSandboxOptions(L *lua.LState, table *lua.LTable) sandbox.Options {
+	o := sandbox.DefaultOptions()
+	if table == nil {
+		return o
+	}
+	switch v := table.RawGetString("timeout").(type) {
+	case lua.LNumber:
+		o.Timeout = time.Duration(float64(v) * float64(time.Second))
+	case lua.LString:
+		d, err := time.ParseDuration(string(v))
+		if err != nil {
+			L.RaiseError("timeout: %s", err)
+		}
+		o.Timeout = d
+	}
+	if n, ok := table.RawGetString("instructions").(lua.LNumber); ok {
+		o.Instructions = int64(n)
+	}
+	if n, ok := table.RawGetString("memory").(lua.LNumber); ok {
+		// In MiB
+		o.Memory = uint64(float64(n) * 1024 * 1024)
+	}
+	stringList := func(key string) []string {
+		list, ok := table.RawGetString(key).(*lua.LTable)
+		if !ok {
+			return nil
+		}
+		var xs []string
+		list.ForEach(func(_, value lua.LValue) {
+			xs = append(xs, value.String())
+		})
+		return xs
+	}
+	if libs := stringList("libs"); libs != nil {
+		o.Libs = libs
+	}
+	o.Allow = stringList("allow")
+	return o
+}
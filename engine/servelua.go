@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/flosch/pongo2"
+	"github.com/xyproto/algernon/csrf"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
@@ -70,6 +71,11 @@ func (ac *Config) LoadServeFile(w http.ResponseWriter, req *http.Request, L *lua
 			return 0 // number of restuls
 		}
 
+		// For the {% csrf_token %} tag
+		pongoMap[csrf.FieldName] = func() string {
+			return ac.csrfToken(w, req)
+		}
+
 		// Retrieve all the function arguments as a bytes.Buffer
 		buf := convert.Arguments2buffer(L, true)
 		// Use the buffer as a template.
@@ -8,8 +8,18 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/auth"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/algernon/leveldb"
+	"github.com/xyproto/algernon/lua/jobs"
+	"github.com/xyproto/algernon/lua/sandbox"
+	"github.com/xyproto/algernon/lua/tasks"
+	"github.com/xyproto/algernon/mail"
+	"github.com/xyproto/algernon/oidc"
+	"github.com/xyproto/algernon/sqlite"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
 	bolt "github.com/xyproto/permissionbolt"
@@ -123,6 +133,18 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		return 1 // number of results
 	}))
 
+	// Set how long sessions last after they were last used, in seconds
+	L.SetGlobal("SetSessionTimeout", L.NewFunction(func(L *lua.LState) int {
+		ac.sessionTimeout = time.Duration(L.CheckNumber(1) * lua.LNumber(time.Second))
+		return 0 // number of results
+	}))
+
+	// Set the largest request body that body and jsonbody will read, in bytes
+	L.SetGlobal("SetBodyLimit", L.NewFunction(func(L *lua.LState) int {
+		ac.bodyLimit = int64(L.CheckNumber(1))
+		return 0 // number of results
+	}))
+
 	// Clear the default path prefixes. This makes everything public.
 	L.SetGlobal("ClearPermissions", L.NewFunction(func(L *lua.LState) int {
 		ac.perm.Clear()
@@ -145,6 +167,30 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		return 0 // number of results
 	}))
 
+	// Registers a path prefix, for instance "/account", where requests
+	// with methods like POST must have a valid CSRF token or come from the
+	// same origin.
+	L.SetGlobal("AddCSRFPrefix", L.NewFunction(func(L *lua.LState) int {
+		path := L.ToString(1)
+		ac.csrf.AddPrefix(path)
+		return 0 // number of results
+	}))
+
+	// Require admins to have verified their second factor (TOTP or recovery code)
+	// before accessing the admin path prefixes. Takes an optional bool.
+	L.SetGlobal("AdminRequiresTwoFactor", L.NewFunction(func(L *lua.LState) int {
+		required := true
+		if L.GetTop() >= 1 {
+			required = L.ToBool(1)
+		}
+		if perm, ok := ac.perm.(*auth.Permissions); ok {
+			perm.SetAdminTwoFactor(required)
+		} else {
+			log.Error("Two-factor authentication is not supported by the current permissions middleware")
+		}
+		return 0 // number of results
+	}))
+
 	// Sets a Lua function as a custom "permissions denied" page handler.
 	L.SetGlobal("DenyHandler", L.NewFunction(func(L *lua.LState) int {
 		luaDenyFunc := L.ToFunction(1)
@@ -223,15 +269,234 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		return 1 // number of results
 	}))
 
+	// Configure login with an OpenID Connect identity provider.
+	// Takes a table with at least "issuer" and "client_id". Returns true if successful.
+	L.SetGlobal("OpenIDConnect", L.NewFunction(func(L *lua.LState) int {
+		luaTable := L.CheckTable(1)
+		conf := oidc.Config{
+			Issuer:        lua.LVAsString(L.GetField(luaTable, "issuer")),
+			ClientID:      lua.LVAsString(L.GetField(luaTable, "client_id")),
+			ClientSecret:  lua.LVAsString(L.GetField(luaTable, "client_secret")),
+			RedirectURL:   lua.LVAsString(L.GetField(luaTable, "redirect_url")),
+			LoginPath:     lua.LVAsString(L.GetField(luaTable, "login_path")),
+			CallbackPath:  lua.LVAsString(L.GetField(luaTable, "callback_path")),
+			AfterLogin:    lua.LVAsString(L.GetField(luaTable, "after_login")),
+			UsernameClaim: lua.LVAsString(L.GetField(luaTable, "username_claim")),
+		}
+		// The scopes can be given as a table or as a space separated string
+		switch scopes := L.GetField(luaTable, "scopes").(type) {
+		case *lua.LTable:
+			scopes.ForEach(func(_, value lua.LValue) {
+				conf.Scopes = append(conf.Scopes, value.String())
+			})
+		case lua.LString:
+			conf.Scopes = strings.Fields(string(scopes))
+		default:
+			conf.Scopes = []string{"openid", "email", "profile"}
+		}
+		client, err := oidc.New(conf, ac.perm.UserState())
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.oidcClient = client
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Configure how e-mail is sent. Takes a table with "from" and either "smtp"
+	// (host:port, with optional "username" and "password"), "maildir" or "file".
+	// Returns true if successful.
+	L.SetGlobal("Mailer", L.NewFunction(func(L *lua.LState) int {
+		luaTable := L.CheckTable(1)
+		field := func(name string) string {
+			return lua.LVAsString(L.GetField(luaTable, name))
+		}
+		from := field("from")
+		if from == "" {
+			log.Error("Mailer: no sender address given")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		switch {
+		case field("smtp") != "":
+			ac.mailer = &mail.SMTPMailer{Addr: field("smtp"), Username: field("username"), Password: field("password")}
+		case field("maildir") != "":
+			ac.mailer = &mail.MaildirMailer{Dir: field("maildir")}
+		case field("file") != "":
+			ac.mailer = &mail.FileMailer{Filename: field("file")}
+		default:
+			log.Error("Mailer: one of smtp, maildir or file must be given")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.mailFrom = from
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set up handlers for account confirmation and password reset links.
+	// Requires Mailer to be called first. Takes a table with settings,
+	// where base_url is required. Returns true if successful.
+	L.SetGlobal("AccountHandlers", L.NewFunction(func(L *lua.LState) int {
+		luaTable := L.CheckTable(1)
+		field := func(name string) string {
+			return lua.LVAsString(L.GetField(luaTable, name))
+		}
+		// Templates are read from files, relative to the server configuration
+		template := func(name string) (string, error) {
+			templateFilename := field(name)
+			if templateFilename == "" {
+				return "", nil
+			}
+			data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(filename), templateFilename))
+			return string(data), err
+		}
+		conf := mail.AccountsConfig{
+			From:           ac.mailFrom,
+			BaseURL:        field("base_url"),
+			ConfirmPath:    field("confirm_path"),
+			ResetPath:      field("reset_path"),
+			AfterConfirm:   field("after_confirm"),
+			AfterReset:     field("after_reset"),
+			Expiry:         time.Duration(lua.LVAsNumber(L.GetField(luaTable, "expiry"))) * time.Second,
+			ConfirmSubject: field("confirm_subject"),
+			ResetSubject:   field("reset_subject"),
+			Theme:          ac.defaultTheme,
+		}
+		var err error
+		if conf.ConfirmTemplate, err = template("confirm_template"); err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if conf.ResetTemplate, err = template("reset_template"); err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		accounts, err := mail.NewAccounts(conf, ac.mailer, ac.perm.UserState())
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.accounts = accounts
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Connect to an SQL database that can be used with SQL(name) in Lua.
+	// Takes a name, a driver ("mysql", "postgres" or "sqlite3") and a DSN.
+	// Returns true if successful.
+	L.SetGlobal("SQLConnection", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		driver := L.CheckString(2)
+		dsn := L.CheckString(3)
+		if name == "" {
+			log.Error("SQLConnection: the connection must have a name")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if err := ac.sqlConnections.Open(name, driver, dsn); err != nil {
+			log.Errorf("SQLConnection: could not connect to %s: %s", name, err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Connect to another database backend, for the data structures in Lua.
+	// The backend can be "redis", "bolt", "sqlite", "leveldb", "mariadb" or "postgres".
+	L.SetGlobal("DatabaseConnection", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		backend := L.CheckString(2)
+		conf := L.OptString(3, "")
+		if name == "" {
+			log.Error("DatabaseConnection: the connection must have a name")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if ac.stores == nil {
+			log.Error("DatabaseConnection: there is no database backend")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		store, closeFunc, err := openStore(backend, conf)
+		if err != nil {
+			log.Errorf("DatabaseConnection: could not connect to %s: %s", name, err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.stores.Add(name, store)
+		AtShutdown(closeFunc)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
 	L.SetGlobal("ServerInfo", L.NewFunction(func(L *lua.LState) int {
 		// Return the string, but drop the final newline
 		L.Push(lua.LString(ac.Info()))
 		return 1 // number of results
 	}))
 
+	// Run the Lua scripts of all sites, or of the site with the given domain,
+	// with limits. Takes an optional domain and an optional table with the
+	// limits. With a domain and false, the scripts of the site are not sandboxed.
+	L.SetGlobal("Sandbox", L.NewFunction(func(L *lua.LState) int {
+		domain := ""
+		n := 1
+		if s, ok := L.Get(1).(lua.LString); ok {
+			domain = string(s)
+			n = 2
+		}
+		var o *sandbox.Options
+		if L.Get(n) != lua.LFalse {
+			options := checkSandboxOptions(L, L.OptTable(n, nil))
+			o = &options
+		} else if domain == "" {
+			L.ArgError(n, "a domain is needed for turning the sandbox off")
+		}
+		ac.sandboxMut.Lock()
+		if domain == "" {
+			ac.sandbox = o
+		} else {
+			if ac.siteSandboxes == nil {
+				ac.siteSandboxes = make(map[string]*sandbox.Options)
+			}
+			ac.siteSandboxes[domain] = o
+		}
+		ac.sandboxMut.Unlock()
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Run Lua functions periodically or on a schedule, with every and schedule
+	if ac.scheduler != nil {
+		jobs.Load(L, ac.scheduler)
+	}
+
+	// Run Lua functions in the background, with spawn, enqueue and worker
+	if ac.tasks != nil {
+		tasks.Load(L, ac.tasks)
+		tasks.LoadWorker(L, ac.tasks)
+	}
+
 	return nil
 }
 
+// newStore returns a Store for the data structures that are available to Lua,
+// using Redis natively if Redis is the database backend
+func (ac *Config) newStore() *datastore.Store {
+	userstate := ac.perm.UserState()
+	if pool, ok := userstate.Host().(*simpleredis.ConnectionPool); ok {
+		return datastore.NewRedis(pool, ac.redisDBindex)
+	}
+	return datastore.New(userstate.Creator())
+}
+
 // DatabaseBackend tries to retrieve a database backend, using one of the
 // available permission middleware packages. It assign a name to dbName
 // (used for the status output) and returns a IPermissions struct.
@@ -241,12 +506,31 @@ func (ac *Config) DatabaseBackend() (pinterface.IPermissions, error) {
 		perm pinterface.IPermissions
 	)
 
+	if ac.sqliteFilename != "" {
+		// New permissions middleware, using an SQLite database
+		perm, err = sqlite.NewWithConf(ac.sqliteFilename)
+		if err != nil {
+			log.Errorf("Could not use SQLite as database backend: %s", err)
+		} else {
+			ac.dbName = "SQLite (" + ac.sqliteFilename + ")"
+		}
+	}
+	if ac.dbName == "" && ac.leveldbDir != "" {
+		// New permissions middleware, using a LevelDB database
+		perm, err = leveldb.NewWithConf(ac.leveldbDir)
+		if err != nil {
+			log.Errorf("Could not use LevelDB as database backend: %s", err)
+		} else {
+			ac.dbName = "LevelDB (" + ac.leveldbDir + ")"
+		}
+	}
+
 	// If Bolt is to be used and no filename is given
-	if ac.useBolt && (ac.boltFilename == "") {
+	if ac.dbName == "" && ac.useBolt && (ac.boltFilename == "") {
 		ac.boltFilename = ac.defaultBoltFilename
 	}
 
-	if ac.boltFilename != "" {
+	if ac.dbName == "" && ac.boltFilename != "" {
 		// New permissions middleware, using a Bolt database
 		perm, err = bolt.NewWithConf(ac.boltFilename)
 		if err != nil {
@@ -394,5 +678,9 @@ func (ac *Config) DatabaseBackend() (pinterface.IPermissions, error) {
 		perm.Clear()
 	}
 
-	return perm, nil
+	// Let the auth package take care of the password hashing
+	if wrapped, ok := perm.(*auth.Permissions); ok {
+		return wrapped, nil
+	}
+	return auth.NewPermissions(perm), nil
 }
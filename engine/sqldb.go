@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/sqlite"
+	"github.com/xyproto/simplehstore"
+	"github.com/xyproto/simplemaria"
+)
+
+// mariadbConnectionString returns a DSN for connecting to the MariaDB/MySQL
+// database that is used as the database backend
+func (ac *Config) mariadbConnectionString() (string, error) {
+	if ac.mariadbDSN == "" {
+		// The same default as when only a database name is given
+		return "test:@tcp(127.0.0.1:3306)/" + ac.mariaDatabase, nil
+	}
+	conf, err := mysql.ParseDSN(ac.mariadbDSN)
+	if err != nil {
+		return "", err
+	}
+	if ac.mariaDatabase != "" {
+		conf.DBName = ac.mariaDatabase
+	}
+	return conf.FormatDSN(), nil
+}
+
+// addBackendSQLConnection makes the database backend available to SQL() in
+// Lua, if it is an SQL database
+func (ac *Config) addBackendSQLConnection() {
+	switch host := ac.perm.UserState().Host().(type) {
+	case *sqlite.Database:
+		ac.sqlConnections.Add("", "sqlite3", host.DB())
+	case *simplehstore.Host:
+		ac.sqlConnections.Add("", "postgres", host.Database())
+	case *simplemaria.Host:
+		// The MariaDB/MySQL host does not expose its connection, so open a new one
+		dsn, err := ac.mariadbConnectionString()
+		if err == nil {
+			err = ac.sqlConnections.Open("", "mysql", dsn)
+		}
+		if err != nil {
+			log.Errorf("Could not connect to MariaDB/MySQL for running SQL queries: %s", err)
+		}
+	}
+}
@@ -2,12 +2,19 @@ package engine
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/gopher-lua"
 )
 
+// How often a comment is sent to keep event streams from Lua open
+const eventStreamKeepAlive = 30 * time.Second
+
 // InsertAutoRefresh inserts JavaScript code to the page that makes the page
 // refresh itself when the source files changes.
 // The JavaScript depends on the event server being available.
@@ -62,3 +69,77 @@ func (ac *Config) InsertAutoRefresh(req *http.Request, htmldata []byte) []byte {
 	// In the unlikely event that no place to insert the JavaScript was found
 	return htmldata
 }
+
+// LoadEventStream makes it possible for Lua scripts to stream the messages
+// that are published on channels to the client, as server-sent events
+func (ac *Config) LoadEventStream(w http.ResponseWriter, req *http.Request, L *lua.LState, flushFunc func()) {
+
+	// Stream the messages that are published on the given channels to the
+	// client, until the client disconnects. If more than one channel is given,
+	// the event type is the name of the channel. Returns false if the channels
+	// could not be subscribed to.
+	L.SetGlobal("eventstream", L.NewFunction(func(L *lua.LState) int {
+		channels := make([]string, L.GetTop())
+		for i := range channels {
+			channels[i] = L.CheckString(i + 1)
+		}
+		if len(channels) == 0 {
+			L.ArgError(1, "channel name expected")
+		}
+		sub, err := ac.stores.Default().Subscribe(channels...)
+		if err != nil {
+			log.Error("eventstream: ", err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream;charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		flush := func() {
+			if flushFunc != nil {
+				flushFunc()
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		flush()
+
+		keepAlive := time.NewTicker(eventStreamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case msg, ok := <-sub.Messages():
+				if !ok {
+					L.Push(lua.LBool(true))
+					return 1 // number of results
+				}
+				var buf bytes.Buffer
+				if len(channels) > 1 {
+					fmt.Fprintf(&buf, "event: %s\n", msg.Channel)
+				}
+				for _, line := range strings.Split(msg.Data, "\n") {
+					fmt.Fprintf(&buf, "data: %s\n", line)
+				}
+				buf.WriteString("\n")
+				if _, err := buf.WriteTo(w); err != nil {
+					L.Push(lua.LBool(true))
+					return 1 // number of results
+				}
+				flush()
+			case <-keepAlive.C:
+				if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+					L.Push(lua.LBool(true))
+					return 1 // number of results
+				}
+				flush()
+			case <-req.Context().Done():
+				// The client disconnected
+				L.Push(lua.LBool(true))
+				return 1 // number of results
+			}
+		}
+	}))
+}
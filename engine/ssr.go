@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jvatic/goja-babel"
+	"github.com/xyproto/algernon/js"
+	"github.com/xyproto/datablock"
+	"github.com/xyproto/gopher-lua"
+)
+
+var (
+	// JSX options for rendering on the server, where only ES5 is supported
+	ssrJSXOptions = map[string]interface{}{
+		"plugins": []string{
+			"transform-react-jsx",
+			"transform-es2015-block-scoping",
+			"transform-es2015-arrow-functions",
+			"transform-es2015-classes",
+			"transform-es2015-computed-properties",
+			"transform-es2015-destructuring",
+			"transform-es2015-for-of",
+			"transform-es2015-parameters",
+			"transform-es2015-shorthand-properties",
+			"transform-es2015-spread",
+			"transform-es2015-template-literals",
+		},
+	}
+
+	// How long a page may take to render on the server
+	ssrTimeout = 10 * time.Second
+
+	// Names from data.lua that can be used as JavaScript variables
+	jsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+)
+
+// ssrEntry is a page that has been rendered on the server, together with the
+// version of the page
+type ssrEntry struct {
+	version string
+	block   *datablock.DataBlock
+}
+
+// fileVersion returns a string that changes when the file changes, or an
+// empty string if the file does not exist
+func fileVersion(filename string) string {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// dataFilename returns the data.lua file to use for the given page
+func (ac *Config) dataFilename(filename string) string {
+	if ac.fs.Exists(ac.defaultLuaDataFilename) {
+		return ac.defaultLuaDataFilename
+	}
+	return filepath.Join(filepath.Dir(filename), ac.defaultLuaDataFilename)
+}
+
+// luaData runs the given data.lua file in the given Lua state, and makes the
+// strings, numbers, booleans and tables that it defines available as global
+// variables in the given JavaScript runtime. Returns a script that defines
+// the same variables in the browser.
+func (ac *Config) luaData(w http.ResponseWriter, req *http.Request, luafilename string, L *lua.LState, r *js.Runtime) (string, error) {
+	// data.lua has the same limits as other scripts of the site
+	sandboxOptions := ac.sandboxOptions(req)
+	ac.loadCommonFunctions(w, req, luafilename, L, nil, nil, sandboxOptions != nil)
+
+	before := make(map[lua.LValue]bool)
+	L.G.Global.ForEach(func(key, _ lua.LValue) {
+		before[key] = true
+	})
+	if err := ac.runLuaFunc(L, req, luafilename, sandboxOptions, func() error {
+		return L.DoFile(luafilename)
+	}); err != nil {
+		return "", err
+	}
+
+	r.L = L
+	var sb strings.Builder
+	var err error
+	L.G.Global.ForEach(func(key, value lua.LValue) {
+		name := key.String()
+		if before[key] || err != nil || !jsIdentifier.MatchString(name) {
+			return
+		}
+		switch value.(type) {
+		case lua.LString, lua.LNumber, lua.LBool, *lua.LTable:
+		default:
+			return
+		}
+		v := r.ToJS(value)
+		r.VM.Set(name, v)
+		var data string
+		if data, err = r.JSON(v); err == nil {
+			sb.WriteString("var " + name + " = " + data + ";\n")
+		}
+	})
+	return sb.String(), err
+}
+
+// renderHyperApp renders the view of the given HyperApp page on the server,
+// with the variables from data.lua, if present. Returns the rendered HTML,
+// followed by a script that defines the variables from data.lua in the
+// browser. If the page is cached, the result is kept until the page changes.
+// Pages with data.lua are not cached, since data.lua runs for each request,
+// and the data may differ between users. Errors are returned as *ssrError.
+func (ac *Config) renderHyperApp(w http.ResponseWriter, req *http.Request, filename string, jsxdata []byte) ([]byte, error) {
+	luafilename := ac.dataFilename(filename)
+	hasData := ac.fs.Exists(luafilename)
+	cached := ac.shouldCache(filepath.Ext(filename)) && !hasData
+	version := fileVersion(filename)
+	if cached {
+		ac.ssrMut.Lock()
+		e, ok := ac.ssrCache[filename]
+		ac.ssrMut.Unlock()
+		if ok && e.version == version {
+			return e.block.MustData(), nil
+		}
+	}
+
+	// Convert JSX to JavaScript that can run on the server
+	script, err := babel.TransformString(string(jsxdata), ssrJSXOptions)
+	if err != nil {
+		return nil, &ssrError{err, filename, jsxdata, "jsx"}
+	}
+
+	r := js.New()
+	var dataScript string
+	if hasData {
+		// A new Lua state, so that only the variables from data.lua are used
+		L := ac.luapool.New()
+		defer closeLuaState(L)
+		if dataScript, err = ac.luaData(w, req, luafilename, L, r); err != nil {
+			luadata, _ := ioutil.ReadFile(luafilename)
+			return nil, &ssrError{err, luafilename, luadata, "lua"}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), ssrTimeout)
+	defer cancel()
+	html, err := r.RenderHyperApp(ctx, filename, []byte(script))
+	if err != nil {
+		// The line numbers refer to the converted script
+		return nil, &ssrError{err, filename, []byte(script), "javascript"}
+	}
+
+	data := []byte(html + "<script>" + dataScript + "</script>")
+	if cached {
+		ac.ssrMut.Lock()
+		ac.ssrCache[filename] = ssrEntry{version, datablock.NewDataBlock(data, true)}
+		ac.ssrMut.Unlock()
+	}
+	return data, nil
+}
+
+// ssrError is an error from rendering a page on the server, together with
+// the file and the source code that the error refers to
+type ssrError struct {
+	err      error
+	filename string
+	source   []byte
+	lang     string
+}
+
+func (e *ssrError) Error() string {
+	return e.err.Error()
+}
@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/xyproto/algernon/lua/transpile"
+	"github.com/xyproto/gopher-lua"
+)
+
+// newCompiler returns a compiler for Fennel and MoonScript files, that looks
+// for fennel.lua in the server directory and the lib directory first
+func (ac *Config) newCompiler() *transpile.Compiler {
+	return transpile.New(ac.serverDirOrFilename, filepath.Join(ac.serverDirOrFilename, "lib"))
+}
+
+// isLuaScript checks if the given file is a Lua script, or a Fennel or
+// MoonScript file that can be compiled to Lua
+func isLuaScript(filename string) bool {
+	return filepath.Ext(filename) == ".lua" || transpile.Supported(filename)
+}
+
+// doFile runs the given Lua, Fennel or MoonScript file in the given Lua state.
+// Fennel and MoonScript files are compiled to Lua first, and compilation errors
+// are returned as *transpile.Error. Server-side JavaScript files are run with
+// the functions of the Lua state.
+func (ac *Config) doFile(L *lua.LState, filename string) error {
+	if isServerJS(filename) {
+		return ac.runJS(L, filename)
+	}
+	if !transpile.Supported(filename) {
+		return L.DoFile(filename)
+	}
+	code, err := ac.compiler.Compile(filename)
+	if err != nil {
+		return err
+	}
+	fn, err := L.Load(bytes.NewReader(code), filename)
+	if err != nil {
+		return err
+	}
+	L.Push(fn)
+	return L.PCall(0, lua.MultRet, nil)
+}
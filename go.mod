@@ -8,12 +8,16 @@ require (
 	github.com/eknkc/amber v0.0.0-20171010120322-cdade1c07385
 	github.com/flosch/pongo2 v0.0.0-20181225140029-79872a7b2769
 	github.com/go-gcfg/gcfg v1.2.3
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/go-sourcemap/sourcemap v2.1.2+incompatible // indirect
 	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/jvatic/goja-babel v0.0.0-20170714233534-00569a238089
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/lucas-clemente/quic-go v0.11.0
 	github.com/mattetti/filebuffer v1.0.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/mitchellh/mapstructure v1.1.2 // indirect
@@ -25,8 +29,10 @@ require (
 	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24 // indirect
 	github.com/sirupsen/logrus v1.4.1
 	github.com/stvp/assert v0.0.0-20170616060220-4bc16443988b // indirect
+	github.com/syndtr/goleveldb v1.0.1-0.20190318030020-c3a204f8e965
 	github.com/tylerb/graceful v1.2.15
 	github.com/wellington/sass v0.0.0-20160911051022-cab90b3986d6
+	github.com/xyproto/cookie v0.0.0-20181220103240-f4de411f45ff
 	github.com/xyproto/datablock v0.0.0-20180830133147-8c3914e5c4fe
 	github.com/xyproto/gluamapper v0.0.0-20190219142928-9e3518c991d4
 	github.com/xyproto/gopher-lua v0.0.0-20190220202711-e72dfa319174
@@ -41,16 +47,18 @@ require (
 	github.com/xyproto/recwatch v0.0.0-20190124180410-f96d3a80bdf1
 	github.com/xyproto/sheepcounter v1.6.0
 	github.com/xyproto/simplebolt v0.0.0-20190219145457-752add4550da
-	github.com/xyproto/simplehstore v0.0.0-20181004171731-44c8a3a3ce5e // indirect
+	github.com/xyproto/simplehstore v0.0.0-20181004171731-44c8a3a3ce5e
+	github.com/xyproto/simplemaria v0.0.0-20181211083039-d325ae02395a
 	github.com/xyproto/simpleredis v0.0.0-20181004131423-f2c3a2cf62d0
 	github.com/xyproto/splash v0.0.0-20190405073251-f213b9090528
 	github.com/xyproto/term v0.3.0
 	github.com/xyproto/unzip v0.0.0-20150601123358-823950573952
 	github.com/yosssi/gcss v0.1.0
-	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5 // indirect
+	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5
 	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
 	google.golang.org/appengine v1.5.0 // indirect
 	gopkg.in/gcfg.v1 v1.2.3 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
+	rsc.io/qr v0.2.0
 )
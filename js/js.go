@@ -0,0 +1,396 @@
+// Package js provides JavaScript runtimes for server-side scripts, where the
+// functions of a Lua state can be called as if they were JavaScript functions
+package js
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The property that refers to the Lua userdata, for objects that wrap userdata
+const userdataKey = "__userdata"
+
+// How deeply nested tables and objects can be when converting between Lua and JavaScript
+const maxDepth = 64
+
+// Functions from the Lua base library, that have JavaScript equivalents or
+// that only make sense in Lua
+var luaOnly = map[string]bool{
+	"_printregs": true, "assert": true, "collectgarbage": true, "dofile": true,
+	"error": true, "getfenv": true, "getmetatable": true, "ipairs": true,
+	"load": true, "loadfile": true, "loadstring": true, "module": true,
+	"newproxy": true, "next": true, "pairs": true, "pcall": true,
+	"rawequal": true, "rawget": true, "rawlen": true, "rawset": true,
+	"require": true, "select": true, "setfenv": true, "setmetatable": true,
+	"tonumber": true, "tostring": true, "type": true, "unpack": true,
+	"xpcall": true,
+}
+
+var (
+	// The types that goja exports plain objects and arrays as
+	objectType = reflect.TypeOf(map[string]interface{}{})
+	arrayType  = reflect.TypeOf([]interface{}{})
+
+	// The position of a stack frame in a goja error message
+	framePosition = regexp.MustCompile(`:(\d+):\d+\(\d+\)`)
+
+	// The position in an error message from the parser
+	parserPosition = regexp.MustCompile(`Line (\d+):\d+ `)
+)
+
+// Error is an error from a JavaScript file
+type Error struct {
+	Filename string
+	Line     int // 0 if the line is not known
+	Message  string
+}
+
+// Error returns the error message on the same form as Lua errors, with the
+// filename and line number first
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Filename, e.Line, e.Message)
+}
+
+// newError returns an *Error with the line number in the given file that the
+// error from goja refers to, if possible
+func newError(filename string, err error) error {
+	switch e := err.(type) {
+	case *goja.CompilerSyntaxError:
+		return &Error{filename, compilerLine(e.CompilerError), "SyntaxError: " + e.Message}
+	case *goja.CompilerReferenceError:
+		return &Error{filename, compilerLine(e.CompilerError), "ReferenceError: " + e.Message}
+	case *goja.InterruptedError:
+		return &Error{filename, frameLine(filename, e.String()), fmt.Sprint(e.Value())}
+	case *goja.Exception:
+		return &Error{filename, frameLine(filename, e.String()), e.Value().String()}
+	}
+	return err
+}
+
+// compilerLine returns the line number of a compilation error, or 0
+func compilerLine(e goja.CompilerError) int {
+	if e.File != nil {
+		return e.File.Position(e.Offset).Line
+	}
+	if m := parserPosition.FindStringSubmatch(e.Message); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	return 0
+}
+
+// frameLine returns the line number of the first stack frame in the given
+// file, or 0
+func frameLine(filename, stack string) int {
+	for _, line := range strings.Split(stack, "\n") {
+		if !strings.Contains(line, filename+":") {
+			continue
+		}
+		if m := framePosition.FindStringSubmatch(line[strings.Index(line, filename+":"):]); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// Runtime is a JavaScript runtime where the global functions of a Lua state
+// are available. Lua tables are converted to JavaScript objects and arrays,
+// and userdata to objects with the methods of the userdata.
+type Runtime struct {
+	VM          *goja.Runtime
+	L           *lua.LState
+	names       map[string]bool // global functions from the Lua state
+	native      map[string]bool // global functions that are set with Set
+	interrupted bool            // if the runtime may have been interrupted
+}
+
+// New returns a new JavaScript runtime
+func New() *Runtime {
+	return &Runtime{VM: goja.New(), names: make(map[string]bool), native: make(map[string]bool)}
+}
+
+// Load makes the global functions of the given Lua state available as
+// JavaScript functions, except for the functions from the Lua base library
+// that only make sense in Lua. Functions from a Lua state that was loaded
+// earlier are removed. The functions look up the Lua function when they are
+// called, so functions that are replaced in the Lua state are also replaced
+// in JavaScript.
+func (r *Runtime) Load(L *lua.LState) {
+	r.L = L
+	current := make(map[string]bool)
+	L.G.Global.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok || luaOnly[string(name)] || r.native[string(name)] {
+			return
+		}
+		if _, ok := value.(*lua.LFunction); ok {
+			current[string(name)] = true
+		}
+	})
+	for name := range r.names {
+		if !current[name] {
+			r.VM.Set(name, goja.Undefined())
+			delete(r.names, name)
+		}
+	}
+	for name := range current {
+		if r.names[name] {
+			continue
+		}
+		name := name
+		r.VM.Set(name, func(call goja.FunctionCall) goja.Value {
+			fn, ok := r.L.GetGlobal(name).(*lua.LFunction)
+			if !ok {
+				panic(r.VM.NewTypeError(name + " is not a function"))
+			}
+			return r.call(fn, r.arguments(nil, call.Arguments))
+		})
+		r.names[name] = true
+	}
+}
+
+// Set sets a global value in the JavaScript runtime, that is kept when a
+// Lua state is loaded
+func (r *Runtime) Set(name string, value interface{}) {
+	r.native[name] = true
+	delete(r.names, name)
+	r.VM.Set(name, value)
+}
+
+// Run runs the given JavaScript source code. If the context is done before
+// the script has finished, the script is interrupted. Errors that refer to
+// the script are returned as *Error.
+func (r *Runtime) Run(ctx context.Context, filename string, source []byte) error {
+	_, err := r.run(ctx, filename, source)
+	return err
+}
+
+// run runs the given JavaScript source code and returns the result
+func (r *Runtime) run(ctx context.Context, filename string, source []byte) (goja.Value, error) {
+	if ctx != nil {
+		finished := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				r.VM.Interrupt(ctx.Err())
+				r.interrupted = true
+			case <-finished:
+			}
+		}()
+		defer func() {
+			close(finished)
+			<-stopped
+		}()
+	}
+	result, err := r.VM.RunScript(filename, string(source))
+	if err != nil {
+		return nil, newError(filename, err)
+	}
+	return result, nil
+}
+
+// Call calls a JavaScript function with the given Lua values as arguments,
+// and returns the result as a Lua value
+func (r *Runtime) Call(fn goja.Callable, args ...lua.LValue) (lua.LValue, error) {
+	values := make([]goja.Value, len(args))
+	for i, arg := range args {
+		values[i] = r.ToJS(arg)
+	}
+	result, err := fn(goja.Undefined(), values...)
+	if err != nil {
+		return lua.LNil, err
+	}
+	return r.ToLua(result), nil
+}
+
+// arguments converts JavaScript arguments to Lua values, after the given
+// first value, if any
+func (r *Runtime) arguments(first lua.LValue, args []goja.Value) []lua.LValue {
+	var values []lua.LValue
+	if first != nil {
+		values = append(values, first)
+	}
+	for _, arg := range args {
+		values = append(values, r.ToLua(arg))
+	}
+	return values
+}
+
+// call calls a Lua function and returns the result. Multiple results are
+// returned as an array. Lua errors are thrown as JavaScript errors.
+func (r *Runtime) call(fn *lua.LFunction, args []lua.LValue) goja.Value {
+	L := r.L
+	top := L.GetTop()
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(args), lua.MultRet, nil); err != nil {
+		L.SetTop(top)
+		panic(r.VM.NewGoError(err))
+	}
+	results := make([]goja.Value, L.GetTop()-top)
+	for i := range results {
+		results[i] = r.ToJS(L.Get(top + 1 + i))
+	}
+	L.SetTop(top)
+	switch len(results) {
+	case 0:
+		return goja.Undefined()
+	case 1:
+		return results[0]
+	}
+	return r.newArray(results)
+}
+
+// newArray returns a JavaScript array with the given values
+func (r *Runtime) newArray(values []goja.Value) goja.Value {
+	arrayFunction, _ := goja.AssertFunction(r.VM.Get("Array"))
+	array, err := arrayFunction(goja.Undefined())
+	if err != nil {
+		panic(err)
+	}
+	obj := array.ToObject(r.VM)
+	for i, value := range values {
+		obj.Set(strconv.Itoa(i), value)
+	}
+	return obj
+}
+
+// ToJS converts a Lua value to a JavaScript value
+func (r *Runtime) ToJS(value lua.LValue) goja.Value {
+	return r.toJS(value, 0)
+}
+
+func (r *Runtime) toJS(value lua.LValue, depth int) goja.Value {
+	if depth > maxDepth {
+		return goja.Null()
+	}
+	switch v := value.(type) {
+	case lua.LBool:
+		return r.VM.ToValue(bool(v))
+	case lua.LNumber:
+		return r.VM.ToValue(float64(v))
+	case lua.LString:
+		return r.VM.ToValue(string(v))
+	case *lua.LTable:
+		count := 0
+		v.ForEach(func(_, _ lua.LValue) {
+			count++
+		})
+		if n := v.MaxN(); n > 0 && n == count {
+			values := make([]goja.Value, n)
+			for i := range values {
+				values[i] = r.toJS(v.RawGetInt(i+1), depth+1)
+			}
+			return r.newArray(values)
+		}
+		obj := r.VM.NewObject()
+		v.ForEach(func(key, value lua.LValue) {
+			obj.Set(key.String(), r.toJS(value, depth+1))
+		})
+		return obj
+	case *lua.LFunction:
+		return r.VM.ToValue(func(call goja.FunctionCall) goja.Value {
+			return r.call(v, r.arguments(nil, call.Arguments))
+		})
+	case *lua.LUserData:
+		return r.userdata(v)
+	case *lua.LNilType:
+		return goja.Null()
+	}
+	return r.VM.ToValue(value.String())
+}
+
+// userdata returns a JavaScript object with the methods of the given userdata
+func (r *Runtime) userdata(ud *lua.LUserData) goja.Value {
+	obj := r.VM.NewObject()
+	obj.DefineDataProperty(userdataKey, r.VM.ToValue(ud), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_FALSE)
+	mt, ok := ud.Metatable.(*lua.LTable)
+	if !ok {
+		return obj
+	}
+	method := func(fn *lua.LFunction) func(goja.FunctionCall) goja.Value {
+		return func(call goja.FunctionCall) goja.Value {
+			return r.call(fn, r.arguments(ud, call.Arguments))
+		}
+	}
+	if methods, ok := mt.RawGetString("__index").(*lua.LTable); ok {
+		methods.ForEach(func(key, value lua.LValue) {
+			if fn, ok := value.(*lua.LFunction); ok {
+				obj.Set(key.String(), method(fn))
+			}
+		})
+	}
+	if fn, ok := mt.RawGetString("__tostring").(*lua.LFunction); ok {
+		obj.Set("toString", method(fn))
+	}
+	return obj
+}
+
+// ToLua converts a JavaScript value to a Lua value
+func (r *Runtime) ToLua(value goja.Value) lua.LValue {
+	return r.toLua(value, 0)
+}
+
+func (r *Runtime) toLua(value goja.Value, depth int) lua.LValue {
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) || depth > maxDepth {
+		return lua.LNil
+	}
+	obj, ok := value.(*goja.Object)
+	if !ok {
+		switch v := value.Export().(type) {
+		case bool:
+			return lua.LBool(v)
+		case int64:
+			return lua.LNumber(v)
+		case float64:
+			return lua.LNumber(v)
+		}
+		return lua.LString(value.String())
+	}
+	if v := obj.Get(userdataKey); v != nil {
+		if ud, ok := v.Export().(*lua.LUserData); ok {
+			return ud
+		}
+	}
+	if fn, ok := goja.AssertFunction(obj); ok {
+		return r.L.NewFunction(func(L *lua.LState) int {
+			args := make([]lua.LValue, L.GetTop())
+			for i := range args {
+				args[i] = L.Get(i + 1)
+			}
+			result, err := r.Call(fn, args...)
+			if err != nil {
+				L.RaiseError("%s", err)
+			}
+			L.Push(result)
+			return 1 // number of results
+		})
+	}
+	table := r.L.NewTable()
+	switch obj.ExportType() {
+	case arrayType:
+		n := int(obj.Get("length").ToInteger())
+		for i := 0; i < n; i++ {
+			table.RawSetInt(i+1, r.toLua(obj.Get(strconv.Itoa(i)), depth+1))
+		}
+	case objectType:
+		for _, key := range obj.Keys() {
+			table.RawSetString(key, r.toLua(obj.Get(key), depth+1))
+		}
+	default:
+		return lua.LString(obj.String())
+	}
+	return table
+}
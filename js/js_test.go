@@ -0,0 +1,173 @@
+package js
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// newLuaState returns a Lua state with a few functions for testing
+func newLuaState(t *testing.T, output *[]string) *lua.LState {
+	L := lua.NewState()
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		*output = append(*output, L.ToString(1))
+		return 0 // number of results
+	}))
+	mt := L.NewTypeMetatable("Counter")
+	mt.RawSetString("__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"add": func(L *lua.LState) int {
+			ud := L.CheckUserData(1)
+			ud.Value = ud.Value.(int) + L.CheckInt(2)
+			return 0 // number of results
+		},
+		"get": func(L *lua.LState) int {
+			L.Push(lua.LNumber(L.CheckUserData(1).Value.(int)))
+			return 1 // number of results
+		},
+	}))
+	assert.Equal(t, L.DoString(`
+		function Counter() return makecounter() end
+		function sum(xs)
+			local total = 0
+			for _, x in ipairs(xs) do total = total + x end
+			return total
+		end
+		function info() return {name = "algernon", tags = {"a", "b"}} end
+		function pair() return nil, "oops" end
+		function fail() error("failed") end
+		function apply(f, x) return f(x) end
+		function same(x) return x end
+	`), nil)
+	L.SetGlobal("makecounter", L.NewFunction(func(L *lua.LState) int {
+		ud := L.NewUserData()
+		ud.Value = 0
+		L.SetMetatable(ud, L.GetTypeMetatable("Counter"))
+		L.Push(ud)
+		return 1 // number of results
+	}))
+	return L
+}
+
+func TestLuaFunctions(t *testing.T) {
+	var output []string
+	L := newLuaState(t, &output)
+	defer L.Close()
+
+	r := New()
+	r.Load(L)
+	assert.Equal(t, r.Run(nil, "test.server.js", []byte(`
+		print("hello " + sum([1, 2, 3]));
+		var i = info();
+		print(i.name + " " + i.tags.length + " " + i.tags[1]);
+		var p = pair();
+		print(p[0] === null ? p[1] : "no");
+		var c = Counter();
+		c.add(2);
+		c.add(3);
+		print("count " + c.get());
+		print(same(c) === undefined ? "lost" : "count " + same(c).get());
+		print("applied " + apply(function (x) { return x * 2; }, 21));
+		try {
+			fail();
+		} catch (e) {
+			print("caught " + (String(e).indexOf("failed") >= 0));
+		}
+		print(typeof pairs);
+	`)), nil)
+	assert.Equal(t, output, []string{
+		"hello 6",
+		"algernon 2 b",
+		"oops",
+		"count 5",
+		"count 5",
+		"applied 42",
+		"caught true",
+		"undefined",
+	})
+
+	// Functions from an earlier Lua state are removed
+	L2 := lua.NewState()
+	defer L2.Close()
+	r.Load(L2)
+	assert.Equal(t, r.Run(nil, "test.server.js", []byte(`
+		if (typeof sum !== "undefined") {
+			throw new Error("sum is still defined");
+		}
+	`)), nil)
+}
+
+func TestErrors(t *testing.T) {
+	r := New()
+	L := lua.NewState()
+	defer L.Close()
+	r.Load(L)
+
+	err := r.Run(nil, "broken.server.js", []byte("var x = 1;\nvar y = ;\n"))
+	jsErr, ok := err.(*Error)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, jsErr.Line, 2)
+
+	err = r.Run(nil, "thrown.server.js", []byte("var x = 1;\n\nundefinedFunction();\n"))
+	jsErr, ok = err.(*Error)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, jsErr.Line, 3)
+	assert.Equal(t, err.Error()[:len("thrown.server.js:3: ")], "thrown.server.js:3: ")
+}
+
+func TestInterrupt(t *testing.T) {
+	p := NewPool()
+	r := p.Get()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := r.Run(ctx, "loop.server.js", []byte("while (true) {}"))
+	_, ok := err.(*Error)
+	assert.Equal(t, ok, true)
+
+	// An interrupted runtime is not reused
+	p.Put(r)
+	assert.NotEqual(t, p.Get(), r)
+
+	// A runtime that finished in time is reused
+	r = p.Get()
+	assert.Equal(t, r.Run(context.Background(), "ok.server.js", []byte("1 + 1")), nil)
+	p.Put(r)
+	assert.Equal(t, p.Get(), r)
+}
+
+func TestRenderHyperApp(t *testing.T) {
+	r := New()
+	r.VM.Set("title", "<Hi>")
+	html, err := r.RenderHyperApp(context.Background(), "index.hyper.jsx", []byte(`import { h, app } from "hyperapp"
+app({
+  state: { count: 2, items: ["a", "b"] },
+  view: function (state, actions) {
+    return h("main", { id: "app", onclick: actions.up, style: { fontSize: "2em" } },
+      h("h1", null, title),
+      h("button", { disabled: state.count <= 0 }, "-"),
+      h("input", { checked: true }),
+      state.items.map(function (item) { return h("b", { key: item }, item); }),
+      state.count);
+  },
+  actions: { up: function (state) { return { count: state.count + 1 }; } }
+});`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, html, `<main id="app" style="font-size:2em"><h1>&lt;Hi&gt;</h1><button>-</button><input checked><b>a</b><b>b</b>2</main>`)
+
+	// Scripts that do not start an app render nothing
+	html, err = New().RenderHyperApp(context.Background(), "empty.hyper.js", []byte(`var x = 1;`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, html, "")
+
+	// Errors refer to the lines of the script
+	_, err = New().RenderHyperApp(context.Background(), "broken.hyper.js", []byte("import { h, app } from 'hyperapp'\n\nmissing();\n"))
+	jsErr, ok := err.(*Error)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, jsErr.Line, 3)
+
+	json, err := r.JSON(r.VM.ToValue("</script>"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, json, `"<\/script>"`)
+}
@@ -0,0 +1,43 @@
+package js
+
+import (
+	"sync"
+)
+
+// The same pool pattern as for Lua states, in lua/pool
+
+// Pool is a pool of JavaScript runtimes, with a mutex
+type Pool struct {
+	m     sync.Mutex
+	saved []*Runtime
+}
+
+// NewPool returns a new pool of JavaScript runtimes
+func NewPool() *Pool {
+	return &Pool{saved: make([]*Runtime, 0, 4)}
+}
+
+// Get borrows an existing JavaScript runtime, or returns a new one
+func (p *Pool) Get() *Runtime {
+	p.m.Lock()
+	defer p.m.Unlock()
+	n := len(p.saved)
+	if n == 0 {
+		return New()
+	}
+	r := p.saved[n-1]
+	p.saved = p.saved[:n-1]
+	return r
+}
+
+// Put delivers back a borrowed JavaScript runtime. Runtimes that may have
+// been interrupted are not reused.
+func (p *Pool) Put(r *Runtime) {
+	if r.interrupted {
+		return
+	}
+	r.L = nil
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.saved = append(p.saved, r)
+}
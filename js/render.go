@@ -0,0 +1,153 @@
+package js
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// The name of the JavaScript function that renders the view of the app
+const renderFunction = "__algernon_render"
+
+// A minimal replacement for HyperApp and the DOM, for rendering the view of
+// an app to HTML. h works like the h function in HyperApp. app only keeps the
+// state, actions and view, since nothing is mounted on the server.
+const hyperAppShim = `
+var __algernon_app = null;
+
+var hyperapp = {
+  h: function (type, props) {
+    var children = [], stack = [];
+    for (var i = arguments.length - 1; i >= 2; i--) {
+      stack.push(arguments[i]);
+    }
+    while (stack.length) {
+      var child = stack.pop();
+      if (Array.isArray(child)) {
+        for (var j = child.length - 1; j >= 0; j--) {
+          stack.push(child[j]);
+        }
+      } else if (child != null && child !== true && child !== false) {
+        children.push(typeof child === "number" ? child + "" : child);
+      }
+    }
+    return typeof type === "string" ? { type: type, props: props || {}, children: children } : type(props || {}, children);
+  },
+  app: function (props) {
+    __algernon_app = props;
+    return {};
+  }
+};
+
+var React = { createElement: hyperapp.h };
+
+var document = {
+  body: null,
+  getElementById: function () { return null; },
+  querySelector: function () { return null; }
+};
+
+var window = { document: document, location: { href: "", pathname: "", search: "", hash: "" } };
+
+function requestAnimationFrame() {}
+
+function setTimeout() {}
+
+function setInterval() {}
+
+var renderToString = (function () {
+  var voidElements = { area: 1, base: 1, br: 1, col: 1, embed: 1, hr: 1, img: 1, input: 1, link: 1, meta: 1, param: 1, source: 1, track: 1, wbr: 1 };
+
+  function escape(s) {
+    return String(s).replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/"/g, "&quot;");
+  }
+
+  function style(value) {
+    return Object.keys(value).map(function (key) {
+      return key.replace(/[A-Z]/g, function (c) { return "-" + c.toLowerCase(); }) + ":" + value[key];
+    }).join(";");
+  }
+
+  function render(node) {
+    if (node == null || node === true || node === false) {
+      return "";
+    }
+    if (typeof node !== "object") {
+      return escape(node);
+    }
+    if (Array.isArray(node)) {
+      return node.map(render).join("");
+    }
+    var html = "<" + node.type, props = node.props || {};
+    for (var name in props) {
+      var value = props[name];
+      if (name === "key" || /^on/.test(name) || typeof value === "function" || value == null || value === false) {
+        continue;
+      }
+      if (name === "style" && typeof value === "object") {
+        value = style(value);
+      }
+      html += " " + (name === "className" ? "class" : name) + (value === true ? "" : "=\"" + escape(value) + "\"");
+    }
+    if (voidElements[node.type]) {
+      return html + ">";
+    }
+    return html + ">" + (node.children || []).map(render).join("") + "</" + node.type + ">";
+  }
+
+  return render;
+})();
+
+function ` + renderFunction + `() {
+  var props = __algernon_app;
+  if (!props || typeof props.view !== "function") {
+    return "";
+  }
+  function wire(actions) {
+    var wired = {};
+    for (var name in actions || {}) {
+      wired[name] = typeof actions[name] === "function" ? function () {} : wire(actions[name]);
+    }
+    return wired;
+  }
+  return renderToString(props.view(props.state || {}, wire(props.actions)));
+}
+`
+
+// Imports of HyperApp, that are replaced by the shim
+var hyperAppImport = regexp.MustCompile(`(?m)^[ \t]*import[ \t]+[^;\n]*[ \t]+from[ \t]+['"]hyperapp['"];?[ \t]*$`)
+
+// RenderHyperApp runs a HyperApp script, where JSX has been converted to
+// ES5 JavaScript, and returns the view of the app with the initial state as
+// HTML. Event handlers are left out, since they are added when the app is
+// started in the browser. Returns an empty string if the script does not
+// start an app. If the context is done before the script has finished, the
+// script is interrupted. Errors that refer to the script are returned as *Error.
+func (r *Runtime) RenderHyperApp(ctx context.Context, filename string, script []byte) (string, error) {
+	if _, err := r.VM.RunScript("hyperapp.js", hyperAppShim); err != nil {
+		return "", err
+	}
+	// Keep the line numbers of the script
+	source := append([]byte("var h = hyperapp.h, app = hyperapp.app; "), hyperAppImport.ReplaceAll(script, nil)...)
+	source = append(source, []byte("\n;"+renderFunction+"()")...)
+	result, err := r.run(ctx, filename, source)
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// JSON returns the given value as JSON that can be placed within a <script> tag
+func (r *Runtime) JSON(value goja.Value) (string, error) {
+	stringify, _ := goja.AssertFunction(r.VM.Get("JSON").ToObject(r.VM).Get("stringify"))
+	result, err := stringify(goja.Undefined(), value)
+	if err != nil {
+		return "", err
+	}
+	if goja.IsUndefined(result) {
+		return "null", nil
+	}
+	return strings.Replace(result.String(), "</", "<\\/", -1), nil
+}
@@ -0,0 +1,232 @@
+// Package jsonfile provides JSON documents that are stored in files, and can
+// be changed safely by several requests or processes at the same time
+package jsonfile
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/jpath"
+)
+
+// File is a JSON document in a file. Every change is made while the file
+// is locked, to the latest version of the file, and the file is replaced
+// in a single step, so that the file is never partially written.
+type File struct {
+	filename string
+	perm     os.FileMode
+	schema   *Schema // may be nil
+	onChange func(data []byte)
+}
+
+// The process-wide locks, per filename
+var (
+	locks    = make(map[string]*sync.Mutex)
+	locksMut sync.Mutex
+)
+
+// New returns a File for the given filename. If the file does not exist, it
+// is created with an empty list, or an empty map if the schema requires it.
+// The schema can be nil.
+func New(filename string, perm os.FileMode, schema *Schema) (*File, error) {
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{absFilename, perm, schema, nil}
+	if _, err := os.Stat(absFilename); os.IsNotExist(err) {
+		empty := "[]\n"
+		if schema != nil && schema.Type() == "object" {
+			empty = "{}\n"
+		}
+		unlock, err := f.lock()
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		// Check again, now that the file is locked
+		if _, err := os.Stat(absFilename); os.IsNotExist(err) {
+			if err := f.write([]byte(empty)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+// Filename returns the absolute path to the file
+func (f *File) Filename() string {
+	return f.filename
+}
+
+// OnChange sets a function that is called with the new JSON document,
+// after every change
+func (f *File) OnChange(fn func(data []byte)) {
+	f.onChange = fn
+}
+
+// lock locks the file, both for this process and for other processes, where supported
+func (f *File) lock() (func(), error) {
+	locksMut.Lock()
+	mut, ok := locks[f.filename]
+	if !ok {
+		mut = &sync.Mutex{}
+		locks[f.filename] = mut
+	}
+	locksMut.Unlock()
+	mut.Lock()
+	unlockFile, err := lockFile(f.filename)
+	if err != nil {
+		mut.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile()
+		mut.Unlock()
+	}, nil
+}
+
+// write replaces the contents of the file by writing to a temporary file in
+// the same directory and then renaming it
+func (f *File) write(data []byte) error {
+	dir, base := filepath.Split(f.filename)
+	tmp, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	tmpFilename := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := os.Chmod(tmpFilename, f.perm); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := os.Rename(tmpFilename, f.filename); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return nil
+}
+
+// Node reads the JSON document. Since the file is always replaced in a
+// single step, reading does not require the file to be locked.
+func (f *File) Node() (*jpath.Node, error) {
+	data, err := ioutil.ReadFile(f.filename)
+	if err != nil {
+		return nil, err
+	}
+	return jpath.New(data)
+}
+
+// JSON returns the JSON document, indented
+func (f *File) JSON() ([]byte, error) {
+	root, err := f.Node()
+	if err != nil {
+		return nil, err
+	}
+	return root.PrettyJSON()
+}
+
+// Validate checks the JSON document against the schema, if there is one
+func (f *File) Validate() error {
+	if f.schema == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.filename)
+	if err != nil {
+		return err
+	}
+	return f.schema.ValidateJSON(data)
+}
+
+// Update locks the file, reads the JSON document and lets the given function
+// change it. If the function returns nil and the changed document is valid
+// according to the schema, the file is replaced with the changed document.
+func (f *File) Update(change func(root *jpath.Node) error) error {
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	root, err := f.Node()
+	if err != nil {
+		return err
+	}
+	if err := change(root); err != nil {
+		return err
+	}
+	data, err := root.PrettyJSON()
+	if err != nil {
+		return err
+	}
+	if f.schema != nil {
+		// The nodes that have been added are not decoded, so encode and
+		// decode the document before checking it
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		if err := f.schema.Validate(doc); err != nil {
+			return err
+		}
+	}
+	if err := f.write(append(data, '\n')); err != nil {
+		return err
+	}
+	if f.onChange != nil {
+		f.onChange(data)
+	}
+	return nil
+}
+
+// SetString changes the value of the key that the JSON path points to
+func (f *File) SetString(JSONpath, value string) error {
+	return f.Update(func(root *jpath.Node) error {
+		_, parent, err := root.GetNodes(JSONpath)
+		if err != nil {
+			return err
+		}
+		m, ok := parent.CheckMap()
+		if !ok {
+			return errors.New("Parent is not a map: " + JSONpath)
+		}
+		m[lastpart(JSONpath)] = value
+		return nil
+	})
+}
+
+// AddJSON adds JSON data to the list that the JSON path points to
+func (f *File) AddJSON(JSONpath string, JSONdata []byte) error {
+	return f.Update(func(root *jpath.Node) error {
+		return root.AddJSON(JSONpath, JSONdata)
+	})
+}
+
+// DelKey removes a key from the map that the JSON path points to
+func (f *File) DelKey(JSONpath string) error {
+	return f.Update(func(root *jpath.Node) error {
+		return root.DelKey(JSONpath)
+	})
+}
+
+// Return the last part of a JSON path, which is the key
+func lastpart(JSONpath string) string {
+	return JSONpath[strings.LastIndex(JSONpath, ".")+1:]
+}
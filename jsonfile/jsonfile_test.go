@@ -0,0 +1,148 @@
+package jsonfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+const testSchema = `{
+  "type": "object",
+  "required": ["name"],
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "age": {"type": "string", "pattern": "^[0-9]+$"},
+    "tags": {"type": "array", "items": {"$ref": "#/definitions/tag"}, "uniqueItems": true}
+  },
+  "additionalProperties": false,
+  "definitions": {
+    "tag": {"type": "string", "enum": ["red", "green", "blue"]}
+  }
+}`
+
+func TestSchema(t *testing.T) {
+	schema, err := NewSchema([]byte(testSchema))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, schema.Type(), "object")
+
+	valid := []string{
+		`{"name": "Bob"}`,
+		`{"name": "Bob", "age": "42", "tags": ["red", "blue"]}`,
+	}
+	for _, doc := range valid {
+		assert.Equal(t, schema.ValidateJSON([]byte(doc)), nil)
+	}
+
+	invalid := map[string]string{
+		`[]`:                                "x: expected object, got array",
+		`{"age": "42"}`:                     `x: the key "name" is required`,
+		`{"name": ""}`:                      "x.name: must be at least 1 characters long",
+		`{"name": "Bob", "age": "old"}`:     "x.age: does not match the pattern ^[0-9]+$",
+		`{"name": "Bob", "tags": ["pink"]}`: "x.tags[0]: the value is not one of the allowed values",
+		`{"name": "Bob", "tags": ["red", "red"]}`: "x.tags[1]: the items must be unique",
+		`{"name": "Bob", "color": "red"}`:         `x: the key "color" is not allowed`,
+	}
+	for doc, message := range invalid {
+		err := schema.ValidateJSON([]byte(doc))
+		assert.NotEqual(t, err, nil)
+		assert.Equal(t, err.Error(), message)
+	}
+
+	schema, err = NewSchema([]byte(`{"type": "integer", "minimum": 1, "exclusiveMaximum": 10, "multipleOf": 3}`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, schema.Validate(6.0), nil)
+	assert.NotEqual(t, schema.Validate(2.5), nil)
+	assert.NotEqual(t, schema.Validate(0.0), nil)
+	assert.NotEqual(t, schema.Validate(4.0), nil)
+	assert.NotEqual(t, schema.Validate(12.0), nil)
+
+	schema, err = NewSchema([]byte(`{"oneOf": [{"type": "string"}, {"type": "null"}], "not": {"const": "x"}}`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, schema.Validate(nil), nil)
+	assert.Equal(t, schema.Validate("y"), nil)
+	assert.NotEqual(t, schema.Validate("x"), nil)
+	assert.NotEqual(t, schema.Validate(true), nil)
+
+	_, err = NewSchema([]byte(`{"pattern": "("}`))
+	assert.NotEqual(t, err, nil)
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonfile")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	schema, err := NewSchema([]byte(testSchema))
+	assert.Equal(t, err, nil)
+	f, err := New(filepath.Join(dir, "person.json"), 0644, schema)
+	assert.Equal(t, err, nil)
+
+	// A new file gets an empty map, since the schema requires an object
+	data, err := f.JSON()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(data), "{}")
+
+	var changes []string
+	f.OnChange(func(data []byte) {
+		changes = append(changes, string(data))
+	})
+
+	assert.Equal(t, f.SetString("x.name", "Bob"), nil)
+	assert.Equal(t, f.SetString("x.age", "42"), nil)
+
+	// Invalid changes are not written
+	err = f.SetString("x.age", "old")
+	assert.NotEqual(t, err, nil)
+	_, ok := err.(*ValidationError)
+	assert.Equal(t, ok, true)
+	assert.NotEqual(t, f.DelKey("x.name"), nil)
+
+	root, err := f.Node()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, root.Get("name").String(), "Bob")
+	assert.Equal(t, root.Get("age").String(), "42")
+	assert.Equal(t, len(changes), 2)
+	assert.Equal(t, f.Validate(), nil)
+
+	// Only the JSON file is left in the directory, the lock file is kept elsewhere
+	entries, err := ioutil.ReadDir(dir)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(entries), 1)
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonfile")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "list.json")
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each request has its own File, for the same filename
+			f, err := New(filename, 0644, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := f.AddJSON("x", []byte(strconv.Itoa(i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	f, err := New(filename, 0644, nil)
+	assert.Equal(t, err, nil)
+	root, err := f.Node()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(root.List()), n)
+}
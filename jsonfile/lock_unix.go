@@ -0,0 +1,56 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package jsonfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// lockDir returns the directory where the lock files are kept. It is outside
+// of the web root, so that the lock files can not be downloaded, and it is
+// per user, so that other users can not replace the lock files.
+func lockDir() (string, error) {
+	uid := os.Getuid()
+	dir := filepath.Join(os.TempDir(), "algernon-locks-"+strconv.Itoa(uid))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !fi.IsDir() || (ok && int(st.Uid) != uid) {
+		return "", fmt.Errorf("jsonfile: %s is not a directory that belongs to this user", dir)
+	}
+	return dir, nil
+}
+
+// lockFile takes an exclusive lock on the lock file for the given JSON file,
+// which is created if needed, so that other processes can not change the
+// JSON file at the same time
+func lockFile(filename string) (func(), error) {
+	dir, err := lockDir()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(filename))
+	f, err := os.OpenFile(filepath.Join(dir, hex.EncodeToString(sum[:])+".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,483 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a JSON Schema. The validation keywords from draft 4 to draft 7
+// are supported, but references can only point within the same schema.
+type Schema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// ValidationError describes where and how a JSON document does not match a schema
+type ValidationError struct {
+	Path    string // a JSON path, where "x" is the root of the document
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// NewSchema parses a JSON Schema
+func NewSchema(data []byte) (*Schema, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid JSON Schema: %s", err)
+	}
+	s := &Schema{root: root, patterns: make(map[string]*regexp.Regexp)}
+	// Compile the regular expressions in advance, to find errors early
+	if err := s.compile(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadSchema reads and parses a JSON Schema file
+func ReadSchema(filename string) (*Schema, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewSchema(data)
+}
+
+// compile compiles all "pattern" and "patternProperties" regular expressions
+func (s *Schema) compile(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, sub := range v {
+			if pattern, ok := sub.(string); ok && key == "pattern" {
+				if err := s.addPattern(pattern); err != nil {
+					return err
+				}
+				continue
+			}
+			if props, ok := sub.(map[string]interface{}); ok && key == "patternProperties" {
+				for pattern := range props {
+					if err := s.addPattern(pattern); err != nil {
+						return err
+					}
+				}
+			}
+			if err := s.compile(sub); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, sub := range v {
+			if err := s.compile(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) addPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern in JSON Schema: %s", err)
+	}
+	s.patterns[pattern] = re
+	return nil
+}
+
+// Type returns the type that the schema requires for the root of the
+// document, or an empty string if there is no single type
+func (s *Schema) Type() string {
+	if m, ok := s.root.(map[string]interface{}); ok {
+		if t, ok := m["type"].(string); ok {
+			return t
+		}
+	}
+	return ""
+}
+
+// Validate checks a JSON document, as decoded by encoding/json
+func (s *Schema) Validate(doc interface{}) error {
+	return s.validate(s.root, doc, "x")
+}
+
+// ValidateJSON checks a JSON document
+func (s *Schema) ValidateJSON(data []byte) error {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return s.Validate(doc)
+}
+
+// resolve finds the schema that a local reference, like "#/definitions/name", points to
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference in JSON Schema: %s", ref)
+	}
+	current := s.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+		switch c := current.(type) {
+		case map[string]interface{}:
+			current = c[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, fmt.Errorf("invalid reference in JSON Schema: %s", ref)
+			}
+			current = c[i]
+		default:
+			current = nil
+		}
+		if current == nil {
+			return nil, fmt.Errorf("invalid reference in JSON Schema: %s", ref)
+		}
+	}
+	return current, nil
+}
+
+// typeName returns the JSON Schema type of a decoded JSON value
+func typeName(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// hasType checks if the value is of the given JSON Schema type
+func hasType(v interface{}, t string) bool {
+	actual := typeName(v)
+	return actual == t || (t == "number" && actual == "integer")
+}
+
+func number(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func errorf(path, format string, args ...interface{}) error {
+	return &ValidationError{path, fmt.Sprintf(format, args...)}
+}
+
+func index(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+func (s *Schema) validate(schema, v interface{}, path string) error {
+	switch schema := schema.(type) {
+	case bool:
+		if !schema {
+			return errorf(path, "no value is allowed here")
+		}
+		return nil
+	case map[string]interface{}:
+		if ref, ok := schema["$ref"].(string); ok {
+			sub, err := s.resolve(ref)
+			if err != nil {
+				return err
+			}
+			return s.validate(sub, v, path)
+		}
+		for _, check := range []func(map[string]interface{}, interface{}, string) error{
+			s.validateGeneric,
+			s.validateNumber,
+			s.validateString,
+			s.validateArray,
+			s.validateObject,
+			s.validateCombined,
+		} {
+			if err := check(schema, v, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid JSON Schema at %s", path)
+}
+
+// validateGeneric checks "type", "enum" and "const"
+func (s *Schema) validateGeneric(schema map[string]interface{}, v interface{}, path string) error {
+	switch t := schema["type"].(type) {
+	case string:
+		if !hasType(v, t) {
+			return errorf(path, "expected %s, got %s", t, typeName(v))
+		}
+	case []interface{}:
+		var names []string
+		for _, name := range t {
+			if name, ok := name.(string); ok {
+				if hasType(v, name) {
+					names = nil
+					break
+				}
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			return errorf(path, "expected %s, got %s", strings.Join(names, " or "), typeName(v))
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errorf(path, "the value is not one of the allowed values")
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, v) {
+		return errorf(path, "the value is not the allowed value")
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(schema map[string]interface{}, v interface{}, path string) error {
+	f, ok := number(v)
+	if !ok {
+		return nil
+	}
+	if min, ok := number(schema["minimum"]); ok {
+		// Draft 4 has a boolean exclusiveMinimum
+		if schema["exclusiveMinimum"] == true && f <= min {
+			return errorf(path, "%v must be greater than %v", f, min)
+		}
+		if f < min {
+			return errorf(path, "%v must be at least %v", f, min)
+		}
+	}
+	if min, ok := number(schema["exclusiveMinimum"]); ok && f <= min {
+		return errorf(path, "%v must be greater than %v", f, min)
+	}
+	if max, ok := number(schema["maximum"]); ok {
+		if schema["exclusiveMaximum"] == true && f >= max {
+			return errorf(path, "%v must be less than %v", f, max)
+		}
+		if f > max {
+			return errorf(path, "%v must be at most %v", f, max)
+		}
+	}
+	if max, ok := number(schema["exclusiveMaximum"]); ok && f >= max {
+		return errorf(path, "%v must be less than %v", f, max)
+	}
+	if m, ok := number(schema["multipleOf"]); ok && m > 0 {
+		if q := f / m; q != math.Trunc(q) {
+			return errorf(path, "%v must be a multiple of %v", f, m)
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateString(schema map[string]interface{}, v interface{}, path string) error {
+	str, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	length := float64(utf8.RuneCountInString(str))
+	if min, ok := number(schema["minLength"]); ok && length < min {
+		return errorf(path, "must be at least %v characters long", min)
+	}
+	if max, ok := number(schema["maxLength"]); ok && length > max {
+		return errorf(path, "must be at most %v characters long", max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok && !s.patterns[pattern].MatchString(str) {
+		return errorf(path, "does not match the pattern %s", pattern)
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(schema map[string]interface{}, v interface{}, path string) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	length := float64(len(list))
+	if min, ok := number(schema["minItems"]); ok && length < min {
+		return errorf(path, "must have at least %v items", min)
+	}
+	if max, ok := number(schema["maxItems"]); ok && length > max {
+		return errorf(path, "must have at most %v items", max)
+	}
+	if schema["uniqueItems"] == true {
+		for i := range list {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(list[i], list[j]) {
+					return errorf(index(path, i), "the items must be unique")
+				}
+			}
+		}
+	}
+	switch items := schema["items"].(type) {
+	case []interface{}:
+		// A schema per position, and "additionalItems" for the rest
+		for i, value := range list {
+			sub, ok := schema["additionalItems"]
+			if i < len(items) {
+				sub, ok = items[i], true
+			}
+			if !ok {
+				break
+			}
+			if err := s.validate(sub, value, index(path, i)); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		for i, value := range list {
+			if err := s.validate(items, value, index(path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	if contains, ok := schema["contains"]; ok {
+		found := false
+		for i, value := range list {
+			if s.validate(contains, value, index(path, i)) == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errorf(path, "no item matches the schema for contained items")
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(schema map[string]interface{}, v interface{}, path string) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, key := range required {
+			if key, ok := key.(string); ok {
+				if _, found := m[key]; !found {
+					return errorf(path, "the key %q is required", key)
+				}
+			}
+		}
+	}
+	length := float64(len(m))
+	if min, ok := number(schema["minProperties"]); ok && length < min {
+		return errorf(path, "must have at least %v keys", min)
+	}
+	if max, ok := number(schema["maxProperties"]); ok && length > max {
+		return errorf(path, "must have at most %v keys", max)
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	patternProperties, _ := schema["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+	// Check the keys in order, so that the same error is returned each time
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := m[key]
+		keyPath := path + "." + key
+		if names, ok := schema["propertyNames"]; ok {
+			if err := s.validate(names, key, keyPath); err != nil {
+				return err
+			}
+		}
+		matched := false
+		if sub, ok := properties[key]; ok {
+			matched = true
+			if err := s.validate(sub, value, keyPath); err != nil {
+				return err
+			}
+		}
+		for pattern, sub := range patternProperties {
+			if s.patterns[pattern].MatchString(key) {
+				matched = true
+				if err := s.validate(sub, value, keyPath); err != nil {
+					return err
+				}
+			}
+		}
+		if !matched && hasAdditional {
+			if additional == false {
+				return errorf(path, "the key %q is not allowed", key)
+			}
+			if err := s.validate(additional, value, keyPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateCombined checks "allOf", "anyOf", "oneOf" and "not"
+func (s *Schema) validateCombined(schema map[string]interface{}, v interface{}, path string) error {
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := s.validate(sub, v, path); err != nil {
+				return err
+			}
+		}
+	}
+	if any, ok := schema["anyOf"].([]interface{}); ok {
+		var firstErr error
+		for _, sub := range any {
+			err := s.validate(sub, v, path)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+	if one, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range one {
+			if s.validate(sub, v, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return errorf(path, "must match exactly one schema in oneOf, but matches %d", matches)
+		}
+	}
+	if not, ok := schema["not"]; ok && s.validate(not, v, path) == nil {
+		return errorf(path, "must not match the schema in not")
+	}
+	return nil
+}
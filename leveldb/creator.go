@@ -0,0 +1,59 @@
+package leveldb
+
+import (
+	"github.com/xyproto/algernon/auth"
+	"github.com/xyproto/algernon/permissions"
+	"github.com/xyproto/pinterface"
+)
+
+// Creator is used for implementing pinterface.ICreator. It contains a
+// database and provides functions for creating data structures within that
+// database.
+type Creator struct {
+	db *Database
+}
+
+// NewCreator can create a new Creator struct
+func NewCreator(db *Database) *Creator {
+	return &Creator{db}
+}
+
+// NewList can create a new List with the given ID
+func (c *Creator) NewList(id string) (pinterface.IList, error) {
+	return NewList(c.db, id)
+}
+
+// NewSet can create a new Set with the given ID
+func (c *Creator) NewSet(id string) (pinterface.ISet, error) {
+	return NewSet(c.db, id)
+}
+
+// NewHashMap can create a new HashMap with the given ID.
+// The HashMap elements have an owner and then a key+value. For example a
+// username for the owner, then "password" as the key and a password hash as
+// the value.
+func (c *Creator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	return NewHashMap(c.db, id)
+}
+
+// NewKeyValue can create a new KeyValue with the given ID.
+// The KeyValue elements have a key with a corresponding value.
+func (c *Creator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	return NewKeyValue(c.db, id)
+}
+
+// NewWithConf opens or creates a LevelDB database in the given directory
+// and returns a Permissions struct for keeping track of users in it.
+// The password hashing is done by the auth package.
+func NewWithConf(dir string) (*auth.Permissions, error) {
+	db, err := Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	state, err := permissions.NewUserState(NewCreator(db), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return auth.NewPermissions(permissions.NewPermissions(state)), nil
+}
@@ -0,0 +1,481 @@
+// Package leveldb provides data structures, users and permissions that are
+// stored in a LevelDB database. LevelDB is an embedded LSM-tree, which is
+// better suited for many small writes than Bolt. The API is the same as for
+// the other database backends, by using the xyproto/pinterface package.
+package leveldb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// ErrKeyNotFound is returned if a key was not found in a HashMap or KeyValue
+	ErrKeyNotFound = errors.New("leveldb: key not found")
+
+	// ErrDoesNotExist is returned when using a data structure that has been removed
+	ErrDoesNotExist = errors.New("leveldb: does not exist")
+
+	// ErrExistsInSet is returned if an element is added to a Set, but it already exists
+	ErrExistsInSet = errors.New("leveldb: element already exists in set")
+
+	// ErrTooFewItems is returned by LastN if the list has fewer than n elements
+	ErrTooFewItems = errors.New("leveldb: too few items in list")
+)
+
+// All data structures share the same key space. The keys start with a
+// letter for the type of data structure and the name of the data structure,
+// separated by zero bytes.
+const (
+	listPrefix     = "l"
+	setPrefix      = "s"
+	hashMapPrefix  = "h"
+	keyValuePrefix = "k"
+	sep            = "\x00"
+)
+
+type (
+	// Database is a LevelDB database
+	Database struct {
+		db  *leveldb.DB
+		dir string
+		mut sync.Mutex // for operations that both read and write
+	}
+
+	// Used for each of the data structures
+	structure struct {
+		db      *Database
+		prefix  string // the type, the name and a separator
+		removed bool
+	}
+
+	// List is a list of strings, in the order they were added
+	List structure
+
+	// Set is a set of unique strings
+	Set structure
+
+	// HashMap has an owner (for instance a username) and then key=>value pairs
+	HashMap structure
+
+	// KeyValue is a key=>value store
+	KeyValue structure
+)
+
+/* --- Database functions --- */
+
+// Open opens a LevelDB database in the given directory, or creates a new
+// one, as needed. Only one process can use the database at the time.
+func Open(dir string) (*Database, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Database{db: db, dir: dir}, nil
+}
+
+// Dir returns the directory of the database
+func (db *Database) Dir() string {
+	return db.dir
+}
+
+// Close the database
+func (db *Database) Close() {
+	db.db.Close()
+}
+
+// Ping the database (only for fulfilling the pinterface.IHost interface)
+func (db *Database) Ping() error {
+	return nil
+}
+
+// get returns the value for a key, or ErrKeyNotFound
+func (db *Database) get(key string) (string, error) {
+	value, err := db.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return "", ErrKeyNotFound
+	}
+	return string(value), err
+}
+
+// has checks if a key exists
+func (db *Database) has(key string) (bool, error) {
+	return db.db.Has([]byte(key), nil)
+}
+
+// put stores a key and a value
+func (db *Database) put(key, value string) error {
+	return db.db.Put([]byte(key), []byte(value), nil)
+}
+
+// del removes a key
+func (db *Database) del(key string) error {
+	return db.db.Delete([]byte(key), nil)
+}
+
+// each calls the given function for all keys with the given prefix, in order.
+// The key is given without the prefix. Stops if the function returns false.
+func (db *Database) each(prefix string, f func(key, value string) bool) error {
+	iter := db.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !f(string(iter.Key()[len(prefix):]), string(iter.Value())) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// delPrefix removes all keys with the given prefix
+func (db *Database) delPrefix(prefix string) error {
+	batch := new(leveldb.Batch)
+	iter := db.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return db.db.Write(batch, nil)
+}
+
+/* --- List functions --- */
+
+// NewList loads or creates a new List with the given ID
+func NewList(db *Database, id string) (*List, error) {
+	return &List{db: db, prefix: listPrefix + sep + id + sep}, nil
+}
+
+// Add an element to the list. The keys are sequence numbers.
+func (l *List) Add(value string) error {
+	if l.removed {
+		return ErrDoesNotExist
+	}
+	l.db.mut.Lock()
+	defer l.db.mut.Unlock()
+	var n uint64
+	iter := l.db.db.NewIterator(util.BytesPrefix([]byte(l.prefix)), nil)
+	if iter.Last() {
+		n = binary.BigEndian.Uint64(iter.Key()[len(l.prefix):])
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n+1)
+	return l.db.put(l.prefix+string(key), value)
+}
+
+// All returns all elements in the list
+func (l *List) All() ([]string, error) {
+	if l.removed {
+		return nil, ErrDoesNotExist
+	}
+	var results []string
+	return results, l.db.each(l.prefix, func(_, value string) bool {
+		results = append(results, value)
+		return true
+	})
+}
+
+// Last returns the last element of the list, or an empty string
+func (l *List) Last() (string, error) {
+	if l.removed {
+		return "", ErrDoesNotExist
+	}
+	iter := l.db.db.NewIterator(util.BytesPrefix([]byte(l.prefix)), nil)
+	defer iter.Release()
+	if iter.Last() {
+		return string(iter.Value()), nil
+	}
+	return "", iter.Error()
+}
+
+// LastN returns the last n elements of the list
+func (l *List) LastN(n int) ([]string, error) {
+	if l.removed {
+		return nil, ErrDoesNotExist
+	}
+	results := make([]string, n)
+	iter := l.db.db.NewIterator(util.BytesPrefix([]byte(l.prefix)), nil)
+	defer iter.Release()
+	i := n - 1
+	for ok := iter.Last(); ok && i >= 0; ok = iter.Prev() {
+		results[i] = string(iter.Value())
+		i--
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if i >= 0 {
+		return nil, ErrTooFewItems
+	}
+	return results, nil
+}
+
+// Remove this list
+func (l *List) Remove() error {
+	err := l.Clear()
+	l.removed = true
+	return err
+}
+
+// Clear removes all elements from this list
+func (l *List) Clear() error {
+	if l.removed {
+		return ErrDoesNotExist
+	}
+	return l.db.delPrefix(l.prefix)
+}
+
+/* --- Set functions --- */
+
+// NewSet loads or creates a new Set with the given ID
+func NewSet(db *Database, id string) (*Set, error) {
+	return &Set{db: db, prefix: setPrefix + sep + id + sep}, nil
+}
+
+// Add an element to the set. Returns ErrExistsInSet if it is already there.
+func (s *Set) Add(value string) error {
+	if s.removed {
+		return ErrDoesNotExist
+	}
+	s.db.mut.Lock()
+	defer s.db.mut.Unlock()
+	exists, err := s.db.has(s.prefix + value)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrExistsInSet
+	}
+	return s.db.put(s.prefix+value, "")
+}
+
+// Has checks if the given value is in the set
+func (s *Set) Has(value string) (bool, error) {
+	if s.removed {
+		return false, ErrDoesNotExist
+	}
+	return s.db.has(s.prefix + value)
+}
+
+// All returns all elements in the set, sorted
+func (s *Set) All() ([]string, error) {
+	if s.removed {
+		return nil, ErrDoesNotExist
+	}
+	var values []string
+	return values, s.db.each(s.prefix, func(value, _ string) bool {
+		values = append(values, value)
+		return true
+	})
+}
+
+// Del removes an element from the set
+func (s *Set) Del(value string) error {
+	if s.removed {
+		return ErrDoesNotExist
+	}
+	return s.db.del(s.prefix + value)
+}
+
+// Remove this set
+func (s *Set) Remove() error {
+	err := s.Clear()
+	s.removed = true
+	return err
+}
+
+// Clear removes all elements from this set
+func (s *Set) Clear() error {
+	if s.removed {
+		return ErrDoesNotExist
+	}
+	return s.db.delPrefix(s.prefix)
+}
+
+/* --- HashMap functions --- */
+
+// NewHashMap loads or creates a new HashMap with the given ID
+func NewHashMap(db *Database, id string) (*HashMap, error) {
+	return &HashMap{db: db, prefix: hashMapPrefix + sep + id + sep}, nil
+}
+
+// Set a value, given an owner (for instance a username) and a key (for instance "password")
+func (h *HashMap) Set(owner, key, value string) error {
+	if h.removed {
+		return ErrDoesNotExist
+	}
+	return h.db.put(h.prefix+owner+sep+key, value)
+}
+
+// Get a value, given an owner and a key. Returns ErrKeyNotFound if it is missing.
+func (h *HashMap) Get(owner, key string) (string, error) {
+	if h.removed {
+		return "", ErrDoesNotExist
+	}
+	return h.db.get(h.prefix + owner + sep + key)
+}
+
+// Has checks if the given owner has the given key
+func (h *HashMap) Has(owner, key string) (bool, error) {
+	if h.removed {
+		return false, ErrDoesNotExist
+	}
+	return h.db.has(h.prefix + owner + sep + key)
+}
+
+// Exists checks if the given owner has any keys at all
+func (h *HashMap) Exists(owner string) (bool, error) {
+	if h.removed {
+		return false, ErrDoesNotExist
+	}
+	found := false
+	return found, h.db.each(h.prefix+owner+sep, func(_, _ string) bool {
+		found = true
+		return false
+	})
+}
+
+// All returns all owners in the hash map, sorted
+func (h *HashMap) All() ([]string, error) {
+	if h.removed {
+		return nil, ErrDoesNotExist
+	}
+	var owners []string
+	return owners, h.db.each(h.prefix, func(key, _ string) bool {
+		owner := key[:strings.Index(key, sep)]
+		// The keys are sorted, so the same owner comes in a row
+		if len(owners) == 0 || owners[len(owners)-1] != owner {
+			owners = append(owners, owner)
+		}
+		return true
+	})
+}
+
+// Keys returns all keys for the given owner, sorted
+func (h *HashMap) Keys(owner string) ([]string, error) {
+	if h.removed {
+		return nil, ErrDoesNotExist
+	}
+	var keys []string
+	return keys, h.db.each(h.prefix+owner+sep, func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+}
+
+// DelKey removes a key for an owner (for instance the e-mail field for a user)
+func (h *HashMap) DelKey(owner, key string) error {
+	if h.removed {
+		return ErrDoesNotExist
+	}
+	return h.db.del(h.prefix + owner + sep + key)
+}
+
+// Del removes an owner and all the keys (for instance a user)
+func (h *HashMap) Del(owner string) error {
+	if h.removed {
+		return ErrDoesNotExist
+	}
+	return h.db.delPrefix(h.prefix + owner + sep)
+}
+
+// Remove this hash map
+func (h *HashMap) Remove() error {
+	err := h.Clear()
+	h.removed = true
+	return err
+}
+
+// Clear removes all elements from this hash map
+func (h *HashMap) Clear() error {
+	if h.removed {
+		return ErrDoesNotExist
+	}
+	return h.db.delPrefix(h.prefix)
+}
+
+/* --- KeyValue functions --- */
+
+// NewKeyValue loads or creates a new KeyValue with the given ID
+func NewKeyValue(db *Database, id string) (*KeyValue, error) {
+	return &KeyValue{db: db, prefix: keyValuePrefix + sep + id + sep}, nil
+}
+
+// Set a key and value
+func (kv *KeyValue) Set(key, value string) error {
+	if kv.removed {
+		return ErrDoesNotExist
+	}
+	return kv.db.put(kv.prefix+key, value)
+}
+
+// Get a value, given a key. Returns ErrKeyNotFound if it is missing.
+func (kv *KeyValue) Get(key string) (string, error) {
+	if kv.removed {
+		return "", ErrDoesNotExist
+	}
+	return kv.db.get(kv.prefix + key)
+}
+
+// Keys returns all keys, sorted
+func (kv *KeyValue) Keys() ([]string, error) {
+	if kv.removed {
+		return nil, ErrDoesNotExist
+	}
+	var keys []string
+	return keys, kv.db.each(kv.prefix, func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+}
+
+// Del removes a key
+func (kv *KeyValue) Del(key string) error {
+	if kv.removed {
+		return ErrDoesNotExist
+	}
+	return kv.db.del(kv.prefix + key)
+}
+
+// Inc increases the value of a key and returns the new value.
+// If the key does not exist, or is not a number, the new value is "1".
+func (kv *KeyValue) Inc(key string) (string, error) {
+	if kv.removed {
+		return "", ErrDoesNotExist
+	}
+	kv.db.mut.Lock()
+	defer kv.db.mut.Unlock()
+	value, err := kv.db.get(kv.prefix + key)
+	if err != nil && err != ErrKeyNotFound {
+		return "", err
+	}
+	num, _ := strconv.Atoi(strings.TrimSpace(value))
+	value = strconv.Itoa(num + 1)
+	return value, kv.db.put(kv.prefix+key, value)
+}
+
+// Remove this key/value
+func (kv *KeyValue) Remove() error {
+	err := kv.Clear()
+	kv.removed = true
+	return err
+}
+
+// Clear removes all keys and values
+func (kv *KeyValue) Clear() error {
+	if kv.removed {
+		return ErrDoesNotExist
+	}
+	return kv.db.delPrefix(kv.prefix)
+}
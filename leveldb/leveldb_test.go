@@ -0,0 +1,244 @@
+package leveldb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/auth"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/simplebolt"
+)
+
+// Check that the interfaces are implemented
+var (
+	_ pinterface.ICreator = &Creator{}
+	_ pinterface.IHost    = &Database{}
+)
+
+func openTemp() (*Database, func(), error) {
+	dir, err := ioutil.TempDir("", "leveldbtest")
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := Open(filepath.Join(dir, "db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+func newDatabase(t *testing.T) (*Database, func()) {
+	db, cleanup, err := openTemp()
+	assert.Equal(t, err, nil)
+	return db, cleanup
+}
+
+func TestList(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	l, _ := NewList(db, "fruits")
+	other, _ := NewList(db, "fruits2")
+	last, err := l.Last()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, last, "")
+	// More than 256 elements, to check the ordering of the sequence numbers
+	for i := 0; i < 300; i++ {
+		assert.Equal(t, l.Add(strconv.Itoa(i)), nil)
+	}
+	other.Add("durian")
+	all, err := l.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(all), 300)
+	assert.Equal(t, all[256], "256")
+	last, _ = l.Last()
+	assert.Equal(t, last, "299")
+	lastN, err := l.LastN(2)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, lastN, []string{"298", "299"})
+	_, err = l.LastN(301)
+	assert.Equal(t, err, ErrTooFewItems)
+	assert.Equal(t, l.Remove(), nil)
+	assert.Equal(t, l.Add("apple"), ErrDoesNotExist)
+	all, _ = other.All()
+	assert.Equal(t, all, []string{"durian"})
+}
+
+func TestSet(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	s, _ := NewSet(db, "names")
+	assert.Equal(t, s.Add("bob"), nil)
+	assert.Equal(t, s.Add("alice"), nil)
+	assert.Equal(t, s.Add("bob"), ErrExistsInSet)
+	has, err := s.Has("bob")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, has, true)
+	all, _ := s.All()
+	assert.Equal(t, all, []string{"alice", "bob"})
+	assert.Equal(t, s.Del("bob"), nil)
+	has, _ = s.Has("bob")
+	assert.Equal(t, has, false)
+	assert.Equal(t, s.Clear(), nil)
+	all, _ = s.All()
+	assert.Equal(t, len(all), 0)
+}
+
+func TestHashMap(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	h, _ := NewHashMap(db, "people")
+	assert.Equal(t, h.Set("bob", "email", "bob@example.com"), nil)
+	assert.Equal(t, h.Set("bob", "email", "bob@example.org"), nil)
+	assert.Equal(t, h.Set("bob", "role", "admin"), nil)
+	assert.Equal(t, h.Set("bobby", "role", "user"), nil)
+	email, err := h.Get("bob", "email")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, email, "bob@example.org")
+	_, err = h.Get("bob", "phone")
+	assert.Equal(t, err, ErrKeyNotFound)
+	has, _ := h.Has("bob", "role")
+	assert.Equal(t, has, true)
+	exists, _ := h.Exists("alice")
+	assert.Equal(t, exists, false)
+	owners, _ := h.All()
+	assert.Equal(t, owners, []string{"bob", "bobby"})
+	keys, _ := h.Keys("bob")
+	assert.Equal(t, keys, []string{"email", "role"})
+	assert.Equal(t, h.DelKey("bob", "role"), nil)
+	keys, _ = h.Keys("bob")
+	assert.Equal(t, keys, []string{"email"})
+	assert.Equal(t, h.Del("bob"), nil)
+	exists, _ = h.Exists("bob")
+	assert.Equal(t, exists, false)
+	exists, _ = h.Exists("bobby")
+	assert.Equal(t, exists, true)
+}
+
+func TestKeyValue(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	kv, _ := NewKeyValue(db, "settings")
+	assert.Equal(t, kv.Set("color", "blue"), nil)
+	color, err := kv.Get("color")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, color, "blue")
+	_, err = kv.Get("size")
+	assert.Equal(t, err, ErrKeyNotFound)
+	n, err := kv.Inc("counter")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, "1")
+	n, _ = kv.Inc("counter")
+	assert.Equal(t, n, "2")
+	assert.Equal(t, kv.Del("color"), nil)
+	_, err = kv.Get("color")
+	assert.Equal(t, err, ErrKeyNotFound)
+}
+
+func TestUserState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldbtest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	perm, err := NewWithConf(filepath.Join(dir, "users"))
+	assert.Equal(t, err, nil)
+	var _ pinterface.IPermissions = perm
+	userstate := perm.UserState()
+	defer userstate.Host().Close()
+
+	// The passwords are hashed by the auth package
+	assert.Equal(t, userstate.SetPasswordAlgo(auth.Argon2id), nil)
+	userstate.AddUser("bob", "hunter2", "bob@example.com")
+	assert.Equal(t, userstate.HasUser("bob"), true)
+	hash, _ := userstate.PasswordHash("bob")
+	assert.Equal(t, auth.HashAlgo(hash), auth.Argon2id)
+	assert.Equal(t, userstate.CorrectPassword("bob", "hunter2"), true)
+	assert.Equal(t, userstate.CorrectPassword("bob", "hunter3"), false)
+	userstate.RemoveUser("bob")
+	assert.Equal(t, userstate.HasUser("bob"), false)
+}
+
+// The benchmarks compare LevelDB with Bolt, for the operations that are
+// available to Lua through the List, Set, HashMap and KeyValue types.
+// Run with: go test -bench . ./leveldb
+
+func benchmarkCreators(b *testing.B, f func(*testing.B, pinterface.ICreator)) {
+	b.Run("LevelDB", func(b *testing.B) {
+		db, cleanup, err := openTemp()
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer cleanup()
+		f(b, NewCreator(db))
+	})
+	b.Run("Bolt", func(b *testing.B) {
+		dir, err := ioutil.TempDir("", "bolttest")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := simplebolt.New(filepath.Join(dir, "bolt.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+		f(b, simplebolt.NewCreator(db))
+	})
+}
+
+func BenchmarkKeyValueInc(b *testing.B) {
+	benchmarkCreators(b, func(b *testing.B, creator pinterface.ICreator) {
+		kv, _ := creator.NewKeyValue("counters")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			kv.Inc("counter")
+		}
+	})
+}
+
+func BenchmarkKeyValueGet(b *testing.B) {
+	benchmarkCreators(b, func(b *testing.B, creator pinterface.ICreator) {
+		kv, _ := creator.NewKeyValue("settings")
+		kv.Set("color", "blue")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			kv.Get("color")
+		}
+	})
+}
+
+func BenchmarkListAdd(b *testing.B) {
+	benchmarkCreators(b, func(b *testing.B, creator pinterface.ICreator) {
+		l, _ := creator.NewList("log")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			l.Add("entry")
+		}
+	})
+}
+
+func BenchmarkSetAdd(b *testing.B) {
+	benchmarkCreators(b, func(b *testing.B, creator pinterface.ICreator) {
+		s, _ := creator.NewSet("visitors")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.Add(strconv.Itoa(i % 1000))
+		}
+	})
+}
+
+func BenchmarkHashMapSet(b *testing.B) {
+	benchmarkCreators(b, func(b *testing.B, creator pinterface.ICreator) {
+		h, _ := creator.NewHashMap("users")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			h.Set("user"+strconv.Itoa(i%100), "visits", strconv.Itoa(i))
+		}
+	})
+}
@@ -16,20 +16,20 @@ const (
 	Class = "CODELIB"
 )
 
-// Get the first argument, "self", and cast it from userdata to a library (which is really a key/value).
-func checkLibrary(L *lua.LState) pinterface.IKeyValue {
+// Get the first argument, "self", and cast it from userdata to a library.
+func checkLibrary(L *lua.LState) *library {
 	ud := L.CheckUserData(1)
-	if hash, ok := ud.Value.(pinterface.IKeyValue); ok {
-		return hash
+	if lib, ok := ud.Value.(*library); ok {
+		return lib
 	}
 	L.ArgError(1, "code library expected")
 	return nil
 }
 
-// Given a namespace, register Lua code.
+// Given a namespace, add Lua code to the current code, as a new version.
 // Takes two strings, returns true if successful.
 func libAdd(L *lua.LState) int {
-	lualib := checkLibrary(L) // arg 1
+	lib := checkLibrary(L) // arg 1
 	namespace := L.ToString(2)
 	if namespace == "" {
 		L.ArgError(2, "namespace expected")
@@ -41,80 +41,113 @@ func libAdd(L *lua.LState) int {
 		return 1
 	}
 	// Append the new code to the old code, if any
-	oldcode, err := lualib.Get(namespace)
+	oldcode, err := lib.code(namespace, 0)
 	if err != nil {
 		oldcode = ""
 	} else {
 		oldcode += "\n"
 	}
-	L.Push(lua.LBool(nil == lualib.Set(namespace, oldcode+code)))
+	L.Push(lua.LBool(nil == lib.store(namespace, oldcode+code)))
 	return 1 // number of results
 }
 
-// Given a namespace, register Lua code as the only code.
+// Given a namespace, register Lua code as the only code, as a new version.
 // Takes two strings, returns true if successful.
 func libSet(L *lua.LState) int {
-	lualib := checkLibrary(L) // arg 1
+	lib := checkLibrary(L) // arg 1
 	namespace := L.ToString(2)
 	if namespace == "" {
 		L.ArgError(2, "namespace expected")
 	}
-	code := L.ToString(3)
 	// Empty string is fine, for clearing a key
-	//if code == "" {
-	//	log.Warn("Empty Lua code given to codelib:set")
-	//	L.Push(lua.LBool(false))
-	//	return 1
-	//}
-	L.Push(lua.LBool(nil == lualib.Set(namespace, code)))
+	code := L.ToString(3)
+	L.Push(lua.LBool(nil == lib.store(namespace, code)))
 	return 1 // number of results
 }
 
-// Given a namespace, return Lua code, or an empty string.
+// Given a namespace and an optional version, return Lua code, or an empty string.
 func libGet(L *lua.LState) int {
-	lualib := checkLibrary(L) // arg 1
+	lib := checkLibrary(L) // arg 1
 	namespace := L.ToString(2)
 	if namespace == "" {
 		L.ArgError(2, "namespace expected")
 	}
-	// Retrieve the Lua code from the HashMap
-	code, err := lualib.Get(namespace)
+	version := L.OptInt(3, 0)
+	code, err := lib.code(namespace, version)
 	if err != nil {
 		// Return an empty string if there was an error
-		L.Push(lua.LString(""))
+		code = ""
 	}
 	// Return the requested Lua code
 	L.Push(lua.LString(code))
 	return 1 // number of results
 }
 
-// Given a namespace, fetch all registered Lua code as a string.
-// Then run the Lua code for this LState.
-// Returns true of successful.
+// Given a namespace, return the current version number, or 0.
+func libVersion(L *lua.LState) int {
+	lib := checkLibrary(L) // arg 1
+	namespace := L.CheckString(2)
+	L.Push(lua.LNumber(lib.current(namespace)))
+	return 1 // number of results
+}
+
+// Given a namespace, return a table with the code of every version,
+// where the index is the version number.
+func libHistory(L *lua.LState) int {
+	lib := checkLibrary(L) // arg 1
+	namespace := L.CheckString(2)
+	table := L.NewTable()
+	for version := 1; version <= lib.latest(namespace); version++ {
+		code, err := lib.code(namespace, version)
+		if err != nil {
+			code = ""
+		}
+		table.RawSetInt(version, lua.LString(code))
+	}
+	L.Push(table)
+	return 1 // number of results
+}
+
+// Given a namespace and an optional version, make that version the current
+// one. The default is the version before the current one.
+// Returns true if successful.
+func libRollback(L *lua.LState) int {
+	lib := checkLibrary(L) // arg 1
+	namespace := L.CheckString(2)
+	version := L.OptInt(3, lib.current(namespace)-1)
+	if err := lib.rollback(namespace, version); err != nil {
+		log.Error("codelib:rollback: ", err)
+		L.Push(lua.LBool(false))
+		return 1 // number of results
+	}
+	L.Push(lua.LBool(true))
+	return 1 // number of results
+}
+
+// Given a namespace, run the current version of the Lua code as a module.
+// Returns the table that the code returns, or a table with the globals
+// that the code defines. Returns false if there was an error.
+// If the code does not return a table, the globals that it defines are also
+// set in the calling script, like they were before code was imported as modules.
 func libImport(L *lua.LState) int {
-	lualib := checkLibrary(L) // arg 1
+	lib := checkLibrary(L) // arg 1
 	namespace := L.ToString(2)
 	if namespace == "" {
 		L.ArgError(2, "namespace expected")
 	}
-
-	code, err := lualib.Get(namespace)
+	module, returned, err := lib.module(L, namespace)
 	if err != nil {
-		// Return false if there was an error
-		L.Push(lua.LBool(false)) // error
-		return 1
-	}
-
-	if err := L.DoString(code); err != nil {
-		L.Close()
-
 		log.Errorf("Error when importing Lua code:\n%s", err)
 		L.Push(lua.LBool(false)) // error
 		return 1                 // number of results
 	}
-
-	L.Push(lua.LBool(true)) // ok
-	return 1                // number of results
+	if !returned {
+		module.ForEach(func(key, value lua.LValue) {
+			L.G.Global.RawSet(key, value)
+		})
+	}
+	L.Push(module)
+	return 1 // number of results
 }
 
 // String representation
@@ -125,22 +158,21 @@ func libToString(L *lua.LState) int {
 
 // Clear the current code library
 func libClear(L *lua.LState) int {
-	lualib := checkLibrary(L) // arg 1
-	L.Push(lua.LBool(nil == lualib.Remove()))
+	lib := checkLibrary(L) // arg 1
+	L.Push(lua.LBool(nil == lib.clear()))
 	return 1 // number of results
 }
 
 // Create a new code library.
-// id is the name of the hash map.
+// id is the name of the key/value that the code is stored in.
 func newCodeLibrary(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LUserData, error) {
-	// Create a new Lua Library (hash map)
-	lualib, err := creator.NewKeyValue(id)
+	lib, err := newLibrary(creator, id)
 	if err != nil {
 		return nil, err
 	}
 	// Create a new userdata struct
 	ud := L.NewUserData()
-	ud.Value = lualib
+	ud.Value = lib
 	L.SetMetatable(ud, L.GetTypeMetatable(Class))
 	return ud, nil
 }
@@ -151,6 +183,9 @@ var libMethods = map[string]lua.LGFunction{
 	"add":        libAdd,
 	"set":        libSet,
 	"get":        libGet,
+	"version":    libVersion,
+	"history":    libHistory,
+	"rollback":   libRollback,
 	"import":     libImport,
 	"clear":      libClear,
 }
@@ -185,4 +220,6 @@ func Load(L *lua.LState, creator pinterface.ICreator) {
 		return 1 // number of results
 	}))
 
+	// Let require("db:namespace") import code from the default library
+	loadRequire(L, creator)
 }
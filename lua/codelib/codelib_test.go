@@ -0,0 +1,84 @@
+package codelib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simplebolt"
+)
+
+func setup(t *testing.T) (*lua.LState, func()) {
+	dir, err := ioutil.TempDir("", "codelibtest")
+	assert.Equal(t, err, nil)
+	db, err := simplebolt.New(filepath.Join(dir, "test.db"))
+	assert.Equal(t, err, nil)
+	L := lua.NewState()
+	Load(L, simplebolt.NewCreator(db))
+	return L, func() {
+		L.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	L, cleanup := setup(t)
+	defer cleanup()
+	err := L.DoString(`
+		local lib = CodeLib()
+		assert(lib:version("greet") == 0)
+		assert(lib:set("greet", "function hello() return 'hi' end"))
+		assert(lib:add("greet", "function bye() return 'bye' end"))
+		assert(lib:version("greet") == 2)
+		assert(#lib:history("greet") == 2)
+		assert(lib:get("greet", 1) == "function hello() return 'hi' end")
+		assert(lib:rollback("greet"))
+		assert(lib:version("greet") == 1)
+		assert(lib:get("greet") == lib:get("greet", 1))
+		assert(not lib:rollback("greet", 3))
+		assert(lib:set("greet", "return 1"))
+		assert(lib:version("greet") == 3)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestImport(t *testing.T) {
+	L, cleanup := setup(t)
+	defer cleanup()
+	err := L.DoString(`
+		local lib = CodeLib()
+		lib:set("globals", "function hello() return 'hi' end")
+		lib:set("module", "local M = {} function M.twice(x) return x * 2 end return M")
+
+		-- The globals of the code end up in the returned table, and are
+		-- also set in the script, since the code does not return a module
+		local g = lib:import("globals")
+		assert(g.hello() == "hi")
+		assert(hello == g.hello)
+
+		-- Code that returns a module does not change the globals
+		local m = lib:import("module")
+		assert(m.twice(2) == 4)
+		assert(twice == nil and M == nil)
+
+		local m = require("db:module")
+		assert(m.twice(21) == 42)
+		assert(require("db:module") == m)
+
+		-- A new version is imported again
+		lib:set("module", "return {version = 2}")
+		assert(require("db:module").version == 2)
+
+		assert(not pcall(require, "db:missing"))
+		assert(require("string") == string)
+
+		-- Namespaces can also be imported without the prefix
+		assert(require("module") == require("db:module"))
+		assert(not pcall(require, "missing"))
+	`)
+	assert.Equal(t, err, nil)
+}
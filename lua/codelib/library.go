@@ -0,0 +1,189 @@
+package codelib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/gopher-lua/parse"
+	"github.com/xyproto/pinterface"
+)
+
+// Each namespace is stored in the key/value with these keys:
+//
+//	namespace          the code of the current version
+//	namespace@N        the code of version N, starting at 1
+//	namespace@latest   the highest version number
+//	namespace@current  the version number of the current version
+//
+// Code that was stored before versions were introduced has version 0.
+const (
+	latestSuffix  = "@latest"
+	currentSuffix = "@current"
+)
+
+// The compiled code, per library, namespace and version
+var (
+	protos    = make(map[string]*lua.FunctionProto)
+	protosMut sync.RWMutex
+)
+
+// library is a code library, stored in a key/value
+type library struct {
+	kv       pinterface.IKeyValue
+	cacheKey string // identifies the library in the cache of compiled code
+}
+
+func newLibrary(creator pinterface.ICreator, id string) (*library, error) {
+	kv, err := creator.NewKeyValue(id)
+	if err != nil {
+		return nil, err
+	}
+	return &library{kv, fmt.Sprintf("%p\x00%s", creator, id)}, nil
+}
+
+// number returns the number that is stored for the given key, or 0
+func (lib *library) number(key string) int {
+	s, err := lib.kv.Get(key)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// current returns the current version of the given namespace, or 0
+func (lib *library) current(namespace string) int {
+	return lib.number(namespace + currentSuffix)
+}
+
+// latest returns the highest version of the given namespace, or 0
+func (lib *library) latest(namespace string) int {
+	return lib.number(namespace + latestSuffix)
+}
+
+// code returns the code of the given version. Version 0 is the current code.
+func (lib *library) code(namespace string, version int) (string, error) {
+	if version == 0 {
+		return lib.kv.Get(namespace)
+	}
+	return lib.kv.Get(namespace + "@" + strconv.Itoa(version))
+}
+
+// store stores the given code as a new version, which becomes the current version
+func (lib *library) store(namespace, code string) error {
+	latest := lib.latest(namespace)
+	if latest == 0 {
+		// Keep code from before there were versions as the first version
+		if oldcode, err := lib.kv.Get(namespace); err == nil && oldcode != "" {
+			if err := lib.kv.Set(namespace+"@1", oldcode); err != nil {
+				return err
+			}
+			latest = 1
+		}
+	}
+	version := strconv.Itoa(latest + 1)
+	if err := lib.kv.Set(namespace+"@"+version, code); err != nil {
+		return err
+	}
+	if err := lib.kv.Set(namespace+latestSuffix, version); err != nil {
+		return err
+	}
+	return lib.use(namespace, version, code)
+}
+
+// use makes the given version the current version
+func (lib *library) use(namespace, version, code string) error {
+	if err := lib.kv.Set(namespace+currentSuffix, version); err != nil {
+		return err
+	}
+	return lib.kv.Set(namespace, code)
+}
+
+// rollback makes an earlier version the current version
+func (lib *library) rollback(namespace string, version int) error {
+	if version < 1 || version > lib.latest(namespace) {
+		return fmt.Errorf("no version %d of %s", version, namespace)
+	}
+	code, err := lib.code(namespace, version)
+	if err != nil {
+		return err
+	}
+	return lib.use(namespace, strconv.Itoa(version), code)
+}
+
+// clear removes all code from the library
+func (lib *library) clear() error {
+	protosMut.Lock()
+	for key := range protos {
+		if strings.HasPrefix(key, lib.cacheKey+"\x00") {
+			delete(protos, key)
+		}
+	}
+	protosMut.Unlock()
+	return lib.kv.Remove()
+}
+
+// compile returns the compiled code for the current version of the namespace.
+// The code is compiled once per version.
+func (lib *library) compile(namespace string) (*lua.FunctionProto, error) {
+	version := lib.current(namespace)
+	key := fmt.Sprintf("%s\x00%s\x00%d", lib.cacheKey, namespace, version)
+	protosMut.RLock()
+	proto, ok := protos[key]
+	protosMut.RUnlock()
+	// Version 0 may be changed by older code, so it is not cached
+	if ok && version > 0 {
+		return proto, nil
+	}
+	code, err := lib.code(namespace, version)
+	if err != nil {
+		return nil, fmt.Errorf("no Lua code for %s", namespace)
+	}
+	chunk, err := parse.Parse(strings.NewReader(code), namespace)
+	if err != nil {
+		return nil, err
+	}
+	proto, err = lua.Compile(chunk, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if version > 0 {
+		protosMut.Lock()
+		protos[key] = proto
+		protosMut.Unlock()
+	}
+	return proto, nil
+}
+
+// module runs the current version of the namespace as a module, with its own
+// environment, where the globals can be read but not changed. Returns the
+// table that the code returns, or the environment if no table is returned,
+// in which case returned is false.
+func (lib *library) module(L *lua.LState, namespace string) (module *lua.LTable, returned bool, err error) {
+	proto, err := lib.compile(namespace)
+	if err != nil {
+		return nil, false, err
+	}
+	env := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.Get(lua.GlobalsIndex))
+	L.SetMetatable(env, mt)
+	fn := L.NewFunctionFromProto(proto)
+	fn.Env = env
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, false, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	if module, ok := ret.(*lua.LTable); ok {
+		return module, true, nil
+	}
+	return env, false, nil
+}
@@ -0,0 +1,89 @@
+package codelib
+
+import (
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// Modules with this prefix are imported from the default code library by require
+	requirePrefix = "db:"
+
+	// Registry keys for the original require function and for the imported modules
+	originalRequireKey = "_CODELIB_REQUIRE"
+	modulesKey         = "_CODELIB_MODULES"
+)
+
+// loadRequire replaces require with a function that imports modules with
+// names like "db:namespace" from the default code library, and passes other
+// names on to the original require function. Names without "db:" are also
+// imported from the code library, if there is such a namespace and the
+// original require function has not already loaded a module with that name.
+// A module is imported again when there is a new current version of it.
+func loadRequire(L *lua.LState, creator pinterface.ICreator) {
+	registry := L.Get(lua.RegistryIndex).(*lua.LTable)
+
+	// The Lua state may be reused, so only keep the very first require function
+	original, ok := registry.RawGetString(originalRequireKey).(*lua.LFunction)
+	if !ok {
+		if original, ok = L.GetGlobal("require").(*lua.LFunction); !ok {
+			return
+		}
+		registry.RawSetString(originalRequireKey, original)
+	}
+
+	modules, ok := registry.RawGetString(modulesKey).(*lua.LTable)
+	if !ok {
+		modules = L.NewTable()
+		registry.RawSetString(modulesKey, modules)
+	}
+
+	// Let the original require function import the module
+	requireOriginal := func(L *lua.LState, name string) int {
+		L.Push(original)
+		L.Push(lua.LString(name))
+		L.Call(1, 1)
+		return 1 // number of results
+	}
+
+	L.SetGlobal("require", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		namespace := strings.TrimPrefix(name, requirePrefix)
+		prefixed := namespace != name
+		if !prefixed {
+			if loaded, ok := registry.RawGetString("_LOADED").(*lua.LTable); ok && loaded.RawGetString(name) != lua.LNil {
+				return requireOriginal(L, name)
+			}
+		}
+		lib, err := newLibrary(creator, defaultID)
+		if err != nil {
+			if !prefixed {
+				return requireOriginal(L, name)
+			}
+			L.RaiseError("module '%s' not found: %s", name, err)
+		}
+		version := lua.LNumber(lib.current(namespace))
+		if version == 0 && !prefixed {
+			return requireOriginal(L, name)
+		}
+		// Modules from the code library are stored with the "db:" prefix
+		name = requirePrefix + namespace
+		// Use the module that has already been imported, if it is the current version
+		if entry, ok := modules.RawGetString(name).(*lua.LTable); ok && version > 0 && entry.RawGetString("version") == version {
+			L.Push(entry.RawGetString("module"))
+			return 1 // number of results
+		}
+		module, _, err := lib.module(L, namespace)
+		if err != nil {
+			L.RaiseError("module '%s' could not be imported: %s", name, err)
+		}
+		entry := L.NewTable()
+		entry.RawSetString("version", version)
+		entry.RawSetString("module", module)
+		modules.RawSetString(name, entry)
+		L.Push(module)
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,112 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// MaxDepth is how deeply tables can be nested in a value that is given to Value2interface
+const MaxDepth = 100
+
+var (
+	// ErrCycle is returned by Value2interface for tables that contain themselves
+	ErrCycle = errors.New("the table contains itself")
+
+	// ErrDepth is returned by Value2interface for tables that are nested too deeply
+	ErrDepth = fmt.Errorf("the tables are nested more than %d levels deep", MaxDepth)
+)
+
+// Value2interface copies a Lua value to a Go value that does not belong to any Lua
+// state, and that can be encoded as JSON. Tables with the keys 1 to n
+// become lists, and other tables become maps. Functions and userdata become nil.
+// Returns an error if a table contains itself, or if the tables are nested too deeply.
+func Value2interface(value lua.LValue) (interface{}, error) {
+	return value2interface(value, make(map[*lua.LTable]bool))
+}
+
+// value2interface converts the given value, where parents are the tables
+// that the value is within
+func value2interface(value lua.LValue, parents map[*lua.LTable]bool) (interface{}, error) {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if parents[v] {
+			return nil, ErrCycle
+		}
+		if len(parents) >= MaxDepth {
+			return nil, ErrDepth
+		}
+		parents[v] = true
+		defer delete(parents, v)
+		if n := v.Len(); n > 0 {
+			count := 0
+			v.ForEach(func(_, _ lua.LValue) { count++ })
+			if count == n {
+				list := make([]interface{}, n)
+				for i := 1; i <= n; i++ {
+					item, err := value2interface(v.RawGetInt(i), parents)
+					if err != nil {
+						return nil, err
+					}
+					list[i-1] = item
+				}
+				return list, nil
+			}
+		}
+		m := make(map[string]interface{})
+		var err error
+		v.ForEach(func(key, value lua.LValue) {
+			if err == nil {
+				m[key.String()], err = value2interface(value, parents)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, nil
+}
+
+// Interface2value creates a Lua value from a value that was returned by Value2interface, or decoded from JSON
+func Interface2value(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.NewTable()
+		for i, item := range v {
+			// Append would skip nil, which would move the following items
+			table.RawSetInt(i+1, Interface2value(L, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.NewTable()
+		for key, item := range v {
+			table.RawSetString(key, Interface2value(L, item))
+		}
+		return table
+	}
+	return lua.LNil
+}
+
+// Values2table converts a map with several values per key, like url.Values,
+// to a Lua table where each key has a list of values
+func Values2table(L *lua.LState, m map[string][]string) *lua.LTable {
+	table := L.NewTable()
+	for key, values := range m {
+		table.RawSetString(key, Strings2table(L, values))
+	}
+	return table
+}
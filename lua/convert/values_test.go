@@ -0,0 +1,72 @@
+package convert
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestValues(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	var value interface{}
+	assert.Equal(t, json.Unmarshal([]byte(`{"name": "bob", "tags": ["a", "b"], "age": 42, "admin": false, "none": null}`), &value), nil)
+	L.SetGlobal("data", Interface2value(L, value))
+
+	values, err := url.ParseQuery("tag=a&tag=b&x=1")
+	assert.Equal(t, err, nil)
+	L.SetGlobal("query", Values2table(L, values))
+
+	assert.Equal(t, L.DoString(`
+		assert(data.name == "bob")
+		assert(#data.tags == 2 and data.tags[2] == "b")
+		assert(data.age == 42)
+		assert(data.admin == false)
+		assert(data.none == nil)
+		assert(#query.tag == 2 and query.tag[1] == "a" and query.tag[2] == "b")
+		assert(query.x[1] == "1")
+	`), nil)
+
+	v, err := Value2interface(L.GetGlobal("data"))
+	assert.Equal(t, err, nil)
+	b, err := json.Marshal(v)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(b), `{"admin":false,"age":42,"name":"bob","tags":["a","b"]}`)
+
+	// Items that are null keep the positions of the following items
+	assert.Equal(t, json.Unmarshal([]byte(`["a", null, "c"]`), &value), nil)
+	L.SetGlobal("list", Interface2value(L, value))
+	assert.Equal(t, L.DoString(`
+		assert(list[1] == "a" and list[2] == nil and list[3] == "c")
+	`), nil)
+}
+
+func TestCycles(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	assert.Equal(t, L.DoString(`
+		shared = {1, 2}
+		ok = {a = shared, b = shared}
+		cycle = {}
+		cycle.self = cycle
+		deep = {}
+		local t = deep
+		for i = 1, 200 do
+			t.next = {}
+			t = t.next
+		end
+	`), nil)
+
+	// A table that is used twice is not a cycle
+	_, err := Value2interface(L.GetGlobal("ok"))
+	assert.Equal(t, err, nil)
+	_, err = Value2interface(L.GetGlobal("cycle"))
+	assert.Equal(t, err, ErrCycle)
+	_, err = Value2interface(L.GetGlobal("deep"))
+	assert.Equal(t, err, ErrDepth)
+}
@@ -0,0 +1,280 @@
+// Package cookies provides Lua functions for getting and setting cookies,
+// where the values can be signed or encrypted with the cookie secret
+package cookies
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+var (
+	// ErrNoSecret is returned when a cookie should be signed or encrypted,
+	// but no cookie secret has been set
+	ErrNoSecret = errors.New("no cookie secret has been set")
+
+	// ErrSameSite is returned for SameSite values that are not "Strict", "Lax" or "None"
+	ErrSameSite = errors.New("samesite must be \"Strict\", \"Lax\" or \"None\"")
+
+	encoding = base64.RawURLEncoding
+)
+
+// mac returns the HMAC of the given cookie name and value
+func mac(secret, name, value string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(name + "=" + value))
+	return h.Sum(nil)
+}
+
+// Sign returns the given value together with a signature, so that the value
+// can be read by the client, but not changed. The signature also covers the
+// name of the cookie, so that a signed value can not be moved to another cookie.
+func Sign(secret, name, value string) string {
+	encoded := encoding.EncodeToString([]byte(value))
+	return encoded + "." + encoding.EncodeToString(mac(secret, name, encoded))
+}
+
+// Verify returns the value of a cookie that was signed with Sign, and true if
+// the signature is valid
+func Verify(secret, name, signed string) (string, bool) {
+	pos := strings.LastIndexByte(signed, '.')
+	if pos < 0 {
+		return "", false
+	}
+	encoded := signed[:pos]
+	signature, err := encoding.DecodeString(signed[pos+1:])
+	if err != nil || !hmac.Equal(signature, mac(secret, name, encoded)) {
+		return "", false
+	}
+	value, err := encoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+// gcm returns AES-GCM with a key that is derived from the cookie secret
+func gcm(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("algernon cookie encryption:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt returns the given value encrypted and authenticated with AES-GCM,
+// so that the value can neither be read nor changed by the client
+func Encrypt(secret, name, value string) (string, error) {
+	aead, err := gcm(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), []byte(name))), nil
+}
+
+// Decrypt returns the value of a cookie that was encrypted with Encrypt, and
+// true if the value could be decrypted
+func Decrypt(secret, name, encrypted string) (string, bool) {
+	aead, err := gcm(secret)
+	if err != nil {
+		return "", false
+	}
+	data, err := encoding.DecodeString(encrypted)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", false
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+// Get returns the value of the given cookie, and true if the cookie is
+// present and, if it is signed or encrypted, valid
+func Get(req *http.Request, secret, name string, signed, encrypted bool) (string, bool) {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	switch {
+	case (signed || encrypted) && secret == "":
+		return "", false
+	case encrypted:
+		return Decrypt(secret, name, cookie.Value)
+	case signed:
+		return Verify(secret, name, cookie.Value)
+	}
+	return cookie.Value, true
+}
+
+// Options are the attributes of a cookie, and how the value is protected
+type Options struct {
+	Path      string
+	Domain    string
+	MaxAge    int // in seconds, 0 for a session cookie and negative for deleting the cookie
+	Secure    bool
+	HTTPOnly  bool
+	SameSite  http.SameSite
+	Signed    bool
+	Encrypted bool
+}
+
+// DefaultOptions returns the options that are used when setting cookies for the
+// given request: the path is "/", the cookie is not available to JavaScript,
+// SameSite is Lax and the cookie is only sent over HTTPS if the request was.
+func DefaultOptions(req *http.Request) Options {
+	return Options{
+		Path:     "/",
+		Secure:   req.TLS != nil,
+		HTTPOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Set sets a cookie in the response, with the given options
+func Set(w http.ResponseWriter, secret, name, value string, o Options) error {
+	var err error
+	switch {
+	case (o.Signed || o.Encrypted) && secret == "":
+		return ErrNoSecret
+	case o.Encrypted:
+		if value, err = Encrypt(secret, name, value); err != nil {
+			return err
+		}
+	case o.Signed:
+		value = Sign(secret, name, value)
+	}
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     o.Path,
+		Domain:   o.Domain,
+		MaxAge:   o.MaxAge,
+		Secure:   o.Secure,
+		HttpOnly: o.HTTPOnly,
+		SameSite: o.SameSite,
+	}
+	if o.MaxAge > 0 {
+		// For older browsers that do not support Max-Age
+		cookie.Expires = time.Now().Add(time.Duration(o.MaxAge) * time.Second)
+	} else if o.MaxAge < 0 {
+		cookie.Expires = time.Unix(0, 0)
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// sameSite returns the http.SameSite for the given string
+func sameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return http.SameSiteDefaultMode, ErrSameSite
+}
+
+// checkOptions reads cookie options from the given table, if any
+func checkOptions(L *lua.LState, n int, o Options) Options {
+	table := L.OptTable(n, nil)
+	if table == nil {
+		return o
+	}
+	if s, ok := table.RawGetString("path").(lua.LString); ok {
+		o.Path = string(s)
+	}
+	if s, ok := table.RawGetString("domain").(lua.LString); ok {
+		o.Domain = string(s)
+	}
+	if maxAge, ok := table.RawGetString("maxage").(lua.LNumber); ok {
+		o.MaxAge = int(maxAge)
+	}
+	if v := table.RawGetString("secure"); v != lua.LNil {
+		o.Secure = lua.LVAsBool(v)
+	}
+	if v := table.RawGetString("httponly"); v != lua.LNil {
+		o.HTTPOnly = lua.LVAsBool(v)
+	}
+	if s, ok := table.RawGetString("samesite").(lua.LString); ok {
+		mode, err := sameSite(string(s))
+		if err != nil {
+			L.ArgError(n, err.Error())
+		}
+		o.SameSite = mode
+		// Browsers reject SameSite=None cookies that are not Secure
+		if mode == http.SameSiteNoneMode {
+			o.Secure = true
+		}
+	}
+	o.Signed = lua.LVAsBool(table.RawGetString("signed"))
+	o.Encrypted = lua.LVAsBool(table.RawGetString("encrypted"))
+	return o
+}
+
+// Load makes functions for getting and setting cookies available to the
+// given Lua state. The secret is used for signed and encrypted cookies.
+func Load(w http.ResponseWriter, req *http.Request, L *lua.LState, secret string) {
+
+	// Get the value of a cookie. Takes the name and an optional table where
+	// "signed" or "encrypted" can be true. Returns nil if the cookie is
+	// missing, or if a signed or encrypted cookie has been tampered with.
+	L.SetGlobal("getcookie", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		o := checkOptions(L, 2, Options{})
+		value, ok := Get(req, secret, name, o.Signed, o.Encrypted)
+		if !ok {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		L.Push(lua.LString(value))
+		return 1 // number of results
+	}))
+
+	// Set a cookie. Takes the name, the value and an optional table with
+	// path, domain, maxage (in seconds), secure, httponly, samesite
+	// ("Strict", "Lax" or "None"), signed and encrypted.
+	// Returns true, or nil and an error.
+	L.SetGlobal("setcookie", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		value := L.CheckString(2)
+		o := checkOptions(L, 3, DefaultOptions(req))
+		if err := Set(w, secret, name, value, o); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Remove a cookie. Takes the name and an optional table with the path
+	// and domain that the cookie was set with.
+	L.SetGlobal("clearcookie", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		o := checkOptions(L, 2, DefaultOptions(req))
+		o.MaxAge = -1
+		o.Signed = false
+		o.Encrypted = false
+		Set(w, secret, name, "", o)
+		return 0 // number of results
+	}))
+}
@@ -0,0 +1,94 @@
+package cookies
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestSign(t *testing.T) {
+	signed := Sign("secret", "name", "bob")
+	value, ok := Verify("secret", "name", signed)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "bob")
+
+	_, ok = Verify("other secret", "name", signed)
+	assert.Equal(t, ok, false)
+	_, ok = Verify("secret", "other name", signed)
+	assert.Equal(t, ok, false)
+	_, ok = Verify("secret", "name", Sign("secret", "name", "alice")[:4]+signed[4:])
+	assert.Equal(t, ok, false)
+}
+
+func TestEncrypt(t *testing.T) {
+	encrypted, err := Encrypt("secret", "name", "bob")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(encrypted, "bob"), false)
+	value, ok := Decrypt("secret", "name", encrypted)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "bob")
+
+	_, ok = Decrypt("other secret", "name", encrypted)
+	assert.Equal(t, ok, false)
+	_, ok = Decrypt("secret", "other name", encrypted)
+	assert.Equal(t, ok, false)
+	_, ok = Decrypt("secret", "name", "x"+encrypted[1:])
+	assert.Equal(t, ok, false)
+}
+
+func TestLua(t *testing.T) {
+	// Set cookies in one response
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	L := lua.NewState()
+	defer L.Close()
+	Load(w, req, L, "secret")
+	assert.Equal(t, L.DoString(`
+		assert(setcookie("plain", "a"))
+		assert(setcookie("signed", "b", {signed = true, maxage = 60, samesite = "Strict"}))
+		assert(setcookie("secret", "c", {encrypted = true, httponly = false, path = "/x", domain = "example.com"}))
+		assert(setcookie("cross", "d", {samesite = "None"}))
+		assert(not pcall(setcookie, "bad", "e", {samesite = "sometimes"}))
+		clearcookie("old")
+	`), nil)
+	header := w.Header()["Set-Cookie"]
+	assert.Equal(t, len(header), 5)
+	assert.Equal(t, header[0], "plain=a; Path=/; HttpOnly; SameSite=Lax")
+	assert.Equal(t, strings.Contains(header[1], "Max-Age=60; HttpOnly; SameSite=Strict"), true)
+	assert.Equal(t, strings.Contains(header[2], "Path=/x; Domain=example.com; SameSite=Lax"), true)
+	assert.Equal(t, header[3], "cross=d; Path=/; HttpOnly; Secure; SameSite=None")
+	assert.Equal(t, strings.Contains(header[4], "old=; Path=/; Expires=Thu, 01 Jan 1970 00:00:00 GMT; Max-Age=0"), true)
+
+	// Get them in the next request
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range (&http.Response{Header: w.Header()}).Cookies() {
+		req.AddCookie(cookie)
+	}
+	req.AddCookie(&http.Cookie{Name: "forged", Value: Sign("wrong", "forged", "f")})
+	L2 := lua.NewState()
+	defer L2.Close()
+	Load(httptest.NewRecorder(), req, L2, "secret")
+	assert.Equal(t, L2.DoString(`
+		assert(getcookie("plain") == "a")
+		assert(getcookie("signed", {signed = true}) == "b")
+		assert(getcookie("signed") ~= "b")
+		assert(getcookie("secret", {encrypted = true}) == "c")
+		assert(getcookie("secret", {signed = true}) == nil)
+		assert(getcookie("forged", {signed = true}) == nil)
+		assert(getcookie("missing") == nil)
+	`), nil)
+
+	// Signed cookies need a secret
+	L3 := lua.NewState()
+	defer L3.Close()
+	Load(httptest.NewRecorder(), req, L3, "")
+	assert.Equal(t, L3.DoString(`
+		local ok, err = setcookie("signed", "b", {signed = true})
+		assert(ok == nil and err ~= nil)
+		assert(getcookie("signed", {signed = true}) == nil)
+	`), nil)
+}
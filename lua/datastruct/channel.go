@@ -0,0 +1,164 @@
+package datastruct
+
+import (
+	"time"
+
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/gopher-lua"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Identifier for the Channel class in Lua
+const lChannelClass = "CHANNEL"
+
+// channel is a publish/subscribe channel
+type channel struct {
+	store *datastore.Store
+	name  string
+	done  <-chan struct{} // closed when the client disconnects, may be nil
+}
+
+// Get the first argument, "self", and cast it from userdata to a channel
+func checkChannel(L *lua.LState) *channel {
+	ud := L.CheckUserData(1)
+	if ch, ok := ud.Value.(*channel); ok {
+		return ch
+	}
+	L.ArgError(1, "channel expected")
+	return nil
+}
+
+// Returns a channel that is closed after the given number of seconds,
+// or nil if no timeout is given
+func timeoutChannel(L *lua.LState, n int) <-chan time.Time {
+	if L.GetTop() < n {
+		return nil
+	}
+	seconds := float64(L.CheckNumber(n))
+	return time.After(time.Duration(seconds * float64(time.Second)))
+}
+
+// String representation
+// tostring(ch) -> string
+func channelToString(L *lua.LState) int {
+	ch := checkChannel(L) // arg 1
+	L.Push(lua.LString("channel " + ch.name))
+	return 1 // Number of returned values
+}
+
+// Publish a message. Returns the number of subscribers that received it.
+// ch:publish(string) -> number
+func channelPublish(L *lua.LState) int {
+	ch := checkChannel(L) // arg 1
+	message := L.CheckString(2)
+	received, err := ch.store.Publish(ch.name, message)
+	if err != nil {
+		log.Error(err.Error())
+	}
+	L.Push(lua.LNumber(received))
+	return 1 // Number of returned values
+}
+
+// Wait for the next message, for up to the given number of seconds.
+// Returns nil if there was a timeout or if the client disconnected.
+// ch:receive([number]) -> string
+func channelReceive(L *lua.LState) int {
+	ch := checkChannel(L) // arg 1
+	timeout := timeoutChannel(L, 2)
+	sub, err := ch.store.Subscribe(ch.name)
+	if err != nil {
+		log.Error(err.Error())
+		L.Push(lua.LNil)
+		return 1 // Number of returned values
+	}
+	defer sub.Close()
+	select {
+	case msg, ok := <-sub.Messages():
+		if ok {
+			L.Push(lua.LString(msg.Data))
+			return 1 // Number of returned values
+		}
+	case <-timeout:
+	case <-ch.done:
+	}
+	L.Push(lua.LNil)
+	return 1 // Number of returned values
+}
+
+// Call the given function for each message that arrives, until the function
+// returns false, the given number of seconds have passed or the client disconnects.
+// Returns the number of messages that were handled.
+// ch:listen(function, [number]) -> number
+func channelListen(L *lua.LState) int {
+	ch := checkChannel(L) // arg 1
+	f := L.CheckFunction(2)
+	timeout := timeoutChannel(L, 3)
+	sub, err := ch.store.Subscribe(ch.name)
+	if err != nil {
+		log.Error(err.Error())
+		L.Push(lua.LNumber(0))
+		return 1 // Number of returned values
+	}
+	defer sub.Close()
+	handled := 0
+	for {
+		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				L.Push(lua.LNumber(handled))
+				return 1 // Number of returned values
+			}
+			handled++
+			L.Push(f)
+			L.Push(lua.LString(msg.Data))
+			L.Call(1, 1)
+			ret := L.Get(-1)
+			L.Pop(1)
+			if ret == lua.LFalse {
+				L.Push(lua.LNumber(handled))
+				return 1 // Number of returned values
+			}
+		case <-timeout:
+			L.Push(lua.LNumber(handled))
+			return 1 // Number of returned values
+		case <-ch.done:
+			L.Push(lua.LNumber(handled))
+			return 1 // Number of returned values
+		}
+	}
+}
+
+// The channel methods that are to be registered
+var channelMethods = map[string]lua.LGFunction{
+	"__tostring": channelToString,
+	"publish":    channelPublish,
+	"receive":    channelReceive,
+	"listen":     channelListen,
+}
+
+// LoadChannel makes functions related to publish/subscribe channels available
+// to Lua scripts. done should be closed when the client disconnects, and can be nil.
+func LoadChannel(L *lua.LState, stores *datastore.Registry, done <-chan struct{}) {
+
+	// Register the Channel class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(lChannelClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, channelMethods)
+
+	// The constructor for channels takes a name and an optional connection name
+	L.SetGlobal("Channel", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		store, err := stores.Get(L.OptString(2, ""))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // Number of returned values
+		}
+		ud := L.NewUserData()
+		ud.Value = &channel{store, name, done}
+		L.SetMetatable(ud, L.GetTypeMetatable(lChannelClass))
+		L.Push(ud)
+		return 1 // Number of returned values
+	}))
+}
@@ -1,2 +1,31 @@
-// Package datastruct provides Lua functions for dealing with hash maps, key/values, lists and sets
+// Package datastruct provides Lua functions for dealing with hash maps, key/values, lists, sets, sorted sets and channels
 package datastruct
+
+import (
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/gopher-lua"
+)
+
+// Find the Store for the optional arguments from position n and onwards,
+// where a number is a database index and a string is a connection name.
+// The database index of the connection is used if no index is given.
+func storeArgs(L *lua.LState, stores *datastore.Registry, n int) (*datastore.Store, error) {
+	name := ""
+	dbindex := -1
+	for i := n; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LNumber:
+			dbindex = int(v)
+		case lua.LString:
+			name = string(v)
+		}
+	}
+	store, err := stores.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if dbindex >= 0 {
+		store = store.Database(dbindex)
+	}
+	return store, nil
+}
@@ -0,0 +1,202 @@
+package datastruct
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simplebolt"
+)
+
+// setup returns a Lua state with the data structure functions, where the
+// default Store is backed by a new Bolt database
+func setup(t *testing.T) (*lua.LState, *datastore.Registry, func()) {
+	dir, err := ioutil.TempDir("", "datastructtest")
+	assert.Equal(t, err, nil)
+	db, err := simplebolt.New(filepath.Join(dir, "test.db"))
+	assert.Equal(t, err, nil)
+	stores := datastore.NewRegistry(datastore.New(simplebolt.NewCreator(db)))
+	L := lua.NewState()
+	LoadSet(L, stores)
+	LoadList(L, stores)
+	LoadHash(L, stores)
+	LoadKeyValue(L, stores)
+	LoadSortedSet(L, stores)
+	LoadChannel(L, stores, nil)
+	LoadTransaction(L)
+	return L, stores, func() {
+		L.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSortedSet(t *testing.T) {
+	L, _, cleanup := setup(t)
+	defer cleanup()
+	assert.Equal(t, L.DoString(`
+		local zset = SortedSet("scores")
+		assert(zset:add("alice", 30))
+		assert(zset:add("bob", 10))
+		assert(zset:add("carol", 20))
+		assert(zset:size() == 3)
+		assert(zset:inc("bob") == 11)
+		assert(zset:inc("bob", 25) == 36)
+		assert(zset:score("carol") == 20)
+		assert(zset:score("nobody") == nil)
+
+		-- Ranks start at 1
+		assert(zset:rank("carol") == 1)
+		assert(zset:rank("bob", true) == 1)
+		assert(zset:rank("nobody") == nil)
+
+		local members = zset:range(1, -1)
+		assert(#members == 3)
+		assert(members[1].member == "carol" and members[1].score == 20)
+		assert(members[3].member == "bob")
+		members = zset:range(1, 1, true)
+		assert(#members == 1 and members[1].member == "bob")
+		members = zset:rangebyscore(20, 30, true)
+		assert(#members == 2 and members[1].member == "alice" and members[2].member == "carol")
+
+		assert(zset:del("bob"))
+		assert(zset:size() == 2)
+		assert(zset:clear())
+		assert(zset:size() == 0)
+	`), nil)
+}
+
+func TestExpire(t *testing.T) {
+	L, _, cleanup := setup(t)
+	defer cleanup()
+	assert.Equal(t, L.DoString(`
+		local kv = KeyValue("sessions")
+		assert(kv:setex("short", "a", 0.01))
+		assert(kv:setex("long", "b", 3600))
+		assert(kv:set("forever", "c"))
+		assert(kv:ttl("long") > 3590)
+		assert(kv:ttl("forever") == 0)
+
+		local hash = HashMap("carts")
+		assert(hash:set("bob", "apples", "3"))
+		assert(hash:expire("bob", 0.01))
+	`), nil)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, L.DoString(`
+		local kv = KeyValue("sessions")
+		assert(kv:get("short") == "")
+		assert(kv:get("long") == "b")
+		assert(kv:get("forever") == "c")
+		assert(not HashMap("carts"):exists("bob"))
+	`), nil)
+}
+
+func TestDatabaseIndex(t *testing.T) {
+	L, stores, cleanup := setup(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "datastructtest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	db, err := simplebolt.New(filepath.Join(dir, "other.db"))
+	assert.Equal(t, err, nil)
+	defer db.Close()
+	stores.Add("other", datastore.New(simplebolt.NewCreator(db)))
+
+	assert.Equal(t, L.DoString(`
+		assert(KeyValue("settings"):set("color", "red"))
+		assert(KeyValue("settings", 2):set("color", "blue"))
+		assert(KeyValue("settings", "other"):set("color", "green"))
+		assert(KeyValue("settings", 2, "other"):set("color", "white"))
+
+		-- The databases do not share data
+		assert(KeyValue("settings"):get("color") == "red")
+		assert(KeyValue("settings", 2):get("color") == "blue")
+		assert(KeyValue("settings", "other"):get("color") == "green")
+		assert(KeyValue("settings", 2, "other"):get("color") == "white")
+
+		Set("tags", 1):add("blue")
+		assert(Set("tags", 1):has("blue"))
+		assert(#Set("tags"):getall() == 0)
+		List("log", 1):add("first")
+		assert(#List("log"):getall() == 0)
+		assert(SortedSet("scores", 1):add("alice", 1))
+		assert(SortedSet("scores"):size() == 0)
+
+		local kv, err = KeyValue("settings", "nope")
+		assert(kv == nil and err ~= nil)
+	`), nil)
+
+	// The data can also be found from Go
+	kv, err := stores.Default().Database(2).NewKeyValue("settings")
+	assert.Equal(t, err, nil)
+	value, err := kv.Get("color")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, value, "blue")
+}
+
+func TestTransaction(t *testing.T) {
+	L, _, cleanup := setup(t)
+	defer cleanup()
+	assert.Equal(t, L.DoString(`
+		local kv = KeyValue("accounts")
+		kv:set("alice", "10")
+		kv:set("bob", "0")
+
+		-- The changes are written when the function returns
+		assert(transaction(function()
+			kv:set("alice", "5")
+			kv:set("bob", "5")
+			assert(kv:get("alice") == "5")
+			SortedSet("scores"):add("alice", 5)
+		end))
+		assert(kv:get("alice") == "5" and kv:get("bob") == "5")
+		assert(SortedSet("scores"):score("alice") == 5)
+
+		-- The changes are discarded if the function returns false
+		assert(transaction(function()
+			kv:set("alice", "0")
+			return false
+		end) == false)
+		assert(kv:get("alice") == "5")
+
+		-- The changes are discarded if the function raises an error
+		local ok, err = transaction(function()
+			kv:set("alice", "0")
+			error("boom")
+		end)
+		assert(not ok and err ~= nil)
+		assert(kv:get("alice") == "5")
+	`), nil)
+}
+
+func TestChannel(t *testing.T) {
+	L, stores, cleanup := setup(t)
+	defer cleanup()
+
+	// Publish until the message has been received
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				stores.Default().Publish("news", "hello")
+			}
+		}
+	}()
+	assert.Equal(t, L.DoString(`
+		local ch = Channel("news")
+		assert(ch:receive(5) == "hello")
+		assert(Channel("quiet"):receive(0.01) == nil)
+		assert(Channel("quiet"):publish("nobody") == 0)
+		local ch, err = Channel("news", "nope")
+		assert(ch == nil and err ~= nil)
+	`), nil)
+}
@@ -2,7 +2,10 @@ package datastruct
 
 import (
 	"strings"
+	"time"
 
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/datastore"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
@@ -15,6 +18,8 @@ const lHashClass = "HASH"
 func checkHash(L *lua.LState) pinterface.IHashMap {
 	ud := L.CheckUserData(1)
 	if hash, ok := ud.Value.(pinterface.IHashMap); ok {
+		// Make the changes part of the transaction, if one is running
+		attach(L, hash)
 		return hash
 	}
 	L.ArgError(1, "hash map expected")
@@ -23,7 +28,6 @@ func checkHash(L *lua.LState) pinterface.IHashMap {
 
 // Create a new hash map.
 // id is the name of the hash map.
-// dbindex is the Redis database index (typically 0).
 func newHashMap(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LUserData, error) {
 	// Create a new hash map
 	hash, err := creator.NewHashMap(id)
@@ -157,6 +161,23 @@ func hashDel(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Make an element (for instance a session), with all of its keys, expire
+// after the given number of seconds. Returns true if successful.
+// hash:expire(string, number) -> bool
+func hashExpire(L *lua.LState) int {
+	hash := checkHash(L) // arg 1
+	elementid := L.CheckString(2)
+	seconds := float64(L.CheckNumber(3))
+	ehash, ok := hash.(datastore.ExpiringHashMap)
+	if !ok {
+		log.Error("hash:expire is not supported by this database backend")
+		L.Push(lua.LBool(false))
+		return 1 // Number of returned values
+	}
+	L.Push(lua.LBool(nil == ehash.Expire(elementid, time.Duration(seconds*float64(time.Second)))))
+	return 1 // Number of returned values
+}
+
 // Remove the hash map itself. Returns true if successful.
 // hash:remove() -> bool
 func hashRemove(L *lua.LState) int {
@@ -184,35 +205,35 @@ var hashMethods = map[string]lua.LGFunction{
 	"keys":       hashKeys,
 	"delkey":     hashDelKey,
 	"del":        hashDel,
+	"expire":     hashExpire,
 	"remove":     hashRemove,
 	"clear":      hashClear,
 }
 
 // LoadHash makes functions related to HTTP requests and responses available to Lua scripts
-func LoadHash(L *lua.LState, creator pinterface.ICreator) {
+func LoadHash(L *lua.LState, stores *datastore.Registry) {
 
 	// Register the hash map class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lHashClass)
 	mt.RawSetH(lua.LString("__index"), mt)
 	L.SetFuncs(mt, hashMethods)
 
-	// The constructor for new hash maps takes a name and an optional redis db index
+	// The constructor for new hash maps takes a name, an optional database index
+	// and an optional connection name
 	L.SetGlobal("HashMap", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 
-		// Check if the optional argument is given
-		if L.GetTop() == 2 {
-			localDBIndex := L.ToInt(2)
-
-			// Set the DB index, if possible
-			switch rh := creator.(type) {
-			case pinterface.IRedisCreator:
-				rh.SelectDatabase(localDBIndex)
-			}
+		// Find the database, without changing it for other scripts
+		store, err := storeArgs(L, stores, 2)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			L.Push(lua.LNumber(1))
+			return 3 // Number of returned values
 		}
 
 		// Create a new hash map in Lua
-		userdata, err := newHashMap(L, creator, name)
+		userdata, err := newHashMap(L, store, name)
 		if err != nil {
 			L.Push(lua.LNil)
 			L.Push(lua.LString(err.Error()))
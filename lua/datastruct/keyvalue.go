@@ -1,6 +1,9 @@
 package datastruct
 
 import (
+	"time"
+
+	"github.com/xyproto/algernon/datastore"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
 
@@ -14,6 +17,8 @@ const lKeyValueClass = "KEYVALUE"
 func checkKeyValue(L *lua.LState) pinterface.IKeyValue {
 	ud := L.CheckUserData(1)
 	if kv, ok := ud.Value.(pinterface.IKeyValue); ok {
+		// Make the changes part of the transaction, if one is running
+		attach(L, kv)
 		return kv
 	}
 	L.ArgError(1, "keyvalue expected")
@@ -22,7 +27,6 @@ func checkKeyValue(L *lua.LState) pinterface.IKeyValue {
 
 // Create a new KeyValue collection.
 // id is the name of the KeyValue collection.
-// dbindex is the Redis database index (typically 0).
 func newKeyValue(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LUserData, error) {
 	// Create a new key/value
 	kv, err := creator.NewKeyValue(id)
@@ -54,6 +58,38 @@ func kvSet(L *lua.LState) int {
 	return 1 // Number of returned values
 }
 
+// Set a key and value that expires after the given number of seconds.
+// Returns true if successful.
+// kv:setex(string, string, number) -> bool
+func kvSetEx(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	key := L.CheckString(2)
+	value := L.ToString(3)
+	seconds := float64(L.CheckNumber(4))
+	ekv, ok := kv.(datastore.ExpiringKeyValue)
+	if !ok {
+		log.Error("kv:setex is not supported by this database backend")
+		L.Push(lua.LBool(false))
+		return 1 // Number of returned values
+	}
+	L.Push(lua.LBool(nil == ekv.SetExpire(key, value, time.Duration(seconds*float64(time.Second)))))
+	return 1 // Number of returned values
+}
+
+// Takes a key, returns the number of seconds until the key expires,
+// or 0 if the key does not expire.
+// kv:ttl(string) -> number
+func kvTTL(L *lua.LState) int {
+	kv := checkKeyValue(L) // arg 1
+	key := L.CheckString(2)
+	var ttl time.Duration
+	if ekv, ok := kv.(datastore.ExpiringKeyValue); ok {
+		ttl, _ = ekv.TimeToLive(key)
+	}
+	L.Push(lua.LNumber(ttl.Seconds()))
+	return 1 // Number of returned values
+}
+
 // Takes a key, returns a value. May return an empty string.
 // kv:get(string) -> string
 func kvGet(L *lua.LState) int {
@@ -113,6 +149,8 @@ func kvClear(L *lua.LState) int {
 var kvMethods = map[string]lua.LGFunction{
 	"__tostring": kvToString,
 	"set":        kvSet,
+	"setex":      kvSetEx,
+	"ttl":        kvTTL,
 	"get":        kvGet,
 	"inc":        kvInc,
 	"del":        kvDel,
@@ -121,30 +159,29 @@ var kvMethods = map[string]lua.LGFunction{
 }
 
 // LoadKeyValue makes functions related to HTTP requests and responses available to Lua scripts
-func LoadKeyValue(L *lua.LState, creator pinterface.ICreator) {
+func LoadKeyValue(L *lua.LState, stores *datastore.Registry) {
 
 	// Register the KeyValue class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lKeyValueClass)
 	mt.RawSetH(lua.LString("__index"), mt)
 	L.SetFuncs(mt, kvMethods)
 
-	// The constructor for new KeyValues takes a name and an optional redis db index
+	// The constructor for new KeyValues takes a name, an optional database index
+	// and an optional connection name
 	L.SetGlobal("KeyValue", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 
-		// Check if the optional argument is given
-		if L.GetTop() == 2 {
-			localDBIndex := L.ToInt(2)
-
-			// Set the DB index, if possible
-			switch rh := creator.(type) {
-			case pinterface.IRedisCreator:
-				rh.SelectDatabase(localDBIndex)
-			}
+		// Find the database, without changing it for other scripts
+		store, err := storeArgs(L, stores, 2)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			L.Push(lua.LNumber(1))
+			return 3 // Number of returned values
 		}
 
 		// Create a new keyvalue in Lua
-		userdata, err := newKeyValue(L, creator, name)
+		userdata, err := newKeyValue(L, store, name)
 		if err != nil {
 			L.Push(lua.LNil)
 			L.Push(lua.LString(err.Error()))
@@ -3,6 +3,7 @@ package datastruct
 import (
 	"strings"
 
+	"github.com/xyproto/algernon/datastore"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
@@ -20,6 +21,8 @@ const (
 func checkList(L *lua.LState) pinterface.IList {
 	ud := L.CheckUserData(1)
 	if list, ok := ud.Value.(pinterface.IList); ok {
+		// Make the changes part of the transaction, if one is running
+		attach(L, list)
 		return list
 	}
 	L.ArgError(1, "list expected")
@@ -28,7 +31,6 @@ func checkList(L *lua.LState) pinterface.IList {
 
 // Create a new list.
 // id is the name of the list.
-// dbindex is the Redis database index (typically 0).
 func newList(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LUserData, error) {
 	// Create a new list
 	list, err := creator.NewList(id)
@@ -152,30 +154,29 @@ var listMethods = map[string]lua.LGFunction{
 }
 
 // LoadList makes functions related to HTTP requests and responses available to Lua scripts
-func LoadList(L *lua.LState, creator pinterface.ICreator) {
+func LoadList(L *lua.LState, stores *datastore.Registry) {
 
 	// Register the list class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lListClass)
 	mt.RawSetH(lua.LString("__index"), mt)
 	L.SetFuncs(mt, listMethods)
 
-	// The constructor for new lists takes a name and an optional redis db index
+	// The constructor for new lists takes a name, an optional database index
+	// and an optional connection name
 	L.SetGlobal("List", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 
-		// Check if the optional argument is given
-		if L.GetTop() == 2 {
-			localDBIndex := L.ToInt(2)
-
-			// Set the DB index, if possible
-			switch rh := creator.(type) {
-			case pinterface.IRedisCreator:
-				rh.SelectDatabase(localDBIndex)
-			}
+		// Find the database, without changing it for other scripts
+		store, err := storeArgs(L, stores, 2)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			L.Push(lua.LNumber(1))
+			return 3 // Number of returned values
 		}
 
 		// Create a new list in Lua
-		userdata, err := newList(L, creator, name)
+		userdata, err := newList(L, store, name)
 		if err != nil {
 			L.Push(lua.LNil)
 			L.Push(lua.LString(err.Error()))
@@ -3,6 +3,7 @@ package datastruct
 import (
 	"strings"
 
+	"github.com/xyproto/algernon/datastore"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
@@ -15,6 +16,8 @@ const lSetClass = "SET"
 func checkSet(L *lua.LState) pinterface.ISet {
 	ud := L.CheckUserData(1)
 	if set, ok := ud.Value.(pinterface.ISet); ok {
+		// Make the changes part of the transaction, if one is running
+		attach(L, set)
 		return set
 	}
 	L.ArgError(1, "set expected")
@@ -23,7 +26,6 @@ func checkSet(L *lua.LState) pinterface.ISet {
 
 // Create a new set.
 // id is the name of the set.
-// dbindex is the Redis database index (typically 0).
 func newSet(L *lua.LState, creator pinterface.ICreator, id string) (*lua.LUserData, error) {
 	// Create a new set
 	set, err := creator.NewSet(id)
@@ -125,30 +127,29 @@ var setMethods = map[string]lua.LGFunction{
 }
 
 // LoadSet makes functions related to HTTP requests and responses available to Lua scripts
-func LoadSet(L *lua.LState, creator pinterface.ICreator) {
+func LoadSet(L *lua.LState, stores *datastore.Registry) {
 
 	// Register the set class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(lSetClass)
 	mt.RawSetH(lua.LString("__index"), mt)
 	L.SetFuncs(mt, setMethods)
 
-	// The constructor for new sets takes a name and an optional redis db index
+	// The constructor for new sets takes a name, an optional database index
+	// and an optional connection name
 	L.SetGlobal("Set", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 
-		// Check if the optional argument is given
-		if L.GetTop() == 2 {
-			localDBIndex := L.ToInt(2)
-
-			// Set the DB index, if possible
-			switch rh := creator.(type) {
-			case pinterface.IRedisCreator:
-				rh.SelectDatabase(localDBIndex)
-			}
+		// Find the database, without changing it for other scripts
+		store, err := storeArgs(L, stores, 2)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			L.Push(lua.LNumber(1))
+			return 3 // Number of returned values
 		}
 
 		// Create a new set in Lua
-		userdata, err := newSet(L, creator, name)
+		userdata, err := newSet(L, store, name)
 		if err != nil {
 			L.Push(lua.LNil)
 			L.Push(lua.LString(err.Error()))
@@ -0,0 +1,245 @@
+package datastruct
+
+import (
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/gopher-lua"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Identifier for the SortedSet class in Lua
+const lSortedSetClass = "SORTEDSET"
+
+// Get the first argument, "self", and cast it from userdata to a sorted set
+func checkSortedSet(L *lua.LState) datastore.SortedSet {
+	ud := L.CheckUserData(1)
+	if zset, ok := ud.Value.(datastore.SortedSet); ok {
+		// Make the changes part of the transaction, if one is running
+		attach(L, zset)
+		return zset
+	}
+	L.ArgError(1, "sorted set expected")
+	return nil
+}
+
+// Create a new sorted set.
+// id is the name of the sorted set.
+func newSortedSet(L *lua.LState, store *datastore.Store, id string) (*lua.LUserData, error) {
+	// Create a new sorted set
+	zset, err := store.NewSortedSet(id)
+	if err != nil {
+		return nil, err
+	}
+	// Create a new userdata struct
+	ud := L.NewUserData()
+	ud.Value = zset
+	L.SetMetatable(ud, L.GetTypeMetatable(lSortedSetClass))
+	return ud, nil
+}
+
+// Convert a rank from Lua (starting at 1) to a rank that starts at 0.
+// Negative ranks count from the end in both cases.
+func fromLuaRank(rank int64) int64 {
+	if rank > 0 {
+		return rank - 1
+	}
+	return rank
+}
+
+// Convert members to a Lua table with one table per member,
+// with the "member" and "score" fields
+func membersTable(L *lua.LState, members []datastore.Member) *lua.LTable {
+	table := L.NewTable()
+	for _, m := range members {
+		row := L.NewTable()
+		row.RawSetString("member", lua.LString(m.Name))
+		row.RawSetString("score", lua.LNumber(m.Score))
+		table.Append(row)
+	}
+	return table
+}
+
+// String representation
+// tostring(zset) -> string
+func zsetToString(L *lua.LState) int {
+	L.Push(lua.LString("sortedset"))
+	return 1 // Number of returned values
+}
+
+// Add a member with a score, or update the score. Returns true if successful.
+// zset:add(string, number) -> bool
+func zsetAdd(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.CheckString(2)
+	score := float64(L.CheckNumber(3))
+	L.Push(lua.LBool(nil == zset.Add(member, score)))
+	return 1 // Number of returned values
+}
+
+// Increase the score of a member by the given number (or 1) and return the new score.
+// The member is added if it does not exist.
+// zset:inc(string, [number]) -> number
+func zsetInc(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.CheckString(2)
+	delta := float64(L.OptNumber(3, 1))
+	score, err := zset.Inc(member, delta)
+	if err != nil {
+		log.Error(err.Error())
+	}
+	L.Push(lua.LNumber(score))
+	return 1 // Number of returned values
+}
+
+// Get the score of a member, or nil
+// zset:score(string) -> number
+func zsetScore(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.CheckString(2)
+	score, err := zset.Score(member)
+	if err != nil {
+		L.Push(lua.LNil)
+		return 1 // Number of returned values
+	}
+	L.Push(lua.LNumber(score))
+	return 1 // Number of returned values
+}
+
+// Get the rank of a member, starting at 1 for the lowest score
+// (or the highest score, if reverse is true), or nil
+// zset:rank(string, [bool]) -> number
+func zsetRank(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.CheckString(2)
+	reverse := L.OptBool(3, false)
+	rank, err := zset.Rank(member, reverse)
+	if err != nil {
+		L.Push(lua.LNil)
+		return 1 // Number of returned values
+	}
+	L.Push(lua.LNumber(rank + 1))
+	return 1 // Number of returned values
+}
+
+// Remove a member. Returns true if successful.
+// zset:del(string) -> bool
+func zsetDel(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	member := L.CheckString(2)
+	L.Push(lua.LBool(nil == zset.Del(member)))
+	return 1 // Number of returned values
+}
+
+// Get the number of members
+// zset:size() -> number
+func zsetSize(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	size, err := zset.Size()
+	if err != nil {
+		log.Error(err.Error())
+	}
+	L.Push(lua.LNumber(size))
+	return 1 // Number of returned values
+}
+
+// Get the members from one rank to another, inclusive. Ranks start at 1 and
+// negative ranks count from the end. If reverse is true, the highest scores
+// come first. Returns a table of tables with the "member" and "score" fields.
+// zset:range(number, number, [bool]) -> table
+func zsetRange(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	start := fromLuaRank(int64(L.CheckInt(2)))
+	stop := fromLuaRank(int64(L.CheckInt(3)))
+	reverse := L.OptBool(4, false)
+	members, err := zset.Range(start, stop, reverse)
+	if err != nil {
+		log.Error(err.Error())
+	}
+	L.Push(membersTable(L, members))
+	return 1 // Number of returned values
+}
+
+// Get the members with a score from min to max, inclusive. If reverse is true,
+// the highest scores come first. Returns a table of tables with the "member"
+// and "score" fields.
+// zset:rangebyscore(number, number, [bool]) -> table
+func zsetRangeByScore(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	min := float64(L.CheckNumber(2))
+	max := float64(L.CheckNumber(3))
+	reverse := L.OptBool(4, false)
+	members, err := zset.RangeByScore(min, max, reverse)
+	if err != nil {
+		log.Error(err.Error())
+	}
+	L.Push(membersTable(L, members))
+	return 1 // Number of returned values
+}
+
+// Remove the sorted set itself. Returns true if successful.
+// zset:remove() -> bool
+func zsetRemove(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	L.Push(lua.LBool(nil == zset.Remove()))
+	return 1 // Number of returned values
+}
+
+// Clear the sorted set. Returns true if successful.
+// zset:clear() -> bool
+func zsetClear(L *lua.LState) int {
+	zset := checkSortedSet(L) // arg 1
+	L.Push(lua.LBool(nil == zset.Clear()))
+	return 1 // Number of returned values
+}
+
+// The sorted set methods that are to be registered
+var zsetMethods = map[string]lua.LGFunction{
+	"__tostring":   zsetToString,
+	"add":          zsetAdd,
+	"inc":          zsetInc,
+	"score":        zsetScore,
+	"rank":         zsetRank,
+	"del":          zsetDel,
+	"size":         zsetSize,
+	"range":        zsetRange,
+	"rangebyscore": zsetRangeByScore,
+	"remove":       zsetRemove,
+	"clear":        zsetClear,
+}
+
+// LoadSortedSet makes functions related to sorted sets available to Lua scripts
+func LoadSortedSet(L *lua.LState, stores *datastore.Registry) {
+
+	// Register the SortedSet class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(lSortedSetClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, zsetMethods)
+
+	// The constructor for new sorted sets takes a name, an optional database
+	// index and an optional connection name
+	L.SetGlobal("SortedSet", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+
+		// Find the database, without changing it for other scripts
+		store, err := storeArgs(L, stores, 2)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			L.Push(lua.LNumber(1))
+			return 3 // Number of returned values
+		}
+
+		// Create a new sorted set in Lua
+		userdata, err := newSortedSet(L, store, name)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			L.Push(lua.LNumber(1))
+			return 3 // Number of returned values
+		}
+
+		// Return the sorted set object
+		L.Push(userdata)
+		return 1 // Number of returned values
+	}))
+}
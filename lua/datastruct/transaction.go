@@ -0,0 +1,78 @@
+package datastruct
+
+import (
+	"sync"
+
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The transactions that are running, per Lua state
+var (
+	transactions    = make(map[*lua.LState]*datastore.Tx)
+	transactionsMut sync.RWMutex
+)
+
+// Find the transaction that is running for the given Lua state, or nil
+func runningTransaction(L *lua.LState) *datastore.Tx {
+	transactionsMut.RLock()
+	defer transactionsMut.RUnlock()
+	return transactions[L]
+}
+
+// Attach a data structure to the transaction that is running for the given Lua state, if any
+func attach(L *lua.LState, v interface{}) {
+	if tx := runningTransaction(L); tx != nil {
+		tx.Attach(v)
+	}
+}
+
+// Run the given function as a transaction. Changes to hash maps, key/values,
+// lists, sets and sorted sets are written when the function returns, or
+// discarded if the function raises an error or returns false. If the data
+// structures that were read are changed by others in the meantime, the
+// function is run again.
+// Returns true if successful, or false and an error message.
+// transaction(function) -> bool, [string]
+func transaction(L *lua.LState) int {
+	f := L.CheckFunction(1)
+	if runningTransaction(L) != nil {
+		// A nested transaction is part of the outer transaction
+		L.Push(f)
+		L.Call(0, 0)
+		L.Push(lua.LTrue)
+		return 1 // Number of returned values
+	}
+	err := datastore.Transaction(func(tx *datastore.Tx) error {
+		transactionsMut.Lock()
+		transactions[L] = tx
+		transactionsMut.Unlock()
+		defer func() {
+			transactionsMut.Lock()
+			delete(transactions, L)
+			transactionsMut.Unlock()
+		}()
+		L.Push(f)
+		if err := L.PCall(0, 1, nil); err != nil {
+			return err
+		}
+		ret := L.Get(-1)
+		L.Pop(1)
+		if ret == lua.LFalse {
+			return datastore.ErrRollback
+		}
+		return nil
+	})
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2 // Number of returned values
+	}
+	L.Push(lua.LTrue)
+	return 1 // Number of returned values
+}
+
+// LoadTransaction makes the transaction function available to Lua scripts
+func LoadTransaction(L *lua.LState) {
+	L.SetGlobal("transaction", L.NewFunction(transaction))
+}
@@ -0,0 +1,469 @@
+// Package httpclient provides a Lua type for sending HTTP requests
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/jpath"
+)
+
+const (
+	// Identifier for the HTTPClient class in Lua
+	lHTTPClientClass = "HTTPClient"
+
+	// The default timeout for each request
+	defaultTimeout = 30 * time.Second
+
+	// The default maximum number of redirects to follow
+	defaultRedirects = 10
+
+	// The default maximum size of a response body, in bytes
+	defaultMaxBody = 10 * 1024 * 1024
+)
+
+// client is an HTTP client in Lua, with headers that are sent with every request
+type client struct {
+	http         *http.Client
+	headers      http.Header
+	maxRedirects int
+	maxBody      int64 // 0 means no limit
+}
+
+// newClient returns a client with a cookie jar, if cookies are enabled
+func newClient(cookies bool) *client {
+	c := &client{
+		http:         &http.Client{Timeout: defaultTimeout},
+		headers:      make(http.Header),
+		maxRedirects: defaultRedirects,
+		maxBody:      defaultMaxBody,
+	}
+	if cookies {
+		// cookiejar.New only returns an error if the options are invalid
+		c.http.Jar, _ = cookiejar.New(nil)
+	}
+	c.http.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > c.maxRedirects {
+			// Return the redirect response instead of following it
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	return c
+}
+
+// Get the first argument, "self", and cast it from userdata to a client
+func checkClient(L *lua.LState) *client {
+	ud := L.CheckUserData(1)
+	if c, ok := ud.Value.(*client); ok {
+		return c
+	}
+	L.ArgError(1, "HTTP client expected")
+	return nil
+}
+
+// seconds converts a number of seconds to a duration
+func seconds(n lua.LNumber) time.Duration {
+	return time.Duration(float64(n) * float64(time.Second))
+}
+
+// stringMap converts a Lua table to a map of strings, where the values may
+// also be lists of strings, for keys that are repeated
+func stringMap(table *lua.LTable) map[string][]string {
+	m := make(map[string][]string)
+	table.ForEach(func(key, value lua.LValue) {
+		k := key.String()
+		if list, ok := value.(*lua.LTable); ok {
+			list.ForEach(func(_, v lua.LValue) {
+				m[k] = append(m[k], v.String())
+			})
+			return
+		}
+		m[k] = append(m[k], value.String())
+	})
+	return m
+}
+
+// jsonBody encodes a string, table or JNode as JSON
+func jsonBody(value lua.LValue) ([]byte, error) {
+	switch v := value.(type) {
+	case lua.LString:
+		return []byte(v), nil
+	case *lua.LTable:
+		return json.Marshal(toGo(v))
+	case *lua.LUserData:
+		if node, ok := v.Value.(*jpath.Node); ok {
+			return node.JSON()
+		}
+	}
+	return nil, errors.New("json must be a string, a table or a JNode")
+}
+
+// toGo converts a Lua value to a value that can be encoded as JSON.
+// Tables with the keys 1 to n become lists, and other tables become maps.
+func toGo(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if n := v.Len(); n > 0 {
+			count := 0
+			v.ForEach(func(_, _ lua.LValue) { count++ })
+			if count == n {
+				list := make([]interface{}, n)
+				for i := 1; i <= n; i++ {
+					list[i-1] = toGo(v.RawGetInt(i))
+				}
+				return list
+			}
+		}
+		m := make(map[string]interface{})
+		v.ForEach(func(key, item lua.LValue) {
+			m[key.String()] = toGo(item)
+		})
+		return m
+	}
+	return nil
+}
+
+// multipartBody encodes a table as multipart/form-data. String values are
+// form fields and tables with "filename" and "content" are files.
+func multipartBody(table *lua.LTable) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	var err error
+	table.ForEach(func(key, value lua.LValue) {
+		if err != nil {
+			return
+		}
+		name := key.String()
+		file, ok := value.(*lua.LTable)
+		if !ok {
+			err = w.WriteField(name, value.String())
+			return
+		}
+		filename := name
+		if value := file.RawGetString("filename"); value != lua.LNil {
+			filename = value.String()
+		}
+		var part io.Writer
+		if contentType := file.RawGetString("content_type"); contentType != lua.LNil {
+			header := make(map[string][]string)
+			header["Content-Disposition"] = []string{fmt.Sprintf(`form-data; name="%s"; filename="%s"`, name, filename)}
+			header["Content-Type"] = []string{contentType.String()}
+			part, err = w.CreatePart(header)
+		} else {
+			part, err = w.CreateFormFile(name, filename)
+		}
+		if err != nil {
+			return
+		}
+		_, err = io.WriteString(part, file.RawGetString("content").String())
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+// newRequest creates a request from the method, URL and a table of options
+func (c *client) newRequest(ctx context.Context, method, rawurl string, options *lua.LTable) (*http.Request, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("URL must start with http or https")
+	}
+	var (
+		body        []byte
+		contentType string
+	)
+	if options != nil {
+		if query, ok := options.RawGetString("query").(*lua.LTable); ok {
+			values := u.Query()
+			for key, list := range stringMap(query) {
+				for _, value := range list {
+					values.Add(key, value)
+				}
+			}
+			u.RawQuery = values.Encode()
+		}
+		if s, ok := options.RawGetString("body").(lua.LString); ok {
+			body = []byte(s)
+		}
+		if form, ok := options.RawGetString("form").(*lua.LTable); ok {
+			body = []byte(url.Values(stringMap(form)).Encode())
+			contentType = "application/x-www-form-urlencoded"
+		}
+		if value := options.RawGetString("json"); value != lua.LNil {
+			if body, err = jsonBody(value); err != nil {
+				return nil, err
+			}
+			contentType = "application/json; charset=utf-8"
+		}
+		if parts, ok := options.RawGetString("multipart").(*lua.LTable); ok {
+			if body, contentType, err = multipartBody(parts); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range c.headers {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if options != nil {
+		if headers, ok := options.RawGetString("headers").(*lua.LTable); ok {
+			for key, values := range stringMap(headers) {
+				req.Header.Del(key)
+				for _, value := range values {
+					req.Header.Add(key, value)
+				}
+			}
+		}
+	}
+	return req, nil
+}
+
+// response converts a response to a Lua table
+func response(L *lua.LState, resp *http.Response, body []byte) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("status", lua.LNumber(resp.StatusCode))
+	table.RawSetString("status_text", lua.LString(resp.Status))
+	table.RawSetString("body", lua.LString(body))
+	table.RawSetString("url", lua.LString(resp.Request.URL.String()))
+	headers := L.NewTable()
+	for key, values := range resp.Header {
+		headers.RawSetString(key, lua.LString(strings.Join(values, ", ")))
+	}
+	table.RawSetString("headers", headers)
+	cookies := L.NewTable()
+	for _, cookie := range resp.Cookies() {
+		cookies.RawSetString(cookie.Name, lua.LString(cookie.Value))
+	}
+	table.RawSetString("cookies", cookies)
+	return table
+}
+
+// readBody reads a response body, but returns an error if it is larger than
+// maxBody bytes. 0 means no limit.
+func readBody(r io.Reader, maxBody int64) ([]byte, error) {
+	if maxBody <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBody {
+		return nil, fmt.Errorf("the response body is larger than %d bytes", maxBody)
+	}
+	return body, nil
+}
+
+// do sends a request and pushes the response table, or nil and an error message
+func (c *client) do(L *lua.LState, method, rawurl string, options *lua.LTable) int {
+	ctx := context.Background()
+	maxBody := c.maxBody
+	if options != nil {
+		if timeout, ok := options.RawGetString("timeout").(lua.LNumber); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, seconds(timeout))
+			defer cancel()
+		}
+		if n, ok := options.RawGetString("maxbody").(lua.LNumber); ok {
+			maxBody = int64(n)
+		}
+	}
+	req, err := c.newRequest(ctx, method, rawurl, options)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp.Body, maxBody)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(response(L, resp, body))
+	return 1 // number of results
+}
+
+// String representation
+// tostring(client) -> string
+func clientToString(L *lua.LState) int {
+	checkClient(L) // arg 1
+	L.Push(lua.LString("HTTP client"))
+	return 1 // number of results
+}
+
+// Send a request with any method.
+// client:request(string, string, [table]) -> table | nil, string
+func clientRequest(L *lua.LState) int {
+	c := checkClient(L) // arg 1
+	method := strings.ToUpper(L.CheckString(2))
+	return c.do(L, method, L.CheckString(3), L.OptTable(4, nil))
+}
+
+// Returns a function for sending requests with the given method.
+// client:get(string, [table]) -> table | nil, string
+func methodFunction(method string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		c := checkClient(L) // arg 1
+		return c.do(L, method, L.CheckString(2), L.OptTable(3, nil))
+	}
+}
+
+// Set a header that is sent with every request. An empty value removes the header.
+// client:header(string, string)
+func clientHeader(L *lua.LState) int {
+	c := checkClient(L) // arg 1
+	key := L.CheckString(2)
+	value := L.OptString(3, "")
+	if value == "" {
+		c.headers.Del(key)
+	} else {
+		c.headers.Set(key, value)
+	}
+	return 0 // number of results
+}
+
+// Set the timeout for each request, in seconds. 0 means no timeout.
+// client:timeout(number)
+func clientTimeout(L *lua.LState) int {
+	c := checkClient(L) // arg 1
+	c.http.Timeout = seconds(L.CheckNumber(2))
+	return 0 // number of results
+}
+
+// Set the maximum number of redirects to follow. 0 means that redirects are returned.
+// client:redirects(number)
+func clientRedirects(L *lua.LState) int {
+	c := checkClient(L) // arg 1
+	c.maxRedirects = L.CheckInt(2)
+	return 0 // number of results
+}
+
+// Set the maximum size of a response body, in bytes. 0 means no limit.
+// client:maxbody(number)
+func clientMaxBody(L *lua.LState) int {
+	c := checkClient(L) // arg 1
+	c.maxBody = int64(L.CheckNumber(2))
+	return 0 // number of results
+}
+
+// Return the cookies that will be sent to the given URL.
+// client:cookies(string) -> table
+func clientCookies(L *lua.LState) int {
+	c := checkClient(L) // arg 1
+	u, err := url.Parse(L.CheckString(2))
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+	table := L.NewTable()
+	if c.http.Jar != nil {
+		for _, cookie := range c.http.Jar.Cookies(u) {
+			table.RawSetString(cookie.Name, lua.LString(cookie.Value))
+		}
+	}
+	L.Push(table)
+	return 1 // number of results
+}
+
+// The HTTP client methods that are to be registered
+var clientMethods = map[string]lua.LGFunction{
+	"__tostring": clientToString,
+	"request":    clientRequest,
+	"get":        methodFunction(http.MethodGet),
+	"head":       methodFunction(http.MethodHead),
+	"post":       methodFunction(http.MethodPost),
+	"put":        methodFunction(http.MethodPut),
+	"patch":      methodFunction(http.MethodPatch),
+	"delete":     methodFunction(http.MethodDelete),
+	"header":     clientHeader,
+	"timeout":    clientTimeout,
+	"redirects":  clientRedirects,
+	"maxbody":    clientMaxBody,
+	"cookies":    clientCookies,
+}
+
+// Load makes the HTTPClient function available to Lua scripts.
+// HTTPClient takes an optional table with "timeout", "redirects", "maxbody",
+// "headers" and "cookies".
+func Load(L *lua.LState) {
+
+	// Register the HTTPClient class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(lHTTPClientClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, clientMethods)
+
+	// The constructor for HTTP clients takes an optional table of options
+	L.SetGlobal("HTTPClient", L.NewFunction(func(L *lua.LState) int {
+		options := L.OptTable(1, nil)
+		cookies := true
+		if options != nil && options.RawGetString("cookies") == lua.LFalse {
+			cookies = false
+		}
+		c := newClient(cookies)
+		if options != nil {
+			if timeout, ok := options.RawGetString("timeout").(lua.LNumber); ok {
+				c.http.Timeout = seconds(timeout)
+			}
+			if redirects, ok := options.RawGetString("redirects").(lua.LNumber); ok {
+				c.maxRedirects = int(redirects)
+			}
+			if maxBody, ok := options.RawGetString("maxbody").(lua.LNumber); ok {
+				c.maxBody = int64(maxBody)
+			}
+			if headers, ok := options.RawGetString("headers").(*lua.LTable); ok {
+				for key, values := range stringMap(headers) {
+					c.headers[http.CanonicalHeaderKey(key)] = values
+				}
+			}
+		}
+		ud := L.NewUserData()
+		ud.Value = c
+		L.SetMetatable(ud, L.GetTypeMetatable(lHTTPClientClass))
+		L.Push(ud)
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,181 @@
+package httpclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// newServer returns a server that describes each request it receives
+func newServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Method", r.Method)
+		json.NewEncoder(w).Encode(map[string]string{
+			"method":       r.Method,
+			"query":        r.URL.RawQuery,
+			"content_type": r.Header.Get("Content-Type"),
+			"token":        r.Header.Get("X-Token"),
+			"agent":        r.Header.Get("User-Agent"),
+			"body":         string(body),
+		})
+	})
+	mux.HandleFunc("/form", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			r.ParseForm()
+		}
+		fmt.Fprint(w, r.Form.Get("name"))
+		if r.MultipartForm != nil {
+			if files := r.MultipartForm.File["upload"]; len(files) == 1 {
+				f, _ := files[0].Open()
+				data, _ := ioutil.ReadAll(f)
+				f.Close()
+				fmt.Fprintf(w, " %s %s", files[0].Filename, data)
+			}
+		}
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		http.Redirect(w, r, "/private", http.StatusFound)
+	})
+	mux.HandleFunc("/private", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err == nil && c.Value == "abc" {
+			fmt.Fprint(w, "welcome")
+			return
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(w, "done")
+	})
+	return httptest.NewServer(mux)
+}
+
+func run(t *testing.T, code string) {
+	server := newServer()
+	defer server.Close()
+	L := lua.NewState()
+	defer L.Close()
+	Load(L)
+	L.SetGlobal("URL", lua.LString(server.URL))
+	// A minimal JSON decoder for the tests, for checking the echoed requests
+	L.SetGlobal("decode", L.NewFunction(func(L *lua.LState) int {
+		var m map[string]string
+		json.Unmarshal([]byte(L.CheckString(1)), &m)
+		table := L.NewTable()
+		for k, v := range m {
+			table.RawSetString(k, lua.LString(v))
+		}
+		L.Push(table)
+		return 1
+	}))
+	assert.Equal(t, L.DoString(code), nil)
+}
+
+func TestRequests(t *testing.T) {
+	run(t, `
+		local client = HTTPClient({headers = {["User-Agent"] = "algernon-test"}})
+		local resp = client:get(URL .. "/echo", {query = {q = "a b", n = {"1", "2"}}, headers = {["X-Token"] = "secret"}})
+		assert(resp.status == 200)
+		assert(resp.status_text == "200 OK")
+		assert(resp.headers["Content-Type"] == "application/json")
+		local echo = decode(resp.body)
+		assert(echo.method == "GET")
+		assert(echo.query == "n=1&n=2&q=a+b")
+		assert(echo.token == "secret")
+		assert(echo.agent == "algernon-test")
+
+		resp = client:request("options", URL .. "/echo")
+		assert(resp.headers["X-Method"] == "OPTIONS")
+
+		resp = client:head(URL .. "/echo")
+		assert(resp.status == 200 and resp.body == "")
+
+		echo = decode(client:post(URL .. "/echo", {json = {name = "Bob", tags = {"a", "b"}, admin = true}}).body)
+		assert(echo.content_type == "application/json; charset=utf-8")
+		assert(echo.body == '{"admin":true,"name":"Bob","tags":["a","b"]}')
+
+		echo = decode(client:put(URL .. "/echo", {json = '{"raw":1}'}).body)
+		assert(echo.method == "PUT" and echo.body == '{"raw":1}')
+
+		echo = decode(client:patch(URL .. "/echo", {body = "plain", headers = {["Content-Type"] = "text/plain"}}).body)
+		assert(echo.method == "PATCH" and echo.body == "plain" and echo.content_type == "text/plain")
+
+		client:header("X-Token", "always")
+		echo = decode(client:delete(URL .. "/echo").body)
+		assert(echo.method == "DELETE" and echo.token == "always")
+		client:header("X-Token")
+		echo = decode(client:get(URL .. "/echo").body)
+		assert(echo.token == "")
+
+		local resp, err = client:get("ftp://example.com/")
+		assert(resp == nil and err ~= nil)
+	`)
+}
+
+func TestForms(t *testing.T) {
+	run(t, `
+		local client = HTTPClient()
+		assert(client:post(URL .. "/form", {form = {name = "Alice"}}).body == "Alice")
+		local resp = client:post(URL .. "/form", {multipart = {
+			name = "Bob",
+			upload = {filename = "hello.txt", content = "hello there", content_type = "text/plain"},
+		}})
+		assert(resp.body == "Bob hello.txt hello there")
+	`)
+}
+
+func TestCookiesAndRedirects(t *testing.T) {
+	run(t, `
+		local client = HTTPClient()
+		local resp = client:get(URL .. "/login")
+		assert(resp.status == 200 and resp.body == "welcome")
+		assert(resp.url == URL .. "/private")
+		assert(client:cookies(URL).session == "abc")
+
+		client:redirects(0)
+		resp = client:get(URL .. "/login")
+		assert(resp.status == 302)
+		assert(resp.headers["Location"] == "/private")
+		assert(resp.cookies.session == "abc")
+
+		local nocookies = HTTPClient({cookies = false})
+		assert(nocookies:get(URL .. "/login").status == 403)
+	`)
+}
+
+func TestTimeout(t *testing.T) {
+	run(t, `
+		local client = HTTPClient({timeout = 0.1})
+		local resp, err = client:get(URL .. "/slow")
+		assert(resp == nil and err ~= nil)
+		client:timeout(2)
+		resp = client:get(URL .. "/slow")
+		assert(resp.body == "done")
+		resp, err = client:get(URL .. "/slow", {timeout = 0.1})
+		assert(resp == nil and err ~= nil)
+	`)
+}
+
+func TestMaxBody(t *testing.T) {
+	run(t, `
+		local client = HTTPClient({maxbody = 3})
+		local resp, err = client:get(URL .. "/slow")
+		assert(resp == nil and err ~= nil)
+		resp = client:get(URL .. "/slow", {maxbody = 4})
+		assert(resp.body == "done")
+		client:maxbody(0)
+		resp = client:get(URL .. "/slow")
+		assert(resp.body == "done")
+	`)
+}
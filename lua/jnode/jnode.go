@@ -205,6 +205,7 @@ func jnodePOSTToURL(L *lua.LState) int {
 		log.Error(err)
 		return 0 // number of results
 	}
+	resp.Body.Close()
 
 	L.Push(lua.LString(resp.Status))
 	return 1 // number of results
@@ -258,6 +259,7 @@ func jnodePUTToURL(L *lua.LState) int {
 		log.Error(err)
 		return 0 // number of results
 	}
+	resp.Body.Close()
 
 	L.Push(lua.LString(resp.Status))
 	return 1 // number of results
@@ -285,6 +287,7 @@ func jnodeGETFromURL(L *lua.LState) int {
 		return 0 // number of results
 	}
 	if resp.Status != "200 OK" {
+		resp.Body.Close()
 		L.Push(lua.LString(resp.Status))
 		return 1 // number of results
 	}
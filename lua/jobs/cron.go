@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of allowed values for one of the fields in a cron expression
+type cronField struct {
+	allowed [60]bool
+	any     bool // the field is "*"
+}
+
+// cronSchedule is a parsed cron expression: minute, hour, day of month, month and day of week
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+}
+
+// The shortcuts that can be used instead of the five fields
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseValue parses a number or a name, where the first name has the value offset
+func parseValue(s string, names []string, offset int) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return i + offset, nil
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// parseField parses a comma separated list of "*", numbers, names and
+// ranges, each with an optional step, like "*/15" or "1-5"
+func parseField(s string, min, max int, names []string, offset int) (cronField, error) {
+	var f cronField
+	f.any = s == "*"
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return f, fmt.Errorf("invalid step: %s", part)
+			}
+			part = part[:i]
+		}
+		first, last := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if first, err = parseValue(bounds[0], names, offset); err != nil {
+				return f, fmt.Errorf("invalid value: %s", bounds[0])
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = parseValue(bounds[1], names, offset); err != nil {
+					return f, fmt.Errorf("invalid value: %s", bounds[1])
+				}
+			} else if step > 1 {
+				// "5/10" means from 5 and up, every 10
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return f, fmt.Errorf("out of range: %s", part)
+		}
+		for i := first; i <= last; i += step {
+			f.allowed[i] = true
+		}
+	}
+	return f, nil
+}
+
+// parseCron parses a cron expression with five fields, or a shortcut like "@daily"
+func parseCron(spec string) (*cronSchedule, error) {
+	if expanded, ok := cronShortcuts[strings.ToLower(strings.TrimSpace(spec))]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("a cron expression must have 5 fields: %s", spec)
+	}
+	var (
+		c   cronSchedule
+		err error
+	)
+	if c.minute, err = parseField(fields[0], 0, 59, nil, 0); err != nil {
+		return nil, fmt.Errorf("minute: %s", err)
+	}
+	if c.hour, err = parseField(fields[1], 0, 23, nil, 0); err != nil {
+		return nil, fmt.Errorf("hour: %s", err)
+	}
+	if c.dom, err = parseField(fields[2], 1, 31, nil, 0); err != nil {
+		return nil, fmt.Errorf("day of month: %s", err)
+	}
+	if c.month, err = parseField(fields[3], 1, 12, monthNames, 1); err != nil {
+		return nil, fmt.Errorf("month: %s", err)
+	}
+	if c.dow, err = parseField(fields[4], 0, 7, dayNames, 0); err != nil {
+		return nil, fmt.Errorf("day of week: %s", err)
+	}
+	// Both 0 and 7 are Sunday
+	if c.dow.allowed[7] {
+		c.dow.allowed[0] = true
+	}
+	return &c, nil
+}
+
+// dayMatches checks the day of month and day of week. As in cron, if both are
+// restricted, a day that matches either of them is enough.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom.allowed[t.Day()]
+	dowMatch := c.dow.allowed[int(t.Weekday())]
+	if c.dom.any || c.dow.any {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next returns the first time after t that matches the schedule,
+// or the zero time if there is none within five years
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.month.allowed[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour.allowed[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute.allowed[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,260 @@
+// Package jobs provides Lua functions for running Lua functions periodically
+// or on a schedule, in the background
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// ErrStopped is returned when adding a job after the scheduler has been stopped
+var ErrStopped = errors.New("jobs: the scheduler has been stopped")
+
+// Job is a Lua function that runs periodically or on a schedule
+type Job struct {
+	id      int
+	spec    string                    // how the job was scheduled, like "every 5m"
+	next    func(time.Time) time.Time // returns the next time the job should run
+	proto   *lua.FunctionProto        // the compiled function
+	mut     sync.Mutex                // protects the fields below
+	running bool
+	runs    int
+	skipped int // the number of times the job was still running when it should run again
+	lastRun time.Time
+	nextRun time.Time // when the job is scheduled to run next
+	result  string
+	failed  bool
+}
+
+// Status is a description of a job and its last run
+type Status struct {
+	ID      int
+	Spec    string
+	Running bool
+	Runs    int
+	Skipped int
+	LastRun time.Time // the zero time if the job has not run yet
+	Result  string    // the first returned value, or the error message
+	Failed  bool
+	NextRun time.Time // the zero time if the job will not run again
+}
+
+// Scheduler runs jobs on Lua states that are borrowed with get and
+// returned with put. get should return a Lua state where the functions
+// that jobs may use have been loaded.
+type Scheduler struct {
+	get     func() *lua.LState
+	put     func(*lua.LState)
+	jobs    []*Job
+	mut     sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// New returns a Scheduler that borrows Lua states with get and returns them with put
+func New(get func() *lua.LState, put func(*lua.LState)) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{get: get, put: put, ctx: ctx, cancel: cancel}
+}
+
+// Every adds a job that runs every given interval, starting one interval from now
+func (s *Scheduler) Every(interval time.Duration, proto *lua.FunctionProto) (*Job, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("jobs: the interval must be positive: %s", interval)
+	}
+	next := func(t time.Time) time.Time {
+		return t.Add(interval)
+	}
+	return s.add("every "+interval.String(), next, proto)
+}
+
+// Schedule adds a job that runs at the times that match the given cron
+// expression, like "0 3 * * *" for 03:00 every night
+func (s *Scheduler) Schedule(spec string, proto *lua.FunctionProto) (*Job, error) {
+	c, err := parseCron(spec)
+	if err != nil {
+		return nil, fmt.Errorf("jobs: %s", err)
+	}
+	return s.add("schedule "+spec, c.next, proto)
+}
+
+// add adds a job and starts running it at the right times
+func (s *Scheduler) add(spec string, next func(time.Time) time.Time, proto *lua.FunctionProto) (*Job, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.stopped {
+		return nil, ErrStopped
+	}
+	job := &Job{id: len(s.jobs) + 1, spec: spec, next: next, proto: proto, nextRun: next(time.Now())}
+	s.jobs = append(s.jobs, job)
+	s.wg.Add(1)
+	go s.loop(job)
+	return job, nil
+}
+
+// loop waits for the next time the job should run and runs it, until the scheduler is stopped
+func (s *Scheduler) loop(job *Job) {
+	defer s.wg.Done()
+	job.mut.Lock()
+	at := job.nextRun
+	job.mut.Unlock()
+	for !at.IsZero() {
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		next := job.next(at)
+		// Do not try to catch up if the time has already passed
+		if now := time.Now(); !next.IsZero() && next.Before(now) {
+			next = job.next(now)
+		}
+		job.mut.Lock()
+		job.nextRun = next
+		if job.running {
+			// Skip this run, instead of running the job twice at the same time
+			job.skipped++
+			job.mut.Unlock()
+			log.Warnf("Job %d (%s) is still running, skipping this run", job.id, job.spec)
+		} else {
+			job.running = true
+			job.mut.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.run(job)
+			}()
+		}
+		at = next
+	}
+}
+
+// run runs the job once, on a borrowed Lua state
+func (s *Scheduler) run(job *Job) {
+	start := time.Now()
+	L := s.get()
+	L.SetContext(s.ctx)
+	L.Push(L.NewFunctionFromProto(job.proto))
+	err := L.PCall(0, 1, nil)
+	var result string
+	if err != nil {
+		result = err.Error()
+		log.Errorf("Job %d (%s) failed: %s", job.id, job.spec, err)
+		// The Lua state may be in a bad state, so it is not returned
+		L.Close()
+	} else {
+		if ret := L.Get(-1); ret != lua.LNil {
+			result = ret.String()
+		}
+		L.Pop(1)
+		L.RemoveContext()
+		s.put(L)
+	}
+	job.mut.Lock()
+	job.running = false
+	job.runs++
+	job.lastRun = start
+	job.result = result
+	job.failed = err != nil
+	job.mut.Unlock()
+}
+
+// Status returns the status of all jobs, in the order they were added
+func (s *Scheduler) Status() []Status {
+	s.mut.Lock()
+	jobs := append([]*Job(nil), s.jobs...)
+	s.mut.Unlock()
+	statuses := make([]Status, len(jobs))
+	for i, job := range jobs {
+		job.mut.Lock()
+		statuses[i] = Status{
+			ID:      job.id,
+			Spec:    job.spec,
+			Running: job.running,
+			Runs:    job.runs,
+			Skipped: job.skipped,
+			LastRun: job.lastRun,
+			Result:  job.result,
+			Failed:  job.failed,
+			NextRun: job.nextRun,
+		}
+		job.mut.Unlock()
+	}
+	return statuses
+}
+
+// Stop stops all jobs, interrupts the jobs that are running and waits for them to finish
+func (s *Scheduler) Stop() {
+	s.mut.Lock()
+	s.stopped = true
+	s.mut.Unlock()
+	s.cancel()
+	s.wg.Wait()
+}
+
+// CheckProto returns the compiled code of the Lua function at position n,
+// for running it on other Lua states. Since the function is not run on the
+// given Lua state, it can not use local variables from outside of the function.
+func CheckProto(L *lua.LState, n int) *lua.FunctionProto {
+	fn := L.CheckFunction(n)
+	if fn.IsG || fn.Proto == nil {
+		L.ArgError(n, "a Lua function is expected")
+	}
+	if len(fn.Upvalues) > 0 {
+		L.ArgError(n, "the function can not use local variables from outside of the function")
+	}
+	return fn.Proto
+}
+
+// Push the job ID, or nil and an error message
+func pushJob(L *lua.LState, job *Job, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LNumber(job.id))
+	return 1 // number of results
+}
+
+// Load makes the every and schedule functions available to Lua scripts
+func Load(L *lua.LState, s *Scheduler) {
+
+	// Run a function every given interval, like "5m" or a number of seconds.
+	// Returns the job ID, or nil and an error message.
+	// every(string | number, function) -> number | nil, string
+	L.SetGlobal("every", L.NewFunction(func(L *lua.LState) int {
+		var interval time.Duration
+		switch v := L.CheckAny(1).(type) {
+		case lua.LNumber:
+			interval = time.Duration(float64(v) * float64(time.Second))
+		case lua.LString:
+			var err error
+			if interval, err = time.ParseDuration(string(v)); err != nil {
+				L.ArgError(1, err.Error())
+			}
+		default:
+			L.ArgError(1, "an interval like \"5m\", or a number of seconds, is expected")
+		}
+		job, err := s.Every(interval, CheckProto(L, 2))
+		return pushJob(L, job, err)
+	}))
+
+	// Run a function at the times that match the given cron expression.
+	// Returns the job ID, or nil and an error message.
+	// schedule(string, function) -> number | nil, string
+	L.SetGlobal("schedule", L.NewFunction(func(L *lua.LState) int {
+		job, err := s.Schedule(L.CheckString(1), CheckProto(L, 2))
+		return pushJob(L, job, err)
+	}))
+}
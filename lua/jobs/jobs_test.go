@@ -0,0 +1,154 @@
+package jobs
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestCron(t *testing.T) {
+	from := time.Date(2020, time.January, 1, 10, 30, 0, 0, time.UTC) // a Wednesday
+	next := map[string]time.Time{
+		"0 3 * * *":       time.Date(2020, time.January, 2, 3, 0, 0, 0, time.UTC),
+		"*/15 * * * *":    time.Date(2020, time.January, 1, 10, 45, 0, 0, time.UTC),
+		"5-10/5 11 * * *": time.Date(2020, time.January, 1, 11, 5, 0, 0, time.UTC),
+		"0 0 15 * mon":    time.Date(2020, time.January, 6, 0, 0, 0, 0, time.UTC),
+		"0 12 * feb *":    time.Date(2020, time.February, 1, 12, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":      time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC),
+		"30 10 * * 7":     time.Date(2020, time.January, 5, 10, 30, 0, 0, time.UTC),
+		"@weekly":         time.Date(2020, time.January, 5, 0, 0, 0, 0, time.UTC),
+		"@hourly":         time.Date(2020, time.January, 1, 11, 0, 0, 0, time.UTC),
+	}
+	for spec, expected := range next {
+		c, err := parseCron(spec)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, c.next(from), expected)
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "x * * * *"} {
+		_, err := parseCron(spec)
+		assert.NotEqual(t, err, nil)
+	}
+	// The 31st of February never happens
+	c, err := parseCron("0 0 31 2 *")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, c.next(from).IsZero(), true)
+}
+
+// newScheduler returns a Scheduler where the Lua states have a tick function
+// that counts calls, and a sleep function
+func newScheduler(ticks *int32) *Scheduler {
+	get := func() *lua.LState {
+		L := lua.NewState()
+		L.SetGlobal("tick", L.NewFunction(func(L *lua.LState) int {
+			atomic.AddInt32(ticks, 1)
+			return 0
+		}))
+		L.SetGlobal("sleep", L.NewFunction(func(L *lua.LState) int {
+			time.Sleep(time.Duration(float64(L.CheckNumber(1)) * float64(time.Second)))
+			return 0
+		}))
+		return L
+	}
+	put := func(L *lua.LState) {
+		L.Close()
+	}
+	return New(get, put)
+}
+
+func TestEvery(t *testing.T) {
+	var ticks int32
+	s := newScheduler(&ticks)
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, s)
+	assert.Equal(t, L.DoString(`
+		assert(every(0.05, function() tick() return "ok" end) == 1)
+		assert(every("50ms", function() error("boom") end) == 2)
+		local id, err = every(-1, function() end)
+		assert(id == nil and err ~= nil)
+	`), nil)
+	time.Sleep(180 * time.Millisecond)
+	s.Stop()
+
+	status := s.Status()
+	assert.Equal(t, len(status), 2)
+	assert.Equal(t, status[0].Spec, "every 50ms")
+	assert.Equal(t, status[0].Runs >= 2, true)
+	assert.Equal(t, int(atomic.LoadInt32(&ticks)), status[0].Runs)
+	assert.Equal(t, status[0].Result, "ok")
+	assert.Equal(t, status[0].Failed, false)
+	assert.Equal(t, status[1].Failed, true)
+	assert.Equal(t, strings.Contains(status[1].Result, "boom"), true)
+
+	// No jobs can be added after the scheduler has been stopped
+	assert.Equal(t, L.DoString(`
+		local id, err = every(1, function() end)
+		assert(id == nil and err ~= nil)
+	`), nil)
+}
+
+func TestNextRun(t *testing.T) {
+	var ticks int32
+	s := newScheduler(&ticks)
+	defer s.Stop()
+	start := time.Now()
+	_, err := s.Every(time.Hour, nil)
+	assert.Equal(t, err, nil)
+
+	// The time the job is scheduled for is reported, not a time computed from now
+	next := s.Status()[0].NextRun
+	assert.Equal(t, !next.Before(start.Add(time.Hour)) && next.Before(time.Now().Add(time.Hour)), true)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, s.Status()[0].NextRun, next)
+}
+
+func TestOverlapAndStop(t *testing.T) {
+	var ticks int32
+	s := newScheduler(&ticks)
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, s)
+	assert.Equal(t, L.DoString(`
+		every(0.02, function() tick() sleep(0.07) end)
+		every(0.02, function() while true do end end)
+	`), nil)
+	time.Sleep(150 * time.Millisecond)
+
+	// Stop interrupts the job that never finishes
+	stopped := make(chan bool)
+	go func() {
+		s.Stop()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the jobs were not stopped")
+	}
+	status := s.Status()
+	assert.Equal(t, status[0].Skipped > 0, true)
+	assert.Equal(t, status[0].Runs < 5, true)
+	assert.Equal(t, status[1].Runs, 1)
+	assert.Equal(t, status[1].Failed, true)
+}
+
+func TestLocalVariables(t *testing.T) {
+	var ticks int32
+	s := newScheduler(&ticks)
+	defer s.Stop()
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, s)
+	err := L.DoString(`
+		local count = 0
+		every(1, function() count = count + 1 end)
+	`)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, L.DoString(`schedule("0 3 * * *", function() local count = 0 return count end)`), nil)
+	_, err = s.Schedule("not cron", nil)
+	assert.NotEqual(t, err, nil)
+}
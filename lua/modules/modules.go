@@ -0,0 +1,128 @@
+// Package modules provides a require function for Lua that imports modules
+// from directories, keeps them for as long as the Lua state is used and
+// imports them again when the files change
+package modules
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// Registry keys for the imported files, the previous require function and
+// the require function that was added by Load
+const (
+	filesKey   = "_MODULES_FILES"
+	nextKey    = "_MODULES_NEXT"
+	requireKey = "_MODULES_REQUIRE"
+)
+
+// loading marks a module that is being imported, for detecting loops
+var loading = &lua.LUserData{}
+
+// Filenames returns the filenames that are tried for the given module name
+// in the given directory. Dots in the name separate directories.
+func Filenames(dir, name string) []string {
+	path := filepath.Join(dir, filepath.FromSlash(strings.Replace(name, ".", "/", -1)))
+	return []string{path + ".lua", filepath.Join(path, "init.lua")}
+}
+
+// fileVersion returns a string that changes when the file changes, or an
+// empty string if the file does not exist
+func fileVersion(filename string) string {
+	fi, err := os.Stat(filename)
+	if err != nil || fi.IsDir() {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// Load replaces require with a function that looks for modules in the given
+// directories, in order, as name.lua or name/init.lua. A module is imported
+// once per Lua state, and again if the file has changed. Modules that are
+// already loaded, like the standard libraries, and modules that are not
+// found in the directories are imported by the previous require function.
+func Load(L *lua.LState, dirs ...string) {
+	registry := L.Get(lua.RegistryIndex).(*lua.LTable)
+
+	// The Lua state may be reused, so do not wrap the function that was added the last time
+	next := L.GetGlobal("require")
+	if installed := registry.RawGetString(requireKey); installed != lua.LNil && installed == next {
+		next = registry.RawGetString(nextKey)
+	}
+	nextFunction, ok := next.(*lua.LFunction)
+	if !ok {
+		return
+	}
+
+	files, ok := registry.RawGetString(filesKey).(*lua.LTable)
+	if !ok {
+		files = L.NewTable()
+		registry.RawSetString(filesKey, files)
+	}
+
+	require := L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+
+		// Standard libraries and modules that have been loaded the regular way
+		if loaded, ok := registry.RawGetString("_LOADED").(*lua.LTable); ok {
+			if module := loaded.RawGetString(name); module != lua.LNil {
+				L.Push(module)
+				return 1 // number of results
+			}
+		}
+
+		for _, dir := range dirs {
+			for _, filename := range Filenames(dir, name) {
+				version := fileVersion(filename)
+				if version == "" {
+					continue
+				}
+				// Use the module that has already been imported, if the file has not changed
+				if entry, ok := files.RawGetString(filename).(*lua.LTable); ok && entry.RawGetString("version") == lua.LString(version) {
+					module := entry.RawGetString("module")
+					if module == loading {
+						L.RaiseError("loop or previous error loading module '%s'", name)
+					}
+					L.Push(module)
+					return 1 // number of results
+				}
+				entry := L.NewTable()
+				entry.RawSetString("version", lua.LString(version))
+				entry.RawSetString("module", loading)
+				files.RawSetString(filename, entry)
+				fn, err := L.LoadFile(filename)
+				if err != nil {
+					files.RawSetString(filename, lua.LNil)
+					L.RaiseError("module '%s' could not be imported: %s", name, err)
+				}
+				L.Push(fn)
+				L.Push(lua.LString(name))
+				if err := L.PCall(1, 1, nil); err != nil {
+					files.RawSetString(filename, lua.LNil)
+					L.RaiseError("module '%s' could not be imported: %s", name, err)
+				}
+				module := L.Get(-1)
+				L.Pop(1)
+				if module == lua.LNil {
+					module = lua.LTrue
+				}
+				entry.RawSetString("module", module)
+				L.Push(module)
+				return 1 // number of results
+			}
+		}
+
+		// Let the previous require function import the module
+		L.Push(nextFunction)
+		L.Push(lua.LString(name))
+		L.Call(1, 1)
+		return 1 // number of results
+	})
+	registry.RawSetString(nextKey, nextFunction)
+	registry.RawSetString(requireKey, require)
+	L.SetGlobal("require", require)
+}
@@ -0,0 +1,74 @@
+package modules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func write(t *testing.T, filename, code string) {
+	assert.Equal(t, os.MkdirAll(filepath.Dir(filename), 0755), nil)
+	assert.Equal(t, ioutil.WriteFile(filename, []byte(code), 0644), nil)
+}
+
+func TestRequire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulestest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	scriptdir := filepath.Join(dir, "pages")
+	libdir := filepath.Join(dir, "lib")
+	write(t, filepath.Join(scriptdir, "local.lua"), `loads = loads + 1 return {name = "local"}`)
+	write(t, filepath.Join(libdir, "shared.lua"), `return {name = "shared", arg = ...}`)
+	write(t, filepath.Join(libdir, "util", "init.lua"), `return {name = "util"}`)
+	write(t, filepath.Join(libdir, "util", "strings.lua"), `return {name = "util.strings"}`)
+	write(t, filepath.Join(libdir, "nothing.lua"), `x = 1`)
+	write(t, filepath.Join(libdir, "loop.lua"), `return require("loop")`)
+	write(t, filepath.Join(libdir, "broken.lua"), `return {`)
+
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, scriptdir, libdir)
+	assert.Equal(t, L.DoString(`
+		loads = 0
+		assert(require("local").name == "local")
+		assert(require("local") == require("local"))
+		assert(loads == 1)
+		assert(require("shared").name == "shared")
+		assert(require("shared").arg == "shared")
+		assert(require("util").name == "util")
+		assert(require("util.strings").name == "util.strings")
+		assert(require("nothing") == true)
+		assert(require("string") == string)
+		assert(not pcall(require, "loop"))
+		assert(not pcall(require, "broken"))
+		assert(not pcall(require, "missing"))
+	`), nil)
+
+	// The Lua state is reused, and the module is not imported again
+	Load(L, scriptdir, libdir)
+	assert.Equal(t, L.DoString(`
+		require("local")
+		assert(loads == 1)
+	`), nil)
+
+	// ...until the file changes
+	filename := filepath.Join(scriptdir, "local.lua")
+	write(t, filename, `loads = loads + 1 return {name = "changed"}`)
+	later := time.Now().Add(time.Minute)
+	assert.Equal(t, os.Chtimes(filename, later, later), nil)
+	assert.Equal(t, L.DoString(`
+		assert(require("local").name == "changed")
+		assert(loads == 2)
+	`), nil)
+
+	// Only the given directories are used
+	L2 := lua.NewState()
+	defer L2.Close()
+	Load(L2, libdir)
+	assert.Equal(t, L2.DoString(`assert(not pcall(require, "local"))`), nil)
+}
@@ -8,6 +8,9 @@ import (
 
 // Extra Lua functions
 const luacode = `
+-- Keep io.popen, for when io is not available to the script
+local popen = io and io.popen
+
 -- Given the name of a python script in the same directory,
 -- return the outputted lines as a table
 function py(filename)
@@ -15,7 +18,7 @@ function py(filename)
     return {}
   end
   local cmd = "python " .. scriptdir() .. "/" .. filename
-  local f = assert(io.popen(cmd, 'r'))
+  local f = assert(popen(cmd, 'r'))
   local a = {}
   for line in f:lines() do
     table.insert(a, line)
@@ -31,7 +34,7 @@ function run(given_command)
     return {}
   end
   local cmd = "cd " .. scriptdir() .. "; " .. given_command
-  local f = assert(io.popen(cmd, 'r'))
+  local f = assert(popen(cmd, 'r'))
   local a = {}
   for line in f:lines() do
     table.insert(a, line)
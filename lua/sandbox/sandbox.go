@@ -0,0 +1,368 @@
+// Package sandbox provides limits for Lua scripts that are run for
+// untrusted sites: a time limit, an instruction limit, a memory limit, a
+// whitelist of standard libraries and file access only within a directory
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// DefaultLibs are the standard Lua libraries that are available in the
+// sandbox by default. "io" and "debug" can also be allowed.
+var DefaultLibs = []string{"base", "package", "table", "string", "math", "coroutine", "channel", "os"}
+
+var (
+	// ErrTimeout is the reason when a script runs for too long
+	ErrTimeout = errors.New("the time limit was exceeded")
+
+	// ErrInstructions is the reason when a script runs too many Lua instructions
+	ErrInstructions = errors.New("the instruction limit was exceeded")
+
+	// ErrMemory is the reason when the memory usage is too high
+	ErrMemory = errors.New("the memory limit was exceeded")
+)
+
+// The standard libraries that can be removed, apart from the base library
+var libNames = []string{"package", "table", "io", "os", "string", "math", "debug", "channel", "coroutine"}
+
+// How many Lua instructions to run between each time the memory usage is checked
+const memoryCheckInterval = 10000
+
+// Options are the limits for sandboxed Lua scripts
+type Options struct {
+	Timeout      time.Duration // how long a script can run, 0 for no limit
+	Instructions int64         // how many Lua instructions a script can run, 0 for no limit
+	Memory       uint64        // scripts are stopped if the heap of the server grows above this many bytes, 0 for no limit
+	Libs         []string      // the standard libraries that are available
+	Allow        []string      // functions that run other programs, like "run", "py" or "Plugin", that are allowed
+}
+
+// DefaultOptions returns the default limits: 10 seconds and 100 million
+// instructions per script, the default libraries and no other programs
+func DefaultOptions() Options {
+	return Options{
+		Timeout:      10 * time.Second,
+		Instructions: 100000000,
+		Libs:         append([]string(nil), DefaultLibs...),
+	}
+}
+
+// Allowed checks if the given function is allowed
+func (o *Options) Allowed(name string) bool {
+	for _, allowed := range o.Allow {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLib checks if the given standard library is available
+func (o *Options) hasLib(name string) bool {
+	for _, lib := range o.Libs {
+		if lib == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitError is returned when a script is stopped for exceeding a limit
+type LimitError struct {
+	Reason error // ErrTimeout, ErrInstructions or ErrMemory
+	Err    error // the error from the Lua state
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("sandbox: %s: %s", e.Reason, e.Err)
+}
+
+// StatusCode returns the HTTP status code for the error:
+// 503 for timeouts and 500 for the other limits
+func (e *LimitError) StatusCode() int {
+	if e.Reason == ErrTimeout {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// limitContext is a context that is done when the parent context is done,
+// or when a limit is exceeded. The Lua VM calls Done once per instruction
+// when a context is set, which is used for counting the instructions.
+type limitContext struct {
+	context.Context
+	done         chan struct{}
+	instructions int64
+	memory       uint64
+	count        int64
+	once         sync.Once
+	mut          sync.Mutex
+	err          error
+}
+
+// stop closes the done channel, with the given reason
+func (c *limitContext) stop(err error) {
+	c.once.Do(func() {
+		c.mut.Lock()
+		c.err = err
+		c.mut.Unlock()
+		close(c.done)
+	})
+}
+
+func (c *limitContext) Done() <-chan struct{} {
+	n := atomic.AddInt64(&c.count, 1)
+	if c.instructions > 0 && n > c.instructions {
+		c.stop(ErrInstructions)
+	}
+	if c.memory > 0 && n%memoryCheckInterval == 0 && heapSize() > c.memory {
+		c.stop(ErrMemory)
+	}
+	return c.done
+}
+
+func (c *limitContext) Err() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.err
+}
+
+// heapSize returns the number of bytes that are used by objects on the heap
+func heapSize() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// Context returns a context for the Lua state that runs a sandboxed
+// script, that is done when the parent is done or when a limit is exceeded.
+// The cancel function must be called when the script is done.
+func Context(parent context.Context, o Options) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if o.Timeout > 0 {
+		parent, cancel = context.WithTimeout(parent, o.Timeout)
+	} else {
+		parent, cancel = context.WithCancel(parent)
+	}
+	c := &limitContext{
+		Context:      parent,
+		done:         make(chan struct{}),
+		instructions: o.Instructions,
+		memory:       o.Memory,
+	}
+	go func() {
+		select {
+		case <-parent.Done():
+			err := parent.Err()
+			if err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+			c.stop(err)
+		case <-c.done:
+		}
+	}()
+	return c, func() {
+		cancel()
+		c.stop(context.Canceled)
+	}
+}
+
+// Active checks if the given context is the context of a sandboxed script
+func Active(ctx context.Context) bool {
+	_, ok := ctx.(*limitContext)
+	return ok
+}
+
+// Check returns a *LimitError if the script was stopped because a limit
+// was exceeded, or else the given error
+func Check(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch reason := ctx.Err(); reason {
+	case ErrTimeout, ErrInstructions, ErrMemory:
+		return &LimitError{reason, err}
+	}
+	return err
+}
+
+// realPath returns the absolute path with all symlinks resolved. For paths
+// that do not exist yet, the symlinks of the nearest parent that exists are resolved.
+func realPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// Inside checks if the given path is within the given directory, after
+// symlinks have been resolved
+func Inside(dir, path string) bool {
+	dir, err := realPath(dir)
+	if err != nil {
+		return false
+	}
+	path, err = realPath(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolve returns the given path, relative to base if it is not absolute
+func resolve(base, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
+
+// Restrict wraps the functions with the given names in the given table, so
+// that they raise an error if the string argument at position n is a path
+// outside of dir. Relative paths are relative to base. The functions are
+// called with the arguments as they were given.
+func Restrict(L *lua.LState, table *lua.LTable, base, dir string, n int, names ...string) {
+	for _, name := range names {
+		name := name
+		fn, ok := table.RawGetString(name).(*lua.LFunction)
+		if !ok {
+			continue
+		}
+		table.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			if path, ok := L.Get(n).(lua.LString); ok && !Inside(dir, resolve(base, string(path))) {
+				L.RaiseError("%s: access denied: %s", name, path)
+			}
+			top := L.GetTop()
+			L.Push(fn)
+			for i := 1; i <= top; i++ {
+				L.Push(L.Get(i))
+			}
+			L.Call(top, lua.MultRet)
+			return L.GetTop() - top // number of results
+		}))
+	}
+}
+
+// Apply removes the standard libraries that are not in the whitelist from
+// the given Lua state, together with the functions in os that are not about
+// time. Files can only be loaded or opened within dir, and relative paths
+// are relative to base. Modules are only found in base.
+func Apply(L *lua.LState, o Options, base, dir string) {
+	for _, lib := range libNames {
+		if !o.hasLib(lib) {
+			L.SetGlobal(lib, lua.LNil)
+		}
+	}
+	if !o.hasLib("base") {
+		for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "collectgarbage", "getfenv", "setfenv", "rawget", "rawset", "rawequal", "getmetatable", "setmetatable", "newproxy"} {
+			L.SetGlobal(name, lua.LNil)
+		}
+	}
+	if !o.hasLib("package") {
+		L.SetGlobal("require", lua.LNil)
+		L.SetGlobal("module", lua.LNil)
+	}
+
+	// Only keep the time related functions in os
+	if lib, ok := L.GetGlobal("os").(*lua.LTable); ok {
+		safe := L.NewTable()
+		for _, name := range []string{"clock", "date", "difftime", "time"} {
+			safe.RawSetString(name, lib.RawGetString(name))
+		}
+		L.SetGlobal("os", safe)
+	}
+
+	// Files can only be opened within dir, and no programs can be started
+	if lib, ok := L.GetGlobal("io").(*lua.LTable); ok {
+		safe := L.NewTable()
+		for _, name := range []string{"open", "lines", "type", "close", "write", "read"} {
+			safe.RawSetString(name, lib.RawGetString(name))
+		}
+		restrictPaths(L, safe, base, dir, "open", "lines")
+		L.SetGlobal("io", safe)
+	}
+	restrictPaths(L, L.G.Global, base, dir, "loadfile")
+
+	// The original libraries are also kept in package.loaded, where require
+	// finds them, so only the libraries that are left are kept there
+	loaded := L.NewTable()
+	loaded.RawSetString("_G", L.G.Global)
+	for _, lib := range libNames {
+		if table, ok := L.GetGlobal(lib).(*lua.LTable); ok {
+			loaded.RawSetString(lib, table)
+		}
+	}
+	L.SetField(L.Get(lua.RegistryIndex), "_LOADED", loaded)
+
+	// Modules are only found in the script directory
+	if pkg, ok := L.GetGlobal("package").(*lua.LTable); ok {
+		pkg.RawSetString("loaded", loaded)
+		pkg.RawSetString("path", lua.LString(filepath.Join(base, "?.lua")+";"+filepath.Join(base, "?", "init.lua")))
+		pkg.RawSetString("cpath", lua.LString(""))
+	}
+}
+
+// restrictPaths wraps the functions with the given names in the given
+// table, so that a relative path in the first argument is relative to
+// base, and so that only paths within dir can be given
+func restrictPaths(L *lua.LState, table *lua.LTable, base, dir string, names ...string) {
+	for _, name := range names {
+		name := name
+		fn, ok := table.RawGetString(name).(*lua.LFunction)
+		if !ok {
+			continue
+		}
+		table.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			top := L.GetTop()
+			L.Push(fn)
+			for i := 1; i <= top; i++ {
+				arg := L.Get(i)
+				if path, ok := arg.(lua.LString); ok && i == 1 {
+					full := resolve(base, string(path))
+					if !Inside(dir, full) {
+						L.RaiseError("%s: access denied: %s", name, path)
+					}
+					arg = lua.LString(full)
+				}
+				L.Push(arg)
+			}
+			L.Call(top, lua.MultRet)
+			return L.GetTop() - top // number of results
+		}))
+	}
+}
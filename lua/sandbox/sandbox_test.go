@@ -0,0 +1,140 @@
+package sandbox
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// run runs the given Lua code in a sandbox with the given options
+func run(o Options, code string) error {
+	L := lua.NewState()
+	defer L.Close()
+	Apply(L, o, ".", ".")
+	ctx, cancel := Context(context.Background(), o)
+	defer cancel()
+	L.SetContext(ctx)
+	return Check(ctx, L.DoString(code))
+}
+
+func TestLimits(t *testing.T) {
+	o := DefaultOptions()
+	o.Timeout = 50 * time.Millisecond
+	o.Instructions = 0
+	err := run(o, `while true do end`)
+	limitErr, ok := err.(*LimitError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, limitErr.Reason, ErrTimeout)
+	assert.Equal(t, limitErr.StatusCode(), 503)
+
+	o = DefaultOptions()
+	o.Instructions = 1000
+	err = run(o, `while true do end`)
+	limitErr, ok = err.(*LimitError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, limitErr.Reason, ErrInstructions)
+	assert.Equal(t, limitErr.StatusCode(), 500)
+	assert.Equal(t, run(o, `local x = 0 for i = 1, 10 do x = x + i end`), nil)
+
+	o = DefaultOptions()
+	o.Memory = 1
+	err = run(o, `while true do end`)
+	limitErr, ok = err.(*LimitError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, limitErr.Reason, ErrMemory)
+
+	// Other errors are returned as they are
+	err = run(DefaultOptions(), `error("boom")`)
+	_, ok = err.(*LimitError)
+	assert.Equal(t, ok, false)
+}
+
+func TestActive(t *testing.T) {
+	ctx, cancel := Context(context.Background(), DefaultOptions())
+	defer cancel()
+	assert.Equal(t, Active(ctx), true)
+	assert.Equal(t, Active(context.Background()), false)
+}
+
+func TestLibs(t *testing.T) {
+	o := DefaultOptions()
+	assert.Equal(t, run(o, `
+		assert(io == nil and debug == nil)
+		assert(os.time() > 0 and os.execute == nil and os.remove == nil and os.getenv == nil)
+		assert(string.upper("a") == "A")
+	`), nil)
+	o.Libs = append(o.Libs, "io")
+	assert.Equal(t, run(o, `assert(io.open ~= nil and io.popen == nil)`), nil)
+	o.Libs = []string{"base"}
+	assert.Equal(t, run(o, `assert(string == nil and os == nil and require == nil and loadfile ~= nil)`), nil)
+	o.Libs = []string{"string"}
+	assert.Equal(t, run(o, `assert(loadfile == nil and setmetatable == nil and string ~= nil)`), nil)
+}
+
+func TestEscapes(t *testing.T) {
+	o := DefaultOptions()
+	assert.Equal(t, run(o, `
+		assert(package.loaded.os.execute == nil and package.loaded.os.remove == nil)
+		assert(package.loaded.os == os and package.loaded._G == _G)
+		assert(package.loaded.io == nil and package.loaded.debug == nil)
+		assert(require("os").remove == nil and require("os").execute == nil)
+		assert(not pcall(require, "io") and not pcall(require, "debug"))
+	`), nil)
+	o.Libs = append(o.Libs, "io")
+	assert.Equal(t, run(o, `
+		assert(package.loaded.io == io and package.loaded.io.popen == nil)
+		assert(require("io").popen == nil)
+	`), nil)
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandboxtest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	site := filepath.Join(dir, "site")
+	assert.Equal(t, os.Mkdir(site, 0755), nil)
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(site, "hello.txt"), []byte("hi"), 0644), nil)
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644), nil)
+
+	assert.Equal(t, Inside(site, filepath.Join(site, "a", "b")), true)
+	assert.Equal(t, Inside(site, site), true)
+	assert.Equal(t, Inside(site, filepath.Join(site, "..", "secret.txt")), false)
+	assert.Equal(t, Inside(site, site+"2"), false)
+
+	// Symlinks that point outside of the directory are not followed
+	assert.Equal(t, os.Symlink(dir, filepath.Join(site, "outside")), nil)
+	assert.Equal(t, os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(site, "secret.txt")), nil)
+	assert.Equal(t, Inside(site, filepath.Join(site, "outside", "secret.txt")), false)
+	assert.Equal(t, Inside(site, filepath.Join(site, "outside", "new", "file.txt")), false)
+	assert.Equal(t, Inside(site, filepath.Join(site, "secret.txt")), false)
+	assert.Equal(t, Inside(site, filepath.Join(site, "new", "file.txt")), true)
+
+	L := lua.NewState()
+	defer L.Close()
+	o := DefaultOptions()
+	o.Libs = append(o.Libs, "io")
+	Apply(L, o, site, site)
+	L.SetGlobal("show", L.NewFunction(func(L *lua.LState) int {
+		L.Push(L.Get(1))
+		return 1
+	}))
+	Restrict(L, L.G.Global, site, site, 1, "show")
+	assert.Equal(t, L.DoString(`
+		local f = assert(io.open("hello.txt"))
+		assert(f:read("*a") == "hi")
+		f:close()
+		assert(show("hello.txt") == "hello.txt")
+	`), nil)
+	for _, code := range []string{`io.open("../secret.txt")`, `io.lines("/etc/passwd")`, `loadfile("../secret.txt")`, `show("../secret.txt")`, `io.open("outside/secret.txt")`, `io.open("secret.txt")`, `io.open("outside/new.txt", "w")`} {
+		err := L.DoString(code)
+		assert.NotEqual(t, err, nil)
+		assert.Equal(t, strings.Contains(err.Error(), "access denied"), true)
+	}
+}
@@ -0,0 +1,230 @@
+// Package session provides a Lua table for data that is kept on the server,
+// per visitor, for as long as the session lasts
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/cookies"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// CookieName is the name of the cookie that holds the session ID
+	CookieName = "algernon_session"
+
+	// DefaultTimeout is how long a session lasts after it was last used
+	DefaultTimeout = 24 * time.Hour
+
+	// The ID of the HashMap where all sessions are kept, with the session IDs as owners
+	hashMapID = "__sessions"
+
+	// The length of a session ID, in bytes
+	idLength = 16
+)
+
+var errExpiring = errors.New("the database backend does not support sessions that expire")
+
+// Session is the server-side data for one visitor
+type Session struct {
+	w       http.ResponseWriter
+	req     *http.Request
+	store   *datastore.Store
+	secret  string
+	timeout time.Duration
+	id      string
+	hm      datastore.ExpiringHashMap
+	ended   bool // if the session has been ended, and the ID in the request should not be used
+}
+
+// New returns the session for the given request, without looking it up yet.
+// The session ID is kept in a cookie that is signed with the given secret.
+func New(w http.ResponseWriter, req *http.Request, store *datastore.Store, secret string, timeout time.Duration) *Session {
+	return &Session{w: w, req: req, store: store, secret: secret, timeout: timeout}
+}
+
+// validID checks if the given string looks like a session ID
+func validID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == idLength
+}
+
+// newID returns a new random session ID
+func newID() (string, error) {
+	b := make([]byte, idLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// start finds the session ID in the request, or creates a new session, and
+// sets the cookie so that the session lasts for another timeout from now.
+// Does nothing if the session has already been started.
+func (s *Session) start() error {
+	if s.hm != nil {
+		return nil
+	}
+	hm, err := s.store.NewHashMap(hashMapID)
+	if err != nil {
+		return err
+	}
+	ehm, ok := hm.(datastore.ExpiringHashMap)
+	if !ok {
+		return errExpiring
+	}
+	id, ok := cookies.Get(s.req, s.secret, CookieName, s.secret != "", false)
+	if !ok || !validID(id) || s.ended {
+		if id, err = newID(); err != nil {
+			return err
+		}
+	}
+	o := cookies.DefaultOptions(s.req)
+	o.MaxAge = int(s.timeout / time.Second)
+	o.Signed = s.secret != ""
+	if err := cookies.Set(s.w, s.secret, CookieName, id, o); err != nil {
+		return err
+	}
+	s.id = id
+	s.hm = ehm
+	// Keep the data, if any, for as long as the cookie
+	if exists, err := ehm.Exists(id); err != nil || !exists {
+		return err
+	}
+	return s.touch()
+}
+
+// touch makes the data of the session expire after timeout from now
+func (s *Session) touch() error {
+	return s.hm.Expire(s.id, s.timeout)
+}
+
+// ID returns the session ID
+func (s *Session) ID() (string, error) {
+	if err := s.start(); err != nil {
+		return "", err
+	}
+	return s.id, nil
+}
+
+// Get returns the JSON encoded value for the given key, or an empty string
+func (s *Session) Get(key string) (string, error) {
+	if err := s.start(); err != nil {
+		return "", err
+	}
+	if has, err := s.hm.Has(s.id, key); err != nil || !has {
+		return "", err
+	}
+	return s.hm.Get(s.id, key)
+}
+
+// Set sets the JSON encoded value for the given key. An empty value removes the key.
+func (s *Session) Set(key, value string) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	if value == "" {
+		return s.hm.DelKey(s.id, key)
+	}
+	if err := s.hm.Set(s.id, key, value); err != nil {
+		return err
+	}
+	return s.touch()
+}
+
+// End removes all data of the session and clears the cookie
+func (s *Session) End() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	o := cookies.DefaultOptions(s.req)
+	o.MaxAge = -1
+	cookies.Set(s.w, "", CookieName, "", o)
+	err := s.hm.Del(s.id)
+	s.hm = nil
+	s.ended = true
+	return err
+}
+
+// Load makes the session and endsession functions available to the given
+// Lua state, for sessions that are kept in the given store
+func Load(w http.ResponseWriter, req *http.Request, L *lua.LState, store *datastore.Store, secret string, timeout time.Duration) {
+	s := New(w, req, store, secret, timeout)
+	var proxy *lua.LTable
+
+	// Return a table for the session of the current visitor. Values are
+	// stored in the database as soon as they are assigned, and can be
+	// strings, numbers, booleans or tables. Assign nil to remove a value.
+	// Must be called before any output, since the session cookie is set.
+	L.SetGlobal("session", L.NewFunction(func(L *lua.LState) int {
+		if err := s.start(); err != nil {
+			log.Error(err)
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		if proxy != nil {
+			L.Push(proxy)
+			return 1 // number of results
+		}
+		mt := L.NewTable()
+		mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+			data, err := s.Get(L.CheckAny(2).String())
+			if err != nil {
+				log.Error(err)
+			}
+			var value interface{}
+			if data == "" || json.Unmarshal([]byte(data), &value) != nil {
+				L.Push(lua.LNil)
+				return 1 // number of results
+			}
+			L.Push(convert.Interface2value(L, value))
+			return 1 // number of results
+		}))
+		mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+			key := L.CheckAny(2).String()
+			var data []byte
+			if value := L.Get(3); value != lua.LNil {
+				switch value.(type) {
+				case lua.LString, lua.LNumber, lua.LBool, *lua.LTable:
+				default:
+					L.ArgError(3, "only strings, numbers, booleans and tables can be stored in a session")
+				}
+				v, err := convert.Value2interface(value)
+				if err != nil {
+					L.RaiseError("%s", err)
+				}
+				if data, err = json.Marshal(v); err != nil {
+					L.RaiseError("%s", err)
+				}
+			}
+			if err := s.Set(key, string(data)); err != nil {
+				L.RaiseError("%s", err)
+			}
+			return 0 // number of results
+		}))
+		proxy = L.NewTable()
+		L.SetMetatable(proxy, mt)
+		L.Push(proxy)
+		return 1 // number of results
+	}))
+
+	// End the session of the current visitor, removing all of the data
+	L.SetGlobal("endsession", L.NewFunction(func(L *lua.LState) int {
+		if err := s.End(); err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
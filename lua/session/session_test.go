@@ -0,0 +1,94 @@
+package session
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simplebolt"
+)
+
+func setup(t *testing.T) (*datastore.Store, func()) {
+	dir, err := ioutil.TempDir("", "sessiontest")
+	assert.Equal(t, err, nil)
+	db, err := simplebolt.New(filepath.Join(dir, "test.db"))
+	assert.Equal(t, err, nil)
+	return datastore.New(simplebolt.NewCreator(db)), func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// run runs the given Lua code as a request with the given cookies, and
+// returns the cookies of the response
+func run(t *testing.T, store *datastore.Store, timeout time.Duration, cookies []*http.Cookie, code string) []*http.Cookie {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	L := lua.NewState()
+	defer L.Close()
+	Load(w, req, L, store, "secret", timeout)
+	assert.Equal(t, L.DoString(code), nil)
+	return (&http.Response{Header: w.Header()}).Cookies()
+}
+
+func TestSession(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+
+	cookies := run(t, store, time.Hour, nil, `
+		local s = session()
+		assert(s.count == nil)
+		s.count = 1
+		s.name = "bob"
+		s.tags = {"a", "b"}
+		s.removed = true
+		s.removed = nil
+		assert(not pcall(function() s.f = print end))
+	`)
+	assert.Equal(t, len(cookies), 1)
+	assert.Equal(t, cookies[0].Name, CookieName)
+	assert.Equal(t, cookies[0].MaxAge, 3600)
+
+	run(t, store, time.Hour, cookies, `
+		local s = session()
+		assert(s.count == 1)
+		s.count = s.count + 1
+		assert(session().count == 2)
+		assert(s.name == "bob")
+		assert(s.tags[2] == "b")
+		assert(s.removed == nil)
+	`)
+
+	// Other visitors and forged cookies get a new session
+	run(t, store, time.Hour, nil, `assert(session().count == nil)`)
+	forged := &http.Cookie{Name: CookieName, Value: cookies[0].Value[:10]}
+	run(t, store, time.Hour, []*http.Cookie{forged}, `assert(session().count == nil)`)
+
+	// Ending the session removes the data and starts a new session
+	run(t, store, time.Hour, cookies, `
+		assert(session().count == 2)
+		assert(endsession())
+		assert(session().count == nil)
+	`)
+	run(t, store, time.Hour, cookies, `assert(session().name == nil)`)
+}
+
+func TestExpiry(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+
+	cookies := run(t, store, 50*time.Millisecond, nil, `session().name = "bob"`)
+	run(t, store, 50*time.Millisecond, cookies, `assert(session().name == "bob")`)
+	time.Sleep(100 * time.Millisecond)
+	run(t, store, 50*time.Millisecond, cookies, `assert(session().name == nil)`)
+}
@@ -0,0 +1,98 @@
+// Package sqldb makes it possible to run SQL queries from Lua, on the SQL
+// database backend or on other named database connections
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// ErrNoConnection is returned when asking for a connection that has not been configured
+var ErrNoConnection = errors.New("no such SQL connection")
+
+// Conn is a named database connection
+type Conn struct {
+	Name   string
+	Driver string
+	DB     *sql.DB
+	owned  bool // if the connection should be closed by the registry
+}
+
+// Registry keeps track of the available SQL connections.
+// The connection to the database backend, if any, has an empty name.
+type Registry struct {
+	conns   map[string]*Conn
+	mut     sync.RWMutex
+	verbose bool
+}
+
+// NewRegistry creates a new Registry. If verbose is true, all queries are logged with timing.
+func NewRegistry(verbose bool) *Registry {
+	return &Registry{conns: make(map[string]*Conn), verbose: verbose}
+}
+
+// driverName returns the name that the given driver is registered with in database/sql
+func driverName(driver string) string {
+	switch driver {
+	case "mariadb", "mysql":
+		return "mysql"
+	case "postgresql", "postgres", "pq":
+		return "postgres"
+	case "sqlite", "sqlite3":
+		return "sqlite3"
+	}
+	return driver
+}
+
+// Add registers an already open connection. The connection is not closed by Close.
+func (r *Registry) Add(name, driver string, db *sql.DB) {
+	r.mut.Lock()
+	r.conns[name] = &Conn{Name: name, Driver: driverName(driver), DB: db}
+	r.mut.Unlock()
+}
+
+// Open connects to a database with the given driver ("mysql", "postgres" or
+// "sqlite3") and data source name, and registers the connection with the given
+// name. Any previous connection with the same name is closed, if it was opened by Open.
+func (r *Registry) Open(name, driver, dsn string) error {
+	driver = driverName(driver)
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+	r.mut.Lock()
+	if previous, ok := r.conns[name]; ok && previous.owned {
+		previous.DB.Close()
+	}
+	r.conns[name] = &Conn{Name: name, Driver: driver, DB: db, owned: true}
+	r.mut.Unlock()
+	return nil
+}
+
+// Get returns the connection with the given name
+func (r *Registry) Get(name string) (*Conn, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	conn, ok := r.conns[name]
+	if !ok {
+		return nil, ErrNoConnection
+	}
+	return conn, nil
+}
+
+// Close closes all the connections that were opened by Open
+func (r *Registry) Close() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for name, conn := range r.conns {
+		if conn.owned {
+			conn.DB.Close()
+		}
+		delete(r.conns, name)
+	}
+}
@@ -0,0 +1,571 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// Identifier for the SQL class in Lua
+	lSQLClass = "SQL"
+
+	// Identifier for the prepared statement class in Lua
+	lStmtClass = "SQLSTMT"
+)
+
+// Both *sql.DB and *sql.Tx can run queries
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// handle is an SQL connection in Lua, that may be in the middle of a transaction
+type handle struct {
+	conn    *Conn
+	tx      *sql.Tx
+	verbose bool
+}
+
+// statement is a prepared statement in Lua
+type statement struct {
+	stmt    *sql.Stmt
+	query   string
+	conn    *Conn
+	verbose bool
+}
+
+// opened is what has been opened in a Lua state and not yet closed
+type opened struct {
+	mut   sync.Mutex
+	txs   map[*sql.Tx]bool
+	stmts map[*sql.Stmt]bool
+}
+
+// The transactions and prepared statements that are open, per Lua state.
+// Coroutines share the same *lua.Global, so that is used as the key.
+var open sync.Map
+
+// openedIn returns what has been opened in the given Lua state
+func openedIn(L *lua.LState) *opened {
+	o, _ := open.LoadOrStore(L.G, &opened{txs: make(map[*sql.Tx]bool), stmts: make(map[*sql.Stmt]bool)})
+	return o.(*opened)
+}
+
+// track records a transaction or prepared statement as open, or as closed
+func track(L *lua.LState, tx *sql.Tx, stmt *sql.Stmt, isOpen bool) {
+	o := openedIn(L)
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if tx != nil {
+		if isOpen {
+			o.txs[tx] = true
+		} else {
+			delete(o.txs, tx)
+		}
+	}
+	if stmt != nil {
+		if isOpen {
+			o.stmts[stmt] = true
+		} else {
+			delete(o.stmts, stmt)
+		}
+	}
+}
+
+// Release closes the prepared statements and rolls back the transactions
+// that have been left open in the given Lua state. Must be called when a
+// script is done, before the Lua state is reused or closed.
+func Release(L *lua.LState) {
+	v, ok := open.Load(L.G)
+	if !ok {
+		return
+	}
+	open.Delete(L.G)
+	o := v.(*opened)
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	for stmt := range o.stmts {
+		stmt.Close()
+	}
+	for tx := range o.txs {
+		tx.Rollback()
+		log.Warn("SQL: a transaction was not committed or rolled back, and has been rolled back")
+	}
+}
+
+// target returns the transaction, if there is one, or else the connection
+func (h *handle) target() querier {
+	if h.tx != nil {
+		return h.tx
+	}
+	return h.conn.DB
+}
+
+// logQuery logs the query and how long it took, in verbose mode
+func logQuery(verbose bool, conn *Conn, query string, start time.Time, err error) {
+	if !verbose {
+		return
+	}
+	entry := log.WithFields(log.Fields{
+		"connection": conn.Name,
+		"driver":     conn.Driver,
+		"duration":   time.Since(start),
+	})
+	if err != nil {
+		entry.WithError(err).Warn(query)
+		return
+	}
+	entry.Info(query)
+}
+
+// Get the first argument, "self", and cast it from userdata to a SQL handle
+func checkHandle(L *lua.LState) *handle {
+	ud := L.CheckUserData(1)
+	if h, ok := ud.Value.(*handle); ok {
+		return h
+	}
+	L.ArgError(1, "SQL connection expected")
+	return nil
+}
+
+// Get the first argument, "self", and cast it from userdata to a prepared statement
+func checkStatement(L *lua.LState) *statement {
+	ud := L.CheckUserData(1)
+	if s, ok := ud.Value.(*statement); ok {
+		return s
+	}
+	L.ArgError(1, "prepared statement expected")
+	return nil
+}
+
+func newHandle(L *lua.LState, h *handle) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = h
+	L.SetMetatable(ud, L.GetTypeMetatable(lSQLClass))
+	return ud
+}
+
+// Convert a Lua value to a query argument
+func toArg(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < (1<<53) {
+			return int64(f)
+		}
+		return f
+	case lua.LString:
+		return string(v)
+	}
+	if value == lua.LNil {
+		return nil
+	}
+	return value.String()
+}
+
+// Collect the query arguments, from the given stack position and up.
+// The arguments can also be given as a single table.
+func toArgs(L *lua.LState, start int) []interface{} {
+	top := L.GetTop()
+	if top == start {
+		if t, ok := L.Get(start).(*lua.LTable); ok {
+			args := make([]interface{}, 0, t.Len())
+			for i := 1; i <= t.Len(); i++ {
+				args = append(args, toArg(t.RawGetInt(i)))
+			}
+			return args
+		}
+	}
+	args := make([]interface{}, 0, top)
+	for i := start; i <= top; i++ {
+		args = append(args, toArg(L.Get(i)))
+	}
+	return args
+}
+
+// Convert a value from a database column to a Lua value
+func toLua(value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case []byte:
+		return lua.LString(string(v))
+	case string:
+		return lua.LString(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	case time.Time:
+		return lua.LString(v.Format(time.RFC3339))
+	}
+	return lua.LString(fmt.Sprint(value))
+}
+
+// Read all the rows into a Lua table with one table per row,
+// where the keys are the column names. NULL values are left out.
+// If only the first row is wanted, that row is returned instead, or nil.
+func readRows(L *lua.LState, rows *sql.Rows, firstOnly bool) (lua.LValue, error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return lua.LNil, err
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	result := L.NewTable()
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return lua.LNil, err
+		}
+		row := L.NewTable()
+		for i, column := range columns {
+			row.RawSetString(column, toLua(values[i]))
+		}
+		if firstOnly {
+			return row, nil
+		}
+		result.Append(row)
+	}
+	if err := rows.Err(); err != nil {
+		return lua.LNil, err
+	}
+	if firstOnly {
+		return lua.LNil, nil
+	}
+	return result, nil
+}
+
+// Push the results of a query, or nil and an error message
+func pushRows(L *lua.LState, rows *sql.Rows, err error, firstOnly bool) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	result, err := readRows(L, rows, firstOnly)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(result)
+	return 1 // number of results
+}
+
+// Push the number of affected rows and the last inserted ID (if supported by
+// the driver), or nil and an error message
+func pushResult(L *lua.LState, result sql.Result, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		affected = 0
+	}
+	L.Push(lua.LNumber(affected))
+	if id, err := result.LastInsertId(); err == nil {
+		L.Push(lua.LNumber(id))
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 2 // number of results
+}
+
+// Push false and an error message, or just true
+func pushOK(L *lua.LState, err error) int {
+	if err != nil {
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LBool(true))
+	return 1 // number of results
+}
+
+// String representation
+// sql:tostring() -> string
+func sqlToString(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	s := "SQL connection"
+	if h.conn.Name != "" {
+		s += " " + h.conn.Name
+	}
+	if h.tx != nil {
+		s += " (transaction)"
+	}
+	L.Push(lua.LString(s))
+	return 1 // number of results
+}
+
+// Returns the name of the database driver: "mysql", "postgres" or "sqlite3"
+// sql:driver() -> string
+func sqlDriver(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	L.Push(lua.LString(h.conn.Driver))
+	return 1 // number of results
+}
+
+// Run a query and return all rows as a table of tables
+// sql:query(string, ...) -> table or nil, string
+func sqlQuery(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	query := L.CheckString(2)
+	start := time.Now()
+	rows, err := h.target().Query(query, toArgs(L, 3)...)
+	logQuery(h.verbose, h.conn, query, start, err)
+	return pushRows(L, rows, err, false)
+}
+
+// Run a query and return the first row as a table, or nil
+// sql:row(string, ...) -> table or nil, string
+func sqlRow(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	query := L.CheckString(2)
+	start := time.Now()
+	rows, err := h.target().Query(query, toArgs(L, 3)...)
+	logQuery(h.verbose, h.conn, query, start, err)
+	return pushRows(L, rows, err, true)
+}
+
+// Run a statement that does not return rows. Returns the number of affected
+// rows and the last inserted ID, if the driver supports it.
+// sql:exec(string, ...) -> number, number or nil, string
+func sqlExec(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	query := L.CheckString(2)
+	start := time.Now()
+	result, err := h.target().Exec(query, toArgs(L, 3)...)
+	logQuery(h.verbose, h.conn, query, start, err)
+	return pushResult(L, result, err)
+}
+
+// Create a prepared statement
+// sql:prepare(string) -> statement or nil, string
+func sqlPrepare(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	query := L.CheckString(2)
+	stmt, err := h.target().Prepare(query)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	track(L, nil, stmt, true)
+	ud := L.NewUserData()
+	ud.Value = &statement{stmt: stmt, query: query, conn: h.conn, verbose: h.verbose}
+	L.SetMetatable(ud, L.GetTypeMetatable(lStmtClass))
+	L.Push(ud)
+	return 1 // number of results
+}
+
+// Start a transaction. Returns a new SQL object where all queries are part of
+// the transaction. If the transaction is not committed or rolled back by the
+// end of the script, it is rolled back.
+// sql:begin() -> SQL or nil, string
+func sqlBegin(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	if h.tx != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("already in a transaction"))
+		return 2 // number of results
+	}
+	tx, err := h.conn.DB.Begin()
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	track(L, tx, nil, true)
+	L.Push(newHandle(L, &handle{conn: h.conn, tx: tx, verbose: h.verbose}))
+	return 1 // number of results
+}
+
+// Commit the transaction
+// sql:commit() -> bool or false, string
+func sqlCommit(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	if h.tx == nil {
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString("not in a transaction"))
+		return 2 // number of results
+	}
+	track(L, h.tx, nil, false)
+	return pushOK(L, h.tx.Commit())
+}
+
+// Roll back the transaction
+// sql:rollback() -> bool or false, string
+func sqlRollback(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	if h.tx == nil {
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString("not in a transaction"))
+		return 2 // number of results
+	}
+	track(L, h.tx, nil, false)
+	return pushOK(L, h.tx.Rollback())
+}
+
+// Run the given function in a transaction. The function is given an SQL
+// object for the transaction. The transaction is committed if the function
+// returns without raising an error and without returning false, and rolled
+// back otherwise.
+// sql:transaction(function) -> bool or false, string
+func sqlTransaction(L *lua.LState) int {
+	h := checkHandle(L) // arg 1
+	f := L.CheckFunction(2)
+	if h.tx != nil {
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString("already in a transaction"))
+		return 2 // number of results
+	}
+	tx, err := h.conn.DB.Begin()
+	if err != nil {
+		return pushOK(L, err)
+	}
+	L.Push(f)
+	L.Push(newHandle(L, &handle{conn: h.conn, tx: tx, verbose: h.verbose}))
+	if err := L.PCall(1, 1, nil); err != nil {
+		tx.Rollback()
+		return pushOK(L, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	if ret == lua.LFalse {
+		tx.Rollback()
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString("rolled back"))
+		return 2 // number of results
+	}
+	if err := tx.Commit(); err != sql.ErrTxDone {
+		return pushOK(L, err)
+	}
+	// The function committed or rolled back on its own
+	L.Push(lua.LBool(true))
+	return 1 // number of results
+}
+
+// String representation
+// stmt:tostring() -> string
+func stmtToString(L *lua.LState) int {
+	s := checkStatement(L) // arg 1
+	L.Push(lua.LString("prepared statement: " + s.query))
+	return 1 // number of results
+}
+
+// Run the prepared statement and return all rows as a table of tables
+// stmt:query(...) -> table or nil, string
+func stmtQuery(L *lua.LState) int {
+	s := checkStatement(L) // arg 1
+	start := time.Now()
+	rows, err := s.stmt.Query(toArgs(L, 2)...)
+	logQuery(s.verbose, s.conn, s.query, start, err)
+	return pushRows(L, rows, err, false)
+}
+
+// Run the prepared statement and return the first row as a table, or nil
+// stmt:row(...) -> table or nil, string
+func stmtRow(L *lua.LState) int {
+	s := checkStatement(L) // arg 1
+	start := time.Now()
+	rows, err := s.stmt.Query(toArgs(L, 2)...)
+	logQuery(s.verbose, s.conn, s.query, start, err)
+	return pushRows(L, rows, err, true)
+}
+
+// Run the prepared statement, when it does not return rows
+// stmt:exec(...) -> number, number or nil, string
+func stmtExec(L *lua.LState) int {
+	s := checkStatement(L) // arg 1
+	start := time.Now()
+	result, err := s.stmt.Exec(toArgs(L, 2)...)
+	logQuery(s.verbose, s.conn, s.query, start, err)
+	return pushResult(L, result, err)
+}
+
+// Close the prepared statement
+// stmt:close() -> bool
+func stmtClose(L *lua.LState) int {
+	s := checkStatement(L) // arg 1
+	track(L, nil, s.stmt, false)
+	return pushOK(L, s.stmt.Close())
+}
+
+// The SQL methods that are to be registered
+var sqlMethods = map[string]lua.LGFunction{
+	"__tostring":  sqlToString,
+	"driver":      sqlDriver,
+	"query":       sqlQuery,
+	"row":         sqlRow,
+	"exec":        sqlExec,
+	"prepare":     sqlPrepare,
+	"begin":       sqlBegin,
+	"commit":      sqlCommit,
+	"rollback":    sqlRollback,
+	"transaction": sqlTransaction,
+}
+
+// The prepared statement methods that are to be registered
+var stmtMethods = map[string]lua.LGFunction{
+	"__tostring": stmtToString,
+	"query":      stmtQuery,
+	"row":        stmtRow,
+	"exec":       stmtExec,
+	"close":      stmtClose,
+}
+
+// Load makes the SQL function available to Lua scripts.
+// SQL() returns the connection to the SQL database backend and
+// SQL(name) returns a named connection from the registry.
+// Only the transactions and prepared statements that are opened after
+// Load has been called, are closed by Release.
+func Load(L *lua.LState, registry *Registry) {
+
+	// What was opened before, like prepared statements in a server
+	// configuration script, is kept open
+	open.Delete(L.G)
+
+	// Register the SQL class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(lSQLClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, sqlMethods)
+
+	// Register the prepared statement class and the methods that belongs with it.
+	mt = L.NewTypeMetatable(lStmtClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, stmtMethods)
+
+	// The constructor for SQL objects takes an optional connection name
+	L.SetGlobal("SQL", L.NewFunction(func(L *lua.LState) int {
+		name := L.OptString(1, "")
+		conn, err := registry.Get(name)
+		if err != nil {
+			L.Push(lua.LNil)
+			if name == "" {
+				L.Push(lua.LString("the database backend is not an SQL database"))
+			} else {
+				L.Push(lua.LString(err.Error() + ": " + name))
+			}
+			return 2 // number of results
+		}
+		L.Push(newHandle(L, &handle{conn: conn, verbose: registry.verbose}))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,150 @@
+package sqldb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/xyproto/gopher-lua"
+)
+
+func setup(t *testing.T) (*lua.LState, *Registry, func()) {
+	dir, err := ioutil.TempDir("", "sqldbtest")
+	assert.Equal(t, err, nil)
+	registry := NewRegistry(false)
+	assert.Equal(t, registry.Open("", "sqlite", filepath.Join(dir, "test.db")), nil)
+	assert.Equal(t, registry.Open("other", "sqlite", filepath.Join(dir, "other.db")), nil)
+	L := lua.NewState()
+	Load(L, registry)
+	return L, registry, func() {
+		L.Close()
+		registry.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	L, _, cleanup := setup(t)
+	defer cleanup()
+	err := L.DoString(`
+		local db = SQL()
+		assert(db:driver() == "sqlite3")
+		assert(db:exec("CREATE TABLE fruit (id INTEGER PRIMARY KEY, name TEXT, price REAL, note TEXT)"))
+		local affected, id = db:exec("INSERT INTO fruit (name, price) VALUES (?, ?)", "apple", 1.5)
+		assert(affected == 1 and id == 1)
+		db:exec("INSERT INTO fruit (name, price, note) VALUES (?, ?, ?)", {"banana", 2, "yellow"})
+		local rows = db:query("SELECT * FROM fruit ORDER BY id")
+		assert(#rows == 2)
+		assert(rows[1].name == "apple" and rows[1].price == 1.5 and rows[1].note == nil)
+		assert(rows[2].name == "banana" and rows[2].note == "yellow")
+		local row = db:row("SELECT name FROM fruit WHERE price > ?", 1.75)
+		assert(row.name == "banana")
+		assert(db:row("SELECT name FROM fruit WHERE id = ?", 42) == nil)
+		local rows, err = db:query("SELECT * FROM nosuchtable")
+		assert(rows == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestPrepare(t *testing.T) {
+	L, _, cleanup := setup(t)
+	defer cleanup()
+	err := L.DoString(`
+		local db = SQL()
+		db:exec("CREATE TABLE numbers (n INTEGER)")
+		local insert = db:prepare("INSERT INTO numbers (n) VALUES (?)")
+		for i = 1, 10 do
+			assert(insert:exec(i) == 1)
+		end
+		assert(insert:close())
+		local sum = db:prepare("SELECT SUM(n) AS total FROM numbers WHERE n <= ?")
+		assert(sum:row(4).total == 10)
+		assert(#sum:query(10) == 1)
+		sum:close()
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestTransaction(t *testing.T) {
+	L, _, cleanup := setup(t)
+	defer cleanup()
+	err := L.DoString(`
+		local db = SQL()
+		db:exec("CREATE TABLE stock (item TEXT PRIMARY KEY, count INTEGER)")
+		db:exec("INSERT INTO stock VALUES ('hat', 1)")
+
+		-- Committed
+		assert(db:transaction(function(tx)
+			tx:exec("UPDATE stock SET count = count - 1 WHERE item = 'hat'")
+		end))
+		assert(db:row("SELECT count FROM stock").count == 0)
+
+		-- Rolled back by returning false
+		local ok, err = db:transaction(function(tx)
+			tx:exec("UPDATE stock SET count = 100")
+			return false
+		end)
+		assert(not ok and err == "rolled back")
+		assert(db:row("SELECT count FROM stock").count == 0)
+
+		-- Rolled back by an error
+		ok, err = db:transaction(function(tx)
+			tx:exec("UPDATE stock SET count = 100")
+			error("out of stock")
+		end)
+		assert(not ok and err:find("out of stock"))
+		assert(db:row("SELECT count FROM stock").count == 0)
+
+		-- Explicit transactions
+		local tx = db:begin()
+		tx:exec("UPDATE stock SET count = 5")
+		assert(tx:rollback())
+		assert(not tx:commit())
+		tx = db:begin()
+		tx:exec("UPDATE stock SET count = 7")
+		assert(tx:commit())
+		assert(db:row("SELECT count FROM stock").count == 7)
+		assert(not db:commit())
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestRelease(t *testing.T) {
+	L, _, cleanup := setup(t)
+	defer cleanup()
+	err := L.DoString(`
+		db = SQL()
+		db:exec("CREATE TABLE stock (count INTEGER)")
+		db:exec("INSERT INTO stock (count) VALUES (0)")
+		local tx = db:begin()
+		tx:exec("UPDATE stock SET count = 5")
+		stmt = db:prepare("SELECT count FROM stock")
+	`)
+	assert.Equal(t, err, nil)
+
+	// The transaction that was left open is rolled back, and the statement is closed
+	Release(L)
+	err = L.DoString(`
+		assert(db:row("SELECT count FROM stock").count == 0)
+		assert(not stmt:row())
+	`)
+	assert.Equal(t, err, nil)
+}
+
+func TestNamedConnections(t *testing.T) {
+	L, registry, cleanup := setup(t)
+	defer cleanup()
+	err := L.DoString(`
+		SQL("other"):exec("CREATE TABLE only_here (x INTEGER)")
+		assert(SQL("other"):query("SELECT * FROM only_here"))
+		assert(not SQL():query("SELECT * FROM only_here"))
+		local db, err = SQL("missing")
+		assert(db == nil and err ~= nil)
+	`)
+	assert.Equal(t, err, nil)
+	_, err = registry.Get("missing")
+	assert.Equal(t, err, ErrNoConnection)
+}
@@ -0,0 +1,760 @@
+// Package tasks provides Lua functions for running Lua functions in the
+// background, on a bounded number of workers, with queues that can be kept
+// in the database so that the tasks are not lost when Algernon is restarted
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/jobs"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The states of a task
+const (
+	Queued  = "queued"
+	Running = "running"
+	Done    = "done"
+	Failed  = "failed"
+)
+
+const (
+	// DefaultAttempts is how many times a queued task is run before it fails
+	DefaultAttempts = 3
+
+	// The tasks are stored in a HashMap with this ID, where the task ID is the owner
+	tasksID = "__tasks"
+
+	// Each queue is a SortedSet of task IDs, with the time the task is due as the score
+	queuePrefix = "__queue_"
+
+	// A task that has been taken from a queue is run again after this long,
+	// if it has not been finished by then, for instance because Algernon was stopped
+	lease = 10 * time.Minute
+
+	// How long the status of finished tasks is kept
+	keepFinished = 24 * time.Hour
+)
+
+var (
+	// The delay before the first retry, which is doubled for each retry
+	firstBackoff = time.Second
+	maxBackoff   = 5 * time.Minute
+
+	// How often the queues in the database are checked for tasks that are due
+	pollInterval = time.Second
+
+	// How many tasks can wait in memory, before new tasks are rejected
+	maxQueued = 10000
+
+	// How many finished tasks the status is kept in memory for
+	maxFinished = 1000
+
+	// ErrStopped is returned when adding tasks after the pool has been stopped
+	ErrStopped = errors.New("tasks: the worker pool has been stopped")
+
+	// ErrFull is returned when adding tasks while too many tasks are waiting in memory
+	ErrFull = errors.New("tasks: too many tasks are waiting")
+
+	// ErrNoWorker is the error for a queued task when no worker function has been added for the queue
+	ErrNoWorker = errors.New("tasks: no worker function for the queue")
+)
+
+// Status is the status of a task
+type Status struct {
+	ID       string
+	Queue    string // empty for spawned tasks
+	State    string
+	Attempts int
+	Result   string // the first value that the function returned
+	Error    string // the error from the last attempt
+}
+
+// task is a task that is kept in memory while it is queued or running
+type task struct {
+	Status
+	maxAttempts int
+	proto       *lua.FunctionProto // for spawned tasks
+	args        []interface{}      // the arguments, or the payload for queued tasks
+	persisted   bool
+}
+
+// pending is a task that is kept in memory, waiting to run at the given time
+type pending struct {
+	t  *task
+	at time.Time
+}
+
+// retired is the ID of a task that is done or has failed, and when it finished
+type retired struct {
+	id string
+	at time.Time
+}
+
+// Pool runs tasks on a bounded number of Lua states at the same time. Lua
+// states are borrowed with get and returned with put. If the pool has a
+// store, queued tasks are kept in the database.
+type Pool struct {
+	get      func() *lua.LState
+	put      func(*lua.LState)
+	store    *datastore.Store // may be nil
+	slots    chan struct{}
+	handlers map[string]*lua.FunctionProto
+	tasks    map[string]*task
+	queue    []pending // sorted by when the tasks are due
+	finished []retired // sorted by when the tasks finished
+	mut      sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	wake     chan struct{}
+	ready    chan struct{}
+	stopped  bool
+}
+
+// New returns a Pool that runs up to the given number of tasks at the same
+// time. store can be nil, then the queued tasks are only kept in memory.
+func New(workers int, store *datastore.Store, get func() *lua.LState, put func(*lua.LState)) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		get:      get,
+		put:      put,
+		store:    store,
+		slots:    make(chan struct{}, workers),
+		handlers: make(map[string]*lua.FunctionProto),
+		tasks:    make(map[string]*task),
+		ctx:      ctx,
+		cancel:   cancel,
+		wake:     make(chan struct{}, 1),
+		ready:    make(chan struct{}, 1),
+	}
+	p.wg.Add(1)
+	go p.schedule()
+	if store != nil {
+		p.wg.Add(1)
+		go p.dispatch()
+	}
+	return p
+}
+
+// newID returns a random task ID
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// backoff returns how long to wait before the next attempt
+func backoff(attempts int) time.Duration {
+	delay := firstBackoff * time.Duration(math.Pow(2, float64(attempts-1)))
+	if delay > maxBackoff || delay <= 0 {
+		return maxBackoff
+	}
+	return delay
+}
+
+// Handle sets the function that runs the tasks in the given queue. The
+// function is called with the payload and the task ID.
+func (p *Pool) Handle(queue string, proto *lua.FunctionProto) {
+	p.mut.Lock()
+	p.handlers[queue] = proto
+	p.mut.Unlock()
+	p.poke()
+}
+
+// poke wakes up the dispatcher, to look for tasks right away
+func (p *Pool) poke() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// signal wakes up the scheduler, to start the tasks in memory that are due
+func (p *Pool) signal() {
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Spawn runs the function with the given arguments in the background, once.
+// The arguments must be values that are returned by convert.Value2interface. Returns the task ID.
+func (p *Pool) Spawn(proto *lua.FunctionProto, args []interface{}) (string, error) {
+	t := &task{Status: Status{ID: newID(), State: Queued}, maxAttempts: 1, proto: proto, args: args}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.stopped {
+		return "", ErrStopped
+	}
+	if len(p.queue) >= maxQueued {
+		return "", ErrFull
+	}
+	p.tasks[t.ID] = t
+	p.later(t, 0)
+	return t.ID, nil
+}
+
+// Enqueue adds a task to the given queue, which is run by the worker function
+// for the queue after the given delay. The payload is a value that is
+// returned by convert.Value2interface. The task is attempted up to the given number of times.
+// Returns the task ID.
+func (p *Pool) Enqueue(queue string, payload interface{}, attempts int, delay time.Duration) (string, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	id := newID()
+	if p.store == nil {
+		t := &task{Status: Status{ID: id, Queue: queue, State: Queued}, maxAttempts: attempts, args: []interface{}{payload}}
+		p.mut.Lock()
+		defer p.mut.Unlock()
+		if p.stopped {
+			return "", ErrStopped
+		}
+		if len(p.queue) >= maxQueued {
+			return "", ErrFull
+		}
+		p.tasks[id] = t
+		p.later(t, delay)
+		return id, nil
+	}
+	p.mut.Lock()
+	stopped := p.stopped
+	p.mut.Unlock()
+	if stopped {
+		return "", ErrStopped
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	hm, err := p.store.NewHashMap(tasksID)
+	if err != nil {
+		return "", err
+	}
+	fields := map[string]string{
+		"queue":    queue,
+		"payload":  string(data),
+		"state":    Queued,
+		"attempts": "0",
+		"max":      strconv.Itoa(attempts),
+	}
+	for key, value := range fields {
+		if err := hm.Set(id, key, value); err != nil {
+			return "", err
+		}
+	}
+	zset, err := p.store.NewSortedSet(queuePrefix + queue)
+	if err != nil {
+		return "", err
+	}
+	if err := zset.Add(id, unixTime(time.Now().Add(delay))); err != nil {
+		return "", err
+	}
+	p.poke()
+	return id, nil
+}
+
+// unixTime returns the time as seconds since 1970, as used for the scores in the queues
+func unixTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// later adds a task that is kept in memory to the tasks that wait for a
+// worker, to run after the given delay. p.mut must be locked.
+func (p *Pool) later(t *task, delay time.Duration) {
+	at := time.Now().Add(delay)
+	i := sort.Search(len(p.queue), func(i int) bool {
+		return p.queue[i].at.After(at)
+	})
+	p.queue = append(p.queue, pending{})
+	copy(p.queue[i+1:], p.queue[i:])
+	p.queue[i] = pending{t: t, at: at}
+	p.signal()
+}
+
+// schedule starts the tasks in memory when they are due and a worker is available
+func (p *Pool) schedule() {
+	defer p.wg.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		wait := p.start()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var due <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			due = timer.C
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.ready:
+		case <-due:
+		}
+	}
+}
+
+// start starts the tasks in memory that are due, while there are free workers.
+// Returns how long it is until the next task is due, or 0 if the scheduler
+// should wait until it is signalled.
+func (p *Pool) start() time.Duration {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for len(p.queue) > 0 {
+		next := p.queue[0]
+		if wait := time.Until(next.at); wait > 0 {
+			return wait
+		}
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			// All workers are busy, the scheduler is signalled when one is free
+			return 0
+		}
+		p.queue[0] = pending{}
+		p.queue = p.queue[1:]
+		p.wg.Add(1)
+		go p.work(next.t)
+	}
+	return 0
+}
+
+// work runs a task on a worker slot that has been taken, and then frees the slot
+func (p *Pool) work(t *task) {
+	defer p.wg.Done()
+	p.run(t)
+	<-p.slots
+	p.signal()
+}
+
+// dispatch takes tasks that are due from the queues in the database, while there are free workers
+func (p *Pool) dispatch() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+		p.mut.Lock()
+		queues := make([]string, 0, len(p.handlers))
+		for queue := range p.handlers {
+			queues = append(queues, queue)
+		}
+		p.mut.Unlock()
+		for _, queue := range queues {
+			if err := p.claim(queue); err != nil {
+				log.Errorf("Could not take tasks from the %s queue: %s", queue, err)
+			}
+		}
+	}
+}
+
+// claim starts the tasks in the given queue that are due, while there are free workers
+func (p *Pool) claim(queue string) error {
+	zset, err := p.store.NewSortedSet(queuePrefix + queue)
+	if err != nil {
+		return err
+	}
+	hm, err := p.store.NewHashMap(tasksID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	due, err := zset.RangeByScore(math.Inf(-1), unixTime(now), false)
+	if err != nil {
+		return err
+	}
+	for _, member := range due {
+		id := member.Name
+		p.mut.Lock()
+		_, running := p.tasks[id]
+		p.mut.Unlock()
+		if running {
+			continue
+		}
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			// All workers are busy
+			return nil
+		}
+		// Take the task, for as long as the lease lasts
+		if err := zset.Add(id, unixTime(now.Add(lease))); err != nil {
+			<-p.slots
+			return err
+		}
+		t, err := loadTask(hm, id)
+		if err != nil {
+			// The task has been removed, or it has expired
+			zset.Del(id)
+			<-p.slots
+			continue
+		}
+		p.mut.Lock()
+		p.tasks[id] = t
+		p.mut.Unlock()
+		p.wg.Add(1)
+		go p.work(t)
+	}
+	return nil
+}
+
+// loadTask reads a queued task from the database
+func loadTask(hm interface {
+	Get(owner, key string) (string, error)
+}, id string) (*task, error) {
+	get := func(key string) string {
+		value, _ := hm.Get(id, key)
+		return value
+	}
+	queue := get("queue")
+	if queue == "" {
+		return nil, fmt.Errorf("tasks: no task with ID %s", id)
+	}
+	var payload interface{}
+	if err := json.Unmarshal([]byte(get("payload")), &payload); err != nil {
+		return nil, err
+	}
+	attempts, _ := strconv.Atoi(get("attempts"))
+	maxAttempts, _ := strconv.Atoi(get("max"))
+	return &task{
+		Status:      Status{ID: id, Queue: queue, State: Queued, Attempts: attempts},
+		maxAttempts: maxAttempts,
+		args:        []interface{}{payload},
+		persisted:   true,
+	}, nil
+}
+
+// save writes the status of a task to the database
+func (p *Pool) save(t *task) error {
+	hm, err := p.store.NewHashMap(tasksID)
+	if err != nil {
+		return err
+	}
+	fields := map[string]string{
+		"state":    t.State,
+		"attempts": strconv.Itoa(t.Attempts),
+		"result":   t.Result,
+		"error":    t.Error,
+	}
+	for key, value := range fields {
+		if err := hm.Set(t.ID, key, value); err != nil {
+			return err
+		}
+	}
+	if t.State == Done || t.State == Failed {
+		if ehm, ok := hm.(datastore.ExpiringHashMap); ok {
+			return ehm.Expire(t.ID, keepFinished)
+		}
+	}
+	return nil
+}
+
+// requeue puts a task that is kept in the database back in the queue, to run at the given time
+func (p *Pool) requeue(t *task, at time.Time) error {
+	zset, err := p.store.NewSortedSet(queuePrefix + t.Queue)
+	if err != nil {
+		return err
+	}
+	if t.State == Queued {
+		return zset.Add(t.ID, unixTime(at))
+	}
+	return zset.Del(t.ID)
+}
+
+// run runs a task once, on a borrowed Lua state, and then decides if it should run again
+func (p *Pool) run(t *task) {
+	p.mut.Lock()
+	t.State = Running
+	t.Attempts++
+	proto := t.proto
+	if t.Queue != "" {
+		proto = p.handlers[t.Queue]
+	}
+	status := t.Status
+	p.mut.Unlock()
+	if t.persisted {
+		if err := p.save(&task{Status: status}); err != nil {
+			log.Error(err)
+		}
+	}
+
+	var (
+		result string
+		err    error
+	)
+	if proto == nil {
+		err = ErrNoWorker
+	} else {
+		result, err = p.call(proto, t)
+	}
+	cancelled := err != nil && p.ctx.Err() != nil
+
+	p.mut.Lock()
+	retryAt := time.Now()
+	switch {
+	case cancelled:
+		// Stopped before the task was done, so this attempt does not count
+		t.State = Queued
+		t.Attempts--
+	case err == nil:
+		t.State = Done
+		t.Result = result
+		t.Error = ""
+	case t.Attempts < t.maxAttempts:
+		t.State = Queued
+		t.Error = err.Error()
+		retryAt = retryAt.Add(backoff(t.Attempts))
+	default:
+		t.State = Failed
+		t.Error = err.Error()
+	}
+	if err != nil && !cancelled {
+		log.Errorf("Task %s failed (attempt %d of %d): %s", t.ID, t.Attempts, t.maxAttempts, err)
+	}
+	status = t.Status
+	if t.State != Queued {
+		// The function and the arguments are not needed anymore
+		t.proto = nil
+		t.args = nil
+	}
+	if t.persisted {
+		// The status is kept in the database from now on
+		delete(p.tasks, t.ID)
+	} else if t.State == Queued && !cancelled {
+		p.later(t, time.Until(retryAt))
+	} else if t.State != Queued {
+		// Keep the status of the finished task for a while
+		p.finished = append(p.finished, retired{id: t.ID, at: time.Now()})
+		p.forget()
+	}
+	p.mut.Unlock()
+
+	if t.persisted {
+		finished := &task{Status: status}
+		if err := p.save(finished); err != nil {
+			log.Error(err)
+		}
+		if err := p.requeue(finished, retryAt); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// forget removes the finished tasks that have been kept for too long, or
+// the oldest ones if there are too many. p.mut must be locked.
+func (p *Pool) forget() {
+	for len(p.finished) > 0 && (len(p.finished) > maxFinished || time.Since(p.finished[0].at) > keepFinished) {
+		delete(p.tasks, p.finished[0].id)
+		p.finished[0] = retired{}
+		p.finished = p.finished[1:]
+	}
+}
+
+// call runs the function of a task on a borrowed Lua state.
+// Queued tasks are called with the payload and the task ID.
+func (p *Pool) call(proto *lua.FunctionProto, t *task) (string, error) {
+	L := p.get()
+	L.SetContext(p.ctx)
+	L.Push(L.NewFunctionFromProto(proto))
+	for _, arg := range t.args {
+		L.Push(convert.Interface2value(L, arg))
+	}
+	nargs := len(t.args)
+	if t.Queue != "" {
+		L.Push(lua.LString(t.ID))
+		nargs++
+	}
+	if err := L.PCall(nargs, 1, nil); err != nil {
+		// The Lua state may be in a bad state, so it is not returned
+		L.Close()
+		return "", err
+	}
+	result := ""
+	if ret := L.Get(-1); ret != lua.LNil {
+		result = ret.String()
+	}
+	L.Pop(1)
+	L.RemoveContext()
+	p.put(L)
+	return result, nil
+}
+
+// Status returns the status of the given task, or false if there is no such task
+func (p *Pool) Status(id string) (Status, bool) {
+	p.mut.Lock()
+	p.forget()
+	t, ok := p.tasks[id]
+	var status Status
+	if ok {
+		status = t.Status
+	}
+	p.mut.Unlock()
+	if ok || p.store == nil {
+		return status, ok
+	}
+	hm, err := p.store.NewHashMap(tasksID)
+	if err != nil {
+		return status, false
+	}
+	get := func(key string) string {
+		value, _ := hm.Get(id, key)
+		return value
+	}
+	status.Queue = get("queue")
+	if status.Queue == "" {
+		return status, false
+	}
+	status.ID = id
+	status.State = get("state")
+	status.Attempts, _ = strconv.Atoi(get("attempts"))
+	status.Result = get("result")
+	status.Error = get("error")
+	return status, true
+}
+
+// Stop stops the workers, interrupts the tasks that are running and waits
+// for them to finish. Tasks that are kept in the database run again after a restart.
+func (p *Pool) Stop() {
+	p.mut.Lock()
+	p.stopped = true
+	p.mut.Unlock()
+	p.cancel()
+	p.wg.Wait()
+}
+
+// checkDuration returns the duration in the given value, which can be a
+// number of seconds or a string like "5m"
+func checkDuration(L *lua.LState, value lua.LValue) time.Duration {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return time.Duration(float64(v) * float64(time.Second))
+	case lua.LString:
+		d, err := time.ParseDuration(string(v))
+		if err != nil {
+			L.RaiseError("%s", err)
+		}
+		return d
+	}
+	L.RaiseError("a duration like \"5m\", or a number of seconds, is expected")
+	return 0
+}
+
+// Push the task ID, or nil and an error message
+func pushTask(L *lua.LState, id string, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LString(id))
+	return 1 // number of results
+}
+
+// Load makes the spawn, enqueue and task functions available to Lua scripts
+func Load(L *lua.LState, p *Pool) {
+
+	// Run a function in the background, with the given arguments.
+	// Tables, strings, numbers and booleans can be given as arguments.
+	// Returns the task ID, or nil and an error message.
+	// spawn(function, ...) -> string | nil, string
+	L.SetGlobal("spawn", L.NewFunction(func(L *lua.LState) int {
+		proto := jobs.CheckProto(L, 1)
+		var args []interface{}
+		for i := 2; i <= L.GetTop(); i++ {
+			arg, err := convert.Value2interface(L.Get(i))
+			if err != nil {
+				return pushTask(L, "", err)
+			}
+			args = append(args, arg)
+		}
+		id, err := p.Spawn(proto, args)
+		return pushTask(L, id, err)
+	}))
+
+	// Add a task to the given queue. The payload can be a table, string,
+	// number or boolean. The optional table can have "attempts" (the default
+	// is 3) and "delay" (a number of seconds, or a string like "5m").
+	// Returns the task ID, or nil and an error message.
+	// enqueue(string, payload[, table]) -> string | nil, string
+	L.SetGlobal("enqueue", L.NewFunction(func(L *lua.LState) int {
+		queue := L.CheckString(1)
+		payload, err := convert.Value2interface(L.CheckAny(2))
+		if err != nil {
+			return pushTask(L, "", err)
+		}
+		attempts := DefaultAttempts
+		var delay time.Duration
+		if options := L.OptTable(3, nil); options != nil {
+			if n, ok := options.RawGetString("attempts").(lua.LNumber); ok {
+				attempts = int(n)
+			}
+			if value := options.RawGetString("delay"); value != lua.LNil {
+				delay = checkDuration(L, value)
+			}
+		}
+		id, err := p.Enqueue(queue, payload, attempts, delay)
+		return pushTask(L, id, err)
+	}))
+
+	// Get the status of a task, as a table with the fields id, queue,
+	// state ("queued", "running", "done" or "failed"), attempts, result and error.
+	// Returns nil if there is no such task.
+	// task(string) -> table | nil
+	L.SetGlobal("task", L.NewFunction(func(L *lua.LState) int {
+		status, ok := p.Status(L.CheckString(1))
+		if !ok {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		table := L.NewTable()
+		table.RawSetString("id", lua.LString(status.ID))
+		table.RawSetString("queue", lua.LString(status.Queue))
+		table.RawSetString("state", lua.LString(status.State))
+		table.RawSetString("attempts", lua.LNumber(status.Attempts))
+		table.RawSetString("result", lua.LString(status.Result))
+		table.RawSetString("error", lua.LString(status.Error))
+		L.Push(table)
+		return 1 // number of results
+	}))
+}
+
+// LoadWorker makes the worker function available to Lua scripts. It is
+// meant for the server configuration.
+func LoadWorker(L *lua.LState, p *Pool) {
+
+	// Set the function that runs the tasks in the given queue. The function
+	// is called with the payload and the task ID. If it raises an error,
+	// the task is attempted again later.
+	// worker(string, function)
+	L.SetGlobal("worker", L.NewFunction(func(L *lua.LState) int {
+		p.Handle(L.CheckString(1), jobs.CheckProto(L, 2))
+		return 0 // number of results
+	}))
+}
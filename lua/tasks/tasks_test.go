@@ -0,0 +1,195 @@
+package tasks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/datastore"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simplebolt"
+)
+
+func init() {
+	firstBackoff = 10 * time.Millisecond
+	pollInterval = 10 * time.Millisecond
+}
+
+// newPool returns a Pool where the Lua states have a count function that
+// returns how many times it has been called
+func newPool(store *datastore.Store, calls *int32) *Pool {
+	get := func() *lua.LState {
+		L := lua.NewState()
+		L.SetGlobal("count", L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(atomic.AddInt32(calls, 1)))
+			return 1
+		}))
+		return L
+	}
+	put := func(L *lua.LState) {
+		L.Close()
+	}
+	return New(2, store, get, put)
+}
+
+// wait waits until the task is done or has failed
+func wait(t *testing.T, p *Pool, id string) Status {
+	for i := 0; i < 200; i++ {
+		status, ok := p.Status(id)
+		assert.Equal(t, ok, true)
+		if status.State == Done || status.State == Failed {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("task %s did not finish", id)
+	return Status{}
+}
+
+func TestSpawn(t *testing.T) {
+	var calls int32
+	p := newPool(nil, &calls)
+	defer p.Stop()
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, p)
+	assert.Equal(t, L.DoString(`
+		ok_id = spawn(function(t, n) count() return t.name .. n end, {name = "x"}, 1)
+		fail_id = spawn(function() error("boom") end)
+		local x = 1
+		assert(not pcall(spawn, function() return x end))
+	`), nil)
+	ok := wait(t, p, L.GetGlobal("ok_id").String())
+	assert.Equal(t, ok.State, Done)
+	assert.Equal(t, ok.Result, "x1")
+	failed := wait(t, p, L.GetGlobal("fail_id").String())
+	assert.Equal(t, failed.State, Failed)
+	assert.Equal(t, failed.Attempts, 1)
+	assert.NotEqual(t, failed.Error, "")
+
+	// The status is also available from Lua
+	assert.Equal(t, L.DoString(`
+		local status = task(ok_id)
+		assert(status.state == "done" and status.attempts == 1 and status.result == "x1")
+		assert(task("nope") == nil)
+	`), nil)
+}
+
+func TestRetry(t *testing.T) {
+	var calls int32
+	p := newPool(nil, &calls)
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, p)
+	LoadWorker(L, p)
+	assert.Equal(t, L.DoString(`
+		worker("mail", function(payload, id)
+			if count() < 3 then
+				error("not yet")
+			end
+			return payload.to
+		end)
+		id = enqueue("mail", {to = "bob"})
+		failing_id = enqueue("other", "x", {attempts = 2, delay = 0.01})
+	`), nil)
+	status := wait(t, p, L.GetGlobal("id").String())
+	assert.Equal(t, status.State, Done)
+	assert.Equal(t, status.Attempts, 3)
+	assert.Equal(t, status.Result, "bob")
+	status = wait(t, p, L.GetGlobal("failing_id").String())
+	assert.Equal(t, status.State, Failed)
+	assert.Equal(t, status.Attempts, 2)
+	assert.Equal(t, status.Error, ErrNoWorker.Error())
+
+	// No tasks can be added after the pool has been stopped
+	p.Stop()
+	assert.Equal(t, L.DoString(`
+		local id, err = enqueue("mail", {})
+		assert(id == nil and err ~= nil)
+	`), nil)
+	assert.Equal(t, backoff(1), firstBackoff)
+	assert.Equal(t, backoff(3), 4*firstBackoff)
+	assert.Equal(t, backoff(100), maxBackoff)
+}
+
+func TestLimits(t *testing.T) {
+	defer func(queued, kept int) {
+		maxQueued, maxFinished = queued, kept
+	}(maxQueued, maxFinished)
+	maxQueued, maxFinished = 2, 1
+	var calls int32
+	p := newPool(nil, &calls)
+	defer p.Stop()
+
+	// Only maxQueued tasks can wait in memory
+	for i := 0; i < maxQueued; i++ {
+		_, err := p.Enqueue("later", "x", 1, time.Hour)
+		assert.Equal(t, err, nil)
+	}
+	_, err := p.Enqueue("later", "x", 1, time.Hour)
+	assert.Equal(t, err, ErrFull)
+	_, err = p.Spawn(nil, nil)
+	assert.Equal(t, err, ErrFull)
+	p.mut.Lock()
+	p.queue = nil
+	p.mut.Unlock()
+
+	// Only the status of the last maxFinished tasks is kept, without the arguments
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, p)
+	assert.Equal(t, L.DoString(`first_id = spawn(function(s) return s end, "a")`), nil)
+	first := L.GetGlobal("first_id").String()
+	wait(t, p, first)
+	p.mut.Lock()
+	assert.Equal(t, p.tasks[first].args == nil, true)
+	p.mut.Unlock()
+	assert.Equal(t, L.DoString(`second_id = spawn(function(s) return s end, "b")`), nil)
+	assert.Equal(t, wait(t, p, L.GetGlobal("second_id").String()).Result, "b")
+	_, ok := p.Status(first)
+	assert.Equal(t, ok, false)
+}
+
+func TestPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taskstest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	db, err := simplebolt.New(filepath.Join(dir, "test.db"))
+	assert.Equal(t, err, nil)
+	defer db.Close()
+	store := datastore.New(simplebolt.NewCreator(db))
+
+	// Tasks that are added while there is no worker are kept in the database
+	var calls int32
+	p := newPool(store, &calls)
+	id, err := p.Enqueue("resize", map[string]interface{}{"size": 2.0}, 1, 0)
+	assert.Equal(t, err, nil)
+	p.Stop()
+	status, ok := p.Status(id)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, status.State, Queued)
+
+	// ...and are run by the next pool that has a worker for the queue
+	p = newPool(store, &calls)
+	defer p.Stop()
+	L := lua.NewState()
+	defer L.Close()
+	LoadWorker(L, p)
+	assert.Equal(t, L.DoString(`worker("resize", function(payload) count() return payload.size * 2 end)`), nil)
+	status = wait(t, p, id)
+	assert.Equal(t, status.State, Done)
+	assert.Equal(t, status.Result, "4")
+	assert.Equal(t, status.Queue, "resize")
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+
+	// The task is no longer in the queue
+	zset, err := store.NewSortedSet(queuePrefix + "resize")
+	assert.Equal(t, err, nil)
+	size, err := zset.Size()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, size, int64(0))
+}
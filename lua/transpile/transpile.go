@@ -0,0 +1,282 @@
+// Package transpile compiles Fennel and MoonScript files to Lua, and keeps
+// the compiled code until the files change
+package transpile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// Directories where fennel.lua is looked for, after the directories given to New
+var fennelDirs = []string{
+	"/usr/share/lua/5.1",
+	"/usr/local/share/lua/5.1",
+	"/usr/share/lua/5.3",
+	"/usr/local/share/lua/5.3",
+	"/usr/share/lua/5.4",
+	"/usr/local/share/lua/5.4",
+}
+
+var (
+	// ErrNoFennel is returned when neither fennel.lua nor the fennel executable can be found
+	ErrNoFennel = errors.New("transpile: could not find fennel.lua or the fennel executable")
+
+	// ErrNoMoonScript is returned when the moonc executable can not be found
+	ErrNoMoonScript = errors.New("transpile: could not find the moonc executable")
+
+	// Patterns for finding the line number in error messages from the compilers
+	fennelLine = regexp.MustCompile(`:(\d+):`)
+	moonLine   = regexp.MustCompile(`\[(\d+)\] >>`)
+
+	// Pattern for a line in the line rewrite table from "moonc -X", with the
+	// Lua line number and the MoonScript line number
+	moonPosition = regexp.MustCompile(`(?m)^\d+\t\s*(\d+):\[.*\] >> (\d+):\[`)
+)
+
+// Error is a compilation error
+type Error struct {
+	Filename string
+	Line     int // 0 if the line is not known
+	Message  string
+}
+
+// Error returns the error message on the same form as Lua errors, with the
+// filename and line number first
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Filename, e.Line, e.Message)
+}
+
+// newError returns an *Error, with the line number from the message, if any.
+// A line number after the filename is used first, then the given pattern.
+func newError(filename, message string, pattern *regexp.Regexp) *Error {
+	message = strings.TrimSpace(message)
+	line := 0
+	for _, re := range []*regexp.Regexp{regexp.MustCompile(regexp.QuoteMeta(filename) + `:(\d+)`), pattern} {
+		if m := re.FindStringSubmatch(message); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			break
+		}
+	}
+	return &Error{filename, line, message}
+}
+
+// entry is compiled Lua code, together with the version of the file
+type entry struct {
+	version string
+	code    []byte
+	lines   map[int]int // from Lua line numbers to line numbers in the file, if they differ
+}
+
+// Compiler compiles Fennel and MoonScript files to Lua. Fennel is compiled
+// in-process with fennel.lua, if it can be found, or else with the fennel
+// executable. MoonScript is compiled with the moonc executable.
+type Compiler struct {
+	dirs   []string // where to look for fennel.lua
+	mut    sync.Mutex
+	cache  map[string]entry
+	fennel *lua.LState // the Lua state with the Fennel compiler, when it has been loaded
+	found  bool        // if fennel.lua has been looked for
+}
+
+// New returns a Compiler that looks for fennel.lua in the given directories,
+// and then in the directories where Lua modules are usually installed
+func New(dirs ...string) *Compiler {
+	return &Compiler{dirs: dirs, cache: make(map[string]entry)}
+}
+
+// Supported checks if the given file can be compiled to Lua
+func Supported(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".fnl", ".moon":
+		return true
+	}
+	return false
+}
+
+// Compile returns the given Fennel or MoonScript file as Lua code. The
+// compiled code is kept until the file changes. Compilation errors are
+// returned as *Error.
+func (c *Compiler) Compile(filename string) ([]byte, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	version := fmt.Sprintf("%d %d", fi.ModTime().UnixNano(), fi.Size())
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if e, ok := c.cache[filename]; ok && e.version == version {
+		return e.code, nil
+	}
+	var (
+		code  []byte
+		lines map[int]int
+	)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".fnl":
+		code, err = c.compileFennel(filename)
+	case ".moon":
+		code, lines, err = compileMoonScript(filename)
+	default:
+		err = fmt.Errorf("transpile: unsupported file: %s", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.cache[filename] = entry{version, code, lines}
+	return code, nil
+}
+
+// MapLines changes the line numbers after the given filename in the given
+// error message, from the lines of the compiled Lua code to the lines of the
+// file. Fennel is compiled with the Lua code on the same lines, so only
+// MoonScript files are changed. Returns false if the lines are not known,
+// because the file has not been compiled or moonc did not give the lines.
+func (c *Compiler) MapLines(filename, message string) (string, bool) {
+	if strings.ToLower(filepath.Ext(filename)) == ".fnl" {
+		return message, true
+	}
+	c.mut.Lock()
+	e, ok := c.cache[filename]
+	c.mut.Unlock()
+	if !ok || len(e.lines) == 0 {
+		return message, false
+	}
+	re := regexp.MustCompile(regexp.QuoteMeta(filename) + `:(\d+):`)
+	return re.ReplaceAllStringFunc(message, func(s string) string {
+		line, _ := strconv.Atoi(re.FindStringSubmatch(s)[1])
+		// Use the closest Lua line before it, that has a known line in the file
+		for l := line; l > 0; l-- {
+			if sourceLine, ok := e.lines[l]; ok {
+				return filename + ":" + strconv.Itoa(sourceLine) + ":"
+			}
+		}
+		return s
+	}), true
+}
+
+// loadFennel loads fennel.lua into a Lua state, the first time it is called.
+// Returns false if fennel.lua could not be found. c.mut must be locked.
+func (c *Compiler) loadFennel() (bool, error) {
+	if c.found {
+		return c.fennel != nil, nil
+	}
+	c.found = true
+	for _, dir := range append(append([]string(nil), c.dirs...), fennelDirs...) {
+		path := filepath.Join(dir, "fennel.lua")
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		L := lua.NewState()
+		if err := L.DoFile(path); err != nil {
+			L.Close()
+			return false, fmt.Errorf("transpile: could not load %s: %s", path, err)
+		}
+		L.SetGlobal("fennel", L.Get(-1))
+		L.Pop(1)
+		c.fennel = L
+		return true, nil
+	}
+	return false, nil
+}
+
+// compileFennel compiles a Fennel file, with the Lua code on the same lines
+// as the Fennel code, as far as possible. c.mut must be locked.
+func (c *Compiler) compileFennel(filename string) ([]byte, error) {
+	ok, err := c.loadFennel()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if _, err := exec.LookPath("fennel"); err != nil {
+			return nil, ErrNoFennel
+		}
+		return run(filename, fennelLine, "fennel", "--compile", "--correlate", filename)
+	}
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	L := c.fennel
+	options := L.NewTable()
+	options.RawSetString("filename", lua.LString(filename))
+	options.RawSetString("correlate", lua.LTrue)
+	fennel, ok := L.GetGlobal("fennel").(*lua.LTable)
+	if !ok {
+		return nil, ErrNoFennel
+	}
+	L.Push(L.GetField(fennel, "compileString"))
+	L.Push(lua.LString(source))
+	L.Push(options)
+	if err := L.PCall(2, 1, nil); err != nil {
+		message := err.Error()
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			message = apiErr.Object.String()
+		}
+		return nil, newError(filename, message, fennelLine)
+	}
+	code := L.Get(-1)
+	L.Pop(1)
+	return []byte(lua.LVAsString(code)), nil
+}
+
+// compileMoonScript compiles a MoonScript file with moonc. Also returns the
+// line numbers in the file for the lines of the Lua code, from the line
+// rewrite table of moonc, or nil if it is not available.
+func compileMoonScript(filename string) ([]byte, map[int]int, error) {
+	if _, err := exec.LookPath("moonc"); err != nil {
+		return nil, nil, ErrNoMoonScript
+	}
+	code, err := run(filename, moonLine, "moonc", "-p", filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	table, err := run(filename, moonLine, "moonc", "-X", filename)
+	if err != nil {
+		// The lines are only used for error messages
+		return code, nil, nil
+	}
+	return code, moonLines(table), nil
+}
+
+// moonLines parses the line rewrite table from "moonc -X", where each line
+// has a position, the Lua line number and code, ">>" and the MoonScript line
+// number and code. Returns a map from Lua line numbers to MoonScript line numbers.
+func moonLines(table []byte) map[int]int {
+	lines := make(map[int]int)
+	for _, m := range moonPosition.FindAllSubmatch(table, -1) {
+		luaLine, _ := strconv.Atoi(string(m[1]))
+		moonLine, _ := strconv.Atoi(string(m[2]))
+		if _, ok := lines[luaLine]; !ok {
+			lines[luaLine] = moonLine
+		}
+	}
+	return lines
+}
+
+// run runs a compiler and returns what it writes to stdout, or an *Error
+// with what it writes to stderr
+func run(filename string, pattern *regexp.Regexp, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := stderr.String()
+		if strings.TrimSpace(message) == "" {
+			message = stdout.String() + err.Error()
+		}
+		return nil, newError(filename, message, pattern)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,118 @@
+package transpile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// A stand-in for fennel.lua, that compiles (print "text") to Lua and
+// raises errors like Fennel does
+const fakeFennel = `
+local calls = 0
+return {
+  compileString = function(source, options)
+    calls = calls + 1
+    assert(options.correlate)
+    local text = source:match('^%(print "(.*)"%)%s*$')
+    if not text then
+      error(options.filename .. ":1:0: Parse error: expected (print \"...\")", 0)
+    end
+    return "print(" .. string.format("%q", text) .. ") return " .. calls
+  end
+}
+`
+
+// A stand-in for moonc, that prints a Lua file with the same name, or an error like moonc does
+const fakeMoonc = `#!/bin/sh
+lua="${2%.moon}.lua"
+if [ "$1" = "-X" ]; then
+  printf '7\t 1:[ local x = 1 ] >> 1:[ x = 1 ]\n'
+  printf '19\t 3:[ print(x) ] >> 4:[ print x ]\n'
+elif [ -f "$lua" ]; then
+  cat "$lua"
+else
+  echo "Failed to parse:" >&2
+  echo " [3] >>    x = " >&2
+  exit 1
+fi
+`
+
+func TestFennel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transpiletest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(dir, "fennel.lua"), []byte(fakeFennel), 0644), nil)
+	filename := filepath.Join(dir, "hello.fnl")
+	assert.Equal(t, ioutil.WriteFile(filename, []byte(`(print "hi")`), 0644), nil)
+
+	c := New(dir)
+	code, err := c.Compile(filename)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(string(code), `print("hi")`), true)
+
+	// The compiled code is kept until the file changes
+	again, err := c.Compile(filename)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(again), string(code))
+	assert.Equal(t, ioutil.WriteFile(filename, []byte(`(oops`), 0644), nil)
+	later := time.Now().Add(time.Minute)
+	assert.Equal(t, os.Chtimes(filename, later, later), nil)
+	_, err = c.Compile(filename)
+	compileErr, ok := err.(*Error)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, compileErr.Line, 1)
+	assert.Equal(t, strings.HasPrefix(err.Error(), filename+":1: "), true)
+
+	// The compiled code runs
+	assert.Equal(t, ioutil.WriteFile(filename, []byte(`(print "again")`), 0644), nil)
+	later = later.Add(time.Minute)
+	assert.Equal(t, os.Chtimes(filename, later, later), nil)
+	code, err = c.Compile(filename)
+	assert.Equal(t, err, nil)
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, L.DoString(string(code)), nil)
+	assert.Equal(t, L.Get(-1), lua.LNumber(3))
+
+	assert.Equal(t, Supported("index.fnl"), true)
+	assert.Equal(t, Supported("index.moon"), true)
+	assert.Equal(t, Supported("index.lua"), false)
+}
+
+func TestMoonScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transpiletest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(dir, "moonc"), []byte(fakeMoonc), 0755), nil)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	filename := filepath.Join(dir, "hello.moon")
+	assert.Equal(t, ioutil.WriteFile(filename, []byte(`print "hi"`), 0644), nil)
+	assert.Equal(t, ioutil.WriteFile(filepath.Join(dir, "hello.lua"), []byte(`print("hi")`), 0644), nil)
+	broken := filepath.Join(dir, "broken.moon")
+	assert.Equal(t, ioutil.WriteFile(broken, []byte("\n\nx = "), 0644), nil)
+
+	c := New()
+	code, err := c.Compile(filename)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(code), `print("hi")`)
+	_, err = c.Compile(broken)
+	compileErr, ok := err.(*Error)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, compileErr.Line, 3)
+
+	// Line numbers in runtime errors are changed to the lines of the MoonScript file
+	message, ok := c.MapLines(filename, filename+":3: boom\n\t"+filename+":4: in main chunk")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, message, filename+":4: boom\n\t"+filename+":4: in main chunk")
+	_, ok = c.MapLines(broken, broken+":1: boom")
+	assert.Equal(t, ok, false)
+}
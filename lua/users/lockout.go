@@ -0,0 +1,125 @@
+package users
+
+import (
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/auth"
+	"github.com/xyproto/gopher-lua"
+)
+
+// secondsLeft returns the number of whole seconds until the given time, rounded up
+func secondsLeft(until time.Time) int {
+	return int((time.Until(until) + time.Second - 1) / time.Second)
+}
+
+// loadLockout makes functions for querying and clearing lockouts available to Lua scripts
+func loadLockout(L *lua.LState, state *auth.UserState) {
+
+	// Check if a username is locked out because of failed login attempts.
+	// Takes a username, returns a bool and the number of seconds left.
+	L.SetGlobal("IsLockedOut", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		until, locked := state.Lockout(username)
+		if !locked {
+			L.Push(lua.LFalse)
+			L.Push(lua.LNumber(0))
+			return 2 // number of results
+		}
+		L.Push(lua.LTrue)
+		L.Push(lua.LNumber(secondsLeft(until)))
+		return 2 // number of results
+	}))
+	// Check if an IP address is locked out because of failed login attempts.
+	// Takes an IP address, returns a bool and the number of seconds left.
+	L.SetGlobal("IsIPLockedOut", L.NewFunction(func(L *lua.LState) int {
+		ip := L.ToString(1)
+		until, locked := state.IPLockout(ip)
+		if !locked {
+			L.Push(lua.LFalse)
+			L.Push(lua.LNumber(0))
+			return 2 // number of results
+		}
+		L.Push(lua.LTrue)
+		L.Push(lua.LNumber(secondsLeft(until)))
+		return 2 // number of results
+	}))
+	// Get the number of recent failed login attempts for a username
+	// Takes a username, returns a number
+	L.SetGlobal("FailedLogins", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		L.Push(lua.LNumber(state.FailedAttempts(username)))
+		return 1 // number of results
+	}))
+	// Remove the failed login attempts and any lockout for a username
+	// Takes a username
+	L.SetGlobal("ClearLockout", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		state.ClearLockout(username)
+		return 0 // number of results
+	}))
+	// Remove the failed login attempts and any lockout for an IP address
+	// Takes an IP address
+	L.SetGlobal("ClearIPLockout", L.NewFunction(func(L *lua.LState) int {
+		ip := L.ToString(1)
+		state.ClearIPLockout(ip)
+		return 0 // number of results
+	}))
+	// Get the most recent entries in the audit log of authentication events,
+	// newest first. Takes an optional number of entries (the default is 100).
+	// Returns a table with tables that has the fields time, event, username and ip.
+	L.SetGlobal("AuditLog", L.NewFunction(func(L *lua.LState) int {
+		n := 100
+		if L.GetTop() >= 1 {
+			n = int(L.ToNumber(1))
+		}
+		table := L.NewTable()
+		if g := state.Guard(); g != nil {
+			for _, entry := range g.AuditLog(n) {
+				fields := strings.SplitN(entry, " ", 4)
+				if len(fields) != 4 {
+					continue
+				}
+				row := L.NewTable()
+				row.RawSetString("time", lua.LString(fields[0]))
+				row.RawSetString("event", lua.LString(fields[1]))
+				row.RawSetString("username", lua.LString(fields[2]))
+				row.RawSetString("ip", lua.LString(fields[3]))
+				table.Append(row)
+			}
+		}
+		L.Push(table)
+		return 1 // number of results
+	}))
+	// Change the lockout policy. Takes a table with the optional fields
+	// max_attempts, max_ip_attempts, lockout, max_lockout, window (durations
+	// are in seconds) and audit_size. Returns true if successful.
+	L.SetGlobal("SetLockoutPolicy", L.NewFunction(func(L *lua.LState) int {
+		table := L.CheckTable(1)
+		g := state.Guard()
+		if g == nil {
+			L.Push(lua.LFalse)
+			return 1 // number of results
+		}
+		policy := g.Policy()
+		setInt := func(field string, target *int) {
+			if n, ok := table.RawGetString(field).(lua.LNumber); ok {
+				*target = int(n)
+			}
+		}
+		setDuration := func(field string, target *time.Duration) {
+			if n, ok := table.RawGetString(field).(lua.LNumber); ok {
+				*target = time.Duration(float64(n) * float64(time.Second))
+			}
+		}
+		setInt("max_attempts", &policy.MaxAttempts)
+		setInt("max_ip_attempts", &policy.MaxIPAttempts)
+		setDuration("lockout", &policy.BaseDuration)
+		setDuration("max_lockout", &policy.MaxDuration)
+		setDuration("window", &policy.Window)
+		setInt("audit_size", &policy.AuditSize)
+		g.SetPolicy(policy)
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+}
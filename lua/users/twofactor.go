@@ -0,0 +1,107 @@
+package users
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/auth"
+	"github.com/xyproto/gopher-lua"
+)
+
+// loadTwoFactor makes functions related to two-factor authentication available to Lua scripts
+func loadTwoFactor(w http.ResponseWriter, req *http.Request, L *lua.LState, state *auth.UserState) {
+
+	// Generate a new TOTP secret for a user. Two-factor authentication is
+	// enabled when the user has confirmed a code with ConfirmTOTP.
+	// Takes a username and optionally an issuer (the default is the host name).
+	// Returns the secret and an otpauth:// URI, or two empty strings.
+	L.SetGlobal("EnrollTOTP", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		issuer := req.Host
+		if L.GetTop() >= 2 {
+			issuer = L.ToString(2)
+		}
+		secret, uri, err := state.EnrollTOTP(username, issuer)
+		if err != nil {
+			log.Errorf("Could not enroll %s for two-factor authentication: %s", username, err)
+		}
+		L.Push(lua.LString(secret))
+		L.Push(lua.LString(uri))
+		return 2 // number of results
+	}))
+	// Enable two-factor authentication for a user, if the one-time password
+	// is valid for the secret from EnrollTOTP, and mark the second factor as
+	// verified for the current session. Returns true if successful.
+	// Takes a username and a one-time password
+	L.SetGlobal("ConfirmTOTP", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		code := L.ToString(2)
+		L.Push(lua.LBool(state.ConfirmTOTP(w, username, code)))
+		return 1 // number of results
+	}))
+	// Check a one-time password or recovery code for a user and mark the
+	// second factor as verified for the current session, until the user logs
+	// out. Returns true if correct.
+	// Takes a username and a one-time password or recovery code
+	L.SetGlobal("VerifyTOTP", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		code := L.ToString(2)
+		L.Push(lua.LBool(state.VerifyTOTP(w, username, code)))
+		return 1 // number of results
+	}))
+	// Check if a user has enabled two-factor authentication, returns bool
+	// Takes a username
+	L.SetGlobal("HasTOTP", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		L.Push(lua.LBool(state.TOTPEnabled(username)))
+		return 1 // number of results
+	}))
+	// Check if a user has verified the second factor in the current session, returns bool
+	// Takes a username
+	L.SetGlobal("TwoFactorVerified", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		L.Push(lua.LBool(state.TwoFactorVerified(req, username)))
+		return 1 // number of results
+	}))
+	// Disable two-factor authentication for a user, removing the secret
+	// and the recovery codes. Takes a username.
+	L.SetGlobal("DisableTOTP", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		state.DisableTOTP(username)
+		return 0 // number of results
+	}))
+	// Generate new recovery codes for a user, replacing the old ones.
+	// Only hashes of the codes are stored, so they can only be shown once.
+	// Takes a username, returns a table with codes
+	L.SetGlobal("RecoveryCodes", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		table := L.NewTable()
+		codes, err := state.GenerateRecoveryCodes(username)
+		if err != nil {
+			log.Errorf("Could not generate recovery codes for %s: %s", username, err)
+		}
+		for _, code := range codes {
+			table.Append(lua.LString(code))
+		}
+		L.Push(table)
+		return 1 // number of results
+	}))
+	// Get the number of unused recovery codes for a user
+	// Takes a username, returns a number
+	L.SetGlobal("RecoveryCodesLeft", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		L.Push(lua.LNumber(state.RecoveryCodesLeft(username)))
+		return 1 // number of results
+	}))
+	// Render an otpauth:// URI (or any other text) as a QR code
+	// Takes a string, returns an SVG image as a string
+	L.SetGlobal("TOTPQRCode", L.NewFunction(func(L *lua.LState) int {
+		uri := L.ToString(1)
+		svg, err := auth.QRCodeSVG(uri)
+		if err != nil {
+			log.Error("Could not create a QR code: ", err)
+		}
+		L.Push(lua.LString(svg))
+		return 1 // number of results
+	}))
+}
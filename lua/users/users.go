@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/auth"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/pinterface"
@@ -250,9 +251,17 @@ func Load(w http.ResponseWriter, req *http.Request, L *lua.LState, userstate pin
 	}))
 	// Log in a user, both on the server and with a cookie.
 	// Returns true of successful.
-	// Takes a username
+	// Takes a username and, if two-factor authentication is enabled for the user,
+	// a one-time password or recovery code, without which the user is not logged in
 	L.SetGlobal("Login", L.NewFunction(func(L *lua.LState) int {
 		username := L.ToString(1)
+		if L.GetTop() >= 2 {
+			// A one-time password or recovery code is given as the second argument
+			if state, ok := userstate.(*auth.UserState); ok {
+				L.Push(lua.LBool(state.LoginWithCode(w, username, L.ToString(2))))
+				return 1 // number of results
+			}
+		}
 		L.Push(lua.LBool(nil == userstate.Login(w, username)))
 		return 1 // number of results
 	}))
@@ -298,20 +307,79 @@ func Load(w http.ResponseWriter, req *http.Request, L *lua.LState, userstate pin
 		userstate.SetCookieSecret(secret)
 		return 0 // number of results
 	}))
-	// Get the current password hashing algorithm (bcrypt, bcrypt+ or sha256)
+	// Get the current password hashing algorithm (argon2id, bcrypt, bcrypt+ or sha256)
 	// Takes nothing
 	L.SetGlobal("PasswordAlgo", L.NewFunction(func(L *lua.LState) int {
 		algorithm := userstate.PasswordAlgo()
 		L.Push(lua.LString(algorithm))
 		return 1 // number of results
 	}))
-	// Set the current password hashing algorithm (bcrypt, bcrypt+ or sha256)
+	// Set the current password hashing algorithm (argon2id, bcrypt, bcrypt+ or sha256)
 	// Takes a string
 	L.SetGlobal("SetPasswordAlgo", L.NewFunction(func(L *lua.LState) int {
 		algorithm := L.ToString(1)
-		userstate.SetPasswordAlgo(algorithm)
+		if err := userstate.SetPasswordAlgo(algorithm); err != nil {
+			log.Error(err)
+		}
 		return 0 // number of results
 	}))
+	// Get the algorithm that was used for hashing the password of the given user
+	// (argon2id, bcrypt or sha256). Returns an empty string if not found.
+	// Takes a username
+	L.SetGlobal("UserPasswordAlgo", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		algorithm := ""
+		if hash, err := userstate.PasswordHash(username); err == nil {
+			algorithm = auth.HashAlgo(hash)
+		}
+		L.Push(lua.LString(algorithm))
+		return 1 // number of results
+	}))
+	// Set the cost that is used when hashing passwords with bcrypt (4 to 31)
+	// Takes a number, returns true if the cost could be set
+	L.SetGlobal("SetBcryptCost", L.NewFunction(func(L *lua.LState) int {
+		cost := L.ToInt(1)
+		state, ok := userstate.(*auth.UserState)
+		if !ok {
+			log.Error("SetBcryptCost is not supported by this user state")
+			L.Push(lua.LFalse)
+			return 1 // number of results
+		}
+		if err := state.SetBcryptCost(cost); err != nil {
+			log.Error(err)
+			L.Push(lua.LFalse)
+			return 1 // number of results
+		}
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+	// Set the parameters that are used when hashing passwords with argon2id
+	// Takes the memory usage in KiB, the number of iterations and optionally
+	// the number of threads. Returns true if the parameters could be set.
+	L.SetGlobal("SetArgon2Params", L.NewFunction(func(L *lua.LState) int {
+		threads := 1
+		if L.GetTop() >= 3 {
+			threads = L.ToInt(3)
+		}
+		p := auth.Argon2Params{
+			Memory:  uint32(L.ToInt(1)),
+			Time:    uint32(L.ToInt(2)),
+			Threads: uint8(threads),
+		}
+		state, ok := userstate.(*auth.UserState)
+		if !ok {
+			log.Error("SetArgon2Params is not supported by this user state")
+			L.Push(lua.LFalse)
+			return 1 // number of results
+		}
+		if err := state.SetArgon2Params(p); err != nil {
+			log.Error(err)
+			L.Push(lua.LFalse)
+			return 1 // number of results
+		}
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
 	// Change the password for a user
 	L.SetGlobal("SetPassword", L.NewFunction(func(L *lua.LState) int {
 		username := L.ToString(1)
@@ -328,11 +396,17 @@ func Load(w http.ResponseWriter, req *http.Request, L *lua.LState, userstate pin
 		L.Push(lua.LString(userstate.HashPassword(username, password)))
 		return 1 // number of results
 	}))
-	// Check if a given username and password is correct, returns a bool
+	// Check if a given username and password is correct, returns a bool.
+	// Too many failed attempts for a username or IP address leads to a lockout.
 	// Takes a username and password
 	L.SetGlobal("CorrectPassword", L.NewFunction(func(L *lua.LState) int {
 		username := L.ToString(1)
 		password := L.ToString(2)
+		if state, ok := userstate.(*auth.UserState); ok {
+			// Also track failed attempts from the IP address of the client
+			L.Push(lua.LBool(state.CheckPassword(username, password, auth.RemoteIP(req))))
+			return 1 // number of results
+		}
 		L.Push(lua.LBool(userstate.CorrectPassword(username, password)))
 		return 1 // number of results
 	}))
@@ -392,4 +466,38 @@ func Load(w http.ResponseWriter, req *http.Request, L *lua.LState, userstate pin
 		L.Push(result)
 		return 1 // number of results
 	}))
+
+	if state, ok := userstate.(*auth.UserState); ok {
+		loadTwoFactor(w, req, L, state)
+		loadLockout(L, state)
+	}
+}
+
+// sandboxedOut are the functions that are left out for sandboxed sites.
+// The users, the cookie secret and the settings are shared by all sites, so
+// these functions would let one site change users, log in as any user, or
+// read the secrets of the other sites.
+var sandboxedOut = []string{
+	"SetBooleanField", "AllUsernames", "Email", "PasswordHash",
+	"AllUnconfirmedUsernames", "ConfirmationCode", "AddUnconfirmed",
+	"RemoveUnconfirmed", "MarkConfirmed", "RemoveUser", "SetAdminStatus",
+	"RemoveAdminStatus", "AddUser", "SetLoggedIn", "SetLoggedOut", "Login",
+	"Logout", "SetUsernameCookie", "SetCookieTimeout", "CookieSecret",
+	"SetCookieSecret", "SetPasswordAlgo", "SetBcryptCost", "SetArgon2Params",
+	"SetPassword", "CorrectPassword", "FindUserByConfirmationCode", "Confirm",
+	"ConfirmUserByConfirmationCode", "SetMinimumConfirmationCodeLength",
+	"GenerateUniqueConfirmationCode", "EnrollTOTP", "ConfirmTOTP", "VerifyTOTP",
+	"DisableTOTP", "RecoveryCodes", "ClearLockout", "ClearIPLockout",
+	"AuditLog", "SetLockoutPolicy",
+}
+
+// LoadSandboxed makes the functions for checking the current user available
+// to Lua scripts for sandboxed sites. The functions for changing users,
+// logging in, admin rights, secrets and settings are left out.
+func LoadSandboxed(w http.ResponseWriter, req *http.Request, L *lua.LState, userstate pinterface.IUserState) {
+	Load(w, req, L, userstate)
+	// The Lua states are reused, so the functions are removed
+	for _, name := range sandboxedOut {
+		L.SetGlobal(name, lua.LNil)
+	}
 }
@@ -0,0 +1,26 @@
+package users
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestLoadSandboxed(t *testing.T) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	L := lua.NewState()
+	defer L.Close()
+
+	// The Lua states are reused, so the functions must be removed after a full Load
+	Load(w, req, L, nil)
+	assert.NotEqual(t, L.GetGlobal("SetAdminStatus"), lua.LNil)
+	LoadSandboxed(w, req, L, nil)
+	for _, name := range sandboxedOut {
+		assert.Equal(t, L.GetGlobal(name), lua.LNil)
+	}
+	assert.NotEqual(t, L.GetGlobal("Username"), lua.LNil)
+	assert.NotEqual(t, L.GetGlobal("AdminRights"), lua.LNil)
+}
@@ -0,0 +1,323 @@
+package mail
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/themes"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// DefaultConfirmPath is the URL path for confirming an account
+	DefaultConfirmPath = "/confirm"
+
+	// DefaultResetPath is the URL path for choosing a new password
+	DefaultResetPath = "/reset"
+
+	// DefaultExpiry is how long the links in the e-mails are valid
+	DefaultExpiry = 24 * time.Hour
+
+	// Name of the KeyValue that holds the expiry times and the password reset tokens
+	tokensID = "__mail_tokens"
+)
+
+// Default templates for the e-mail bodies
+const (
+	defaultConfirmTemplate = `Hi {{ username }},
+
+Please confirm your account by visiting this link:
+
+{{ url }}
+
+The link expires {{ expires }}.
+`
+	defaultResetTemplate = `Hi {{ username }},
+
+A new password was requested for your account. You can choose a new password here:
+
+{{ url }}
+
+The link expires {{ expires }}. If you did not request a new password, you can ignore this e-mail.
+`
+)
+
+// ErrNoEmail is returned when a user has no e-mail address
+var ErrNoEmail = errors.New("mail: the user has no e-mail address")
+
+// AccountsConfig contains the settings for the account confirmation and password reset flows
+type AccountsConfig struct {
+	From            string        // The sender address
+	BaseURL         string        // The scheme and host of the links, like "https://example.com"
+	ConfirmPath     string        // Path for confirming an account
+	ResetPath       string        // Path for choosing a new password
+	AfterConfirm    string        // Where to redirect after confirming ("/" by default)
+	AfterReset      string        // Where to redirect after a new password is set ("/" by default)
+	Expiry          time.Duration // How long the links are valid
+	ConfirmSubject  string        // The subject of the confirmation e-mail
+	ResetSubject    string        // The subject of the password reset e-mail
+	ConfirmTemplate string        // Pongo2 template for the confirmation e-mail, with username, url and expires
+	ResetTemplate   string        // Pongo2 template for the password reset e-mail, with username, url and expires
+	Theme           string        // Theme for the password reset form and the error pages
+}
+
+// Accounts sends confirmation and password reset e-mails and
+// provides the handlers for the links in the e-mails
+type Accounts struct {
+	conf      AccountsConfig
+	mailer    Mailer
+	userstate pinterface.IUserState
+	tokens    pinterface.IKeyValue
+}
+
+// NewAccounts creates the account flows, using the given mailer and user state
+func NewAccounts(conf AccountsConfig, mailer Mailer, userstate pinterface.IUserState) (*Accounts, error) {
+	if mailer == nil {
+		return nil, errors.New("mail: no mailer given")
+	}
+	if conf.From == "" {
+		return nil, errors.New("mail: no sender address given")
+	}
+	// The links are not based on the Host header of the request, since
+	// it can be set to anything by the one who requests the e-mail
+	if u, err := url.Parse(conf.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("mail: a base URL like https://example.com must be given")
+	}
+	conf.BaseURL = strings.TrimSuffix(conf.BaseURL, "/")
+	if conf.ConfirmPath == "" {
+		conf.ConfirmPath = DefaultConfirmPath
+	}
+	if conf.ResetPath == "" {
+		conf.ResetPath = DefaultResetPath
+	}
+	if conf.AfterConfirm == "" {
+		conf.AfterConfirm = "/"
+	}
+	if conf.AfterReset == "" {
+		conf.AfterReset = "/"
+	}
+	if conf.Expiry <= 0 {
+		conf.Expiry = DefaultExpiry
+	}
+	if conf.ConfirmSubject == "" {
+		conf.ConfirmSubject = "Please confirm your account"
+	}
+	if conf.ResetSubject == "" {
+		conf.ResetSubject = "Choose a new password"
+	}
+	if conf.ConfirmTemplate == "" {
+		conf.ConfirmTemplate = defaultConfirmTemplate
+	}
+	if conf.ResetTemplate == "" {
+		conf.ResetTemplate = defaultResetTemplate
+	}
+	if conf.Theme == "" {
+		conf.Theme = themes.DefaultTheme
+	}
+	tokens, err := userstate.Creator().NewKeyValue(tokensID)
+	if err != nil {
+		return nil, err
+	}
+	return &Accounts{conf: conf, mailer: mailer, userstate: userstate, tokens: tokens}, nil
+}
+
+// Config returns the configuration, with defaults filled in
+func (a *Accounts) Config() AccountsConfig {
+	return a.conf
+}
+
+// Register adds the confirmation and password reset handlers to the given mux
+func (a *Accounts) Register(mux *http.ServeMux) {
+	mux.HandleFunc(a.conf.ConfirmPath, a.ConfirmHandler)
+	mux.HandleFunc(a.conf.ResetPath, a.ResetHandler)
+}
+
+// Render renders a Pongo2 template string with the given data
+func Render(template string, data map[string]interface{}) (string, error) {
+	tpl, err := pongo2.FromString(template)
+	if err != nil {
+		return "", err
+	}
+	return tpl.Execute(pongo2.Context(data))
+}
+
+// send renders the template and sends it to the given user
+func (a *Accounts) send(username, subject, template, link string) error {
+	email, err := a.userstate.Email(username)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return ErrNoEmail
+	}
+	body, err := Render(template, map[string]interface{}{
+		"username": username,
+		"url":      link,
+		"expires":  time.Now().Add(a.conf.Expiry).Format("2006-01-02 15:04 MST"),
+	})
+	if err != nil {
+		return err
+	}
+	return a.mailer.Send(&Message{From: a.conf.From, To: email, Subject: subject, Body: body})
+}
+
+// SendConfirmation marks the given user as unconfirmed and sends an e-mail
+// with a confirmation link
+func (a *Accounts) SendConfirmation(username string) error {
+	if !a.userstate.HasUser(username) {
+		return errors.New("mail: no such user: " + username)
+	}
+	code, err := a.userstate.GenerateUniqueConfirmationCode()
+	if err != nil {
+		return err
+	}
+	a.userstate.AddUnconfirmed(username, code)
+	if err := a.tokens.Set("confirm:"+username, strconv.FormatInt(time.Now().Add(a.conf.Expiry).Unix(), 10)); err != nil {
+		return err
+	}
+	return a.send(username, a.conf.ConfirmSubject, a.conf.ConfirmTemplate, a.conf.BaseURL+a.conf.ConfirmPath+"?code="+code)
+}
+
+// SendPasswordReset sends an e-mail with a link for choosing a new password.
+// Links that have been sent to the user earlier can no longer be used.
+func (a *Accounts) SendPasswordReset(username string) error {
+	if !a.userstate.HasUser(username) {
+		return errors.New("mail: no such user: " + username)
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	a.forgetReset(username)
+	// Only a hash of the token is stored
+	hash := hashToken(token)
+	value := strconv.FormatInt(time.Now().Add(a.conf.Expiry).Unix(), 10) + " " + username
+	if err := a.tokens.Set("reset:"+hash, value); err != nil {
+		return err
+	}
+	if err := a.tokens.Set("resetuser:"+username, hash); err != nil {
+		return err
+	}
+	return a.send(username, a.conf.ResetSubject, a.conf.ResetTemplate, a.conf.BaseURL+a.conf.ResetPath+"?token="+token)
+}
+
+// forgetReset removes the password reset token of the given user, if any
+func (a *Accounts) forgetReset(username string) {
+	if hash, err := a.tokens.Get("resetuser:" + username); err == nil && hash != "" {
+		a.tokens.Del("reset:" + hash)
+	}
+	a.tokens.Del("resetuser:" + username)
+}
+
+// expired checks if the given unix timestamp has passed
+func expired(timestamp string) bool {
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	return err != nil || time.Now().Unix() > t
+}
+
+// resetUser returns the user for a valid password reset token
+func (a *Accounts) resetUser(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	hash := hashToken(token)
+	value, err := a.tokens.Get("reset:" + hash)
+	if err != nil {
+		return "", false
+	}
+	fields := strings.SplitN(value, " ", 2)
+	if len(fields) != 2 || expired(fields[0]) || !a.userstate.HasUser(fields[1]) {
+		return "", false
+	}
+	// Only the most recent token of the user is valid
+	if current, err := a.tokens.Get("resetuser:" + fields[1]); err != nil || current != hash {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// page writes a page that uses the configured theme
+func (a *Accounts) page(w http.ResponseWriter, status int, title, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, themes.MessagePage(title, body, a.conf.Theme)+"</body></html>")
+}
+
+// ConfirmHandler confirms the account that the "code" query parameter belongs to
+func (a *Accounts) ConfirmHandler(w http.ResponseWriter, req *http.Request) {
+	code := req.URL.Query().Get("code")
+	username, err := a.userstate.FindUserByConfirmationCode(code)
+	if code == "" || err != nil {
+		a.page(w, http.StatusBadRequest, "Invalid link", "<p>The confirmation link is invalid or has already been used.</p>")
+		return
+	}
+	if expires, err := a.tokens.Get("confirm:" + username); err == nil && expired(expires) {
+		a.page(w, http.StatusBadRequest, "Expired link", "<p>The confirmation link has expired.</p>")
+		return
+	}
+	a.userstate.Confirm(username)
+	a.tokens.Del("confirm:" + username)
+	http.Redirect(w, req, a.conf.AfterConfirm, http.StatusFound)
+}
+
+// ResetHandler shows a form for choosing a new password (GET) and sets
+// the new password (POST), given a valid "token" parameter
+func (a *Accounts) ResetHandler(w http.ResponseWriter, req *http.Request) {
+	token := req.FormValue("token")
+	username, ok := a.resetUser(token)
+	if !ok {
+		a.page(w, http.StatusBadRequest, "Invalid link", "<p>The password reset link is invalid or has expired.</p>")
+		return
+	}
+	message := ""
+	if req.Method == http.MethodPost {
+		password := req.PostFormValue("password")
+		switch {
+		case password == "":
+			message = "Please enter a new password."
+		case password != req.PostFormValue("password2"):
+			message = "The passwords do not match."
+		default:
+			a.userstate.SetPassword(username, password)
+			a.forgetReset(username)
+			log.Infof("New password set for %s", username)
+			http.Redirect(w, req, a.conf.AfterReset, http.StatusFound)
+			return
+		}
+	}
+	var sb strings.Builder
+	if message != "" {
+		sb.WriteString("<p>" + html.EscapeString(message) + "</p>")
+	}
+	sb.WriteString(`<form method="POST" action="` + html.EscapeString(a.conf.ResetPath) + `">`)
+	sb.WriteString(`<input type="hidden" name="token" value="` + html.EscapeString(token) + `">`)
+	sb.WriteString(`<p><label>New password for ` + html.EscapeString(username) + `<br><input type="password" name="password" autocomplete="new-password"></label></p>`)
+	sb.WriteString(`<p><label>Repeat the password<br><input type="password" name="password2" autocomplete="new-password"></label></p>`)
+	sb.WriteString(`<p><input type="submit" value="Set password"></p></form>`)
+	a.page(w, http.StatusOK, "Choose a new password", sb.String())
+}
+
+// randomToken returns 64 hexadecimal characters from a cryptographically secure source
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
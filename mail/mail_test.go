@@ -0,0 +1,151 @@
+package mail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	bolt "github.com/xyproto/permissionbolt"
+	"github.com/xyproto/pinterface"
+)
+
+func setup(t *testing.T) (*Accounts, pinterface.IUserState, string, func()) {
+	dir, err := ioutil.TempDir("", "mailtest")
+	assert.Equal(t, err, nil)
+	perm, err := bolt.NewWithConf(filepath.Join(dir, "test.db"))
+	assert.Equal(t, err, nil)
+	userstate := perm.UserState()
+	maildir := filepath.Join(dir, "maildir")
+	accounts, err := NewAccounts(AccountsConfig{From: "noreply@example.com", BaseURL: "http://example.com"}, &MaildirMailer{Dir: maildir}, userstate)
+	assert.Equal(t, err, nil)
+	return accounts, userstate, maildir, func() { os.RemoveAll(dir) }
+}
+
+// lastLink returns the link in the most recently delivered e-mail
+func lastLink(t *testing.T, maildir string) string {
+	files, err := ioutil.ReadDir(filepath.Join(maildir, "new"))
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, len(files), 0)
+	newest := files[0]
+	for _, fi := range files {
+		if fi.Name() > newest.Name() {
+			newest = fi
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(maildir, "new", newest.Name()))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.Contains(string(data), "To: bob@example.com\r\n"), true)
+	return regexp.MustCompile(`http://\S+`).FindString(string(data))
+}
+
+func TestBaseURL(t *testing.T) {
+	mailer := &MaildirMailer{Dir: "unused"}
+	for _, baseURL := range []string{"", "example.com", "ftp://example.com", "https://"} {
+		_, err := NewAccounts(AccountsConfig{From: "noreply@example.com", BaseURL: baseURL}, mailer, nil)
+		assert.NotEqual(t, err, nil)
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	msg := &Message{From: "a@example.com", To: "b@example.com\r\nBcc: c@example.com", Subject: "Hi"}
+	_, err := msg.Bytes()
+	assert.Equal(t, err, ErrHeaderInjection)
+}
+
+func TestConfirm(t *testing.T) {
+	accounts, userstate, maildir, cleanup := setup(t)
+	defer cleanup()
+	mux := http.NewServeMux()
+	accounts.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	accounts.conf.BaseURL = server.URL
+
+	userstate.AddUser("bob", "hunter2", "bob@example.com")
+	assert.Equal(t, accounts.SendConfirmation("bob"), nil)
+	link := lastLink(t, maildir)
+	assert.Equal(t, strings.HasPrefix(link, server.URL+DefaultConfirmPath+"?code="), true)
+	assert.Equal(t, userstate.IsConfirmed("bob"), false)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(link)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusFound)
+	assert.Equal(t, userstate.IsConfirmed("bob"), true)
+
+	// The link can only be used once
+	resp, err = client.Get(link)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestReset(t *testing.T) {
+	accounts, userstate, maildir, cleanup := setup(t)
+	defer cleanup()
+	mux := http.NewServeMux()
+	accounts.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	accounts.conf.BaseURL = server.URL
+
+	userstate.AddUser("bob", "hunter2", "bob@example.com")
+	assert.Equal(t, accounts.SendPasswordReset("bob"), nil)
+	link := lastLink(t, maildir)
+	u, err := url.Parse(link)
+	assert.Equal(t, err, nil)
+	token := u.Query().Get("token")
+
+	resp, err := http.Get(link)
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	// Mismatching passwords shows the form again
+	resp, err = http.PostForm(server.URL+DefaultResetPath, url.Values{"token": {token}, "password": {"a"}, "password2": {"b"}})
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, userstate.CorrectPassword("bob", "hunter2"), true)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.PostForm(server.URL+DefaultResetPath, url.Values{"token": {token}, "password": {"s3cret"}, "password2": {"s3cret"}})
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusFound)
+	assert.Equal(t, userstate.CorrectPassword("bob", "s3cret"), true)
+
+	// The token can only be used once
+	_, ok := accounts.resetUser(token)
+	assert.Equal(t, ok, false)
+
+	// Only the most recent token is valid
+	assert.Equal(t, accounts.SendPasswordReset("bob"), nil)
+	u, _ = url.Parse(lastLink(t, maildir))
+	first := u.Query().Get("token")
+	assert.Equal(t, accounts.SendPasswordReset("bob"), nil)
+	u, _ = url.Parse(lastLink(t, maildir))
+	second := u.Query().Get("token")
+	assert.NotEqual(t, first, second)
+	_, ok = accounts.resetUser(first)
+	assert.Equal(t, ok, false)
+	username, ok := accounts.resetUser(second)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, username, "bob")
+
+	// Expired tokens are rejected
+	accounts.conf.Expiry = -time.Minute
+	assert.Equal(t, accounts.SendPasswordReset("bob"), nil)
+	u, _ = url.Parse(lastLink(t, maildir))
+	_, ok = accounts.resetUser(u.Query().Get("token"))
+	assert.Equal(t, ok, false)
+}
@@ -0,0 +1,173 @@
+// Package mail provides mailers for sending e-mail with SMTP or to a local
+// maildir or file, and ready-made flows for account confirmation and password reset
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an e-mail message
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+	HTML    bool // send the body as text/html instead of text/plain
+}
+
+// Mailer can send e-mail messages
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// ErrHeaderInjection is returned if an address or the subject contains newlines
+var ErrHeaderInjection = errors.New("mail: newline in header field")
+
+// Bytes returns the message in the RFC 5322 format, with CRLF line endings
+func (msg *Message) Bytes() ([]byte, error) {
+	for _, field := range []string{msg.From, msg.To, msg.Subject} {
+		if strings.ContainsAny(field, "\r\n") {
+			return nil, ErrHeaderInjection
+		}
+	}
+	contentType := "text/plain"
+	if msg.HTML {
+		contentType = "text/html"
+	}
+	host := "localhost"
+	if i := strings.LastIndex(msg.From, "@"); i >= 0 {
+		host = strings.Trim(msg.From[i+1:], "> ")
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", uniqueName(), host)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	body := strings.Replace(msg.Body, "\r\n", "\n", -1)
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	if !strings.HasSuffix(body, "\n") {
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// uniqueName returns a name that is unique for this host, for use in
+// Message-IDs and maildir filenames
+func uniqueName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), hex.EncodeToString(b), strings.Replace(hostname, "/", "_", -1))
+}
+
+// address returns only the e-mail address part of an address like "Bob <bob@example.com>"
+func address(s string) string {
+	if i := strings.LastIndex(s, "<"); i >= 0 {
+		return strings.TrimSuffix(s[i+1:], ">")
+	}
+	return strings.TrimSpace(s)
+}
+
+// SMTPMailer sends e-mail through an SMTP server.
+// STARTTLS is used if the server supports it.
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string // optional
+	Password string // optional
+}
+
+// Send sends the message to the SMTP server
+func (m *SMTPMailer) Send(msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, address(msg.From), []string{address(msg.To)}, data)
+}
+
+// MaildirMailer delivers e-mail to a local maildir, for development
+type MaildirMailer struct {
+	Dir string
+}
+
+// Send writes the message to the "new" directory of the maildir
+func (m *MaildirMailer) Send(msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	// Write to tmp first, then move to new, so that readers never see a partial message
+	name := uniqueName()
+	tmpFilename := filepath.Join(m.Dir, "tmp", name)
+	if err := writeFile(tmpFilename, data); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filepath.Join(m.Dir, "new", name))
+}
+
+func writeFile(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// FileMailer appends e-mail to a file in the mbox format, for development
+type FileMailer struct {
+	Filename string
+	mut      sync.Mutex
+}
+
+// Send appends the message to the mbox file
+func (m *FileMailer) Send(msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	f, err := os.OpenFile(m.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	// Lines starting with "From " in the body must be quoted
+	data = bytes.Replace(data, []byte("\nFrom "), []byte("\n>From "), -1)
+	_, err = fmt.Fprintf(f, "From %s %s\n%s\n", address(msg.From), time.Now().Format(time.ANSIC), data)
+	return err
+}
@@ -18,8 +18,8 @@ func main() {
 	// Create a new Algernon server. Also initialize log files etc.
 	algernon, err := engine.New(versionString, description)
 	if err != nil {
-		if err == engine.ErrVersion {
-			// Exit with error code 0 if --version was specified
+		if err == engine.ErrVersion || err == engine.ErrDataTransfer {
+			// Exit with error code 0 if --version, --export or --import was specified
 			os.Exit(0)
 		} else {
 			// Exit if there are problems with the fundamental setup
@@ -0,0 +1,183 @@
+package oidc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// keySet is a parsed JSON Web Key Set, with public keys by key ID
+type keySet struct {
+	keys map[string]crypto.PublicKey
+}
+
+// jsonWebKey is the relevant part of a JSON Web Key
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys retrieves the public keys of the identity provider
+func (c *Client) fetchKeys(jwksURI string) (*keySet, error) {
+	resp, err := c.httpClient.Get(jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: fetching keys returned %s", resp.Status)
+	}
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	ks := &keySet{keys: make(map[string]crypto.PublicKey)}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			ks.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			ks.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return ks, nil
+}
+
+// key returns the public key with the given key ID. The key set is fetched
+// again if the key ID is unknown, since identity providers rotate their keys.
+func (c *Client) key(kid string) (crypto.PublicKey, error) {
+	md, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+	c.mut.Lock()
+	ks := c.keys
+	c.mut.Unlock()
+	if ks != nil {
+		if k, ok := ks.keys[kid]; ok {
+			return k, nil
+		}
+	}
+	ks, err = c.fetchKeys(md.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	c.mut.Lock()
+	c.keys = ks
+	c.mut.Unlock()
+	if k, ok := ks.keys[kid]; ok {
+		return k, nil
+	}
+	// Use the only key, if the token does not name one
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+}
+
+// verifySignature checks the signature of a JWT and returns the claims.
+// RS256 and ES256 are checked with the provider keys, HS256 with the client secret.
+func (c *Client) verifySignature(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed ID token")
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("oidc: malformed ID token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, errors.New("oidc: malformed ID token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("oidc: malformed ID token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	switch header.Alg {
+	case "RS256":
+		k, err := c.key(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := k.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("oidc: invalid ID token signature")
+		}
+	case "ES256":
+		k, err := c.key(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := k.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 || !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, errors.New("oidc: invalid ID token signature")
+		}
+	case "HS256":
+		if c.conf.ClientSecret == "" {
+			return nil, errors.New("oidc: HS256 requires a client secret")
+		}
+		mac := hmac.New(sha256.New, []byte(c.conf.ClientSecret))
+		mac.Write(signed)
+		if subtle.ConstantTimeCompare(mac.Sum(nil), signature) != 1 {
+			return nil, errors.New("oidc: invalid ID token signature")
+		}
+	default:
+		return nil, fmt.Errorf("oidc: unsupported signing algorithm %q", header.Alg)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("oidc: malformed ID token payload")
+	}
+	claims := make(map[string]interface{})
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	if err := dec.Decode(&claims); err != nil {
+		return nil, errors.New("oidc: malformed ID token payload")
+	}
+	return claims, nil
+}
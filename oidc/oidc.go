@@ -0,0 +1,422 @@
+// Package oidc provides an OAuth2 / OpenID Connect client that logs users in
+// with an external identity provider and links them to the userstate
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/cookie"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// DefaultLoginPath is the URL path that starts the login flow
+	DefaultLoginPath = "/oidc/login"
+
+	// DefaultCallbackPath is the URL path the identity provider redirects back to
+	DefaultCallbackPath = "/oidc/callback"
+
+	// Name of the cookie that holds the state, nonce and return URL during the login flow
+	stateCookieName = "oidc_state"
+
+	// How long the login flow may take, in seconds
+	stateCookieTime = 600
+
+	// Name of the KeyValue that maps "issuer subject" to usernames
+	subjectsID = "__oidc_subjects"
+)
+
+// Config contains the settings for an OpenID Connect client
+type Config struct {
+	Issuer       string   // The issuer URL, for instance "https://accounts.example.com"
+	ClientID     string   // The client ID, as registered with the identity provider
+	ClientSecret string   // The client secret, as registered with the identity provider
+	Scopes       []string // "openid" is always included
+	RedirectURL  string   // Full callback URL. Derived from the request if empty.
+	LoginPath    string   // Path for starting the login flow
+	CallbackPath string   // Path for receiving the authorization code
+	AfterLogin   string   // Where to redirect after a successful login ("/" by default)
+
+	// The claim that is used as the username for new users.
+	// "preferred_username" is the default. Falls back to "email" and "sub".
+	UsernameClaim string
+}
+
+// trustedLogin is implemented by userstates where Login requires a second
+// factor, like auth.UserState. The identity provider is trusted to have
+// authenticated the user, so these users are logged in with LoginTrusted.
+type trustedLogin interface {
+	LoginTrusted(w http.ResponseWriter, username string) error
+}
+
+// Client is an OpenID Connect relying party that logs users into a userstate
+type Client struct {
+	conf       Config
+	userstate  pinterface.IUserState
+	httpClient *http.Client
+
+	mut      sync.Mutex
+	metadata *providerMetadata
+	keys     *keySet
+}
+
+// providerMetadata is the relevant part of the OpenID Provider configuration document
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// New creates a new OpenID Connect client. The provider configuration is
+// fetched the first time a user logs in, so the identity provider does not
+// need to be available when the server starts.
+func New(conf Config, userstate pinterface.IUserState) (*Client, error) {
+	if conf.Issuer == "" {
+		return nil, errors.New("oidc: no issuer given")
+	}
+	if conf.ClientID == "" {
+		return nil, errors.New("oidc: no client ID given")
+	}
+	conf.Issuer = strings.TrimSuffix(conf.Issuer, "/")
+	if !has(conf.Scopes, "openid") {
+		conf.Scopes = append([]string{"openid"}, conf.Scopes...)
+	}
+	if conf.LoginPath == "" {
+		conf.LoginPath = DefaultLoginPath
+	}
+	if conf.CallbackPath == "" {
+		conf.CallbackPath = DefaultCallbackPath
+	}
+	if conf.AfterLogin == "" {
+		conf.AfterLogin = "/"
+	}
+	if conf.UsernameClaim == "" {
+		conf.UsernameClaim = "preferred_username"
+	}
+	return &Client{
+		conf:       conf,
+		userstate:  userstate,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Config returns the configuration for this client, with defaults filled in
+func (c *Client) Config() Config {
+	return c.conf
+}
+
+// Register adds the login and callback handlers to the given mux
+func (c *Client) Register(mux *http.ServeMux) {
+	mux.HandleFunc(c.conf.LoginPath, c.LoginHandler)
+	mux.HandleFunc(c.conf.CallbackPath, c.CallbackHandler)
+}
+
+// discover fetches and caches the provider configuration document
+func (c *Client) discover() (*providerMetadata, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.metadata != nil {
+		return c.metadata, nil
+	}
+	resp, err := c.httpClient.Get(c.conf.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery returned %s", resp.Status)
+	}
+	var md providerMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&md); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(md.Issuer, "/") != c.conf.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch, expected %s but got %s", c.conf.Issuer, md.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, errors.New("oidc: incomplete provider configuration")
+	}
+	c.metadata = &md
+	return c.metadata, nil
+}
+
+// redirectURL returns the configured callback URL, or one derived from the request
+func (c *Client) redirectURL(req *http.Request) string {
+	if c.conf.RedirectURL != "" {
+		return c.conf.RedirectURL
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + c.conf.CallbackPath
+}
+
+// LoginHandler redirects the browser to the identity provider.
+// An optional "next" query parameter gives the local path to return to.
+func (c *Client) LoginHandler(w http.ResponseWriter, req *http.Request) {
+	md, err := c.discover()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+		return
+	}
+	state, nonce := randomToken(), randomToken()
+	next := req.URL.Query().Get("next")
+	if !localPath(next) {
+		next = c.conf.AfterLogin
+	}
+	// The state, nonce and return path are kept in a signed cookie until the callback
+	cookie.SetSecureCookiePathWithFlags(w, stateCookieName, state+" "+nonce+" "+next, stateCookieTime, c.conf.CallbackPath, c.userstate.CookieSecret(), req.TLS != nil, true)
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", c.conf.ClientID)
+	v.Set("redirect_uri", c.redirectURL(req))
+	v.Set("scope", strings.Join(c.conf.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, req, md.AuthorizationEndpoint+sep+v.Encode(), http.StatusFound)
+}
+
+// CallbackHandler exchanges the authorization code for an ID token, verifies
+// it, creates or links the user and logs the user in with the username cookie.
+func (c *Client) CallbackHandler(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if errCode := q.Get("error"); errCode != "" {
+		log.Warnf("oidc: login was not completed: %s %s", errCode, q.Get("error_description"))
+		http.Error(w, "Login was not completed", http.StatusUnauthorized)
+		return
+	}
+	stored, ok := cookie.SecureCookie(req, stateCookieName, c.userstate.CookieSecret())
+	fields := strings.SplitN(stored, " ", 3)
+	if !ok || len(fields) != 3 || q.Get("state") == "" || q.Get("state") != fields[0] {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	nonce, next := fields[1], fields[2]
+	cookie.ClearCookie(w, stateCookieName, c.conf.CallbackPath)
+
+	claims, err := c.exchange(req, q.Get("code"), nonce)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	username, err := c.linkUser(claims)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	if err := c.login(w, username); err != nil {
+		log.Error(err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, next, http.StatusFound)
+}
+
+// login logs in the given user, which has been authenticated by the identity provider
+func (c *Client) login(w http.ResponseWriter, username string) error {
+	if trusted, ok := c.userstate.(trustedLogin); ok {
+		return trusted.LoginTrusted(w, username)
+	}
+	return c.userstate.Login(w, username)
+}
+
+// tokenResponse is the relevant part of the response from the token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+}
+
+// exchange trades an authorization code for a verified set of ID token claims
+func (c *Client) exchange(req *http.Request, code, nonce string) (map[string]interface{}, error) {
+	if code == "" {
+		return nil, errors.New("oidc: no authorization code given")
+	}
+	md, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", c.redirectURL(req))
+	tokenReq, err := http.NewRequest("POST", md.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.Header.Set("Accept", "application/json")
+	tokenReq.SetBasicAuth(url.QueryEscape(c.conf.ClientID), url.QueryEscape(c.conf.ClientSecret))
+	resp, err := c.httpClient.Do(tokenReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("oidc: could not decode the token response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("oidc: token endpoint returned %s %s", resp.Status, tr.Error)
+	}
+	if tr.IDToken == "" {
+		return nil, errors.New("oidc: no ID token in the token response")
+	}
+	claims, err := c.verify(tr.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claimString(claims, "nonce") != nonce {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// verify checks the signature and the standard claims of an ID token
+func (c *Client) verify(idToken string) (map[string]interface{}, error) {
+	claims, err := c.verifySignature(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(claimString(claims, "iss"), "/") != c.conf.Issuer {
+		return nil, errors.New("oidc: wrong issuer in ID token")
+	}
+	if !audienceContains(claims["aud"], c.conf.ClientID) {
+		return nil, errors.New("oidc: wrong audience in ID token")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Now().Add(-time.Minute).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("oidc: the ID token has expired")
+	}
+	if claimString(claims, "sub") == "" {
+		return nil, errors.New("oidc: no subject in ID token")
+	}
+	return claims, nil
+}
+
+// linkUser finds the user that is linked to the subject in the given claims,
+// or links an existing confirmed user with the same verified e-mail, or creates a new one.
+func (c *Client) linkUser(claims map[string]interface{}) (string, error) {
+	subjects, err := c.userstate.Creator().NewKeyValue(subjectsID)
+	if err != nil {
+		return "", err
+	}
+	subjectKey := c.conf.Issuer + " " + claimString(claims, "sub")
+	if username, err := subjects.Get(subjectKey); err == nil && username != "" && c.userstate.HasUser(username) {
+		return username, nil
+	}
+
+	email := claimString(claims, "email")
+	emailVerified, _ := claims["email_verified"].(bool)
+
+	base := sanitizeUsername(claimString(claims, c.conf.UsernameClaim))
+	if base == "" {
+		base = sanitizeUsername(strings.SplitN(email, "@", 2)[0])
+	}
+	if base == "" {
+		base = sanitizeUsername(claimString(claims, "sub"))
+	}
+	if base == "" {
+		return "", errors.New("oidc: could not find a username in the ID token")
+	}
+
+	username := base
+	for i := 2; c.userstate.HasUser(username); i++ {
+		// Link to an existing local user only if the identity provider vouches for the e-mail,
+		// and the local user has confirmed it. Otherwise, anyone could register an
+		// unconfirmed user with the e-mail of someone else, and take over the identity.
+		if existingEmail, err := c.userstate.Email(username); err == nil && emailVerified && email != "" && strings.EqualFold(existingEmail, email) && c.userstate.IsConfirmed(username) {
+			break
+		}
+		username = fmt.Sprintf("%s_%d", base, i)
+	}
+
+	if !c.userstate.HasUser(username) {
+		// The password is random, since the user logs in through the identity provider
+		c.userstate.AddUser(username, randomToken()+randomToken(), email)
+		c.userstate.MarkConfirmed(username)
+		log.Infof("oidc: created user %s for %s", username, subjectKey)
+	}
+	c.userstate.Users().Set(username, "oidc_subject", subjectKey)
+	return username, subjects.Set(subjectKey, username)
+}
+
+// randomToken returns 32 hexadecimal characters from a cryptographically secure source
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("oidc: could not read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// localPath checks if the given string is a local path that is safe to redirect to
+func localPath(s string) bool {
+	return strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") && !strings.Contains(s, "\\") && !strings.ContainsAny(s, " \r\n")
+}
+
+// sanitizeUsername replaces characters that are not allowed in usernames with underscores
+func sanitizeUsername(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return strings.Trim(sb.String(), "_")
+}
+
+// claimString returns the given claim as a string, or an empty string
+func claimString(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// audienceContains checks if the "aud" claim, which is a string or a list of strings, contains the client ID
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, e := range a {
+			if s, ok := e.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// has checks if a given slice of strings contains a given string
+func has(sl []string, e string) bool {
+	for _, s := range sl {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
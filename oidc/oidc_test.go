@@ -0,0 +1,184 @@
+package oidc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/auth"
+	"github.com/xyproto/algernon/oidc/oidctest"
+	bolt "github.com/xyproto/permissionbolt"
+	"github.com/xyproto/pinterface"
+)
+
+func newUserState(t *testing.T) (pinterface.IUserState, func()) {
+	dir, err := ioutil.TempDir("", "oidctest")
+	assert.Equal(t, err, nil)
+	perm, err := bolt.NewWithConf(filepath.Join(dir, "test.db"))
+	assert.Equal(t, err, nil)
+	return perm.UserState(), func() { os.RemoveAll(dir) }
+}
+
+// login runs the full login flow against the given server and returns the client
+func login(t *testing.T, server *httptest.Server) *http.Client {
+	jar, err := cookiejar.New(nil)
+	assert.Equal(t, err, nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(server.URL + DefaultLoginPath + "?next=/welcome")
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.Request.URL.Path, "/welcome")
+	return client
+}
+
+func TestLogin(t *testing.T) {
+	provider := oidctest.NewProvider("algernon", "s3cret")
+	defer provider.Close()
+
+	userstate, cleanup := newUserState(t)
+	defer cleanup()
+
+	c, err := New(Config{Issuer: provider.Issuer(), ClientID: "algernon", ClientSecret: "s3cret"}, userstate)
+	assert.Equal(t, err, nil)
+
+	mux := http.NewServeMux()
+	c.Register(mux)
+	mux.HandleFunc("/welcome", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(userstate.Username(req)))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	login(t, server)
+	assert.Equal(t, userstate.HasUser("alice"), true)
+	assert.Equal(t, userstate.IsLoggedIn("alice"), true)
+	assert.Equal(t, userstate.IsConfirmed("alice"), true)
+	email, _ := userstate.Email("alice")
+	assert.Equal(t, email, "alice@example.com")
+
+	// Logging in again with the same subject uses the same user
+	login(t, server)
+	usernames, _ := userstate.AllUsernames()
+	assert.Equal(t, len(usernames), 1)
+
+	// A different subject with a taken username and another e-mail gets a new user
+	provider.Claims["sub"] = "5678"
+	provider.Claims["email"] = "other@example.com"
+	login(t, server)
+	assert.Equal(t, userstate.HasUser("alice_2"), true)
+}
+
+func TestLinkExisting(t *testing.T) {
+	provider := oidctest.NewProvider("algernon", "s3cret")
+	defer provider.Close()
+
+	userstate, cleanup := newUserState(t)
+	defer cleanup()
+	userstate.AddUser("alice", "hunter2", "alice@example.com")
+	userstate.MarkConfirmed("alice")
+
+	c, err := New(Config{Issuer: provider.Issuer(), ClientID: "algernon", ClientSecret: "s3cret"}, userstate)
+	assert.Equal(t, err, nil)
+	mux := http.NewServeMux()
+	c.Register(mux)
+	mux.HandleFunc("/welcome", func(w http.ResponseWriter, req *http.Request) {})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	login(t, server)
+	usernames, _ := userstate.AllUsernames()
+	assert.Equal(t, len(usernames), 1)
+	subject, _ := userstate.Users().Get("alice", "oidc_subject")
+	assert.Equal(t, subject, provider.Issuer()+" 1234")
+	// The local password still works
+	assert.Equal(t, userstate.CorrectPassword("alice", "hunter2"), true)
+}
+
+func TestUnconfirmedNotLinked(t *testing.T) {
+	provider := oidctest.NewProvider("algernon", "s3cret")
+	defer provider.Close()
+
+	userstate, cleanup := newUserState(t)
+	defer cleanup()
+	// Someone registers with the e-mail of alice, but never confirms it
+	userstate.AddUser("alice", "hunter2", "alice@example.com")
+
+	c, err := New(Config{Issuer: provider.Issuer(), ClientID: "algernon", ClientSecret: "s3cret"}, userstate)
+	assert.Equal(t, err, nil)
+	mux := http.NewServeMux()
+	c.Register(mux)
+	mux.HandleFunc("/welcome", func(w http.ResponseWriter, req *http.Request) {})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	login(t, server)
+	assert.Equal(t, userstate.HasUser("alice_2"), true)
+	assert.Equal(t, userstate.IsLoggedIn("alice"), false)
+	subject, _ := userstate.Users().Get("alice", "oidc_subject")
+	assert.Equal(t, subject, "")
+}
+
+func TestBadSignature(t *testing.T) {
+	provider := oidctest.NewProvider("algernon", "s3cret")
+	defer provider.Close()
+	other := oidctest.NewProvider("algernon", "s3cret")
+	defer other.Close()
+
+	userstate, cleanup := newUserState(t)
+	defer cleanup()
+
+	c, err := New(Config{Issuer: provider.Issuer(), ClientID: "algernon"}, userstate)
+	assert.Equal(t, err, nil)
+
+	// A token signed by another provider must be rejected
+	token := other.Sign(map[string]interface{}{"iss": provider.Issuer(), "aud": "algernon", "sub": "1", "exp": 9999999999})
+	_, err = c.verify(token)
+	assert.NotEqual(t, err, nil)
+
+	// A token with the wrong audience must be rejected
+	token = provider.Sign(map[string]interface{}{"iss": provider.Issuer(), "aud": "someone-else", "sub": "1", "exp": 9999999999})
+	_, err = c.verify(token)
+	assert.NotEqual(t, err, nil)
+
+	token = provider.Sign(map[string]interface{}{"iss": provider.Issuer(), "aud": "algernon", "sub": "1", "exp": 9999999999})
+	_, err = c.verify(token)
+	assert.Equal(t, err, nil)
+}
+
+func TestTwoFactorUser(t *testing.T) {
+	provider := oidctest.NewProvider("algernon", "s3cret")
+	defer provider.Close()
+
+	inner, cleanup := newUserState(t)
+	defer cleanup()
+	userstate := auth.NewUserState(inner)
+	userstate.AddUser("alice", "hunter2", "alice@example.com")
+	userstate.MarkConfirmed("alice")
+	secret, _, err := userstate.EnrollTOTP("alice", "example.com")
+	assert.Equal(t, err, nil)
+	code, _ := auth.TOTP(secret, time.Now())
+	assert.Equal(t, userstate.ConfirmTOTP(httptest.NewRecorder(), "alice", code), true)
+	assert.Equal(t, userstate.Login(httptest.NewRecorder(), "alice"), auth.ErrTwoFactorRequired)
+
+	c, err := New(Config{Issuer: provider.Issuer(), ClientID: "algernon", ClientSecret: "s3cret"}, userstate)
+	assert.Equal(t, err, nil)
+	mux := http.NewServeMux()
+	c.Register(mux)
+	var verified bool
+	mux.HandleFunc("/welcome", func(w http.ResponseWriter, req *http.Request) {
+		verified = userstate.TwoFactorVerified(req, "alice")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// The identity provider is trusted, but the second factor is not marked as verified
+	login(t, server)
+	assert.Equal(t, userstate.IsLoggedIn("alice"), true)
+	assert.Equal(t, verified, false)
+}
@@ -0,0 +1,7 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+// The SQLite driver is written in C, and is available when cgo is enabled
+const haveCgo = true
@@ -0,0 +1,7 @@
+//go:build !cgo
+// +build !cgo
+
+package sqlite
+
+// Without cgo, the SQLite driver is only a stub that fails when it is used
+const haveCgo = false
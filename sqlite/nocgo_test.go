@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package sqlite
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestNoCgo(t *testing.T) {
+	_, err := Open(":memory:")
+	assert.Equal(t, err, ErrNoCgo)
+}
@@ -0,0 +1,482 @@
+// Package sqlite provides data structures, users and permissions that are
+// stored in an SQLite database. The API is the same as for the Bolt, Redis,
+// MariaDB/MySQL and PostgreSQL backends, by using the xyproto/pinterface package.
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	// The SQLite database driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	// ErrKeyNotFound is returned if a key was not found in a HashMap or KeyValue
+	ErrKeyNotFound = errors.New("sqlite: key not found")
+
+	// ErrDoesNotExist is returned when using a data structure that has been removed
+	ErrDoesNotExist = errors.New("sqlite: does not exist")
+
+	// ErrExistsInSet is returned if an element is added to a Set, but it already exists
+	ErrExistsInSet = errors.New("sqlite: element already exists in set")
+
+	// ErrTooFewItems is returned by LastN if the list has fewer than n elements
+	ErrTooFewItems = errors.New("sqlite: too few items in list")
+
+	// ErrNoCgo is returned by Open if Algernon was built without cgo (CGO_ENABLED=0)
+	ErrNoCgo = errors.New("sqlite: Algernon was built with CGO_ENABLED=0, but cgo is needed for SQLite")
+)
+
+// All data structures are stored in these four tables, so that the data can
+// easily be inspected with the sqlite3 command line utility
+const schema = `
+CREATE TABLE IF NOT EXISTS lists (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS lists_name ON lists (name, id);
+CREATE TABLE IF NOT EXISTS sets (
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (name, value)
+);
+CREATE TABLE IF NOT EXISTS hashmaps (
+	name TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (name, owner, key)
+);
+CREATE TABLE IF NOT EXISTS keyvalues (
+	name TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (name, key)
+);
+`
+
+type (
+	// Database is an SQLite database
+	Database struct {
+		db       *sql.DB
+		filename string
+	}
+
+	// Used for each of the data structures
+	table struct {
+		db      *Database
+		name    string
+		removed bool
+	}
+
+	// List is a list of strings, in the order they were added
+	List table
+
+	// Set is a set of unique strings
+	Set table
+
+	// HashMap has an owner (for instance a username) and then key=>value pairs
+	HashMap table
+
+	// KeyValue is a key=>value store
+	KeyValue table
+)
+
+/* --- Database functions --- */
+
+// Open opens an SQLite database, or creates a new file, as needed.
+// The write-ahead log is enabled, so that readers do not block writers,
+// and several processes may use the same database file.
+func Open(filename string) (*Database, error) {
+	if !haveCgo {
+		return nil, ErrNoCgo
+	}
+	options := url.Values{}
+	options.Set("_busy_timeout", "5000")
+	// Take the write lock at the start of transactions, instead of
+	// failing with "database is locked" when upgrading the lock later.
+	options.Set("_txlock", "immediate")
+	if filename != ":memory:" {
+		options.Set("_journal_mode", "WAL")
+		options.Set("_synchronous", "NORMAL")
+	}
+	// The filename is escaped, so that "?", "#" and "%" are not read as part of the URI
+	path := (&url.URL{Path: filename}).EscapedPath()
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+options.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if filename == ":memory:" {
+		// Every connection to an in-memory database is a new database
+		db.SetMaxOpenConns(1)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Database{db, filename}, nil
+}
+
+// DB returns the underlying *sql.DB, for running SQL queries directly
+func (db *Database) DB() *sql.DB {
+	return db.db
+}
+
+// Filename returns the filename of the database
+func (db *Database) Filename() string {
+	return db.filename
+}
+
+// Close the database
+func (db *Database) Close() {
+	db.db.Close()
+}
+
+// Ping the database
+func (db *Database) Ping() error {
+	return db.db.Ping()
+}
+
+// strings returns all the strings that are returned by a query
+func (db *Database) strings(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		results = append(results, s)
+	}
+	return results, rows.Err()
+}
+
+// value returns a single string that is returned by a query, or ErrKeyNotFound
+func (db *Database) value(query string, args ...interface{}) (string, error) {
+	var s string
+	err := db.db.QueryRow(query, args...).Scan(&s)
+	if err == sql.ErrNoRows {
+		return "", ErrKeyNotFound
+	}
+	return s, err
+}
+
+// exists checks if a query returns any rows
+func (db *Database) exists(query string, args ...interface{}) (bool, error) {
+	var one int
+	err := db.db.QueryRow(query, args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/* --- List functions --- */
+
+// NewList loads or creates a new List with the given ID
+func NewList(db *Database, id string) (*List, error) {
+	return &List{db: db, name: id}, nil
+}
+
+// Add an element to the list
+func (l *List) Add(value string) error {
+	if l.removed {
+		return ErrDoesNotExist
+	}
+	_, err := l.db.db.Exec("INSERT INTO lists (name, value) VALUES (?, ?)", l.name, value)
+	return err
+}
+
+// All returns all elements in the list
+func (l *List) All() ([]string, error) {
+	if l.removed {
+		return nil, ErrDoesNotExist
+	}
+	return l.db.strings("SELECT value FROM lists WHERE name = ? ORDER BY id", l.name)
+}
+
+// Last returns the last element of the list, or an empty string
+func (l *List) Last() (string, error) {
+	if l.removed {
+		return "", ErrDoesNotExist
+	}
+	value, err := l.db.value("SELECT value FROM lists WHERE name = ? ORDER BY id DESC LIMIT 1", l.name)
+	if err == ErrKeyNotFound {
+		return "", nil
+	}
+	return value, err
+}
+
+// LastN returns the last n elements of the list
+func (l *List) LastN(n int) ([]string, error) {
+	if l.removed {
+		return nil, ErrDoesNotExist
+	}
+	results, err := l.db.strings("SELECT value FROM (SELECT id, value FROM lists WHERE name = ? ORDER BY id DESC LIMIT ?) ORDER BY id", l.name, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) < n {
+		return nil, ErrTooFewItems
+	}
+	return results, nil
+}
+
+// Remove this list
+func (l *List) Remove() error {
+	err := l.Clear()
+	l.removed = true
+	return err
+}
+
+// Clear removes all elements from this list
+func (l *List) Clear() error {
+	if l.removed {
+		return ErrDoesNotExist
+	}
+	_, err := l.db.db.Exec("DELETE FROM lists WHERE name = ?", l.name)
+	return err
+}
+
+/* --- Set functions --- */
+
+// NewSet loads or creates a new Set with the given ID
+func NewSet(db *Database, id string) (*Set, error) {
+	return &Set{db: db, name: id}, nil
+}
+
+// Add an element to the set. Returns ErrExistsInSet if it is already there.
+func (s *Set) Add(value string) error {
+	if s.removed {
+		return ErrDoesNotExist
+	}
+	result, err := s.db.db.Exec("INSERT OR IGNORE INTO sets (name, value) VALUES (?, ?)", s.name, value)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrExistsInSet
+	}
+	return nil
+}
+
+// Has checks if the given value is in the set
+func (s *Set) Has(value string) (bool, error) {
+	if s.removed {
+		return false, ErrDoesNotExist
+	}
+	return s.db.exists("SELECT 1 FROM sets WHERE name = ? AND value = ?", s.name, value)
+}
+
+// All returns all elements in the set, in the order they were added
+func (s *Set) All() ([]string, error) {
+	if s.removed {
+		return nil, ErrDoesNotExist
+	}
+	return s.db.strings("SELECT value FROM sets WHERE name = ? ORDER BY rowid", s.name)
+}
+
+// Del removes an element from the set
+func (s *Set) Del(value string) error {
+	if s.removed {
+		return ErrDoesNotExist
+	}
+	_, err := s.db.db.Exec("DELETE FROM sets WHERE name = ? AND value = ?", s.name, value)
+	return err
+}
+
+// Remove this set
+func (s *Set) Remove() error {
+	err := s.Clear()
+	s.removed = true
+	return err
+}
+
+// Clear removes all elements from this set
+func (s *Set) Clear() error {
+	if s.removed {
+		return ErrDoesNotExist
+	}
+	_, err := s.db.db.Exec("DELETE FROM sets WHERE name = ?", s.name)
+	return err
+}
+
+/* --- HashMap functions --- */
+
+// NewHashMap loads or creates a new HashMap with the given ID
+func NewHashMap(db *Database, id string) (*HashMap, error) {
+	return &HashMap{db: db, name: id}, nil
+}
+
+// Set a value, given an owner (for instance a username) and a key (for instance "password")
+func (h *HashMap) Set(owner, key, value string) error {
+	if h.removed {
+		return ErrDoesNotExist
+	}
+	_, err := h.db.db.Exec("INSERT INTO hashmaps (name, owner, key, value) VALUES (?, ?, ?, ?) ON CONFLICT (name, owner, key) DO UPDATE SET value = excluded.value", h.name, owner, key, value)
+	return err
+}
+
+// Get a value, given an owner and a key. Returns ErrKeyNotFound if it is missing.
+func (h *HashMap) Get(owner, key string) (string, error) {
+	if h.removed {
+		return "", ErrDoesNotExist
+	}
+	return h.db.value("SELECT value FROM hashmaps WHERE name = ? AND owner = ? AND key = ?", h.name, owner, key)
+}
+
+// Has checks if the given owner has the given key
+func (h *HashMap) Has(owner, key string) (bool, error) {
+	if h.removed {
+		return false, ErrDoesNotExist
+	}
+	return h.db.exists("SELECT 1 FROM hashmaps WHERE name = ? AND owner = ? AND key = ?", h.name, owner, key)
+}
+
+// Exists checks if the given owner has any keys at all
+func (h *HashMap) Exists(owner string) (bool, error) {
+	if h.removed {
+		return false, ErrDoesNotExist
+	}
+	return h.db.exists("SELECT 1 FROM hashmaps WHERE name = ? AND owner = ? LIMIT 1", h.name, owner)
+}
+
+// All returns all owners in the hash map
+func (h *HashMap) All() ([]string, error) {
+	if h.removed {
+		return nil, ErrDoesNotExist
+	}
+	return h.db.strings("SELECT owner FROM hashmaps WHERE name = ? GROUP BY owner ORDER BY MIN(rowid)", h.name)
+}
+
+// Keys returns all keys for the given owner
+func (h *HashMap) Keys(owner string) ([]string, error) {
+	if h.removed {
+		return nil, ErrDoesNotExist
+	}
+	return h.db.strings("SELECT key FROM hashmaps WHERE name = ? AND owner = ? ORDER BY rowid", h.name, owner)
+}
+
+// DelKey removes a key for an owner (for instance the e-mail field for a user)
+func (h *HashMap) DelKey(owner, key string) error {
+	if h.removed {
+		return ErrDoesNotExist
+	}
+	_, err := h.db.db.Exec("DELETE FROM hashmaps WHERE name = ? AND owner = ? AND key = ?", h.name, owner, key)
+	return err
+}
+
+// Del removes an owner and all the keys (for instance a user)
+func (h *HashMap) Del(owner string) error {
+	if h.removed {
+		return ErrDoesNotExist
+	}
+	_, err := h.db.db.Exec("DELETE FROM hashmaps WHERE name = ? AND owner = ?", h.name, owner)
+	return err
+}
+
+// Remove this hash map
+func (h *HashMap) Remove() error {
+	err := h.Clear()
+	h.removed = true
+	return err
+}
+
+// Clear removes all elements from this hash map
+func (h *HashMap) Clear() error {
+	if h.removed {
+		return ErrDoesNotExist
+	}
+	_, err := h.db.db.Exec("DELETE FROM hashmaps WHERE name = ?", h.name)
+	return err
+}
+
+/* --- KeyValue functions --- */
+
+// NewKeyValue loads or creates a new KeyValue with the given ID
+func NewKeyValue(db *Database, id string) (*KeyValue, error) {
+	return &KeyValue{db: db, name: id}, nil
+}
+
+// Set a key and value
+func (kv *KeyValue) Set(key, value string) error {
+	if kv.removed {
+		return ErrDoesNotExist
+	}
+	_, err := kv.db.db.Exec("INSERT INTO keyvalues (name, key, value) VALUES (?, ?, ?) ON CONFLICT (name, key) DO UPDATE SET value = excluded.value", kv.name, key, value)
+	return err
+}
+
+// Get a value, given a key. Returns ErrKeyNotFound if it is missing.
+func (kv *KeyValue) Get(key string) (string, error) {
+	if kv.removed {
+		return "", ErrDoesNotExist
+	}
+	return kv.db.value("SELECT value FROM keyvalues WHERE name = ? AND key = ?", kv.name, key)
+}
+
+// Keys returns all keys, in the order they were added
+func (kv *KeyValue) Keys() ([]string, error) {
+	if kv.removed {
+		return nil, ErrDoesNotExist
+	}
+	return kv.db.strings("SELECT key FROM keyvalues WHERE name = ? ORDER BY rowid", kv.name)
+}
+
+// Del removes a key
+func (kv *KeyValue) Del(key string) error {
+	if kv.removed {
+		return ErrDoesNotExist
+	}
+	_, err := kv.db.db.Exec("DELETE FROM keyvalues WHERE name = ? AND key = ?", kv.name, key)
+	return err
+}
+
+// Inc increases the value of a key and returns the new value.
+// If the key does not exist, or is not a number, the new value is "1".
+func (kv *KeyValue) Inc(key string) (string, error) {
+	if kv.removed {
+		return "", ErrDoesNotExist
+	}
+	tx, err := kv.db.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var value string
+	err = tx.QueryRow("SELECT value FROM keyvalues WHERE name = ? AND key = ?", kv.name, key).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	num, _ := strconv.Atoi(strings.TrimSpace(value))
+	value = strconv.Itoa(num + 1)
+	if _, err := tx.Exec("INSERT INTO keyvalues (name, key, value) VALUES (?, ?, ?) ON CONFLICT (name, key) DO UPDATE SET value = excluded.value", kv.name, key, value); err != nil {
+		return "", err
+	}
+	return value, tx.Commit()
+}
+
+// Remove this key/value
+func (kv *KeyValue) Remove() error {
+	err := kv.Clear()
+	kv.removed = true
+	return err
+}
+
+// Clear removes all keys and values
+func (kv *KeyValue) Clear() error {
+	if kv.removed {
+		return ErrDoesNotExist
+	}
+	_, err := kv.db.db.Exec("DELETE FROM keyvalues WHERE name = ?", kv.name)
+	return err
+}
@@ -0,0 +1,212 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/xyproto/algernon/permissions"
+	"github.com/xyproto/pinterface"
+)
+
+// Check that the interfaces are implemented
+var (
+	_ pinterface.ICreator     = &Creator{}
+	_ pinterface.IHost        = &Database{}
+	_ pinterface.IPermissions = &permissions.Permissions{}
+	_ pinterface.IUserState   = &permissions.UserState{}
+)
+
+func newDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "sqlitetest")
+	assert.Equal(t, err, nil)
+	db, err := Open(filepath.Join(dir, "test.sqlite"))
+	assert.Equal(t, err, nil)
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFilename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitetest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "a?b#c%20d.sqlite")
+	db, err := Open(filename)
+	assert.Equal(t, err, nil)
+	kv, _ := NewKeyValue(db, "test")
+	assert.Equal(t, kv.Set("a", "b"), nil)
+	db.Close()
+	_, err = os.Stat(filename)
+	assert.Equal(t, err, nil)
+}
+
+func TestList(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	l, _ := NewList(db, "fruits")
+	other, _ := NewList(db, "other")
+	last, err := l.Last()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, last, "")
+	for _, fruit := range []string{"apple", "banana", "cherry"} {
+		assert.Equal(t, l.Add(fruit), nil)
+	}
+	other.Add("durian")
+	all, err := l.All()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, all, []string{"apple", "banana", "cherry"})
+	last, _ = l.Last()
+	assert.Equal(t, last, "cherry")
+	lastN, err := l.LastN(2)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, lastN, []string{"banana", "cherry"})
+	_, err = l.LastN(4)
+	assert.Equal(t, err, ErrTooFewItems)
+	assert.Equal(t, l.Remove(), nil)
+	assert.Equal(t, l.Add("apple"), ErrDoesNotExist)
+	all, _ = other.All()
+	assert.Equal(t, all, []string{"durian"})
+}
+
+func TestSet(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	s, _ := NewSet(db, "names")
+	assert.Equal(t, s.Add("bob"), nil)
+	assert.Equal(t, s.Add("alice"), nil)
+	assert.Equal(t, s.Add("bob"), ErrExistsInSet)
+	has, err := s.Has("bob")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, has, true)
+	all, _ := s.All()
+	assert.Equal(t, all, []string{"bob", "alice"})
+	assert.Equal(t, s.Del("bob"), nil)
+	has, _ = s.Has("bob")
+	assert.Equal(t, has, false)
+	assert.Equal(t, s.Clear(), nil)
+	all, _ = s.All()
+	assert.Equal(t, len(all), 0)
+}
+
+func TestHashMap(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	h, _ := NewHashMap(db, "people")
+	assert.Equal(t, h.Set("bob", "email", "bob@example.com"), nil)
+	assert.Equal(t, h.Set("bob", "email", "bob@example.org"), nil)
+	assert.Equal(t, h.Set("bob", "role", "admin"), nil)
+	// Colons are allowed, unlike with Bolt
+	assert.Equal(t, h.Set("ip:::1", "count", "1"), nil)
+	email, err := h.Get("bob", "email")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, email, "bob@example.org")
+	_, err = h.Get("bob", "phone")
+	assert.Equal(t, err, ErrKeyNotFound)
+	has, _ := h.Has("bob", "role")
+	assert.Equal(t, has, true)
+	exists, _ := h.Exists("alice")
+	assert.Equal(t, exists, false)
+	owners, _ := h.All()
+	assert.Equal(t, owners, []string{"bob", "ip:::1"})
+	keys, _ := h.Keys("bob")
+	assert.Equal(t, keys, []string{"email", "role"})
+	assert.Equal(t, h.DelKey("bob", "role"), nil)
+	keys, _ = h.Keys("bob")
+	assert.Equal(t, keys, []string{"email"})
+	assert.Equal(t, h.Del("bob"), nil)
+	exists, _ = h.Exists("bob")
+	assert.Equal(t, exists, false)
+}
+
+func TestKeyValue(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	kv, _ := NewKeyValue(db, "settings")
+	assert.Equal(t, kv.Set("color", "blue"), nil)
+	color, err := kv.Get("color")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, color, "blue")
+	_, err = kv.Get("size")
+	assert.Equal(t, err, ErrKeyNotFound)
+	n, err := kv.Inc("counter")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, "1")
+	n, _ = kv.Inc("counter")
+	assert.Equal(t, n, "2")
+	assert.Equal(t, kv.Del("color"), nil)
+	_, err = kv.Get("color")
+	assert.Equal(t, err, ErrKeyNotFound)
+}
+
+// Several goroutines and connections may use the database at the same time
+func TestConcurrency(t *testing.T) {
+	db, cleanup := newDatabase(t)
+	defer cleanup()
+	other, err := Open(db.Filename())
+	assert.Equal(t, err, nil)
+	defer other.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d := db
+			if i%2 == 0 {
+				d = other
+			}
+			kv, _ := NewKeyValue(d, "counters")
+			l, _ := NewList(d, "numbers")
+			for j := 0; j < 20; j++ {
+				_, err := kv.Inc("counter")
+				assert.Equal(t, err, nil)
+				assert.Equal(t, l.Add(strconv.Itoa(j)), nil)
+				_, err = l.All()
+				assert.Equal(t, err, nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+	kv, _ := NewKeyValue(db, "counters")
+	n, _ := kv.Get("counter")
+	assert.Equal(t, n, "200")
+}
+
+func TestUserState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitetest")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	perm, err := NewWithConf(filepath.Join(dir, "users.sqlite"))
+	assert.Equal(t, err, nil)
+	userstate := perm.UserState()
+
+	userstate.AddUser("bob", "hunter2", "bob@example.com")
+	assert.Equal(t, userstate.HasUser("bob"), true)
+	assert.Equal(t, userstate.CorrectPassword("bob", "hunter2"), true)
+	assert.Equal(t, userstate.CorrectPassword("bob", "hunter3"), false)
+	email, _ := userstate.Email("bob")
+	assert.Equal(t, email, "bob@example.com")
+	assert.Equal(t, userstate.IsAdmin("bob"), false)
+	userstate.SetAdminStatus("bob")
+	assert.Equal(t, userstate.IsAdmin("bob"), true)
+
+	code, err := userstate.GenerateUniqueConfirmationCode()
+	assert.Equal(t, err, nil)
+	userstate.AddUnconfirmed("bob", code)
+	assert.Equal(t, userstate.ConfirmUserByConfirmationCode(code), nil)
+	assert.Equal(t, userstate.IsConfirmed("bob"), true)
+
+	usernames, _ := userstate.AllUsernames()
+	assert.Equal(t, usernames, []string{"bob"})
+	userstate.RemoveUser("bob")
+	assert.Equal(t, userstate.HasUser("bob"), false)
+}